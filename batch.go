@@ -102,6 +102,19 @@ type Batch struct {
 
 	commit  sync.WaitGroup
 	applied uint32 // updated atomically
+
+	// Entries added by SetNoCopy which have not yet been copied into data. They
+	// logically follow the entries in data. See encodeNoCopy.
+	noCopy []noCopyEntry
+
+	// Whether the memtable should be flushed after the batch is committed. See
+	// Options.MemTableHugeValueThreshold.
+	flushAfterCommit bool
+}
+
+// noCopyEntry is a set operation whose key and value are owned by the caller.
+type noCopyEntry struct {
+	key, value []byte
 }
 
 var _ Reader = (*Batch)(nil)
@@ -150,6 +163,7 @@ func (b *Batch) release() {
 	b.memTableSize = 0
 	b.db = nil
 	b.flushable = nil
+	b.flushAfterCommit = false
 	b.commit = sync.WaitGroup{}
 	atomic.StoreUint32(&b.applied, 0)
 
@@ -173,10 +187,35 @@ func (b *Batch) refreshMemTableSize() {
 	}
 }
 
+// hasValueAtLeast returns true if the batch contains a set or merge whose value
+// is at least n bytes.
+func (b *Batch) hasValueAtLeast(n int) bool {
+	for iter := b.iter(); ; {
+		kind, _, value, ok := iter.next()
+		if !ok {
+			break
+		}
+		switch kind {
+		case db.InternalKeyKindSet, db.InternalKeyKindMerge:
+			if len(value) >= n {
+				return true
+			}
+		}
+	}
+	for _, e := range b.noCopy {
+		if len(e.value) >= n {
+			return true
+		}
+	}
+	return false
+}
+
 // Apply the operations contained in the batch to the receiver batch.
 //
 // It is safe to modify the contents of the arguments after Apply returns.
 func (b *Batch) Apply(batch *Batch, _ *db.WriteOptions) error {
+	b.encodeNoCopy()
+	batch.encodeNoCopy()
 	if len(batch.data) == 0 {
 		return nil
 	}
@@ -229,7 +268,7 @@ func (b *Batch) Get(key []byte) (value []byte, err error) {
 	if b.index == nil {
 		return nil, ErrNotIndexed
 	}
-	return b.db.getInternal(key, b, nil /* snapshot */)
+	return b.db.getInternal(key, b, nil /* snapshot */, nil /* opts */)
 }
 
 func (b *Batch) encodeKeyValue(key, value []byte, kind db.InternalKeyKind) uint32 {
@@ -247,6 +286,7 @@ func (b *Batch) encodeKeyValue(key, value []byte, kind db.InternalKeyKind) uint3
 //
 // It is safe to modify the contents of the arguments after Set returns.
 func (b *Batch) Set(key, value []byte, _ *db.WriteOptions) error {
+	b.encodeNoCopy()
 	if len(b.data) == 0 {
 		b.init(len(key) + len(value) + 2*binary.MaxVarintLen64 + batchHeaderLen)
 	}
@@ -266,12 +306,84 @@ func (b *Batch) Set(key, value []byte, _ *db.WriteOptions) error {
 	return nil
 }
 
+// SetNoCopy adds an action to the batch that sets the key to map to the
+// value, like Set, but defers copying the key and value until the batch is
+// committed. The pending arguments are then written to the WAL and the
+// memtable directly from the caller's memory, rather than first being copied
+// into the batch buffer, which is otherwise copied again every time it
+// doubles in size. This significantly reduces allocation and copying for
+// batches of large values. Adding any other operation to the batch, or
+// accessing its representation, copies the pending arguments into the batch
+// buffer at that point. Indexed batches copy the arguments immediately, as
+// Set does.
+//
+// The caller must not modify the contents of the arguments until the batch
+// has been committed or closed.
+func (b *Batch) SetNoCopy(key, value []byte, opts *db.WriteOptions) error {
+	if b.index != nil {
+		return b.Set(key, value, opts)
+	}
+	if len(b.data) == 0 {
+		b.init(batchHeaderLen)
+	}
+	if !b.increment() {
+		return ErrInvalidBatch
+	}
+	b.noCopy = append(b.noCopy, noCopyEntry{key: key, value: value})
+	b.memTableSize += memTableEntrySize(len(key), len(value))
+	return nil
+}
+
+// encodeNoCopy copies the entries added by SetNoCopy into the batch data. It
+// must be called before the batch data is accessed.
+func (b *Batch) encodeNoCopy() {
+	if len(b.noCopy) == 0 {
+		return
+	}
+	n := len(b.data)
+	for _, e := range b.noCopy {
+		n += 1 + 2*maxVarintLen32 + len(e.key) + len(e.value)
+	}
+	if n > cap(b.data) {
+		newData := rawalloc.New(len(b.data), n)
+		copy(newData, b.data)
+		b.data = newData
+	}
+	for i := range b.noCopy {
+		e := &b.noCopy[i]
+		b.encodeKeyValue(e.key, e.value, db.InternalKeyKindSet)
+		// Drop the references to the caller's memory.
+		*e = noCopyEntry{}
+	}
+	b.noCopy = b.noCopy[:0]
+}
+
+// logParts returns the batch data followed by the encoding of the entries
+// added by SetNoCopy, allowing the batch to be written to the WAL without
+// first copying the pending arguments into the batch data.
+func (b *Batch) logParts() [][]byte {
+	parts := make([][]byte, 0, 1+3*len(b.noCopy))
+	parts = append(parts, b.data)
+	hdrs := make([]byte, len(b.noCopy)*(1+2*maxVarintLen32))
+	for _, e := range b.noCopy {
+		hdrs[0] = byte(db.InternalKeyKindSet)
+		n := 1 + binary.PutUvarint(hdrs[1:], uint64(len(e.key)))
+		parts = append(parts, hdrs[:n], e.key)
+		hdrs = hdrs[n:]
+		n = binary.PutUvarint(hdrs, uint64(len(e.value)))
+		parts = append(parts, hdrs[:n], e.value)
+		hdrs = hdrs[n:]
+	}
+	return parts
+}
+
 // Merge adds an action to the batch that merges the value at key with the new
 // value. The details of the merge are dependent upon the configured merge
 // operator.
 //
 // It is safe to modify the contents of the arguments after Merge returns.
 func (b *Batch) Merge(key, value []byte, _ *db.WriteOptions) error {
+	b.encodeNoCopy()
 	if len(b.data) == 0 {
 		b.init(len(key) + len(value) + 2*binary.MaxVarintLen64 + batchHeaderLen)
 	}
@@ -295,6 +407,7 @@ func (b *Batch) Merge(key, value []byte, _ *db.WriteOptions) error {
 //
 // It is safe to modify the contents of the arguments after Delete returns.
 func (b *Batch) Delete(key []byte, _ *db.WriteOptions) error {
+	b.encodeNoCopy()
 	if len(b.data) == 0 {
 		b.init(len(key) + binary.MaxVarintLen64 + batchHeaderLen)
 	}
@@ -325,6 +438,7 @@ func (b *Batch) Delete(key []byte, _ *db.WriteOptions) error {
 // It is safe to modify the contents of the arguments after DeleteRange
 // returns.
 func (b *Batch) DeleteRange(start, end []byte, _ *db.WriteOptions) error {
+	b.encodeNoCopy()
 	if len(b.data) == 0 {
 		b.init(len(start) + len(end) + 2*binary.MaxVarintLen64 + batchHeaderLen)
 	}
@@ -349,12 +463,50 @@ func (b *Batch) DeleteRange(start, end []byte, _ *db.WriteOptions) error {
 	return nil
 }
 
+// DeletePrefix deletes all of the keys (and values) which have the specified
+// prefix. The range tombstone end key is computed using
+// Comparer.RangeEndSentinel.
+//
+// It is safe to modify the contents of the arguments after DeletePrefix
+// returns.
+func (b *Batch) DeletePrefix(prefix []byte, opts *db.WriteOptions) error {
+	comparer := db.DefaultComparer
+	if b.db != nil {
+		comparer = b.db.opts.Comparer
+	}
+	if comparer.RangeEndSentinel == nil {
+		return fmt.Errorf("pebble: comparer %s does not define a range end sentinel", comparer.Name)
+	}
+	end := comparer.RangeEndSentinel(prefix)
+	if end == nil {
+		return fmt.Errorf("pebble: prefix %q has no range end sentinel", prefix)
+	}
+	return b.DeleteRange(prefix, end, opts)
+}
+
 // Repr returns the underlying batch representation. It is not safe to modify
 // the contents.
 func (b *Batch) Repr() []byte {
+	b.encodeNoCopy()
 	return b.data
 }
 
+// SeqNum returns the sequence number assigned to the first record of the
+// batch when it was committed. The records of the batch are assigned
+// consecutive sequence numbers in the order they were added, so the i'th
+// record has the sequence number SeqNum()+i. The result is only meaningful
+// after the batch has been committed, and remains valid for a large batch
+// whose contents were cleared by the commit.
+func (b *Batch) SeqNum() uint64 {
+	if b.flushable != nil {
+		return b.flushable.seqNum
+	}
+	if len(b.data) == 0 {
+		return 0
+	}
+	return b.seqNum()
+}
+
 // NewIter returns an iterator that is unpositioned (Iterator.Valid() will
 // return false). The iterator can be positioned via a call to SeekGE, SeekLT,
 // First or Last. Only indexed batches support iterators.
@@ -440,6 +592,10 @@ func (b *Batch) init(cap int) {
 }
 
 func (b *Batch) reset() {
+	for i := range b.noCopy {
+		b.noCopy[i] = noCopyEntry{}
+	}
+	b.noCopy = b.noCopy[:0]
 	if b.data != nil {
 		if cap(b.data) > batchMaxRetainedSize {
 			// If the capacity of the buffer is larger than our maximum
@@ -8,8 +8,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/petermattis/pebble/db"
@@ -64,6 +67,87 @@ func TestBatch(t *testing.T) {
 	}
 }
 
+func TestBatchSetNoCopy(t *testing.T) {
+	var b Batch
+	key1, value1 := []byte("a"), []byte("1")
+	key2, value2 := []byte("b"), bytes.Repeat([]byte("2"), 2000)
+	b.SetNoCopy(key1, value1, nil)
+	b.SetNoCopy(key2, value2, nil)
+	b.Delete([]byte("a"), nil)
+	b.SetNoCopy(key1, value2, nil)
+	if b.count() != 4 {
+		t.Fatalf("expected 4 entries, but found %d", b.count())
+	}
+	expected := []struct {
+		kind       db.InternalKeyKind
+		key, value string
+	}{
+		{db.InternalKeyKindSet, "a", "1"},
+		{db.InternalKeyKindSet, "b", string(value2)},
+		{db.InternalKeyKindDelete, "a", ""},
+		{db.InternalKeyKindSet, "a", string(value2)},
+	}
+	iter := batchReader(b.Repr()[batchHeaderLen:])
+	for _, e := range expected {
+		kind, k, v, ok := iter.next()
+		if !ok {
+			t.Fatalf("next returned !ok: expected %v", e)
+		}
+		if kind != e.kind || string(k) != e.key || string(v) != e.value {
+			t.Errorf("got (%d, %q, %q), want (%d, %q, %q)", kind, k, v, e.kind, e.key, e.value)
+		}
+	}
+	if len(iter) != 0 {
+		t.Errorf("iterator was not exhausted: remaining bytes = %q", iter)
+	}
+
+	// The references are copied into the WAL and the memtable when the batch
+	// is committed, after which the caller is free to modify its buffers.
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := d.NewBatch()
+	batch.SetNoCopy(key1, value1, nil)
+	batch.SetNoCopy(key2, value2, nil)
+	if err := batch.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	value1[0] = 'x'
+	value2[0] = 'x'
+	check := func() {
+		for _, c := range []struct {
+			key, value string
+		}{
+			{"a", "1"},
+			{"b", strings.Repeat("2", 2000)},
+		} {
+			if v, err := d.Get([]byte(c.key)); err != nil {
+				t.Fatal(err)
+			} else if string(v) != c.value {
+				t.Fatalf("%s: expected %q, but found %q", c.key, c.value, v)
+			}
+		}
+	}
+	check()
+
+	// Reopening the DB replays the WAL.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err = Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	check()
+}
+
 func TestBatchIncrement(t *testing.T) {
 	testCases := []uint32{
 		0x00000000,
@@ -259,6 +343,95 @@ func TestBatchDeleteRange(t *testing.T) {
 	})
 }
 
+func TestBatchSeqNum(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:      storage.NewMem(),
+		MemTableSize: 256 << 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	type committed struct {
+		seqNum uint64
+		keys   []string
+	}
+	const numGoroutines = 8
+	const numBatches = 50
+	results := make([][]committed, numGoroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < numGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(g)))
+			for j := 0; j < numBatches; j++ {
+				b := d.NewBatch()
+				var keys []string
+				// Every 25th batch is large enough to bypass the memtable.
+				value := []byte("v")
+				if j%25 == 0 {
+					value = make([]byte, 200<<10)
+				}
+				for k := rng.Intn(10); k >= 0; k-- {
+					key := fmt.Sprintf("%d-%d-%d", g, j, k)
+					b.Set([]byte(key), value, nil)
+					keys = append(keys, key)
+				}
+				if err := d.Apply(b, nil); err != nil {
+					t.Error(err)
+					return
+				}
+				results[g] = append(results[g], committed{b.SeqNum(), keys})
+				b.Close()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// The batches are assigned disjoint, contiguous ranges of sequence numbers.
+	var all []committed
+	expected := make(map[string]uint64)
+	for _, r := range results {
+		all = append(all, r...)
+		for _, c := range r {
+			for k, key := range c.keys {
+				expected[key] = c.seqNum + uint64(k)
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].seqNum < all[j].seqNum
+	})
+	for j := 1; j < len(all); j++ {
+		prev := all[j-1]
+		if next := prev.seqNum + uint64(len(prev.keys)); all[j].seqNum != next {
+			t.Fatalf("expected batch at seqnum %d, but found %d", next, all[j].seqNum)
+		}
+	}
+
+	// The records were written with the sequence numbers implied by SeqNum.
+	iter := d.NewStreamIter()
+	var n int
+	for valid := iter.First(); valid; valid = iter.Next() {
+		e := iter.Event()
+		if seqNum := expected[string(e.Key.UserKey)]; seqNum != e.Key.SeqNum() {
+			t.Fatalf("%s: expected seqnum %d, but found %d", e.Key.UserKey, seqNum, e.Key.SeqNum())
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(expected) {
+		t.Fatalf("expected %d records, but found %d", len(expected), n)
+	}
+}
+
 func TestFlushableBatchIter(t *testing.T) {
 	var b *flushableBatch
 	datadriven.RunTest(t, "testdata/internal_iter_next", func(d *datadriven.TestData) string {
@@ -409,6 +582,45 @@ func BenchmarkBatchSet(b *testing.B) {
 	b.StopTimer()
 }
 
+func benchmarkBatchLargeValues(b *testing.B, set func(batch *Batch, key, value []byte)) {
+	const numValues = 8
+	keys := make([][]byte, numValues)
+	values := make([][]byte, numValues)
+	for i := range values {
+		keys[i] = make([]byte, 8)
+		binary.BigEndian.PutUint64(keys[i], uint64(i))
+		values[i] = bytes.Repeat([]byte{byte(i)}, 1<<20)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(numValues << 20)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		batch := newBatch(nil)
+		for j := range values {
+			set(batch, keys[j], values[j])
+		}
+		// Encode the batch as a commit would.
+		_ = batch.Repr()
+		batch.release()
+	}
+
+	b.StopTimer()
+}
+
+func BenchmarkBatchSetLargeValues(b *testing.B) {
+	benchmarkBatchLargeValues(b, func(batch *Batch, key, value []byte) {
+		batch.Set(key, value, nil)
+	})
+}
+
+func BenchmarkBatchSetNoCopyLargeValues(b *testing.B) {
+	benchmarkBatchLargeValues(b, func(batch *Batch, key, value []byte) {
+		batch.SetNoCopy(key, value, nil)
+	})
+}
+
 func BenchmarkIndexedBatchSet(b *testing.B) {
 	value := make([]byte, 10)
 	for i := range value {
@@ -8,6 +8,8 @@ package bloom // import "github.com/petermattis/pebble/bloom"
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
+	"math/bits"
 
 	"github.com/petermattis/pebble/db"
 )
@@ -17,6 +19,60 @@ const (
 	cacheLineBits = cacheLineSize * 8
 )
 
+// HashKind is the hash function applied to the keys of a Bloom filter. The
+// kind is recorded in the filter data alongside the number of probes, so a
+// filter is queried with the hash function it was written with regardless of
+// the policy used to read it.
+type HashKind uint8
+
+// The available hash functions.
+const (
+	// DefaultHash is the hash function of LevelDB and RocksDB Bloom filters,
+	// which is similar to the Murmur hash.
+	DefaultHash HashKind = iota
+	// XXHash is the 32-bit xxHash function. It distributes keys sharing long
+	// prefixes more uniformly than DefaultHash, at a slightly higher cost for
+	// short keys. Filters written with XXHash cannot be read by RocksDB or
+	// LevelDB.
+	XXHash
+)
+
+// The number of probes of a filter is stored in a byte, whose high bits hold
+// the HashKind. Numbers of probes greater than 30 are reserved.
+const (
+	hashKindShift = 6
+	nProbesMask   = 1<<hashKindShift - 1
+)
+
+func (k HashKind) String() string {
+	switch k {
+	case DefaultHash:
+		return "default"
+	case XXHash:
+		return "xxhash"
+	}
+	return "unknown"
+}
+
+func (k HashKind) hash(b []byte) uint32 {
+	if k == XXHash {
+		return xxhash32(b)
+	}
+	return hash(b)
+}
+
+// decodeProbes decodes the byte holding the number of probes and the hash
+// kind of a filter. It returns false if the filter uses an unknown encoding,
+// which is considered to match every key.
+func decodeProbes(b byte) (HashKind, uint8, bool) {
+	kind, nProbes := HashKind(b>>hashKindShift), b&nProbesMask
+	return kind, nProbes, kind <= XXHash && nProbes <= 30
+}
+
+func encodeProbes(kind HashKind, nProbes uint32) byte {
+	return byte(kind)<<hashKindShift | byte(nProbes)
+}
+
 // blockFilter is an encoded set of []byte keys.
 type blockFilter []byte
 
@@ -26,14 +82,14 @@ func (f blockFilter) MayContain(key []byte) bool {
 	if len(f) <= 1 {
 		return false
 	}
-	nProbes := f[len(f)-1]
-	if nProbes > 30 {
+	kind, nProbes, ok := decodeProbes(f[len(f)-1])
+	if !ok {
 		// This is reserved for potentially new encodings for short Bloom filters.
 		// Consider it a match.
 		return true
 	}
 	nBits := uint32(8 * (len(f) - 1))
-	h := hash(key)
+	h := kind.hash(key)
 	delta := h>>17 | h<<15
 	for j := uint8(0); j < nProbes; j++ {
 		bitPos := h % nBits
@@ -52,11 +108,14 @@ func (f tableFilter) MayContain(key []byte) bool {
 		return false
 	}
 	n := len(f) - 5
-	nProbes := f[n]
+	kind, nProbes, ok := decodeProbes(f[n])
+	if !ok {
+		return true
+	}
 	nLines := binary.LittleEndian.Uint32(f[n+1:])
 	cacheLineBits := 8 * (uint32(n) / nLines)
 
-	h := hash(key)
+	h := kind.hash(key)
 	delta := h>>17 | h<<15
 	b := (h % nLines) * cacheLineBits
 
@@ -132,14 +191,61 @@ func hash(b []byte) uint32 {
 	return h
 }
 
+// xxhash32 implements the 32-bit xxHash function, with a seed of zero.
+func xxhash32(b []byte) uint32 {
+	const (
+		prime1 uint32 = 2654435761
+		prime2 uint32 = 2246822519
+		prime3 uint32 = 3266489917
+		prime4 uint32 = 668265263
+		prime5 uint32 = 374761393
+	)
+	round := func(acc, input uint32) uint32 {
+		return bits.RotateLeft32(acc+input*prime2, 13) * prime1
+	}
+
+	n := len(b)
+	var h uint32
+	if n >= 16 {
+		// The accumulators are seeded with prime1+prime2, prime2, 0 and -prime1,
+		// modulo 2^32.
+		v1, v2, v3, v4 := uint32(606290984), prime2, uint32(0), uint32(1640531535)
+		for ; len(b) >= 16; b = b[16:] {
+			v1 = round(v1, binary.LittleEndian.Uint32(b[0:]))
+			v2 = round(v2, binary.LittleEndian.Uint32(b[4:]))
+			v3 = round(v3, binary.LittleEndian.Uint32(b[8:]))
+			v4 = round(v4, binary.LittleEndian.Uint32(b[12:]))
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) +
+			bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = prime5
+	}
+	h += uint32(n)
+	for ; len(b) >= 4; b = b[4:] {
+		h = bits.RotateLeft32(h+binary.LittleEndian.Uint32(b)*prime3, 17) * prime4
+	}
+	for ; len(b) > 0; b = b[1:] {
+		h = bits.RotateLeft32(h+uint32(b[0])*prime5, 11) * prime1
+	}
+	h ^= h >> 15
+	h *= prime2
+	h ^= h >> 13
+	h *= prime3
+	h ^= h >> 16
+	return h
+}
+
 type blockFilterWriter struct {
-	bitsPerKey int
+	bitsPerKey float64
+	nProbes    uint32
+	hashKind   HashKind
 	hashes     []uint32
 }
 
 // AddKey implements the db.FilterWriter interface.
 func (w *blockFilterWriter) AddKey(key []byte) {
-	h := hash(key)
+	h := w.hashKind.hash(key)
 	if n := len(w.hashes); n == 0 || h != w.hashes[n-1] {
 		w.hashes = append(w.hashes, h)
 	}
@@ -150,8 +256,8 @@ func (w *blockFilterWriter) Finish(buf []byte) []byte {
 	if w.bitsPerKey < 0 {
 		w.bitsPerKey = 0
 	}
-	nProbes := calculateProbes(w.bitsPerKey)
-	nBits := len(w.hashes) * w.bitsPerKey
+	nProbes := w.nProbes
+	nBits := int(math.Ceil(float64(len(w.hashes)) * w.bitsPerKey))
 	// For small len(keys), we can see a very high false positive rate. Fix it
 	// by enforcing a minimum bloom filter length.
 	if nBits < 64 {
@@ -169,20 +275,22 @@ func (w *blockFilterWriter) Finish(buf []byte) []byte {
 			h += delta
 		}
 	}
-	filter[nBytes] = uint8(nProbes)
+	filter[nBytes] = encodeProbes(w.hashKind, nProbes)
 
 	w.hashes = w.hashes[:0]
 	return buf
 }
 
 type tableFilterWriter struct {
-	bitsPerKey int
+	bitsPerKey float64
+	nProbes    uint32
+	hashKind   HashKind
 	hashes     []uint32
 }
 
 // AddKey implements the db.FilterWriter interface.
 func (w *tableFilterWriter) AddKey(key []byte) {
-	h := hash(key)
+	h := w.hashKind.hash(key)
 	if n := len(w.hashes); n == 0 || h != w.hashes[n-1] {
 		w.hashes = append(w.hashes, h)
 	}
@@ -193,7 +301,7 @@ func (w *tableFilterWriter) Finish(buf []byte) []byte {
 	// The table filter format matches the RocksDB full-file filter format.
 	var nBits, nLines int
 	if len(w.hashes) != 0 {
-		nBits = len(w.hashes) * w.bitsPerKey
+		nBits = int(math.Ceil(float64(len(w.hashes)) * w.bitsPerKey))
 		nLines = (nBits + cacheLineBits - 1) / (cacheLineBits)
 		// Make nLines an odd number to make sure more bits are involved when
 		// determining which block.
@@ -209,7 +317,7 @@ func (w *tableFilterWriter) Finish(buf []byte) []byte {
 	buf, filter := extend(buf, nBytes+5)
 
 	if nBits != 0 && nLines != 0 {
-		nProbes := calculateProbes(w.bitsPerKey)
+		nProbes := w.nProbes
 		for _, h := range w.hashes {
 			delta := h>>17 | h<<15 // rotate right 17 bits
 			b := (h % uint32(nLines)) * (cacheLineBits)
@@ -219,7 +327,7 @@ func (w *tableFilterWriter) Finish(buf []byte) []byte {
 				h += delta
 			}
 		}
-		filter[nBytes] = byte(nProbes)
+		filter[nBytes] = encodeProbes(w.hashKind, nProbes)
 		binary.LittleEndian.PutUint32(filter[nBytes+1:], uint32(nLines))
 	}
 
@@ -262,11 +370,200 @@ func (p FilterPolicy) NewWriter(ftype db.FilterType) db.FilterWriter {
 	switch ftype {
 	case db.BlockFilter:
 		return &blockFilterWriter{
-			bitsPerKey: int(p),
+			bitsPerKey: float64(p),
+			nProbes:    calculateProbes(int(p)),
+		}
+	case db.TableFilter:
+		return &tableFilterWriter{
+			bitsPerKey: float64(p),
+			nProbes:    calculateProbes(int(p)),
+		}
+	default:
+		panic(fmt.Sprintf("unknown filter type: %v", ftype))
+	}
+}
+
+// WithBitsPerKey implements the db.SizedFilterPolicy interface.
+func (p FilterPolicy) WithBitsPerKey(bitsPerKey int) db.FilterPolicy {
+	return FilterPolicy(bitsPerKey)
+}
+
+// hashPolicy is a Bloom filter policy using a specified hash function. See
+// FilterPolicyWithHash.
+type hashPolicy struct {
+	bitsPerKey int
+	hashKind   HashKind
+}
+
+// FilterPolicyWithHash returns a Bloom filter policy which uses approximately
+// bitsPerKey bits per key, like FilterPolicy, and hashes the keys with the
+// specified hash function. The filters are readable by any policy of this
+// package, as the hash function is recorded in the filter data.
+func FilterPolicyWithHash(bitsPerKey int, hashKind HashKind) db.FilterPolicy {
+	return hashPolicy{bitsPerKey: bitsPerKey, hashKind: hashKind}
+}
+
+// Name implements the db.FilterPolicy interface.
+func (p hashPolicy) Name() string {
+	return FilterPolicy(0).Name()
+}
+
+// MayContain implements the db.FilterPolicy interface.
+func (p hashPolicy) MayContain(ftype db.FilterType, f, key []byte) bool {
+	return FilterPolicy(0).MayContain(ftype, f, key)
+}
+
+// NewWriter implements the db.FilterPolicy interface.
+func (p hashPolicy) NewWriter(ftype db.FilterType) db.FilterWriter {
+	switch ftype {
+	case db.BlockFilter:
+		return &blockFilterWriter{
+			bitsPerKey: float64(p.bitsPerKey),
+			nProbes:    calculateProbes(p.bitsPerKey),
+			hashKind:   p.hashKind,
+		}
+	case db.TableFilter:
+		return &tableFilterWriter{
+			bitsPerKey: float64(p.bitsPerKey),
+			nProbes:    calculateProbes(p.bitsPerKey),
+			hashKind:   p.hashKind,
+		}
+	default:
+		panic(fmt.Sprintf("unknown filter type: %v", ftype))
+	}
+}
+
+// WithBitsPerKey implements the db.SizedFilterPolicy interface.
+func (p hashPolicy) WithBitsPerKey(bitsPerKey int) db.FilterPolicy {
+	return FilterPolicyWithHash(bitsPerKey, p.hashKind)
+}
+
+// fpRatePolicy is a Bloom filter policy sized for a target false positive
+// rate. See FilterPolicyForFPRate.
+type fpRatePolicy struct {
+	// The parameters for block filters, which are standard Bloom filters.
+	bitsPerKey float64
+	nProbes    uint32
+	// The parameters for table filters. Confining the probes for a key to a
+	// single cache line increases the false positive rate, which requires more
+	// bits per key to compensate.
+	tableBitsPerKey float64
+	tableNProbes    uint32
+}
+
+// FilterPolicyForFPRate returns a Bloom filter policy which sizes filters to
+// achieve the specified false positive rate, which must be in the range (0,
+// 1). The number of bits per key and the number of probes are derived from
+// the rate. The probe count is stored in the filter data, so the filters are
+// readable by FilterPolicy (and by RocksDB) and vice versa.
+//
+// Table filters confine the probes for a key to a single cache line, and
+// need more bits per key than block filters to achieve the same rate. The
+// difference grows quickly for rates below 0.1%, as the probes for some keys
+// revisit the same bits.
+//
+// The rate takes precedence over LevelOptions.FilterBitsPerKey: the policy
+// does not implement db.SizedFilterPolicy, so the option is ignored for it.
+func FilterPolicyForFPRate(fpRate float64) (db.FilterPolicy, error) {
+	if !(fpRate > 0 && fpRate < 1) {
+		return nil, fmt.Errorf("pebble/bloom: false positive rate must be in (0, 1): %v", fpRate)
+	}
+	// For an optimally configured Bloom filter, the false positive rate is
+	// (1/2)^k where k = ln(2) * bitsPerKey is the number of probes.
+	k := math.Log2(1 / fpRate)
+	p := &fpRatePolicy{
+		bitsPerKey: k / math.Ln2,
+		nProbes:    clampProbes(math.Floor(k + 0.5)),
+	}
+	// There is no closed form for the false positive rate of a cache-local
+	// Bloom filter, so search for the smallest number of bits per key which
+	// achieves the rate, over the plausible probe counts.
+	p.tableBitsPerKey = math.Inf(1)
+	for n := clampProbes(k - 2); n <= clampProbes(k+2); n++ {
+		lo, hi := p.bitsPerKey, 2*p.bitsPerKey+8
+		if tableFilterFPRate(hi, n) > fpRate {
+			continue
+		}
+		for i := 0; i < 30; i++ {
+			if mid := (lo + hi) / 2; tableFilterFPRate(mid, n) > fpRate {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		if hi < p.tableBitsPerKey {
+			p.tableBitsPerKey, p.tableNProbes = hi, n
+		}
+	}
+	if p.tableNProbes == 0 {
+		p.tableBitsPerKey, p.tableNProbes = p.bitsPerKey, p.nProbes
+	}
+	return p, nil
+}
+
+func clampProbes(n float64) uint32 {
+	if n < 1 {
+		return 1
+	}
+	if n > 30 {
+		return 30
+	}
+	return uint32(n)
+}
+
+// tableFilterFPRate estimates the false positive rate of a table filter. The
+// number of keys hashed to a cache line is approximately Poisson distributed,
+// and each line is a Bloom filter over its keys. The probes for a key step
+// through the line by a hash-derived delta, so a delta sharing a large power
+// of two with the line size revisits bit positions and probes fewer distinct
+// bits.
+func tableFilterFPRate(bitsPerKey float64, nProbes uint32) float64 {
+	lambda := cacheLineBits / bitsPerKey
+	k := float64(nProbes)
+	var rate float64
+	// pois is the Poisson probability of j keys in a line.
+	pois := math.Exp(-lambda)
+	for j := 0; j < int(lambda+10*math.Sqrt(lambda)+10); j++ {
+		if j > 0 {
+			pois *= lambda / float64(j)
+		}
+		set := 1 - math.Pow(1-1.0/cacheLineBits, k*float64(j))
+		// The delta is divisible by exactly 2^i with probability 2^-(i+1), in
+		// which case the probes cycle through cacheLineBits/2^i positions.
+		for i, prob := uint(0), 0.5; (1 << i) <= cacheLineBits; i++ {
+			if (1 << i) == cacheLineBits {
+				prob *= 2
+			}
+			distinct := math.Min(k, float64(int(cacheLineBits)>>i))
+			rate += pois * prob * math.Pow(set, distinct)
+			prob /= 2
+		}
+	}
+	return rate
+}
+
+// Name implements the db.FilterPolicy interface.
+func (p *fpRatePolicy) Name() string {
+	return FilterPolicy(0).Name()
+}
+
+// MayContain implements the db.FilterPolicy interface.
+func (p *fpRatePolicy) MayContain(ftype db.FilterType, f, key []byte) bool {
+	return FilterPolicy(0).MayContain(ftype, f, key)
+}
+
+// NewWriter implements the db.FilterPolicy interface.
+func (p *fpRatePolicy) NewWriter(ftype db.FilterType) db.FilterWriter {
+	switch ftype {
+	case db.BlockFilter:
+		return &blockFilterWriter{
+			bitsPerKey: p.bitsPerKey,
+			nProbes:    p.nProbes,
 		}
 	case db.TableFilter:
 		return &tableFilterWriter{
-			bitsPerKey: int(p),
+			bitsPerKey: p.tableBitsPerKey,
+			nProbes:    p.tableNProbes,
 		}
 	default:
 		panic(fmt.Sprintf("unknown filter type: %v", ftype))
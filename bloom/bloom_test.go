@@ -5,6 +5,8 @@
 package bloom
 
 import (
+	"fmt"
+	"math"
 	"testing"
 
 	"github.com/petermattis/pebble/db"
@@ -146,3 +148,122 @@ func TestHash(t *testing.T) {
 		}
 	}
 }
+
+func TestFilterPolicyForFPRate(t *testing.T) {
+	for _, fpRate := range []float64{0, -0.1, 1, 1.5} {
+		if _, err := FilterPolicyForFPRate(fpRate); err == nil {
+			t.Errorf("fpRate=%v: expected error", fpRate)
+		}
+	}
+
+	le32 := func(i int) []byte {
+		b := make([]byte, 4)
+		b[0] = uint8(uint32(i) >> 0)
+		b[1] = uint8(uint32(i) >> 8)
+		b[2] = uint8(uint32(i) >> 16)
+		b[3] = uint8(uint32(i) >> 24)
+		return b
+	}
+
+	const nKeys = 10000
+	const nProbes = 100000
+	for _, ftype := range []db.FilterType{db.BlockFilter, db.TableFilter} {
+		for _, fpRate := range []float64{0.1, 0.01, 0.001} {
+			p, err := FilterPolicyForFPRate(fpRate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name := p.Name(); name != FilterPolicy(10).Name() {
+				t.Fatalf("unexpected name: %s", name)
+			}
+			w := p.NewWriter(ftype)
+			for i := 0; i < nKeys; i++ {
+				w.AddKey(le32(i))
+			}
+			f := w.Finish(nil)
+
+			for i := 0; i < nKeys; i++ {
+				if !p.MayContain(ftype, f, le32(i)) {
+					t.Fatalf("%s: fpRate=%v: did not contain key %d", ftype, fpRate, i)
+				}
+			}
+			nFalsePositive := 0
+			for i := 0; i < nProbes; i++ {
+				if p.MayContain(ftype, f, le32(1e9+i)) {
+					nFalsePositive++
+				}
+			}
+			rate := float64(nFalsePositive) / nProbes
+			if rate < fpRate/2 || rate > fpRate*2 {
+				t.Errorf("%s: fpRate=%v: empirical false positive rate %v", ftype, fpRate, rate)
+			}
+		}
+	}
+}
+
+func TestXXHash(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want uint32
+	}{
+		{"", 0x02cc5d05},
+		{"a", 0x550d7456},
+		{"abc", 0x32d153ff},
+		{"Nobody inspects the spammish repetition", 0xe2293b2f},
+	}
+	for _, tc := range testCases {
+		if got := xxhash32([]byte(tc.s)); got != tc.want {
+			t.Errorf("s=%q: got 0x%08x, want 0x%08x", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestFilterPolicyWithHash(t *testing.T) {
+	const bitsPerKey = 10
+	const nKeys = 10000
+	const nProbes = 100000
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-with-a-long-shared-prefix-%08d", i))
+	}
+	// The expected false positive rates, for a standard Bloom filter and a
+	// cache-local one.
+	k := float64(calculateProbes(bitsPerKey))
+	expected := map[db.FilterType]float64{
+		db.BlockFilter: math.Pow(1-math.Exp(-k/bitsPerKey), k),
+		db.TableFilter: tableFilterFPRate(bitsPerKey, uint32(k)),
+	}
+
+	for _, kind := range []HashKind{DefaultHash, XXHash} {
+		for _, ftype := range []db.FilterType{db.BlockFilter, db.TableFilter} {
+			p := FilterPolicyWithHash(bitsPerKey, kind)
+			if name := p.Name(); name != FilterPolicy(bitsPerKey).Name() {
+				t.Fatalf("unexpected name: %s", name)
+			}
+			w := p.NewWriter(ftype)
+			for i := 0; i < nKeys; i++ {
+				w.AddKey(key(i))
+			}
+			f := w.Finish(nil)
+
+			// The filter is read with the hash function it was written with, by
+			// any policy.
+			for _, r := range []db.FilterPolicy{p, FilterPolicy(bitsPerKey)} {
+				for i := 0; i < nKeys; i++ {
+					if !r.MayContain(ftype, f, key(i)) {
+						t.Fatalf("%s: %s: did not contain key %d", kind, ftype, i)
+					}
+				}
+			}
+			nFalsePositive := 0
+			for i := 0; i < nProbes; i++ {
+				if p.MayContain(ftype, f, key(nKeys+i)) {
+					nFalsePositive++
+				}
+			}
+			rate := float64(nFalsePositive) / nProbes
+			if e := expected[ftype]; rate < e/2 || rate > e*2 {
+				t.Errorf("%s: %s: empirical false positive rate %v, expected %v", kind, ftype, rate, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import "sync/atomic"
+
+// Allocator manages the memory of cached values outside of the Go garbage
+// collector, such as in a pool of recycled slabs. Alloc returns a buffer of
+// length n, and Free returns a buffer previously returned by Alloc. A Cache
+// frees an allocated value once it has been evicted and every Handle to it
+// has been released. The methods may be called concurrently.
+type Allocator interface {
+	Alloc(n int) []byte
+	Free(b []byte)
+}
+
+// Handle is a counted reference to a value in a Cache. The memory of a value
+// allocated by an Allocator is not freed while a handle to it is held, even
+// if the value is evicted. The handle must be released once the value is no
+// longer used.
+type Handle struct {
+	value []byte
+	alloc Allocator
+	refs  int32
+}
+
+// Get returns the value.
+func (h *Handle) Get() []byte {
+	return h.value
+}
+
+// Release releases the reference to the value, freeing the value if it was
+// the last reference to an allocated value. It is valid to release a nil
+// handle.
+func (h *Handle) Release() {
+	if h == nil || h.alloc == nil {
+		return
+	}
+	if atomic.AddInt32(&h.refs, -1) == 0 {
+		h.alloc.Free(h.value)
+		h.value = nil
+	}
+}
+
+// allocatedLocked returns the handle of the value if it was allocated by an
+// Allocator. Requires c.mu to be held.
+func (c *Cache) allocatedLocked(value []byte) *Handle {
+	if len(value) == 0 || c.allocated == nil {
+		return nil
+	}
+	return c.allocated[&value[0]]
+}
+
+// evicted is called by the policy, with c.mu held, when it drops a value. The
+// cache's reference to an allocated value is released.
+func (c *Cache) evicted(value []byte) {
+	if h := c.allocatedLocked(value); h != nil {
+		delete(c.allocated, &value[0])
+		h.Release()
+	}
+}
+
+// GetHandle retrieves the cache value for the specified file, epoch and
+// offset, returning nil if no value is present. The returned handle holds a
+// reference to the value, which must be released.
+func (c *Cache) GetHandle(fileNum, epoch, offset uint64) *Handle {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v := c.policy.get(key{fileNum: fileNum, epoch: epoch, offset: offset})
+	if v == nil {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	if h := c.allocatedLocked(v); h != nil {
+		atomic.AddInt32(&h.refs, 1)
+		return h
+	}
+	return &Handle{value: v}
+}
+
+// SetAllocated sets the cache value for the specified file, epoch and offset
+// to a value allocated by a, overwriting an existing value if present. The
+// value is returned to a once it has been evicted and its handles released.
+// The returned handle holds a reference to the value, which must be released.
+func (c *Cache) SetAllocated(fileNum, epoch, offset uint64, value []byte, a Allocator) *Handle {
+	h := &Handle{value: value, alloc: a, refs: 1}
+	if c == nil || len(value) == 0 {
+		return h
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.allocated == nil {
+		c.allocated = make(map[*byte]*Handle)
+	}
+	// One reference for the caller and one for the cache, which is released
+	// when the value is evicted.
+	h.refs = 2
+	c.allocated[&value[0]] = h
+	c.policy.set(key{fileNum: fileNum, epoch: epoch, offset: offset}, value)
+	return h
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+// slabPool is an Allocator which recycles fixed size slabs.
+type slabPool struct {
+	size  int
+	free  [][]byte
+	slabs int
+	frees int
+}
+
+func (p *slabPool) Alloc(n int) []byte {
+	if n > p.size {
+		panic("allocation larger than slab")
+	}
+	if len(p.free) > 0 {
+		b := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		return b[:n]
+	}
+	p.slabs++
+	return make([]byte, n, p.size)
+}
+
+func (p *slabPool) Free(b []byte) {
+	p.frees++
+	p.free = append(p.free, b[:0])
+}
+
+func TestAllocator(t *testing.T) {
+	for _, policy := range []EvictionPolicy{ClockPro, LRU} {
+		t.Run(policy.String(), func(t *testing.T) {
+			p := &slabPool{size: 10}
+			c := NewWithPolicy(100, policy)
+
+			set := func(fileNum uint64, s string) *Handle {
+				v := p.Alloc(len(s))
+				copy(v, s)
+				return c.SetAllocated(fileNum, 0, 0, v, p)
+			}
+
+			for i := 1; i < 1000; i++ {
+				set(uint64(i), "0123456789").Release()
+			}
+			if p.frees == 0 {
+				t.Fatalf("expected evicted values to be freed")
+			}
+			// The evicted slabs are reused, so the number of slabs is bounded by
+			// the size of the cache rather than the number of values set.
+			if p.slabs > 30 {
+				t.Fatalf("expected evicted slabs to be reused, but allocated %d slabs", p.slabs)
+			}
+
+			// A value retrieved with GetHandle is not freed until its handle is
+			// released, even if it is evicted, and Get returns a copy of it.
+			set(2000, "abc").Release()
+			h := c.GetHandle(2000, 0, 0)
+			if h == nil || string(h.Get()) != "abc" {
+				t.Fatalf("expected abc")
+			}
+			v := c.Get(2000, 0)
+			if !bytes.Equal(v, h.Get()) || &v[0] == &h.Get()[0] {
+				t.Fatalf("expected a copy of the value")
+			}
+			frees := p.frees
+			c.EvictFile(2000)
+			if p.frees != frees {
+				t.Fatalf("expected value with a held handle not to be freed")
+			}
+			h.Release()
+			if p.frees != frees+1 {
+				t.Fatalf("expected released value to be freed")
+			}
+		})
+	}
+}
@@ -1,7 +1,8 @@
 // Copyright 2018. All rights reserved. Use of this source code is governed by
 // an MIT-style license that can be found in the LICENSE file.
 
-// Package cache implements the CLOCK-Pro caching algorithm.
+// Package cache implements the CLOCK-Pro caching algorithm, along with a
+// strict LRU alternative (see EvictionPolicy).
 /*
 
 CLOCK-Pro is a patent-free alternative to the Adaptive Replacement Cache,
@@ -47,6 +48,7 @@ func (p entryType) String() string {
 
 type key struct {
 	fileNum uint64
+	epoch   uint64
 	offset  uint64
 }
 
@@ -147,38 +149,81 @@ type WeakHandle interface {
 	Get() []byte
 }
 
+// policy is an eviction policy: the structure which holds the values in a
+// Cache and chooses which of them to evict when the cache is full. The methods
+// are called with Cache.mu held. The policy calls Cache.evicted for each value
+// it drops, whether evicted or overwritten.
+type policy interface {
+	// get returns the value for the key, or nil if no value is present.
+	get(k key) []byte
+	// set sets the value for the key, overwriting an existing value and
+	// evicting other values as necessary.
+	set(k key, value []byte) WeakHandle
+	// evictFile evicts all of the values for the file.
+	evictFile(fileNum uint64)
+	// size returns the space used by the values.
+	size() int64
+}
+
 // Cache ...
 type Cache struct {
 	mu sync.Mutex
 
-	maxSize  int64
-	coldSize int64
-	blocks   map[key]*entry    // fileNum+offset -> block
-	files    map[uint64]*entry // fileNum -> list of blocks
+	maxSize int64
 
-	handHot  *entry
-	handCold *entry
-	handTest *entry
+	// The number of Get calls which found, and did not find, a value.
+	hits   int64
+	misses int64
 
-	countHot  int64
-	countCold int64
-	countTest int64
+	evictionPolicy EvictionPolicy
+	policy         policy
+
+	// allocated holds the handles of the values allocated by an Allocator,
+	// keyed by the address of their first byte. See SetAllocated.
+	allocated map[*byte]*Handle
 }
 
-// New creates a new cache of the specified size. Memory for the cache is
-// allocated on demand, not during initialization.
+// New creates a new cache of the specified size using the CLOCK-Pro eviction
+// policy. Memory for the cache is allocated on demand, not during
+// initialization.
 func New(size int64) *Cache {
-	return &Cache{
-		maxSize:  size,
-		coldSize: size,
-		blocks:   make(map[key]*entry),
-		files:    make(map[uint64]*entry),
-	}
+	return NewWithPolicy(size, ClockPro)
+}
+
+// NewWithPolicy creates a new cache of the specified size using the specified
+// eviction policy. Memory for the cache is allocated on demand, not during
+// initialization.
+func NewWithPolicy(size int64, evictionPolicy EvictionPolicy) *Cache {
+	c := &Cache{
+		maxSize:        size,
+		evictionPolicy: evictionPolicy,
+	}
+	switch evictionPolicy {
+	case LRU:
+		c.policy = newLRU(&c.mu, size, c.evicted)
+	default:
+		c.policy = newClockPro(size, c.evicted)
+	}
+	return c
+}
+
+// Policy returns the eviction policy of the cache.
+func (c *Cache) Policy() EvictionPolicy {
+	return c.evictionPolicy
 }
 
 // Get retrieves the cache value for the specified file and offset, returning
 // nil if no value is present.
 func (c *Cache) Get(fileNum, offset uint64) []byte {
+	return c.GetWithEpoch(fileNum, 0, offset)
+}
+
+// GetWithEpoch retrieves the cache value for the specified file, epoch and
+// offset, returning nil if no value is present. The epoch distinguishes
+// successive incarnations of a file which reuse the same file number. A copy
+// of a value allocated by an Allocator is returned, as the value's memory may
+// be freed once it is evicted; use GetHandle to retrieve it without copying.
+func (c *Cache) GetWithEpoch(fileNum, epoch, offset uint64) []byte {
 	if c == nil {
 		return nil
 	}
@@ -186,11 +231,16 @@ func (c *Cache) Get(fileNum, offset uint64) []byte {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	e := c.blocks[key{fileNum: fileNum, offset: offset}]
-	if e == nil {
-		return nil
+	v := c.policy.get(key{fileNum: fileNum, epoch: epoch, offset: offset})
+	if v == nil {
+		c.misses++
+	} else {
+		c.hits++
+		if c.allocatedLocked(v) != nil {
+			v = append([]byte(nil), v...)
+		}
 	}
-	return e.Get()
+	return v
 }
 
 // Set sets the cache value for the specified file and offset, overwriting an
@@ -198,6 +248,12 @@ func (c *Cache) Get(fileNum, offset uint64) []byte {
 // retrieval of the cached value than Get (lock-free and avoidance of the map
 // lookup).
 func (c *Cache) Set(fileNum, offset uint64, value []byte) WeakHandle {
+	return c.SetWithEpoch(fileNum, 0, offset, value)
+}
+
+// SetWithEpoch sets the cache value for the specified file, epoch and offset,
+// overwriting an existing value if present. See Set.
+func (c *Cache) SetWithEpoch(fileNum, epoch, offset uint64, value []byte) WeakHandle {
 	if c == nil {
 		return nil
 	}
@@ -205,7 +261,91 @@ func (c *Cache) Set(fileNum, offset uint64, value []byte) WeakHandle {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	k := key{fileNum: fileNum, offset: offset}
+	return c.policy.set(key{fileNum: fileNum, epoch: epoch, offset: offset}, value)
+}
+
+// EvictFile evicts all of the cache values for the specified file.
+func (c *Cache) EvictFile(fileNum uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.policy.evictFile(fileNum)
+}
+
+// MaxSize returns the max size of the cache.
+func (c *Cache) MaxSize() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.maxSize
+}
+
+// Size returns the current space used by the cache.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	size := c.policy.size()
+	c.mu.Unlock()
+	return size
+}
+
+// Hits returns the number of Get calls which found a value in the cache.
+func (c *Cache) Hits() int64 {
+	c.mu.Lock()
+	hits := c.hits
+	c.mu.Unlock()
+	return hits
+}
+
+// Misses returns the number of Get calls which did not find a value in the
+// cache.
+func (c *Cache) Misses() int64 {
+	c.mu.Lock()
+	misses := c.misses
+	c.mu.Unlock()
+	return misses
+}
+
+// clockPro implements the CLOCK-Pro eviction policy.
+type clockPro struct {
+	maxSize  int64
+	coldSize int64
+	blocks   map[key]*entry    // fileNum+offset -> block
+	files    map[uint64]*entry // fileNum -> list of blocks
+
+	handHot  *entry
+	handCold *entry
+	handTest *entry
+
+	countHot  int64
+	countCold int64
+	countTest int64
+
+	evicted func(value []byte)
+}
+
+func newClockPro(size int64, evicted func(value []byte)) *clockPro {
+	return &clockPro{
+		maxSize:  size,
+		coldSize: size,
+		blocks:   make(map[key]*entry),
+		files:    make(map[uint64]*entry),
+		evicted:  evicted,
+	}
+}
+
+func (c *clockPro) get(k key) []byte {
+	e := c.blocks[k]
+	if e == nil {
+		return nil
+	}
+	return e.Get()
+}
+
+func (c *clockPro) set(k key, value []byte) WeakHandle {
 	e := c.blocks[k]
 	if e == nil {
 		// no cache entry? add it
@@ -217,9 +357,10 @@ func (c *Cache) Set(fileNum, offset uint64, value []byte) WeakHandle {
 		return e
 	}
 
-	if e.val.get() != nil {
+	if old := e.val.get(); old != nil {
 		// cache entry was a hot or cold page
 		e.val.set(value)
+		c.evicted(old)
 		atomic.StoreInt32(&e.ref, 1)
 		delta := int64(len(value)) - e.size
 		e.size = int64(len(value))
@@ -247,15 +388,7 @@ func (c *Cache) Set(fileNum, offset uint64, value []byte) WeakHandle {
 	return e
 }
 
-// EvictFile evicts all of the cache values for the specified file.
-func (c *Cache) EvictFile(fileNum uint64) {
-	if c == nil {
-		return
-	}
-
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
+func (c *clockPro) evictFile(fileNum uint64) {
 	blocks := c.files[fileNum]
 	if blocks == nil {
 		return
@@ -270,6 +403,9 @@ func (c *Cache) EvictFile(fileNum uint64) {
 			c.countTest -= b.size
 		}
 		n = b.fileLink.next
+		if v := b.val.get(); v != nil {
+			c.evicted(v)
+		}
 		c.metaDel(b)
 		if b == n {
 			break
@@ -277,23 +413,11 @@ func (c *Cache) EvictFile(fileNum uint64) {
 	}
 }
 
-// MaxSize returns the max size of the cache.
-func (c *Cache) MaxSize() int64 {
-	if c == nil {
-		return 0
-	}
-	return c.maxSize
-}
-
-// Size returns the current space used by the cache.
-func (c *Cache) Size() int64 {
-	c.mu.Lock()
-	size := c.countHot + c.countCold
-	c.mu.Unlock()
-	return size
+func (c *clockPro) size() int64 {
+	return c.countHot + c.countCold
 }
 
-func (c *Cache) metaAdd(key key, e *entry) {
+func (c *clockPro) metaAdd(key key, e *entry) {
 	c.evict()
 
 	c.blocks[key] = e
@@ -318,7 +442,7 @@ func (c *Cache) metaAdd(key key, e *entry) {
 	}
 }
 
-func (c *Cache) metaDel(e *entry) {
+func (c *clockPro) metaDel(e *entry) {
 	delete(c.blocks, e.key)
 
 	if e == c.handHot {
@@ -345,13 +469,13 @@ func (c *Cache) metaDel(e *entry) {
 	}
 }
 
-func (c *Cache) evict() {
+func (c *clockPro) evict() {
 	for c.maxSize <= c.countHot+c.countCold {
 		c.runHandCold()
 	}
 }
 
-func (c *Cache) runHandCold() {
+func (c *clockPro) runHandCold() {
 	if c.handCold == nil {
 		return
 	}
@@ -364,6 +488,7 @@ func (c *Cache) runHandCold() {
 			c.countCold -= e.size
 			c.countHot += e.size
 		} else {
+			c.evicted(e.val.get())
 			e.val.set(nil)
 			e.ptype = etTest
 			c.countCold -= e.size
@@ -381,7 +506,7 @@ func (c *Cache) runHandCold() {
 	}
 }
 
-func (c *Cache) runHandHot() {
+func (c *clockPro) runHandHot() {
 	if c.handHot == c.handTest {
 		c.runHandTest()
 	}
@@ -403,7 +528,7 @@ func (c *Cache) runHandHot() {
 	c.handHot = c.handHot.next()
 }
 
-func (c *Cache) runHandTest() {
+func (c *clockPro) runHandTest() {
 	if c.countCold > 0 && c.handTest == c.handCold {
 		c.runHandCold()
 	}
@@ -0,0 +1,162 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import (
+	"fmt"
+	"sync"
+)
+
+// EvictionPolicy is the algorithm used by a Cache to choose the values to
+// evict when the cache is full.
+type EvictionPolicy int
+
+// The available eviction policies.
+const (
+	// ClockPro uses the CLOCK-Pro algorithm. A cache hit only sets a reference
+	// bit on the entry, and the entries are reordered as the clock hands sweep
+	// over them during eviction. CLOCK-Pro is scan resistant: values which are
+	// only accessed once are evicted before frequently accessed values.
+	ClockPro EvictionPolicy = iota
+	// LRU evicts the least recently used value. Every cache hit moves the entry
+	// to the front of the recency list, which makes hits more expensive than
+	// with ClockPro. Unlike with ClockPro, a retrieval through a WeakHandle
+	// acquires the cache mutex to do so.
+	LRU
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case ClockPro:
+		return "clock-pro"
+	case LRU:
+		return "lru"
+	}
+	return fmt.Sprintf("unknown(%d)", int(p))
+}
+
+// lruEntry is an entry in a cache using the LRU eviction policy. It
+// implements the WeakHandle interface.
+type lruEntry struct {
+	p          *lru
+	key        key
+	val        []byte
+	prev, next *lruEntry
+}
+
+// Get implements WeakHandle.Get. A value retrieved through the handle is
+// marked as the most recently used.
+func (e *lruEntry) Get() []byte {
+	p := e.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.val != nil {
+		p.touch(e)
+	}
+	return e.val
+}
+
+// lru implements the LRU eviction policy.
+type lru struct {
+	// mu is Cache.mu, which is acquired by lruEntry.Get.
+	mu      *sync.Mutex
+	maxSize int64
+	entries map[key]*lruEntry
+	files   map[uint64]map[key]*lruEntry
+	// list is the sentinel of a circular list of the entries, ordered from most
+	// recently used (list.next) to least recently used (list.prev).
+	list      lruEntry
+	totalSize int64
+	evicted   func(value []byte)
+}
+
+func newLRU(mu *sync.Mutex, size int64, evicted func(value []byte)) *lru {
+	p := &lru{
+		mu:      mu,
+		maxSize: size,
+		entries: make(map[key]*lruEntry),
+		files:   make(map[uint64]map[key]*lruEntry),
+		evicted: evicted,
+	}
+	p.list.next = &p.list
+	p.list.prev = &p.list
+	return p
+}
+
+func (p *lru) touch(e *lruEntry) {
+	if p.list.next == e {
+		return
+	}
+	p.unlink(e)
+	p.pushFront(e)
+}
+
+func (p *lru) pushFront(e *lruEntry) {
+	e.prev = &p.list
+	e.next = p.list.next
+	e.prev.next = e
+	e.next.prev = e
+}
+
+func (p *lru) unlink(e *lruEntry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	e.prev, e.next = nil, nil
+}
+
+func (p *lru) remove(e *lruEntry) {
+	p.unlink(e)
+	delete(p.entries, e.key)
+	if blocks := p.files[e.key.fileNum]; blocks != nil {
+		delete(blocks, e.key)
+		if len(blocks) == 0 {
+			delete(p.files, e.key.fileNum)
+		}
+	}
+	p.totalSize -= int64(len(e.val))
+	p.evicted(e.val)
+	e.val = nil
+}
+
+func (p *lru) get(k key) []byte {
+	e := p.entries[k]
+	if e == nil {
+		return nil
+	}
+	p.touch(e)
+	return e.val
+}
+
+func (p *lru) set(k key, value []byte) WeakHandle {
+	if e := p.entries[k]; e != nil {
+		p.remove(e)
+	}
+	e := &lruEntry{p: p, key: k, val: value}
+	p.entries[k] = e
+	blocks := p.files[k.fileNum]
+	if blocks == nil {
+		blocks = make(map[key]*lruEntry)
+		p.files[k.fileNum] = blocks
+	}
+	blocks[k] = e
+	p.pushFront(e)
+	p.totalSize += int64(len(value))
+	// A value larger than the cache evicts every other value, and is then
+	// evicted itself.
+	for p.totalSize > p.maxSize {
+		p.remove(p.list.prev)
+	}
+	return e
+}
+
+func (p *lru) evictFile(fileNum uint64) {
+	for _, e := range p.files[fileNum] {
+		p.remove(e)
+	}
+}
+
+func (p *lru) size() int64 {
+	return p.totalSize
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	c := NewWithPolicy(10, LRU)
+	c.Set(1, 0, bytes.Repeat([]byte("a"), 4))
+	h := c.Set(1, 1, bytes.Repeat([]byte("b"), 4))
+	c.Set(2, 0, bytes.Repeat([]byte("c"), 2))
+	if n := c.Size(); n != 10 {
+		t.Fatalf("expected size 10, but found %d", n)
+	}
+
+	// Accessing "a" makes "b" the least recently used value, which is evicted
+	// to make room for "d".
+	if v := c.Get(1, 0); string(v) != "aaaa" {
+		t.Fatalf("expected aaaa, but found %s", v)
+	}
+	c.Set(2, 1, bytes.Repeat([]byte("d"), 4))
+	if v := h.Get(); v != nil {
+		t.Fatalf("expected nil, but found %s", v)
+	}
+	if v := c.Get(1, 1); v != nil {
+		t.Fatalf("expected nil, but found %s", v)
+	}
+	if hits, misses := c.Hits(), c.Misses(); hits != 1 || misses != 1 {
+		t.Fatalf("expected 1 hit and 1 miss, but found %d and %d", hits, misses)
+	}
+
+	c.EvictFile(2)
+	if v := c.Get(2, 0); v != nil {
+		t.Fatalf("expected nil, but found %s", v)
+	}
+	if n := c.Size(); n != 4 {
+		t.Fatalf("expected size 4, but found %d", n)
+	}
+
+	// A value larger than the cache is not retained.
+	c.Set(3, 0, bytes.Repeat([]byte("e"), 11))
+	if n := c.Size(); n != 0 {
+		t.Fatalf("expected size 0, but found %d", n)
+	}
+
+	// The values are evicted from the least to the most recently used, where
+	// both setting and getting a value use it. The entries are inspected
+	// directly, as a Get would reorder them.
+	c = NewWithPolicy(4, LRU)
+	for i := uint64(0); i < 4; i++ {
+		c.Set(4, i, []byte{byte('a' + i)})
+	}
+	for _, i := range []uint64{2, 0} {
+		if v := c.Get(4, i); v == nil {
+			t.Fatalf("expected a value at offset %d", i)
+		}
+	}
+	p := c.policy.(*lru)
+	for j, expected := range []uint64{1, 3, 2, 0} {
+		c.Set(5, uint64(j), []byte{'x'})
+		var remaining []uint64
+		for i := uint64(0); i < 4; i++ {
+			if _, ok := p.entries[key{fileNum: 4, offset: i}]; ok {
+				remaining = append(remaining, i)
+			}
+		}
+		for _, i := range remaining {
+			if i == expected {
+				t.Fatalf("expected offset %d to be evicted, but found %v remaining", expected, remaining)
+			}
+		}
+		if len(remaining) != 3-j {
+			t.Fatalf("expected only offset %d to be evicted, but found %v remaining", expected, remaining)
+		}
+	}
+}
+
+// BenchmarkCacheHits measures the cost of concurrent cache hits for each
+// eviction policy. Cache.Get serializes the hits on the cache mutex under
+// either policy.
+func BenchmarkCacheHits(b *testing.B) {
+	const numBlocks = 1024
+	for _, policy := range []EvictionPolicy{ClockPro, LRU} {
+		b.Run(fmt.Sprint(policy), func(b *testing.B) {
+			c := NewWithPolicy(numBlocks*64, policy)
+			for i := 0; i < numBlocks; i++ {
+				c.Set(uint64(i), 0, make([]byte, 64))
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					if c.Get(uint64(rng.Intn(numBlocks)), 0) == nil {
+						b.Fatal("expected a cache hit")
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import "sync"
+
+// Pinned is a memory budget for blocks which are pinned in memory outside of
+// the block cache, such as the index and filter blocks of open tables. When
+// pinning a block would exceed the budget, the least recently used blocks are
+// unpinned to make room. The owner of an unpinned block is expected to reload
+// it on demand.
+type Pinned struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	// lru is the sentinel of a circular list of the pinned blocks, ordered from
+	// most recently used (lru.next) to least recently used (lru.prev).
+	lru PinnedHandle
+}
+
+// NewPinned returns a new budget of the specified size for pinned blocks.
+func NewPinned(maxSize int64) *Pinned {
+	p := &Pinned{maxSize: maxSize}
+	p.lru.next = &p.lru
+	p.lru.prev = &p.lru
+	return p
+}
+
+// PinnedHandle is a reference to a pinned block. It implements the WeakHandle
+// interface.
+type PinnedHandle struct {
+	p          *Pinned
+	value      []byte
+	prev, next *PinnedHandle
+}
+
+// Pin pins the value, unpinning the least recently used blocks if necessary to
+// stay within the budget. Returns nil if the value is larger than the budget.
+func (p *Pinned) Pin(value []byte) *PinnedHandle {
+	if p == nil || int64(len(value)) > p.maxSize {
+		return nil
+	}
+	h := &PinnedHandle{p: p, value: value}
+
+	p.mu.Lock()
+	for p.size+int64(len(value)) > p.maxSize {
+		p.unpinLocked(p.lru.prev)
+	}
+	p.size += int64(len(value))
+	p.pushFrontLocked(h)
+	p.mu.Unlock()
+	return h
+}
+
+// Size returns the number of bytes currently pinned.
+func (p *Pinned) Size() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// MaxSize returns the budget for pinned blocks.
+func (p *Pinned) MaxSize() int64 {
+	return p.maxSize
+}
+
+func (p *Pinned) pushFrontLocked(h *PinnedHandle) {
+	h.prev = &p.lru
+	h.next = p.lru.next
+	h.prev.next = h
+	h.next.prev = h
+}
+
+func (p *Pinned) removeLocked(h *PinnedHandle) {
+	h.prev.next = h.next
+	h.next.prev = h.prev
+	h.prev, h.next = nil, nil
+}
+
+func (p *Pinned) unpinLocked(h *PinnedHandle) {
+	p.removeLocked(h)
+	p.size -= int64(len(h.value))
+	h.value = nil
+}
+
+// Get returns the pinned value, or nil if it has been unpinned, and marks the
+// value as the most recently used.
+func (h *PinnedHandle) Get() []byte {
+	if h == nil {
+		return nil
+	}
+	p := h.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h.value != nil && p.lru.next != h {
+		p.removeLocked(h)
+		p.pushFrontLocked(h)
+	}
+	return h.value
+}
+
+// Release unpins the value, returning its memory to the budget. It is valid
+// to release a handle which has already been unpinned.
+func (h *PinnedHandle) Release() {
+	if h == nil {
+		return
+	}
+	p := h.p
+	p.mu.Lock()
+	if h.value != nil {
+		p.unpinLocked(h)
+	}
+	p.mu.Unlock()
+}
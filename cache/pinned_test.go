@@ -0,0 +1,48 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPinned(t *testing.T) {
+	p := NewPinned(10)
+	a := p.Pin(bytes.Repeat([]byte("a"), 4))
+	b := p.Pin(bytes.Repeat([]byte("b"), 4))
+	if h := p.Pin(bytes.Repeat([]byte("x"), 11)); h != nil {
+		t.Fatalf("expected a value larger than the budget to not be pinned")
+	}
+	if v := pinnedValue(a); v != "aaaa" {
+		t.Fatalf("expected aaaa, but found %s", v)
+	}
+
+	// Pinning c unpins b, which is the least recently used.
+	c := p.Pin(bytes.Repeat([]byte("c"), 4))
+	if v := pinnedValue(b); v != "" {
+		t.Fatalf("expected b to be unpinned, but found %s", v)
+	}
+	if v := pinnedValue(a) + pinnedValue(c); v != "aaaacccc" {
+		t.Fatalf("expected aaaacccc, but found %s", v)
+	}
+	if n := p.Size(); n != 8 {
+		t.Fatalf("expected 8 bytes pinned, but found %d", n)
+	}
+
+	a.Release()
+	a.Release()
+	b.Release()
+	if n := p.Size(); n != 4 {
+		t.Fatalf("expected 4 bytes pinned, but found %d", n)
+	}
+	if v := pinnedValue(a); v != "" {
+		t.Fatalf("expected a to be unpinned, but found %s", v)
+	}
+}
+
+func pinnedValue(h *PinnedHandle) string {
+	return string(h.Get())
+}
@@ -0,0 +1,32 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"github.com/petermattis/pebble/internal/crc"
+	"github.com/petermattis/pebble/storage"
+)
+
+// checksummedFile computes the checksum of the data written to a file. See
+// Options.CompactionOutputChecksums.
+type checksummedFile struct {
+	storage.File
+	crc crc.CRC
+}
+
+func newChecksummedFile(f storage.File) *checksummedFile {
+	return &checksummedFile{File: f}
+}
+
+func (f *checksummedFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	f.crc = f.crc.Update(b[:n])
+	return n, err
+}
+
+// checksum returns the checksum of the data written so far.
+func (f *checksummedFile) checksum() uint32 {
+	return f.crc.Value()
+}
@@ -33,6 +33,16 @@ func maxGrandparentOverlapBytes(opts *db.Options, level int) uint64 {
 	return uint64(10 * opts.Level(level).TargetFileSize)
 }
 
+// tableWriterOptions returns the options for writing a table to the given
+// level. Filters are omitted for levels above Options.MinLevelForFilters.
+func tableWriterOptions(opts *db.Options, level int) db.LevelOptions {
+	lo := opts.Level(level)
+	if level < opts.MinLevelForFilters {
+		lo.FilterPolicy = nil
+	}
+	return lo
+}
+
 // compaction is a table compaction from one level to the next, starting from a
 // given version.
 type compaction struct {
@@ -42,6 +52,12 @@ type compaction struct {
 	// level is the level that is being compacted. Inputs from level and
 	// level+1 will be merged to produce a set of level+1 files.
 	level int
+	// intraLevel is true for a compaction which merges tables in level into
+	// a set of level files, with no inputs from level+1.
+	intraLevel bool
+	// filters, if non-empty, are the block property filters applied to the
+	// input tables. See DB.CompactWithFilters.
+	filters []db.BlockPropertyFilter
 
 	// maxOutputFileSize is the maximum size of an individual table created
 	// during compaction.
@@ -62,6 +78,11 @@ type compaction struct {
 	grandparents    []fileMetadata
 	overlappedBytes uint64 // bytes of overlap with grandparent tables
 	seenKey         bool   // some output key has been seen
+
+	// changes are copies of the records written to the output tables, in the
+	// order they were written, if Options.ChangeConsumer is set. They are sent
+	// to the consumer once the compaction has been committed.
+	changes []db.ChangeRecord
 }
 
 func newCompaction(opts *db.Options, cur *version, level int) *compaction {
@@ -76,6 +97,28 @@ func newCompaction(opts *db.Options, cur *version, level int) *compaction {
 	return c
 }
 
+// newIntraLevelCompaction returns a compaction of the tables in level which
+// outputs its tables to the same level.
+func newIntraLevelCompaction(opts *db.Options, cur *version, level int) *compaction {
+	return &compaction{
+		cmp:               opts.Comparer.Compare,
+		version:           cur,
+		level:             level,
+		intraLevel:        true,
+		maxOutputFileSize: uint64(opts.Level(level).TargetFileSize),
+		maxOverlapBytes:   maxGrandparentOverlapBytes(opts, level),
+		maxExpandedBytes:  expandedCompactionByteSizeLimit(opts, level),
+	}
+}
+
+// outputLevel returns the level to which the compaction writes its tables.
+func (c *compaction) outputLevel() int {
+	if c.intraLevel {
+		return c.level
+	}
+	return c.level + 1
+}
+
 // setupOtherInputs fills in the rest of the compaction inputs, regardless of
 // whether the compaction was automatically scheduled or user initiated.
 func (c *compaction) setupOtherInputs() {
@@ -199,12 +242,12 @@ func (c *compaction) shouldStopBefore(key db.InternalKey) bool {
 
 // elideTombstone returns true if it is ok to elide a tombstone for the
 // specified key. A return value of true guarantees that there are no key/value
-// pairs at c.level+2 or higher that possibly contain the specified user key.
+// pairs below the output level that possibly contain the specified user key.
 func (c *compaction) elideTombstone(key []byte) bool {
 	// TODO(peter): this can be faster if ukey is always increasing between
 	// successive elideTombstones calls and we can keep some state in between
 	// calls.
-	for level := c.level + 2; level < numLevels; level++ {
+	for level := c.outputLevel() + 1; level < numLevels; level++ {
 		for _, f := range c.version.files[level] {
 			if c.cmp(key, f.largest.UserKey) <= 0 {
 				if c.cmp(key, f.smallest.UserKey) >= 0 {
@@ -221,9 +264,12 @@ func (c *compaction) elideTombstone(key []byte) bool {
 
 // elideRangeTombstone returns true if it is ok to elide the specified range
 // tombstone. A return value of true guarantees that there are no key/value
-// pairs at c.level+2 or higher that possibly overlap the specified tombstone.
+// pairs below the output level that possibly overlap the specified tombstone.
 func (c *compaction) elideRangeTombstone(start, end []byte) bool {
-	for level := c.level + 2; level < numLevels; level++ {
+	if c.overlapsFilterable(start, end) {
+		return false
+	}
+	for level := c.outputLevel() + 1; level < numLevels; level++ {
 		overlaps := c.version.overlaps(level, c.cmp, start, end)
 		if len(overlaps) > 0 {
 			return false
@@ -232,6 +278,33 @@ func (c *compaction) elideRangeTombstone(start, end []byte) bool {
 	return true
 }
 
+// isBottom returns true if there are no tables below the output level which
+// overlap the key range of the compaction, in which case every range
+// tombstone in the last snapshot stripe is elided by the compaction.
+func (c *compaction) isBottom() bool {
+	smallest, largest := ikeyRange(c.cmp, c.inputs[0], c.inputs[1])
+	return c.elideRangeTombstone(smallest.UserKey, largest.UserKey)
+}
+
+// addChange records a copy of a record written to an output table, to be sent
+// to Options.ChangeConsumer once the compaction has been committed.
+func (c *compaction) addChange(key db.InternalKey, value []byte) {
+	c.changes = append(c.changes, db.ChangeRecord{
+		Key:   key.Clone(),
+		Value: append([]byte(nil), value...),
+	})
+}
+
+// spansPartitions returns true if the input tables contain keys from more
+// than one output partition. See db.Options.OutputPartitioner.
+func (c *compaction) spansPartitions(partitioner func(key []byte) int) bool {
+	if partitioner == nil {
+		return false
+	}
+	smallest, largest := ikeyRange(c.cmp, c.inputs[0], c.inputs[1])
+	return partitioner(smallest.UserKey) != partitioner(largest.UserKey)
+}
+
 // newInputIter returns an iterator over all the input tables in a compaction.
 func (c *compaction) newInputIter(
 	newIters tableNewIters,
@@ -254,8 +327,78 @@ func (c *compaction) newInputIter(
 	// levelIters per level, one which iterates over the point operations, and
 	// one which iterates over the range deletions. These two iterators are
 	// combined with a mergingIter.
-	newRangeDelIter := func(f *fileMetadata) (internalIterator, internalIterator, error) {
-		iter, rangeDelIter, err := newIters(f)
+	newRangeDelIter := rangeDelOnly(newIters)
+
+	// The block property filters restrict the point operations of the tables
+	// they apply to to the data blocks which intersect the filters. The other
+	// blocks are copied to the output by the iterator returned by
+	// newCopyIter.
+	newPointIters := newIters
+	if len(c.filters) > 0 {
+		newPointIters = func(f *fileMetadata, o *db.IterOptions) (internalIterator, internalIterator, error) {
+			return c.newFilteredIters(newIters, f, o, false)
+		}
+	}
+
+	// TODO(peter,rangedel): test that range tombstones are properly included in
+	// the output sstable.
+	if c.level != 0 {
+		iters = append(iters, newLevelIter(nil, c.cmp, newPointIters, c.inputs[0]))
+		iters = append(iters, newLevelIter(nil, c.cmp, newRangeDelIter, c.inputs[0]))
+	} else {
+		for i := range c.inputs[0] {
+			f := &c.inputs[0][i]
+			iter, rangeDelIter, err := newPointIters(f, nil)
+			if err != nil {
+				return nil, fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
+			}
+			iters = append(iters, iter)
+			if rangeDelIter != nil {
+				iters = append(iters, rangeDelIter)
+			}
+		}
+	}
+
+	iters = append(iters, newLevelIter(nil, c.cmp, newPointIters, c.inputs[1]))
+	iters = append(iters, newLevelIter(nil, c.cmp, newRangeDelIter, c.inputs[1]))
+	return newMergingIter(c.cmp, iters...), nil
+}
+
+// isInput returns true if the table is one of the inputs from level
+// c.level+i.
+func (c *compaction) isInput(i int, fileNum uint64) bool {
+	for _, f := range c.inputs[i] {
+		if f.fileNum == fileNum {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapsOtherTables returns an error if the user key range [start,end]
+// overlaps a table in any level which is not an input of the compaction. Used
+// to verify that the keys rewritten by Options.KeyRewriter do not move into the
+// key range of a table which is not being compacted.
+func (c *compaction) overlapsOtherTables(start, end []byte) error {
+	for level := 0; level < numLevels; level++ {
+		for _, f := range c.version.overlaps(level, c.cmp, start, end) {
+			if (level == c.level && c.isInput(0, f.fileNum)) ||
+				(level == c.level+1 && c.isInput(1, f.fileNum)) {
+				continue
+			}
+			return fmt.Errorf(
+				"pebble: keys rewritten by KeyRewriter overlap table %d in L%d", f.fileNum, level)
+		}
+	}
+	return nil
+}
+
+// rangeDelOnly returns a tableNewIters which returns the range deletion
+// iterator of a table in place of its point iterator, for use with a
+// levelIter which iterates over the range deletions in a level.
+func rangeDelOnly(newIters tableNewIters) tableNewIters {
+	return func(f *fileMetadata, opts *db.IterOptions) (internalIterator, internalIterator, error) {
+		iter, rangeDelIter, err := newIters(f, opts)
 		if err == nil {
 			// TODO(peter): It is mildly wasteful to open the point iterator only to
 			// immediately close it. One way to solve this would be to add new
@@ -269,31 +412,107 @@ func (c *compaction) newInputIter(
 		}
 		return rangeDelIter, nil, err
 	}
+}
 
-	// TODO(peter,rangedel): test that range tombstones are properly included in
-	// the output sstable.
-	if c.level != 0 {
-		iters = append(iters, newLevelIter(nil, c.cmp, newIters, c.inputs[0]))
-		iters = append(iters, newLevelIter(nil, c.cmp, newRangeDelIter, c.inputs[0]))
-	} else {
-		for i := range c.inputs[0] {
-			f := &c.inputs[0][i]
-			iter, rangeDelIter, err := newIters(f)
+// newCopyIter returns an iterator over the point operations of the data blocks
+// of the filterable input tables which do not intersect the block property
+// filters of the compaction, or nil if the compaction has no filters. These
+// blocks are not merged, and their point operations are copied to the output
+// unchanged so that no key of the input tables is lost.
+func (c *compaction) newCopyIter(newIters tableNewIters) (_ internalIterator, retErr error) {
+	if len(c.filters) == 0 {
+		return nil, nil
+	}
+	var iters []internalIterator
+	defer func() {
+		if retErr != nil {
+			for _, iter := range iters {
+				iter.Close()
+			}
+		}
+	}()
+	for i := range c.inputs {
+		for j := range c.inputs[i] {
+			f := &c.inputs[i][j]
+			if !c.filterable(f) {
+				continue
+			}
+			iter, rangeDelIter, err := c.newFilteredIters(newIters, f, nil, true)
 			if err != nil {
 				return nil, fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
 			}
 			iters = append(iters, iter)
 			if rangeDelIter != nil {
-				iters = append(iters, rangeDelIter)
+				// The range deletions are merged by the input iterator.
+				if err := rangeDelIter.Close(); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
-
-	iters = append(iters, newLevelIter(nil, c.cmp, newIters, c.inputs[1]))
-	iters = append(iters, newLevelIter(nil, c.cmp, newRangeDelIter, c.inputs[1]))
 	return newMergingIter(c.cmp, iters...), nil
 }
 
+// newFilteredIters returns the iterators of newIters for the input table f,
+// restricting the point iterator of a filterable table to the data blocks
+// which intersect the block property filters of the compaction, or to the
+// blocks which do not if invert is true. The point iterator of a table which
+// is not filterable is returned unchanged.
+func (c *compaction) newFilteredIters(
+	newIters tableNewIters, f *fileMetadata, o *db.IterOptions, invert bool,
+) (internalIterator, internalIterator, error) {
+	iter, rangeDelIter, err := newIters(f, o)
+	if err != nil || !c.filterable(f) {
+		return iter, rangeDelIter, err
+	}
+	if err := iter.(*sstable.Iterator).SetBlockPropertyFilters(c.filters, invert); err != nil {
+		iter.Close()
+		if rangeDelIter != nil {
+			rangeDelIter.Close()
+		}
+		return nil, nil, err
+	}
+	return iter, rangeDelIter, nil
+}
+
+// filterable returns true if the block property filters of the compaction may
+// be applied to the input table f, which is the case if no other input table
+// overlaps it. The versions of the keys in the data blocks of f which do not
+// intersect the filters are then not shadowed by, and do not shadow, any
+// version which is merged.
+func (c *compaction) filterable(f *fileMetadata) bool {
+	for i := range c.inputs {
+		for j := range c.inputs[i] {
+			g := &c.inputs[i][j]
+			if g.fileNum != f.fileNum &&
+				c.cmp(g.largest.UserKey, f.smallest.UserKey) >= 0 &&
+				c.cmp(g.smallest.UserKey, f.largest.UserKey) <= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// overlapsFilterable returns true if the specified key range overlaps a
+// filterable input table of the compaction. A range tombstone which does may
+// cover the keys copied to the output, and must not be elided.
+func (c *compaction) overlapsFilterable(start, end []byte) bool {
+	if len(c.filters) == 0 {
+		return false
+	}
+	for i := range c.inputs {
+		for j := range c.inputs[i] {
+			f := &c.inputs[i][j]
+			if c.cmp(f.largest.UserKey, start) >= 0 && c.cmp(f.smallest.UserKey, end) < 0 &&
+				c.filterable(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (c *compaction) String() string {
 	var buf bytes.Buffer
 	for i := range c.inputs {
@@ -311,6 +530,11 @@ type manualCompaction struct {
 	done  chan error
 	start db.InternalKey
 	end   db.InternalKey
+	// intraLevel is true for a compaction requested by CompactWithinLevel.
+	intraLevel bool
+	// filters are the block property filters of the compaction. See
+	// DB.CompactWithFilters.
+	filters []db.BlockPropertyFilter
 }
 
 // maybeScheduleFlush schedules a flush if necessary.
@@ -429,12 +653,30 @@ func (d *DB) flush1() error {
 		return err
 	}
 
-	err = d.mu.versions.logAndApply(&versionEdit{
-		logNumber: d.mu.log.number,
-		newFiles: []newFileEntry{
-			{level: 0, meta: meta},
-		},
-	})
+	// A compaction may write tables overlapping the flushed table to any level
+	// below L0, so the flushed table is only placed below L0 if no compaction
+	// is running. The compaction slot is then held until the version edit has
+	// been applied, as the mutex is dropped while the edit is persisted, and a
+	// compaction scheduled meanwhile would not see the flushed table. The
+	// caller schedules any compaction which was held off.
+	level := 0
+	holdCompaction := d.opts.MaxFlushLevel > 0 && !d.mu.compact.compacting
+	if holdCompaction {
+		d.mu.compact.compacting = true
+		level = flushTargetLevel(d.cmp, d.mu.versions.currentVersion(), &meta, d.opts.MaxFlushLevel)
+	}
+	err = d.persistDeferred()
+	if err == nil {
+		err = d.mu.versions.logAndApply(&versionEdit{
+			logNumber: d.mu.log.number,
+			newFiles: []newFileEntry{
+				{level: level, meta: meta},
+			},
+		})
+	}
+	if holdCompaction {
+		d.mu.compact.compacting = false
+	}
 	if _, ok := d.mu.compact.pendingOutputs[meta.fileNum]; !ok {
 		panic("pebble: expected pending output not present")
 	}
@@ -460,6 +702,18 @@ func (d *DB) flush1() error {
 	return nil
 }
 
+// flushTargetLevel returns the level into which a flushed table is placed: the
+// lowest level, no deeper than maxLevel, such that neither it nor any higher
+// level holds a table overlapping the flushed table. See
+// Options.MaxFlushLevel.
+func flushTargetLevel(cmp db.Compare, v *version, meta *fileMetadata, maxLevel int) int {
+	level := ingestTargetLevel(cmp, v, meta)
+	if level > maxLevel {
+		level = maxLevel
+	}
+	return level
+}
+
 // writeLevel0Table writes a memtable to a level-0 on-disk table.
 //
 // If no error is returned, it adds the file number of that on-disk table to
@@ -506,6 +760,7 @@ func (d *DB) writeLevel0Table(
 		func([]byte) bool { return false },
 		elideRangeTombstone,
 	)
+	iter.retainVersions = d.opts.RetainVersions
 	var (
 		file storage.File
 		tw   *sstable.Writer
@@ -528,7 +783,7 @@ func (d *DB) writeLevel0Table(
 		return fileMetadata{}, err
 	}
 	file = newRateLimitedFile(file, d.flushController)
-	tw = sstable.NewWriter(file, d.opts, d.opts.Level(0))
+	tw = sstable.NewWriter(file, d.opts, tableWriterOptions(d.opts, 0))
 
 	var count int
 	for valid := iter.First(); valid; valid = iter.Next() {
@@ -571,6 +826,7 @@ func (d *DB) writeLevel0Table(
 	meta.largest = writerMeta.Largest(d.cmp)
 	meta.smallestSeqNum = writerMeta.SmallestSeqNum
 	meta.largestSeqNum = writerMeta.LargestSeqNum
+	meta.markedForCompaction = tombstoneDense(d.opts, writerMeta)
 	tw = nil
 
 	// TODO(peter): After a flush we set the commit rate to 110% of the flush
@@ -586,6 +842,13 @@ func (d *DB) writeLevel0Table(
 	return meta, nil
 }
 
+// tombstoneDense returns whether the fraction of the point entries of a table
+// which are deletions exceeds Options.TombstoneDensityThreshold.
+func tombstoneDense(opts *db.Options, m *sstable.WriterMetadata) bool {
+	return opts.TombstoneDensityThreshold > 0 && m.NumEntries > 0 &&
+		float64(m.NumDeletions)/float64(m.NumEntries) > opts.TombstoneDensityThreshold
+}
+
 // maybeScheduleCompaction schedules a compaction if necessary.
 //
 // d.mu must be held when calling this.
@@ -600,10 +863,14 @@ func (d *DB) maybeScheduleCompaction() {
 		return
 	}
 
-	if !d.mu.versions.picker.compactionNeeded() {
+	if !d.mu.versions.picker.compactionNeeded() && !d.mu.compact.rebuildFilters {
 		// There is no work to be done.
 		return
 	}
+	if d.pauseCompaction() {
+		// The compaction is rescheduled once the foreground latency recovers.
+		return
+	}
 
 	d.mu.compact.compacting = true
 	go d.compact()
@@ -639,6 +906,11 @@ func (d *DB) compact1() (err error) {
 		}()
 	} else {
 		c = d.mu.versions.picker.pickAuto(d.opts)
+		if c == nil && d.mu.compact.rebuildFilters {
+			if c, err = d.pickFilterRebuild(); err != nil {
+				return err
+			}
+		}
 	}
 	if c == nil {
 		return nil
@@ -662,7 +934,7 @@ func (d *DB) compact1() (err error) {
 		}
 		if err != nil {
 			info.Input.Level = c.level
-			info.Output.Level = c.level + 1
+			info.Output.Level = c.outputLevel()
 			for i := range c.inputs {
 				for j := range c.inputs[i] {
 					m := &c.inputs[i][j]
@@ -681,6 +953,9 @@ func (d *DB) compact1() (err error) {
 		return err
 	}
 	err = d.mu.versions.logAndApply(ve)
+	if err == nil && len(c.changes) > 0 {
+		d.sendChanges(c)
+	}
 	for _, fileNum := range pendingOutputs {
 		if _, ok := d.mu.compact.pendingOutputs[fileNum]; !ok {
 			panic("pebble: expected pending output not present")
@@ -694,6 +969,99 @@ func (d *DB) compact1() (err error) {
 	return nil
 }
 
+// pickFilterRebuild picks the rewrite of a table whose filter was written with
+// a different policy than the one configured for its level, once no other
+// compaction is needed. The tables are checked lazily, one at a time, until
+// one with a stale filter is found or another compaction is needed.
+// rebuildFilters is cleared once every table has been checked. Tables in L0
+// are not rewritten in place, as a rewritten table could not elide tombstones
+// which shadow the keys of older tables in L0. They are rewritten by their
+// compaction into Lbase instead. See Options.RebuildFilters.
+//
+// d.mu must be held when calling this, but the mutex is dropped and
+// re-acquired while each table is checked.
+func (d *DB) pickFilterRebuild() (*compaction, error) {
+	for {
+		current := d.mu.versions.currentVersion()
+		level, meta := d.nextUncheckedFilter(current)
+		if meta == nil {
+			d.mu.compact.rebuildFilters = false
+			return nil, nil
+		}
+		fileNum := meta.fileNum
+		d.mu.compact.filtersChecked[fileNum] = struct{}{}
+		name := tableWriterOptions(d.opts, level).FilterPolicy.Name()
+
+		current.ref()
+		d.mu.Unlock()
+		var stale bool
+		err := d.tableCache.withReader(meta, func(r *sstable.Reader) error {
+			stale = r.Properties.FilterPolicyName != name
+			return nil
+		})
+		current.unref()
+		d.mu.Lock()
+		if err != nil {
+			return nil, err
+		}
+
+		picker := d.mu.versions.picker
+		if picker.compactionNeeded() || len(d.mu.compact.manual) > 0 {
+			// A stale table is checked again once the other compactions are
+			// done.
+			if stale {
+				delete(d.mu.compact.filtersChecked, fileNum)
+			}
+			return nil, nil
+		}
+		if stale {
+			// The table is no longer present if it was compacted while the
+			// mutex was dropped.
+			if c := picker.pickRewrite(d.opts, level, fileNum); c != nil {
+				return c, nil
+			}
+		}
+	}
+}
+
+// nextUncheckedFilter returns a table in v which has not been checked for a
+// stale filter, along with its level, or nil if there is none. Levels without
+// a filter policy are not checked.
+//
+// d.mu must be held when calling this.
+func (d *DB) nextUncheckedFilter(v *version) (int, *fileMetadata) {
+	for level := 1; level < numLevels; level++ {
+		if tableWriterOptions(d.opts, level).FilterPolicy == nil {
+			continue
+		}
+		files := v.files[level]
+		for i := range files {
+			if _, ok := d.mu.compact.filtersChecked[files[i].fileNum]; !ok {
+				return level, &files[i]
+			}
+		}
+	}
+	return 0, nil
+}
+
+// sendChanges sends the records written by a committed compaction to
+// Options.ChangeConsumer. The records are only sent once the version edit has
+// been applied, rather than as they are written, so that the consumer never
+// sees the records of a compaction which fails and is retried.
+//
+// d.mu must be held when calling this, but the mutex is dropped and
+// re-acquired.
+func (d *DB) sendChanges(c *compaction) {
+	d.mu.Unlock()
+	defer d.mu.Lock()
+
+	consumer := d.opts.ChangeConsumer
+	for i := range c.changes {
+		consumer.SendRecord(c.changes[i])
+	}
+	c.changes = nil
+}
+
 // compactDiskTables runs a compaction that produces new on-disk tables from
 // old on-disk tables.
 //
@@ -703,9 +1071,15 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 	// Check for a trivial move of one table from one level to the next. We avoid
 	// such a move if there is lots of overlapping grandparent data. Otherwise,
 	// the move could create a parent file that will require a very expensive
-	// merge later on.
-	if len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 &&
-		totalSize(c.grandparents) <= maxGrandparentOverlapBytes(d.opts, c.level+1) {
+	// merge later on. A table moved to Options.MinLevelForFilters is instead
+	// rewritten, as it was written without the filter that level requires, and
+	// so is a table marked for compaction, whose tombstones are only dropped by
+	// a rewrite.
+	if !c.intraLevel && len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 &&
+		!c.inputs[0][0].markedForCompaction &&
+		totalSize(c.grandparents) <= maxGrandparentOverlapBytes(d.opts, c.level+1) &&
+		!c.spansPartitions(d.opts.OutputPartitioner) && d.opts.KeyRewriter == nil &&
+		(c.level+1 != d.opts.MinLevelForFilters || d.opts.Level(c.level+1).FilterPolicy == nil) {
 		meta := &c.inputs[0][0]
 		return &versionEdit{
 			deletedFiles: map[deletedFileEntry]bool{
@@ -738,12 +1112,22 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 	if err != nil {
 		return nil, pendingOutputs, err
 	}
-	iter := newCompactionIter(d.cmp, d.merge, iiter, snapshots,
-		c.elideTombstone, c.elideRangeTombstone)
+	citer, err := c.newCopyIter(d.newIters)
+	if err != nil {
+		iiter.Close()
+		return nil, pendingOutputs, err
+	}
+	iter := newCopyingCompactionIter(d.cmp, newCompactionIter(d.cmp, d.merge, iiter, snapshots,
+		c.elideTombstone, c.elideRangeTombstone), citer)
+	iter.zeroSeqNum = d.opts.ZeroSeqNums && c.isBottom()
+	iter.retainVersions = d.opts.RetainVersions
 
 	var (
 		filenames []string
 		tw        *sstable.Writer
+		// checksummed is the file of the current output table, if
+		// Options.CompactionOutputChecksums is set.
+		checksummed *checksummedFile
 	)
 	defer func() {
 		if iter != nil {
@@ -776,10 +1160,15 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 			return err
 		}
 		filenames = append(filenames, filename)
-		tw = sstable.NewWriter(file, d.opts, d.opts.Level(c.level+1))
+		checksummed = nil
+		if d.opts.CompactionOutputChecksums {
+			checksummed = newChecksummedFile(file)
+			file = checksummed
+		}
+		tw = sstable.NewWriter(file, d.opts, tableWriterOptions(d.opts, c.outputLevel()))
 
 		ve.newFiles = append(ve.newFiles, newFileEntry{
-			level: c.level + 1,
+			level: c.outputLevel(),
 			meta: fileMetadata{
 				fileNum: fileNum,
 			},
@@ -787,7 +1176,58 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		return nil
 	}
 
-	finishOutput := func(key db.InternalKey) error {
+	// rewrite applies Options.KeyRewriter to a point key emitted by the
+	// compaction, verifying that the rewritten user keys are strictly
+	// increasing, with the versions of a user key rewritten to the same key,
+	// and that a key which is changed does not overlap a table outside of the
+	// compaction. The keys are verified before they are written.
+	//
+	// Keys are only rewritten by a compaction which has no tables below its
+	// output level overlapping its key range. Otherwise, an older version of a
+	// rewritten key in a lower level would no longer be shadowed by the newer
+	// versions which moved to the rewritten key.
+	rewriter := d.opts.KeyRewriter
+	if rewriter != nil && !c.isBottom() {
+		rewriter = nil
+	}
+	var prevUserKey, prevRewritten []byte
+	var havePrevKey bool
+	rewrite := func(key db.InternalKey) (db.InternalKey, error) {
+		if rewriter == nil {
+			return key, nil
+		}
+		userKey, err := rewriter(key.UserKey)
+		if err != nil {
+			return db.InternalKey{}, err
+		}
+		if havePrevKey {
+			order := d.cmp(prevRewritten, userKey)
+			if d.cmp(prevUserKey, key.UserKey) == 0 {
+				if order != 0 {
+					return db.InternalKey{}, fmt.Errorf(
+						"pebble: KeyRewriter is not deterministic: %q rewritten to both %q and %q",
+						key.UserKey, prevRewritten, userKey)
+				}
+			} else if order >= 0 {
+				return db.InternalKey{}, fmt.Errorf(
+					"pebble: KeyRewriter is not monotonic: %q rewritten to %q, which does not follow %q",
+					key.UserKey, userKey, prevRewritten)
+			}
+		}
+		if d.cmp(userKey, key.UserKey) != 0 {
+			if err := c.overlapsOtherTables(userKey, userKey); err != nil {
+				return db.InternalKey{}, err
+			}
+		}
+		prevUserKey = append(prevUserKey[:0], key.UserKey...)
+		prevRewritten = append(prevRewritten[:0], userKey...)
+		havePrevKey = true
+		return db.InternalKey{UserKey: userKey, Trailer: key.Trailer}, nil
+	}
+
+	// finishOutput finishes the current output table. The key is the next key
+	// emitted by the compaction, and rkey is the rewritten key.
+	finishOutput := func(key, rkey db.InternalKey) error {
 		if tw == nil {
 			return nil
 		}
@@ -796,10 +1236,31 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		// compactionIter.Tombstones via rangedel.Fragmenter.FlushTo.
 		key = key.Clone()
 		for _, v := range iter.Tombstones(key.UserKey) {
+			if rewriter != nil {
+				start, err := rewriter(v.Start.UserKey)
+				if err != nil {
+					return err
+				}
+				end, err := rewriter(v.End)
+				if err != nil {
+					return err
+				}
+				if d.cmp(start, v.Start.UserKey) != 0 || d.cmp(end, v.End) != 0 {
+					if err := c.overlapsOtherTables(start, end); err != nil {
+						return err
+					}
+				}
+				v.Start.UserKey, v.End = start, end
+			}
 			if err := tw.Add(v.Start, v.End); err != nil {
 				return err
 			}
+			if d.opts.ChangeConsumer != nil {
+				c.addChange(v.Start, v.End)
+			}
 		}
+		// The rewritten key may be retained as the boundary of the table.
+		key = rkey.Clone()
 
 		if err := tw.Close(); err != nil {
 			tw = nil
@@ -815,6 +1276,11 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		meta.size = writerMeta.Size
 		meta.smallestSeqNum = writerMeta.SmallestSeqNum
 		meta.largestSeqNum = writerMeta.LargestSeqNum
+		meta.markedForCompaction = tombstoneDense(d.opts, writerMeta)
+		if checksummed != nil {
+			meta.checksum = checksummed.checksum()
+			meta.hasChecksum = true
+		}
 
 		// The handling of range boundaries is a bit complicated.
 		if n := len(ve.newFiles); n > 1 {
@@ -841,15 +1307,32 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		meta.smallest = writerMeta.Smallest(d.cmp)
 		meta.largest = writerMeta.Largest(d.cmp)
 
+		if d.opts.VerifyCompactionOutputs {
+			return d.verifyCompactionOutput(filenames[len(filenames)-1], meta)
+		}
 		return nil
 	}
 
+	partitioner := d.opts.OutputPartitioner
+	var partition int
 	for valid := iter.First(); valid; valid = iter.Next() {
-		key := iter.Key()
-		// TODO(peter,rangedel): Need to incorporate the range tombstones in the
-		// shouldStopBefore decision.
-		if tw != nil && (tw.EstimatedSize() >= c.maxOutputFileSize || c.shouldStopBefore(key)) {
-			if err := finishOutput(key); err != nil {
+		origKey := iter.Key()
+		key, err := rewrite(origKey)
+		if err != nil {
+			return nil, pendingOutputs, err
+		}
+		var stop bool
+		if partitioner != nil {
+			p := partitioner(key.UserKey)
+			stop = tw != nil && p != partition
+			partition = p
+		} else {
+			// TODO(peter,rangedel): Need to incorporate the range tombstones in the
+			// shouldStopBefore decision.
+			stop = tw != nil && (tw.EstimatedSize() >= c.maxOutputFileSize || c.shouldStopBefore(key))
+		}
+		if stop {
+			if err := finishOutput(origKey, key); err != nil {
 				return nil, pendingOutputs, err
 			}
 		}
@@ -863,10 +1346,13 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		if err := tw.Add(key, iter.Value()); err != nil {
 			return nil, pendingOutputs, err
 		}
+		if d.opts.ChangeConsumer != nil {
+			c.addChange(key, iter.Value())
+		}
 	}
 
-	if err := finishOutput(db.InternalKey{}); err != nil {
-		return nil, pendingOutputs, nil
+	if err := finishOutput(db.InternalKey{}, db.InternalKey{}); err != nil {
+		return nil, pendingOutputs, err
 	}
 
 	for i := range c.inputs {
@@ -880,6 +1366,80 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 	return ve, pendingOutputs, nil
 }
 
+// verifyCompactionOutput re-reads a table written by a compaction, verifying
+// the checksums of its data blocks, the ordering of its keys and that its keys
+// lie within the bounds recorded in meta. See Options.VerifyCompactionOutputs.
+func (d *DB) verifyCompactionOutput(filename string, meta *fileMetadata) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("pebble: compaction output %s failed verification: %v", filename, err)
+		}
+	}()
+
+	f, err := d.opts.Storage.Open(filename)
+	if err != nil {
+		return err
+	}
+	r := sstable.NewReader(f, meta.fileNum, d.opts)
+	defer func() {
+		err = firstError(err, r.Close())
+	}()
+
+	checkBounds := func(key db.InternalKey) error {
+		if db.InternalCompare(d.cmp, key, meta.smallest) < 0 ||
+			db.InternalCompare(d.cmp, key, meta.largest) > 0 {
+			return fmt.Errorf("key %s outside of the recorded bounds [%s,%s]",
+				key, meta.smallest, meta.largest)
+		}
+		return nil
+	}
+
+	var first, last db.InternalKey
+	iter := r.NewIter(nil)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		key := iter.Key()
+		if last.UserKey != nil && db.InternalCompare(d.cmp, last, key) >= 0 {
+			iter.Close()
+			return fmt.Errorf("keys out of order: %s, %s", last, key)
+		}
+		if err := checkBounds(key); err != nil {
+			iter.Close()
+			return err
+		}
+		if first.UserKey == nil {
+			first = key.Clone()
+		}
+		last.UserKey = append(last.UserKey[:0], key.UserKey...)
+		last.Trailer = key.Trailer
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	rangeDelIter := r.NewRangeDelIter(nil)
+	if rangeDelIter == nil {
+		// Without range tombstones, the bounds are exactly the first and last
+		// point keys.
+		if db.InternalCompare(d.cmp, first, meta.smallest) != 0 ||
+			db.InternalCompare(d.cmp, last, meta.largest) != 0 {
+			return fmt.Errorf("keys [%s,%s] do not match the recorded bounds [%s,%s]",
+				first, last, meta.smallest, meta.largest)
+		}
+		return nil
+	}
+	// A range tombstone may start before the smallest bound, which is moved
+	// past the largest key of the previous output, but must overlap the bounds.
+	for valid := rangeDelIter.First(); valid; valid = rangeDelIter.Next() {
+		start, end := rangeDelIter.Key(), rangeDelIter.Value()
+		if d.cmp(start.UserKey, meta.largest.UserKey) > 0 || d.cmp(end, meta.smallest.UserKey) < 0 {
+			rangeDelIter.Close()
+			return fmt.Errorf("range tombstone %s-%s outside of the recorded bounds [%s,%s]",
+				start, end, meta.smallest, meta.largest)
+		}
+	}
+	return rangeDelIter.Close()
+}
+
 // deleteObsoleteFiles deletes those files that are no longer needed.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
@@ -121,6 +121,35 @@ import (
 // to take the range tombstones into consideration when outputting normal
 // keys. Just as with point deletions, a range deletion covering an entry can
 // cause the entry to be elided.
+//
+// 5. Sequence Number Zeroing
+//
+// When compacting to the bottom of the LSM for the compaction's key range, a
+// SET in the last snapshot stripe does not need its sequence number: there is
+// no older version of the key below it and no snapshot which can distinguish
+// the version from an older one. Such keys are output with a sequence number
+// of 0 if zeroSeqNum is set, which makes the trailers of successive keys
+// identical and improves their compression. The caller must only set
+// zeroSeqNum if every range tombstone in the last snapshot stripe is elided,
+// otherwise a zeroed key could be shadowed by a tombstone which is older than
+// the original key.
+//
+// 6. Retained Versions
+//
+// If retainVersions is greater than one, the first retainVersions entries of
+// each user key are each output in their own stripe, as if there were a
+// snapshot between every pair of them, and the remaining entries are
+// collapsed as usual. A MERGE is therefore only merged with older operands
+// beyond the retained versions, and a DELETE is only elided, and a SET only
+// has its sequence number zeroed, if no older versions are retained. Range
+// tombstones continue to delete the entries they cover. Consider the entries
+// below with retainVersions=3:
+//
+//   a.PUT.9        a.PUT.9
+//   a.PUT.8  --->  a.PUT.8
+//   a.DEL.7        a.DEL.7
+//   a.PUT.6
+//   a.PUT.5
 type compactionIter struct {
 	cmp   db.Compare
 	merge db.Merge
@@ -156,6 +185,15 @@ type compactionIter struct {
 	alloc               bytealloc.A
 	elideTombstone      func(key []byte) bool
 	elideRangeTombstone func(start, end []byte) bool
+	// zeroSeqNum enables zeroing the sequence numbers of SETs in the last
+	// snapshot stripe. See the Sequence Number Zeroing description above.
+	zeroSeqNum bool
+	// retainVersions is the number of versions of each user key which are
+	// output in their own stripes, and versions is the number of versions of
+	// the current user key seen so far. See the Retained Versions description
+	// above.
+	retainVersions int
+	versions       int
 }
 
 func newCompactionIter(
@@ -207,7 +245,8 @@ func (i *compactionIter) Next() bool {
 		case db.InternalKeyKindDelete:
 			// If we're at the last snapshot stripe and the tombstone can be elided
 			// skip to the next stripe (which will be the next user key).
-			if i.curSnapshotIdx == 0 && i.elideTombstone(i.key.UserKey) {
+			i.versions++
+			if i.curSnapshotIdx == 0 && !i.retainingVersions() && i.elideTombstone(i.key.UserKey) {
 				i.saveKey()
 				i.skipStripe()
 				continue
@@ -232,10 +271,12 @@ func (i *compactionIter) Next() bool {
 				continue
 			}
 
+			i.versions++
 			i.saveKey()
 			i.value = i.iter.Value()
 			i.valid = true
 			i.skip = true
+			i.maybeZeroSeqNum()
 			return true
 
 		case db.InternalKeyKindMerge:
@@ -245,11 +286,13 @@ func (i *compactionIter) Next() bool {
 				continue
 			}
 
+			i.versions++
 			return i.mergeNext()
 
 		case db.InternalKeyKindInvalid:
 			// NB: Invalid keys occur when there is some error parsing the key. Pass
 			// them through unmodified.
+			i.versions = 0
 			i.saveKey()
 			i.saveValue()
 			i.iterValid = i.iter.Next()
@@ -290,6 +333,7 @@ func (i *compactionIter) nextInStripe() bool {
 	key := i.iter.Key()
 	if i.cmp(i.key.UserKey, key.UserKey) != 0 {
 		i.curSnapshotIdx, i.curSnapshotSeqNum = snapshotIndex(key.SeqNum(), i.snapshots)
+		i.versions = 0
 		return false
 	}
 	switch key.Kind() {
@@ -300,13 +344,18 @@ func (i *compactionIter) nextInStripe() bool {
 		return true
 	case db.InternalKeyKindInvalid:
 		i.curSnapshotIdx, i.curSnapshotSeqNum = snapshotIndex(key.SeqNum(), i.snapshots)
+		i.versions = 0
 		return false
 	}
 	if len(i.snapshots) == 0 {
-		return true
+		// A retained version of the key starts a new stripe.
+		return !i.retainingVersions()
 	}
+	// The snapshot stripe of the next version is determined even if the version
+	// starts a new stripe because it is retained, as the stripe's snapshot
+	// determines which range tombstones delete the version.
 	idx, seqNum := snapshotIndex(key.SeqNum(), i.snapshots)
-	if i.curSnapshotIdx == idx {
+	if i.curSnapshotIdx == idx && !i.retainingVersions() {
 		return true
 	}
 	i.curSnapshotIdx = idx
@@ -355,6 +404,7 @@ func (i *compactionIter) mergeNext() bool {
 			i.valueBuf = i.value[:0]
 			i.key.SetKind(db.InternalKeyKindSet)
 			i.skip = true
+			i.maybeZeroSeqNum()
 			return true
 
 		case db.InternalKeyKindMerge:
@@ -375,6 +425,20 @@ func (i *compactionIter) mergeNext() bool {
 	}
 }
 
+// maybeZeroSeqNum zeroes the sequence number of the current key, which must
+// be a SET, if it is in the last snapshot stripe.
+func (i *compactionIter) maybeZeroSeqNum() {
+	if i.zeroSeqNum && i.curSnapshotIdx == 0 && !i.retainingVersions() {
+		i.key.SetSeqNum(0)
+	}
+}
+
+// retainingVersions returns true if older versions of the current user key are
+// retained in stripes of their own.
+func (i *compactionIter) retainingVersions() bool {
+	return i.versions < i.retainVersions
+}
+
 func (i *compactionIter) saveKey() {
 	i.keyBuf = append(i.keyBuf[:0], i.iter.Key().UserKey...)
 	i.key.UserKey = i.keyBuf
@@ -448,3 +512,88 @@ func (i *compactionIter) emitRangeDelChunk(fragmented []rangedel.Tombstone) {
 		currentIdx = idx
 	}
 }
+
+// copyingCompactionIter interleaves the output of a compactionIter with the
+// point operations of a copy iterator, which are passed through unchanged. The
+// user keys of the two iterators must be disjoint. See
+// compaction.newCopyIter.
+type copyingCompactionIter struct {
+	*compactionIter
+	cmp  db.Compare
+	copy internalIterator
+	// fromCopy is true if the iterator is positioned at the copy iterator.
+	fromCopy bool
+}
+
+func newCopyingCompactionIter(
+	cmp db.Compare, iter *compactionIter, copy internalIterator,
+) *copyingCompactionIter {
+	return &copyingCompactionIter{compactionIter: iter, cmp: cmp, copy: copy}
+}
+
+func (i *copyingCompactionIter) First() bool {
+	i.compactionIter.First()
+	if i.copy != nil {
+		i.copy.First()
+	}
+	return i.choose()
+}
+
+func (i *copyingCompactionIter) Next() bool {
+	if i.fromCopy {
+		i.copy.Next()
+	} else {
+		i.compactionIter.Next()
+	}
+	return i.choose()
+}
+
+// choose positions the iterator at the smaller of the current keys of the two
+// iterators.
+func (i *copyingCompactionIter) choose() bool {
+	i.fromCopy = false
+	if i.copy == nil || !i.copy.Valid() {
+		return i.compactionIter.Valid()
+	}
+	if !i.compactionIter.Valid() ||
+		db.InternalCompare(i.cmp, i.copy.Key(), i.compactionIter.Key()) < 0 {
+		i.fromCopy = true
+	}
+	return true
+}
+
+func (i *copyingCompactionIter) Key() db.InternalKey {
+	if i.fromCopy {
+		return i.copy.Key()
+	}
+	return i.compactionIter.Key()
+}
+
+func (i *copyingCompactionIter) Value() []byte {
+	if i.fromCopy {
+		return i.copy.Value()
+	}
+	return i.compactionIter.Value()
+}
+
+func (i *copyingCompactionIter) Valid() bool {
+	return i.fromCopy || i.compactionIter.Valid()
+}
+
+func (i *copyingCompactionIter) Error() error {
+	if err := i.compactionIter.Error(); err != nil {
+		return err
+	}
+	if i.copy != nil {
+		return i.copy.Error()
+	}
+	return nil
+}
+
+func (i *copyingCompactionIter) Close() error {
+	err := i.compactionIter.Close()
+	if i.copy != nil {
+		err = firstError(err, i.copy.Close())
+	}
+	return err
+}
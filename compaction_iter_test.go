@@ -51,9 +51,11 @@ func TestCompactionIter(t *testing.T) {
 	var vals [][]byte
 	var snapshots []uint64
 	var elideTombstones bool
+	var zeroSeqNums bool
+	var retainVersions int
 
 	newIter := func() *compactionIter {
-		return newCompactionIter(
+		i := newCompactionIter(
 			db.DefaultComparer.Compare,
 			db.DefaultMerger.Merge,
 			&fakeIter{keys: keys, vals: vals},
@@ -65,6 +67,9 @@ func TestCompactionIter(t *testing.T) {
 				return elideTombstones
 			},
 		)
+		i.zeroSeqNum = zeroSeqNums
+		i.retainVersions = retainVersions
+		return i
 	}
 
 	datadriven.RunTest(t, "testdata/compaction_iter", func(d *datadriven.TestData) string {
@@ -82,6 +87,8 @@ func TestCompactionIter(t *testing.T) {
 		case "iter":
 			snapshots = snapshots[:0]
 			elideTombstones = false
+			zeroSeqNums = false
+			retainVersions = 0
 			for _, arg := range d.CmdArgs {
 				switch arg.Key {
 				case "snapshots":
@@ -98,6 +105,18 @@ func TestCompactionIter(t *testing.T) {
 					if err != nil {
 						return err.Error()
 					}
+				case "zero-seqnums":
+					var err error
+					zeroSeqNums, err = strconv.ParseBool(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
+				case "retain-versions":
+					var err error
+					retainVersions, err = strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
 				default:
 					return fmt.Sprintf("%s: unknown arg: %s", d.Cmd, arg.Key)
 				}
@@ -30,6 +30,10 @@ type compactionPicker struct {
 	score float64
 	level int
 	file  int
+
+	// estimatedDebt is an estimate of the number of bytes which need to be
+	// compacted for the LSM to reach a stable shape. See Metrics.
+	estimatedDebt uint64
 }
 
 func newCompactionPicker(v *version, opts *db.Options) *compactionPicker {
@@ -38,6 +42,7 @@ func newCompactionPicker(v *version, opts *db.Options) *compactionPicker {
 	}
 	p.initLevelMaxBytes(v, opts)
 	p.initTarget(v, opts)
+	p.initEstimatedDebt(v, opts)
 	return p
 }
 
@@ -146,6 +151,31 @@ func (p *compactionPicker) initLevelMaxBytes(v *version, opts *db.Options) {
 	}
 }
 
+// initEstimatedDebt estimates the number of bytes which need to be compacted
+// for L0 to be below its compaction threshold and for every other level to be
+// no larger than its max bytes setting. The bytes compacted out of a level are
+// added to the size of the next level, and are assumed to be merged with a
+// proportional share of the bytes of the next level. This is the same estimate
+// as RocksDB's estimated pending compaction bytes.
+func (p *compactionPicker) initEstimatedDebt(v *version, opts *db.Options) {
+	var debt, bytesAdded uint64
+	if len(v.files[0]) >= opts.L0CompactionThreshold {
+		// All of L0 is compacted into the base level.
+		bytesAdded = totalSize(v.files[0])
+		debt += bytesAdded + totalSize(v.files[p.baseLevel])
+	}
+	for level := p.baseLevel; level < numLevels-1; level++ {
+		levelSize := totalSize(v.files[level]) + bytesAdded
+		bytesAdded = 0
+		if maxBytes := uint64(p.levelMaxBytes[level]); levelSize > maxBytes {
+			bytesAdded = levelSize - maxBytes
+			nextLevelSize := totalSize(v.files[level+1])
+			debt += uint64(float64(bytesAdded) * (float64(nextLevelSize)/float64(levelSize) + 1))
+		}
+	}
+	p.estimatedDebt = debt
+}
+
 // initTarget initializes the compaction score and level. If the compaction
 // score indicates compaction is needed, a target table within the target level
 // is selected for compaction.
@@ -193,22 +223,34 @@ func (p *compactionPicker) initTarget(v *version, opts *db.Options) {
 		// - Sequential write+delete (queue)
 
 		// The current heuristic matches the RocksDB kOldestSmallestSeqFirst
-		// heuristic.
-		smallestSeqNum := uint64(math.MaxUint64)
-		files := v.files[p.level]
-		for i := range files {
-			f := &files[i]
-			if smallestSeqNum > f.smallestSeqNum {
-				smallestSeqNum = f.smallestSeqNum
-				p.file = i
+		// heuristic. When compacting into the bottom level, tables which would
+		// rewrite a bottom level table larger than BottomLevelSkipThreshold are
+		// only picked if every table in the level would.
+		skipLarge := opts.BottomLevelSkipThreshold > 0 && p.level+1 == numLevels-1
+		for {
+			p.file = -1
+			smallestSeqNum := uint64(math.MaxUint64)
+			files := v.files[p.level]
+			for i := range files {
+				f := &files[i]
+				if skipLarge && overlapsLargeFile(v, opts, p.level+1, f) {
+					continue
+				}
+				if smallestSeqNum > f.smallestSeqNum {
+					smallestSeqNum = f.smallestSeqNum
+					p.file = i
+				}
 			}
+			if p.file >= 0 || !skipLarge {
+				return
+			}
+			skipLarge = false
 		}
-		return
 	}
 
 	// No levels exceeded their size threshold. Check for forced compactions.
 	for level := 0; level < numLevels-1; level++ {
-		files := v.files[p.level]
+		files := v.files[level]
 		for i := range files {
 			f := &files[i]
 			if f.markedForCompaction {
@@ -225,6 +267,18 @@ func (p *compactionPicker) initTarget(v *version, opts *db.Options) {
 	// snapshot.
 }
 
+// overlapsLargeFile returns whether f overlaps a table in level which is larger
+// than opts.BottomLevelSkipThreshold.
+func overlapsLargeFile(v *version, opts *db.Options, level int, f *fileMetadata) bool {
+	overlaps := v.overlaps(level, opts.Comparer.Compare, f.smallest.UserKey, f.largest.UserKey)
+	for i := range overlaps {
+		if int64(overlaps[i].size) > opts.BottomLevelSkipThreshold {
+			return true
+		}
+	}
+	return false
+}
+
 // pickAuto picks the best compaction, if any.
 func (p *compactionPicker) pickAuto(opts *db.Options) (c *compaction) {
 	if !p.compactionNeeded() {
@@ -254,6 +308,10 @@ func (p *compactionPicker) pickManual(opts *db.Options, manual *manualCompaction
 		return nil
 	}
 
+	if manual.intraLevel {
+		return p.pickIntraLevel(opts, manual.level)
+	}
+
 	// TODO(peter): The logic here is untested and possibly incomplete.
 	cur := p.vers
 	c = newCompaction(opts, cur, manual.level)
@@ -262,6 +320,67 @@ func (p *compactionPicker) pickManual(opts *db.Options, manual *manualCompaction
 	if len(c.inputs[0]) == 0 {
 		return nil
 	}
+	c.filters = manual.filters
 	c.setupOtherInputs()
 	return c
 }
+
+// pickRewrite picks the table with the specified file number in level, if it
+// is still present, for a compaction which rewrites it in place.
+func (p *compactionPicker) pickRewrite(opts *db.Options, level int, fileNum uint64) *compaction {
+	if p == nil {
+		return nil
+	}
+	files := p.vers.files[level]
+	for i := range files {
+		if files[i].fileNum != fileNum {
+			continue
+		}
+		c := newIntraLevelCompaction(opts, p.vers, level)
+		c.inputs[0] = c.expandInputs(files[i : i+1])
+		if level+1 < numLevels {
+			smallest, largest := ikeyRange(c.cmp, c.inputs[0], nil)
+			c.grandparents = p.vers.overlaps(level+1, c.cmp, smallest.UserKey, largest.UserKey)
+		}
+		return c
+	}
+	return nil
+}
+
+// pickIntraLevel picks the longest run of adjacent small tables in level, if
+// there is a run of at least two, for an intra-level compaction. A table is
+// small if it is less than half of the target file size of the level.
+func (p *compactionPicker) pickIntraLevel(opts *db.Options, level int) *compaction {
+	files := p.vers.files[level]
+	small := uint64(opts.Level(level).TargetFileSize) / 2
+	limit := expandedCompactionByteSizeLimit(opts, level)
+	var bestStart, bestEnd int
+	for start := 0; start < len(files); {
+		if files[start].size >= small {
+			start++
+			continue
+		}
+		end, size := start+1, files[start].size
+		for ; end < len(files) && files[end].size < small; end++ {
+			if size+files[end].size > limit {
+				break
+			}
+			size += files[end].size
+		}
+		if end-start > bestEnd-bestStart {
+			bestStart, bestEnd = start, end
+		}
+		start = end
+	}
+	if bestEnd-bestStart < 2 {
+		return nil
+	}
+
+	c := newIntraLevelCompaction(opts, p.vers, level)
+	c.inputs[0] = c.expandInputs(files[bestStart:bestEnd])
+	if level+1 < numLevels {
+		smallest, largest := ikeyRange(c.cmp, c.inputs[0], nil)
+		c.grandparents = p.vers.overlaps(level+1, c.cmp, smallest.UserKey, largest.UserKey)
+	}
+	return c
+}
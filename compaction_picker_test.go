@@ -134,3 +134,54 @@ func TestCompactionPickerTargetLevel(t *testing.T) {
 			}
 		})
 }
+
+func TestCompactionPickerBottomLevelSkipThreshold(t *testing.T) {
+	ikey := func(s string) db.InternalKey {
+		return db.MakeInternalKey([]byte(s), 0, db.InternalKeyKindSet)
+	}
+	// The oldest table in L5 overlaps a large table in L6, while a newer table
+	// overlaps a small one.
+	vers := &version{}
+	vers.files[numLevels-2] = []fileMetadata{
+		{fileNum: 1, size: 200 << 20, smallest: ikey("a"), largest: ikey("c"), smallestSeqNum: 1},
+		{fileNum: 2, size: 200 << 20, smallest: ikey("x"), largest: ikey("z"), smallestSeqNum: 2},
+	}
+	vers.files[numLevels-1] = []fileMetadata{
+		{fileNum: 3, size: 1 << 30, smallest: ikey("a"), largest: ikey("m")},
+		{fileNum: 4, size: 1 << 20, smallest: ikey("w"), largest: ikey("z")},
+	}
+
+	testCases := []struct {
+		threshold int64
+		expected  string
+	}{
+		{0, "L5: 1 L6: 3"},
+		{1 << 31, "L5: 1 L6: 3"},
+		{100 << 20, "L5: 2 L6: 4"},
+		// When every compaction would rewrite a large table, the oldest table is
+		// compacted.
+		{1 << 10, "L5: 1 L6: 3"},
+	}
+	for _, c := range testCases {
+		opts := &db.Options{BottomLevelSkipThreshold: c.threshold}
+		opts.EnsureDefaults()
+		p := newCompactionPicker(vers, opts)
+		comp := p.pickAuto(opts)
+		if comp == nil {
+			t.Fatalf("%d: expected a compaction", c.threshold)
+		}
+		var buf bytes.Buffer
+		for i, inputs := range comp.inputs {
+			fmt.Fprintf(&buf, "L%d:", comp.level+i)
+			for _, f := range inputs {
+				fmt.Fprintf(&buf, " %d", f.fileNum)
+			}
+			if i == 0 {
+				buf.WriteString(" ")
+			}
+		}
+		if s := buf.String(); s != c.expected {
+			t.Fatalf("%d: expected %s, but found %s", c.threshold, c.expected, s)
+		}
+	}
+}
@@ -6,15 +6,24 @@ package pebble
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/petermattis/pebble/bloom"
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/crc"
 	"github.com/petermattis/pebble/internal/datadriven"
+	"github.com/petermattis/pebble/internal/record"
 	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/storage"
 )
@@ -907,3 +916,1934 @@ func TestCompactionExpandInputs(t *testing.T) {
 			}
 		})
 }
+
+// timestampCollector collects the range of the timestamps stored at the start
+// of the values of a data block.
+type timestampCollector struct {
+	min, max uint64
+}
+
+func (c *timestampCollector) Name() string {
+	return "timestamp"
+}
+
+func (c *timestampCollector) Add(key db.InternalKey, value []byte) error {
+	if len(value) == 0 {
+		return nil
+	}
+	ts, err := strconv.ParseUint(string(value[:4]), 10, 64)
+	if err != nil {
+		return err
+	}
+	if c.min == 0 || ts < c.min {
+		c.min = ts
+	}
+	if ts > c.max {
+		c.max = ts
+	}
+	return nil
+}
+
+func (c *timestampCollector) FinishDataBlock(dst []byte) ([]byte, error) {
+	var buf [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], c.min)
+	n += binary.PutUvarint(buf[n:], c.max)
+	c.min, c.max = 0, 0
+	return append(dst, buf[:n]...), nil
+}
+
+// timestampFilter matches the data blocks holding a timestamp within
+// [min,max], recording the blocks it is applied to.
+type timestampFilter struct {
+	min, max uint64
+	excluded int
+}
+
+func (f *timestampFilter) Name() string {
+	return "timestamp"
+}
+
+func (f *timestampFilter) Intersects(prop []byte) (bool, error) {
+	min, n := binary.Uvarint(prop)
+	max, m := binary.Uvarint(prop[n:])
+	if n <= 0 || m <= 0 {
+		return false, fmt.Errorf("invalid timestamp property: %x", prop)
+	}
+	if max < f.min || min > f.max {
+		f.excluded++
+		return false, nil
+	}
+	return true, nil
+}
+
+func TestCompactWithFilters(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		BlockPropertyCollectors: []func() db.BlockPropertyCollector{
+			func() db.BlockPropertyCollector { return &timestampCollector{} },
+		},
+		Levels: []db.LevelOptions{{
+			// Hold two entries per data block, so that the versions of a key
+			// share a block.
+			BlockSize: 200,
+		}},
+		Storage:     fs,
+		TableFormat: db.TableFormatPebblev1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	pad := strings.Repeat("x", 100)
+	value := func(ts int) []byte {
+		return []byte(fmt.Sprintf("%04d%s", ts, pad))
+	}
+
+	// Write two L0 tables with disjoint keys, each key holding two versions
+	// which are kept apart by a snapshot while the tables are flushed. The
+	// keys "g" through "q" have timestamps outside of the window [10,20] of
+	// the filter. The newest version of "k" is a deletion, which is written
+	// last so that the other data blocks hold the two versions of a key.
+	var snapshots []*Snapshot
+	for _, keys := range []string{"acegik", "moqsuw"} {
+		for round := 0; round < 2; round++ {
+			for _, k := range keys {
+				key := []byte{byte(k)}
+				ts := 1 + round
+				if strings.ContainsRune("acesuw", k) {
+					ts += 10
+				}
+				var err error
+				if k == 'k' && round == 1 {
+					err = d.Delete(key, nil)
+				} else {
+					err = d.Set(key, value(ts), nil)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if round == 0 {
+				snapshots = append(snapshots, d.NewSnapshot())
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scan := func() string {
+		var buf bytes.Buffer
+		iter := d.NewIter(nil)
+		for valid := iter.First(); valid; valid = iter.Next() {
+			fmt.Fprintf(&buf, "%s:%s ", iter.Key(), iter.Value()[:4])
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	before := scan()
+
+	// Release the snapshots so that the compaction collapses the versions of
+	// the keys it merges.
+	for _, s := range snapshots {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filter := &timestampFilter{min: 10, max: 20}
+	if err := d.CompactWithFilters([]byte("a"), []byte("z"), []db.BlockPropertyFilter{filter}); err != nil {
+		t.Fatal(err)
+	}
+	if filter.excluded == 0 {
+		t.Fatalf("expected data blocks to be excluded")
+	}
+
+	d.mu.Lock()
+	v := d.mu.versions.currentVersion()
+	d.mu.Unlock()
+	if len(v.files[0]) != 0 || len(v.files[1]) == 0 {
+		t.Fatalf("expected the L0 tables to be compacted into L1:\n%s", v)
+	}
+
+	// The out-of-window blocks are copied through with both versions of their
+	// keys, while the versions of the keys in the window are collapsed.
+	var buf bytes.Buffer
+	for _, meta := range v.files[1] {
+		f, err := fs.Open(dbFilename("", fileTypeTable, meta.fileNum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := sstable.NewReader(f, meta.fileNum, nil)
+		iter := r.NewIter(nil)
+		for valid := iter.First(); valid; valid = iter.Next() {
+			fmt.Fprintf(&buf, "%s ", iter.Key().UserKey)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected, actual := "a c e g g i i k k m m o o q q s u w ", buf.String(); expected != actual {
+		t.Fatalf("expected %s, but found %s", expected, actual)
+	}
+
+	if after := scan(); before != after {
+		t.Fatalf("expected\n%s\nbut found\n%s", before, after)
+	}
+}
+
+func TestCompactionChangeConsumer(t *testing.T) {
+	consumer := &db.ChangeConsumer{
+		C: make(chan db.ChangeRecord, 1000),
+	}
+	d, err := Open("", &db.Options{
+		ChangeConsumer: consumer,
+		Storage:        storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Create two overlapping L0 tables so that the compaction into L1 is not a
+	// trivial move.
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 10; j++ {
+			key := []byte(fmt.Sprintf("%02d", j))
+			if err := d.Set(key, []byte(fmt.Sprint(i)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 1 {
+			if err := d.DeleteRange([]byte("03"), []byte("05"), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact([]byte("00"), []byte("99")); err != nil {
+		t.Fatal(err)
+	}
+
+	received := changeRecordsReceived(consumer)
+	written := changeRecordsWritten(t, d, 1)
+	if len(written) == 0 {
+		t.Fatalf("expected records to be written")
+	}
+	if expected, actual := strings.Join(written, "\n"), strings.Join(received, "\n"); expected != actual {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, actual)
+	}
+	if n := consumer.Dropped(); n != 0 {
+		t.Fatalf("expected no dropped records, but found %d", n)
+	}
+}
+
+// changeRecordsReceived drains the records received by the consumer.
+func changeRecordsReceived(consumer *db.ChangeConsumer) []string {
+	var received []string
+	for {
+		select {
+		case r := <-consumer.C:
+			received = append(received, fmt.Sprintf("%s:%s", r.Key, r.Value))
+		default:
+			return received
+		}
+	}
+}
+
+// changeRecordsWritten returns the records of the tables in the given level,
+// in the order in which a compaction writing them sends them to the consumer.
+func changeRecordsWritten(t *testing.T, d *DB, level int) []string {
+	d.mu.Lock()
+	files := d.mu.versions.currentVersion().files[level]
+	d.mu.Unlock()
+	if len(files) == 0 {
+		t.Fatalf("expected compaction output in L%d", level)
+	}
+
+	var written []string
+	for _, meta := range files {
+		f, err := d.opts.Storage.Open(dbFilename(d.dirname, fileTypeTable, meta.fileNum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := sstable.NewReader(f, meta.fileNum, nil)
+		iter := r.NewIter(nil)
+		for valid := iter.First(); valid; valid = iter.Next() {
+			written = append(written, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if rangeDelIter := r.NewRangeDelIter(nil); rangeDelIter != nil {
+			for valid := rangeDelIter.First(); valid; valid = rangeDelIter.Next() {
+				written = append(written, fmt.Sprintf("%s:%s", rangeDelIter.Key(), rangeDelIter.Value()))
+			}
+			if err := rangeDelIter.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return written
+}
+
+func TestCompactionChangeConsumerFailure(t *testing.T) {
+	consumer := &db.ChangeConsumer{
+		C: make(chan db.ChangeRecord, 1000),
+	}
+	fs := &syncFailingStorage{Storage: storage.NewMem()}
+	d, err := Open("", &db.Options{
+		ChangeConsumer: consumer,
+		Storage:        fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 10; j++ {
+			key := []byte(fmt.Sprintf("%02d", j))
+			if err := d.Set(key, []byte(fmt.Sprint(i)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The output of the first compaction fails to be synced, after its
+	// records have been written. None of them are sent.
+	atomic.StoreInt32(&fs.fail, 1)
+	if err := d.Compact([]byte("00"), []byte("99")); err == nil {
+		t.Fatalf("expected the compaction to fail")
+	}
+	if received := changeRecordsReceived(consumer); len(received) != 0 {
+		t.Fatalf("expected no records from the failed compaction, but found\n%s",
+			strings.Join(received, "\n"))
+	}
+
+	// The records of the retried compaction are sent once.
+	atomic.StoreInt32(&fs.fail, 0)
+	if err := d.Compact([]byte("00"), []byte("99")); err != nil {
+		t.Fatal(err)
+	}
+	written := changeRecordsWritten(t, d, 1)
+	received := changeRecordsReceived(consumer)
+	if expected, actual := strings.Join(written, "\n"), strings.Join(received, "\n"); expected != actual {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, actual)
+	}
+}
+
+// syncFailingStorage fails the syncs of the tables created while fail is
+// set.
+type syncFailingStorage struct {
+	storage.Storage
+	fail int32
+}
+
+func (fs *syncFailingStorage) Create(name string) (storage.File, error) {
+	f, err := fs.Storage.Create(name)
+	if err != nil || !strings.HasSuffix(name, ".sst") || atomic.LoadInt32(&fs.fail) == 0 {
+		return f, err
+	}
+	return syncFailingFile{f}, nil
+}
+
+type syncFailingFile struct {
+	storage.File
+}
+
+func (syncFailingFile) Sync() error {
+	return errors.New("injected sync failure")
+}
+
+func TestChangeConsumerDrop(t *testing.T) {
+	for _, maxWait := range []time.Duration{0, time.Millisecond} {
+		t.Run(maxWait.String(), func(t *testing.T) {
+			consumer := &db.ChangeConsumer{
+				C:       make(chan db.ChangeRecord, 1),
+				MaxWait: maxWait,
+			}
+			key := db.MakeInternalKey([]byte("a"), 1, db.InternalKeyKindSet)
+			if !consumer.Send(key, []byte("1")) {
+				t.Fatalf("expected record to be sent")
+			}
+			// The consumer is not reading, so subsequent records are dropped.
+			for i := 0; i < 3; i++ {
+				if consumer.Send(key, []byte("2")) {
+					t.Fatalf("expected record to be dropped")
+				}
+			}
+			if n := consumer.Dropped(); n != 3 {
+				t.Fatalf("expected 3 dropped records, but found %d", n)
+			}
+			if r := <-consumer.C; string(r.Value) != "1" {
+				t.Fatalf("expected 1, but found %s", r.Value)
+			}
+		})
+	}
+}
+
+func TestCompactionZeroSeqNums(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:     storage.NewMem(),
+		ZeroSeqNums: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Create two overlapping L0 tables with a snapshot in between. The versions
+	// visible to the snapshot are in the last snapshot stripe and have their
+	// sequence numbers zeroed when compacted into L1, which is the bottom of
+	// the LSM. The newer versions must retain their sequence numbers.
+	const n = 10
+	var snap *Snapshot
+	for i := 0; i < 2; i++ {
+		for j := 0; j < n; j++ {
+			key := []byte(fmt.Sprintf("%02d", j))
+			if err := d.Set(key, []byte(fmt.Sprint(i)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			snap = d.NewSnapshot()
+		}
+	}
+	if err := d.Compact([]byte("00"), []byte("99")); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	files := d.mu.versions.currentVersion().files[1]
+	d.mu.Unlock()
+	if len(files) == 0 {
+		t.Fatalf("expected compaction output in L1")
+	}
+	var written []string
+	for _, meta := range files {
+		f, err := d.opts.Storage.Open(dbFilename(d.dirname, fileTypeTable, meta.fileNum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := sstable.NewReader(f, meta.fileNum, nil)
+		iter := r.NewIter(nil)
+		for valid := iter.First(); valid; valid = iter.Next() {
+			written = append(written, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var expected []string
+	for j := 0; j < n; j++ {
+		expected = append(expected,
+			fmt.Sprintf("%02d#%d,1:1", j, n+j),
+			fmt.Sprintf("%02d#0,1:0", j))
+	}
+	if e, a := strings.Join(expected, " "), strings.Join(written, " "); e != a {
+		t.Fatalf("expected\n%s\nbut found\n%s", e, a)
+	}
+
+	// The zeroed versions remain readable through the snapshot, and are still
+	// shadowed by the newer versions.
+	for j := 0; j < n; j++ {
+		key := []byte(fmt.Sprintf("%02d", j))
+		if v, err := d.Get(key); err != nil || string(v) != "1" {
+			t.Fatalf("%s: expected 1, but found %q (%v)", key, v, err)
+		}
+		if v, err := snap.Get(key); err != nil || string(v) != "0" {
+			t.Fatalf("%s: expected 0 at snapshot, but found %q (%v)", key, v, err)
+		}
+	}
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactionOutputPartitioner(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		// A tiny target file size would split the output after every key if the
+		// output was split by size.
+		Levels: []db.LevelOptions{{TargetFileSize: 1}},
+		OutputPartitioner: func(key []byte) int {
+			return int(key[0])
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Write every partition to each of two overlapping L0 tables.
+	const partitions = "abc"
+	for i := 0; i < 2; i++ {
+		for _, p := range partitions {
+			for j := 0; j < 10; j++ {
+				key := []byte(fmt.Sprintf("%c%02d", p, j+i))
+				if err := d.Set(key, []byte(fmt.Sprint(i)), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact([]byte("a"), []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	files := d.mu.versions.currentVersion().files[1]
+	d.mu.Unlock()
+	var found []string
+	for _, meta := range files {
+		f, err := d.opts.Storage.Open(dbFilename(d.dirname, fileTypeTable, meta.fileNum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := sstable.NewReader(f, meta.fileNum, nil)
+		iter := r.NewIter(nil)
+		var prefixes []byte
+		for valid := iter.First(); valid; valid = iter.Next() {
+			if p := iter.Key().UserKey[0]; len(prefixes) == 0 || prefixes[len(prefixes)-1] != p {
+				prefixes = append(prefixes, p)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, string(prefixes))
+	}
+	if expected, actual := "a b c", strings.Join(found, " "); expected != actual {
+		t.Fatalf("expected partitions %q, but found %q", expected, actual)
+	}
+}
+
+func TestCompactionFilterBitsPerKey(t *testing.T) {
+	lo := db.LevelOptions{
+		FilterPolicy: bloom.FilterPolicy(10),
+		FilterType:   db.TableFilter,
+	}
+	levels := []db.LevelOptions{lo, lo}
+	levels[0].FilterBitsPerKey = 2
+	levels[1].FilterBitsPerKey = 20
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		Levels:  levels,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// filterBitsPerKey returns the number of filter bits per key of the tables
+	// in the specified level.
+	filterBitsPerKey := func(level int) float64 {
+		d.mu.Lock()
+		files := d.mu.versions.currentVersion().files[level]
+		d.mu.Unlock()
+		if len(files) == 0 {
+			t.Fatalf("expected tables in L%d", level)
+		}
+		var size, entries uint64
+		for i := range files {
+			err := d.tableCache.withReader(&files[i], func(r *sstable.Reader) error {
+				size += r.Properties.FilterSize
+				entries += r.Properties.NumEntries
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return float64(8*size) / float64(entries)
+	}
+
+	// Write two overlapping L0 tables to prevent the compaction from moving a
+	// table to L1 without rewriting it.
+	const numKeys = 1000
+	for j := 0; j < 2; j++ {
+		for i := 0; i < numKeys; i++ {
+			if err := d.Set([]byte(fmt.Sprintf("%04d", i)), nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l0 := filterBitsPerKey(0)
+
+	if err := d.Compact([]byte("0"), []byte("9")); err != nil {
+		t.Fatal(err)
+	}
+	l1 := filterBitsPerKey(1)
+	if l0 < 1 || l0 > 4 || l1 < 19 || l1 > 22 {
+		t.Fatalf("expected ~2 and ~20 filter bits per key in L0 and L1, but found %.1f and %.1f", l0, l1)
+	}
+
+	// The filters are readable regardless of their size.
+	for i := 0; i < numKeys; i++ {
+		if _, err := d.Get([]byte(fmt.Sprintf("%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompactionKeyRewriter(t *testing.T) {
+	var rewriter func(key []byte) ([]byte, error)
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		KeyRewriter: func(key []byte) ([]byte, error) {
+			return rewriter(key)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	const numKeys = 20
+	for i := 0; i < numKeys; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("old/%02d", i)), []byte(fmt.Sprint(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// The snapshot prevents the compaction from dropping the range tombstone
+	// and the keys it deletes.
+	s := d.NewSnapshot()
+	defer s.Close()
+	if err := d.DeleteRange([]byte("old/05"), []byte("old/08"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rewriter which reverses the order of the keys is rejected.
+	rewriter = func(key []byte) ([]byte, error) {
+		return []byte{'z' - key[len(key)-1]}, nil
+	}
+	if err := d.Compact([]byte("old/"), []byte("old0")); err == nil {
+		t.Fatalf("expected a non-monotonic rewriter to fail the compaction")
+	} else if !strings.Contains(err.Error(), "not monotonic") {
+		t.Fatalf("expected a non-monotonic rewriter error, but found %v", err)
+	}
+
+	rewriter = func(key []byte) ([]byte, error) {
+		if !bytes.HasPrefix(key, []byte("old/")) {
+			return key, nil
+		}
+		return append([]byte("new/"), key[4:]...), nil
+	}
+	if err := d.Compact([]byte("old/"), []byte("old0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys are readable under the new prefix, including the effect of the
+	// rewritten range tombstone.
+	var found []string
+	iter := d.NewIter(nil)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		found = append(found, fmt.Sprintf("%s=%s", iter.Key(), iter.Value()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for i := 0; i < numKeys; i++ {
+		if i < 5 || i >= 8 {
+			expected = append(expected, fmt.Sprintf("new/%02d=%d", i, i))
+		}
+	}
+	if e, f := strings.Join(expected, " "), strings.Join(found, " "); e != f {
+		t.Fatalf("expected\n%s\nbut found\n%s", e, f)
+	}
+	if v, err := d.Get([]byte("new/10")); err != nil || string(v) != "10" {
+		t.Fatalf("expected 10, but found %q (%v)", v, err)
+	}
+	if _, err := d.Get([]byte("old/10")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+}
+
+func TestCompactionKeyRewriterCollision(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		KeyRewriter: func(key []byte) ([]byte, error) {
+			return []byte("k"), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The keys are written in reverse order, so that the sequence numbers of
+	// the rewritten keys decrease as the keys do in the output of the
+	// compaction. Their versions would merge into those of a single key.
+	for _, key := range []string{"b", "a"} {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("c")); err == nil {
+		t.Fatalf("expected a colliding rewriter to fail the compaction")
+	} else if !strings.Contains(err.Error(), "not monotonic") {
+		t.Fatalf("expected a non-monotonic rewriter error, but found %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if v, err := d.Get([]byte(key)); err != nil || string(v) != key {
+			t.Fatalf("expected %s, but found %q (%v)", key, v, err)
+		}
+	}
+}
+
+func TestCompactionKeyRewriterDeeperLevel(t *testing.T) {
+	var rewriter func(key []byte) ([]byte, error)
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		KeyRewriter: func(key []byte) ([]byte, error) {
+			return rewriter(key)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Compact a table containing "new/05" down to L3. Each manual compaction
+	// moves the table down a level, as it is never moved without rewriting.
+	rewriter = func(key []byte) ([]byte, error) {
+		return key, nil
+	}
+	if err := d.Set([]byte("new/05"), []byte("deep"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := d.Compact([]byte("new/"), []byte("new0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.mu.Lock()
+	deep := d.mu.versions.currentVersion().files[3]
+	d.mu.Unlock()
+	if len(deep) != 1 {
+		t.Fatalf("expected a table in L3, but found %d", len(deep))
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("old/%02d", i)), []byte(fmt.Sprint(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewriting the keys into the range of the table in L3 is rejected, even
+	// though the table is not in the output level of the compaction.
+	rewriter = func(key []byte) ([]byte, error) {
+		if !bytes.HasPrefix(key, []byte("old/")) {
+			return key, nil
+		}
+		return append([]byte("new/"), key[4:]...), nil
+	}
+	expected := fmt.Sprintf("overlap table %d in L3", deep[0].fileNum)
+	if err := d.Compact([]byte("old/"), []byte("old0")); err == nil {
+		t.Fatalf("expected the compaction to fail")
+	} else if !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected %q, but found %v", expected, err)
+	}
+
+	// The keys are unchanged.
+	if v, err := d.Get([]byte("old/05")); err != nil || string(v) != "5" {
+		t.Fatalf("expected 5, but found %q (%v)", v, err)
+	}
+	if v, err := d.Get([]byte("new/05")); err != nil || string(v) != "deep" {
+		t.Fatalf("expected deep, but found %q (%v)", v, err)
+	}
+}
+
+func TestCompactionKeyRewriterStaleVersion(t *testing.T) {
+	var rewriter func(key []byte) ([]byte, error)
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		KeyRewriter: func(key []byte) ([]byte, error) {
+			return rewriter(key)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Compact a stale version of "old/k" down to L6.
+	rewriter = func(key []byte) ([]byte, error) {
+		return key, nil
+	}
+	if err := d.Set([]byte("old/k"), []byte("stale"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numLevels-1; i++ {
+		if err := d.Compact([]byte("old/"), []byte("old0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.mu.Lock()
+	deep := d.mu.versions.currentVersion().files[numLevels-1]
+	d.mu.Unlock()
+	if len(deep) != 1 {
+		t.Fatalf("expected a table in L%d, but found %d", numLevels-1, len(deep))
+	}
+
+	if err := d.Set([]byte("old/k"), []byte("fresh"), nil); err != nil {
+		t.Fatal(err)
+	}
+	rewriter = func(key []byte) ([]byte, error) {
+		if !bytes.HasPrefix(key, []byte("old/")) {
+			return key, nil
+		}
+		return append([]byte("new/"), key[4:]...), nil
+	}
+
+	get := func(key string) string {
+		v, err := d.Get([]byte(key))
+		if err == db.ErrNotFound {
+			return "<not found>"
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(v)
+	}
+
+	// Compact the fresh version down one level at a time. The key is not
+	// rewritten while the stale version lies below the output level of the
+	// compactions, as that would expose the stale version.
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	compact := func(level int) {
+		err := d.manualCompact(&manualCompaction{
+			done:  make(chan error, 1),
+			level: level,
+			start: db.MakeInternalKey([]byte("old/"), db.InternalKeySeqNumMax, db.InternalKeyKindMax),
+			end:   db.MakeInternalKey([]byte("old0"), 0, 0),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for level := 0; level < numLevels-2; level++ {
+		compact(level)
+		if v := get("old/k"); v != "fresh" {
+			t.Fatalf("L%d: expected fresh, but found %s", level, v)
+		}
+		if v := get("new/k"); v != "<not found>" {
+			t.Fatalf("L%d: expected not found, but found %s", level, v)
+		}
+	}
+
+	// The compaction into L6 merges both versions and rewrites the key.
+	compact(numLevels - 2)
+	if v := get("old/k"); v != "<not found>" {
+		t.Fatalf("expected not found, but found %s", v)
+	}
+	if v := get("new/k"); v != "fresh" {
+		t.Fatalf("expected fresh, but found %s", v)
+	}
+}
+
+func TestCompactWithinLevel(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Create ten small tables in L3. Each table is flushed and then moved down
+	// to L3 by manual compactions of its key range.
+	var expected []string
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 2; j++ {
+			key := fmt.Sprintf("%02d/%d", i, j)
+			if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+				t.Fatal(err)
+			}
+			expected = append(expected, key)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		start, end := []byte(fmt.Sprintf("%02d/", i)), []byte(fmt.Sprintf("%02d0", i))
+		for j := 0; j < 3; j++ {
+			if err := d.Compact(start, end); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	numFiles := func(level int) int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.mu.versions.currentVersion().files[level])
+	}
+	if n := numFiles(3); n != 10 {
+		t.Fatalf("expected 10 tables in L3, but found %d", n)
+	}
+
+	if err := d.CompactWithinLevel(3); err != nil {
+		t.Fatal(err)
+	}
+	if n := numFiles(3); n != 1 {
+		t.Fatalf("expected 1 table in L3, but found %d", n)
+	}
+	for level := 0; level < numLevels; level++ {
+		if n := numFiles(level); level != 3 && n != 0 {
+			t.Fatalf("expected no tables in L%d, but found %d", level, n)
+		}
+	}
+
+	var keys []string
+	iter := d.NewIter(nil)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if string(iter.Key()) != string(iter.Value()) {
+			t.Fatalf("%s: unexpected value %s", iter.Key(), iter.Value())
+		}
+		keys = append(keys, string(iter.Key()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e, f := strings.Join(expected, " "), strings.Join(keys, " "); e != f {
+		t.Fatalf("expected %s, but found %s", e, f)
+	}
+
+	// There is no longer a run of small tables to compact.
+	if err := d.CompactWithinLevel(3); err != nil {
+		t.Fatal(err)
+	}
+	if n := numFiles(3); n != 1 {
+		t.Fatalf("expected 1 table in L3, but found %d", n)
+	}
+	if err := d.CompactWithinLevel(0); err == nil {
+		t.Fatalf("expected an error compacting within L0")
+	}
+}
+
+func TestMinLevelForFilters(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		Levels: []db.LevelOptions{{
+			FilterPolicy: bloom.FilterPolicy(10),
+		}},
+		MinLevelForFilters: numLevels - 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		if err := d.Set(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// checkFilter verifies that the single table in the given level has a
+	// filter if and only if expected is true, and that its keys can be read.
+	checkFilter := func(level int, expected bool) {
+		t.Helper()
+		d.mu.Lock()
+		files := d.mu.versions.currentVersion().files[level]
+		d.mu.Unlock()
+		if len(files) != 1 {
+			t.Fatalf("expected 1 table in L%d, but found %d", level, len(files))
+		}
+		f, err := d.opts.Storage.Open(dbFilename(d.dirname, fileTypeTable, files[0].fileNum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := sstable.NewReader(f, files[0].fileNum, nil)
+		if name := r.Properties.FilterPolicyName; (name != "") != expected {
+			t.Fatalf("L%d: expected filter %t, but found filter policy %q", level, expected, name)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"000", "050", "099"} {
+			if v, err := d.Get([]byte(key)); err != nil || string(v) != key {
+				t.Fatalf("L%d: expected %s, but found %s (%v)", level, key, v, err)
+			}
+		}
+		if _, err := d.Get([]byte("100")); err != db.ErrNotFound {
+			t.Fatalf("L%d: expected not found, but found %v", level, err)
+		}
+	}
+	checkFilter(0, false)
+
+	// Each manual compaction moves the table down one level.
+	for level := 1; level < numLevels; level++ {
+		if err := d.Compact([]byte("000"), []byte("100")); err != nil {
+			t.Fatal(err)
+		}
+		checkFilter(level, level == numLevels-1)
+	}
+}
+
+// renamedFilterPolicy is a filter policy which writes the filters of another
+// policy under a different name.
+type renamedFilterPolicy struct {
+	db.FilterPolicy
+	name string
+}
+
+func (p renamedFilterPolicy) Name() string {
+	return p.name
+}
+
+func TestRebuildFilters(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		Storage: mem,
+		Levels: []db.LevelOptions{{
+			FilterPolicy: renamedFilterPolicy{bloom.FilterPolicy(10), "test.old"},
+		}},
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Place a table in L2 and another in L1.
+	for _, prefix := range []string{"a", "b"} {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("%s%03d", prefix, i))
+			if err := d.Set(key, key, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		for level := 1; level <= 2; level++ {
+			if prefix == "b" && level == 2 {
+				break
+			}
+			if err := d.Compact([]byte(prefix), []byte(prefix+"999")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// filterPolicies returns the filter policies of the tables, by level.
+	filterPolicies := func(d *DB) string {
+		d.mu.Lock()
+		current := d.mu.versions.currentVersion()
+		current.ref()
+		d.mu.Unlock()
+		defer current.unref()
+		var buf bytes.Buffer
+		for level := range current.files {
+			for i := range current.files[level] {
+				err := d.tableCache.withReader(&current.files[level][i], func(r *sstable.Reader) error {
+					fmt.Fprintf(&buf, "L%d:%s ", level, r.Properties.FilterPolicyName)
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return strings.TrimSpace(buf.String())
+	}
+
+	for _, rebuild := range []bool{false, true} {
+		d, err = Open("", &db.Options{
+			Storage: mem,
+			Levels: []db.LevelOptions{{
+				FilterPolicy: bloom.FilterPolicy(10),
+			}},
+			RebuildFilters: rebuild,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "L1:test.old L2:test.old"
+		if rebuild {
+			name := bloom.FilterPolicy(10).Name()
+			expected = "L1:" + name + " L2:" + name
+		}
+		err := try(time.Millisecond, 10*time.Second, func() error {
+			if s := filterPolicies(d); s != expected {
+				return fmt.Errorf("expected %s, but found %s", expected, s)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("rebuild=%t: %v", rebuild, err)
+		}
+		for _, key := range []string{"a000", "a099", "b050"} {
+			if v, err := d.Get([]byte(key)); err != nil || string(v) != key {
+				t.Fatalf("expected %s, but found %s (%v)", key, v, err)
+			}
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompactToFile(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: mem,
+		Levels: []db.LevelOptions{{
+			Compression:    db.NoCompression,
+			TargetFileSize: 1024,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Write several versions of the keys spread across the levels and the
+	// memtable.
+	value := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		if err := d.Set(key, value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact([]byte("000"), []byte("100")); err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]string)
+	for i := 0; i < 100; i += 2 {
+		key := fmt.Sprintf("%03d", i)
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = key
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i += 3 {
+		key := fmt.Sprintf("%03d", i)
+		if err := d.Delete([]byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, key)
+	}
+	for i := 1; i < 100; i += 2 {
+		if key := fmt.Sprintf("%03d", i); expected[key] == "" && i%3 != 0 {
+			expected[key] = string(value)
+		}
+	}
+
+	const start, end = "010", "090"
+	if err := d.CompactToFile([]byte(start), []byte(end), "export"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := mem.Open("export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := sstable.NewReader(f, 0, nil)
+	defer r.Close()
+	var n int
+	iter := r.NewIter(nil)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		key := iter.Key()
+		if key.SeqNum() != 0 || key.Kind() != db.InternalKeyKindSet {
+			t.Fatalf("expected a set with sequence number 0, but found %s", key)
+		}
+		k := string(key.UserKey)
+		if k < start || k >= end {
+			t.Fatalf("unexpected key %s outside of [%s,%s)", k, start, end)
+		}
+		if v := expected[k]; v != string(iter.Value()) {
+			t.Fatalf("%s: expected %q, but found %q", k, v, iter.Value())
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var expectedN int
+	for k := range expected {
+		if k >= start && k < end {
+			expectedN++
+		}
+	}
+	if n != expectedN {
+		t.Fatalf("expected %d keys, but found %d", expectedN, n)
+	}
+	if size := r.Properties.DataSize; size <= 1024 {
+		t.Fatalf("expected a table larger than the target file size, but found %d bytes", size)
+	}
+}
+
+func TestCompactionRetainVersions(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:        storage.NewMem(),
+		RetainVersions: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Write five versions of "a" to two overlapping tables, which prevents the
+	// compaction from trivially moving a single table.
+	for i := 0; i < 5; i++ {
+		if err := d.Set([]byte("a"), []byte(fmt.Sprintf("a%d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 || i == 4 {
+			if err := d.Set([]byte("b"), []byte(fmt.Sprintf("b%d", i)), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := d.Compact([]byte("a"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	n := len(current.files[0])
+	d.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected the L0 tables to be compacted, but found %d", n)
+	}
+
+	var found []string
+	iter := d.NewStreamIter()
+	for valid := iter.First(); valid; valid = iter.Next() {
+		e := iter.Event()
+		found = append(found, fmt.Sprintf("%s#%d:%s", e.Key.UserKey, e.Key.SeqNum(), e.Value))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "a#5:a4 a#4:a3 a#2:a2 b#6:b4 b#3:b2"
+	if s := strings.Join(found, " "); expected != s {
+		t.Fatalf("expected %s, but found %s", expected, s)
+	}
+
+	// The newest version is visible to reads.
+	if v, err := d.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "a4" {
+		t.Fatalf("expected a4, but found %s", v)
+	}
+}
+
+// corruptingStorage wraps a Storage, flipping the first byte written to each
+// table created while corrupt is non-zero.
+type corruptingStorage struct {
+	storage.Storage
+	corrupt int32
+}
+
+func (fs *corruptingStorage) Create(name string) (storage.File, error) {
+	f, err := fs.Storage.Create(name)
+	if err != nil || !strings.HasSuffix(name, ".sst") || atomic.LoadInt32(&fs.corrupt) == 0 {
+		return f, err
+	}
+	return &corruptingFile{File: f}, nil
+}
+
+type corruptingFile struct {
+	storage.File
+	done bool
+}
+
+func (f *corruptingFile) Write(p []byte) (int, error) {
+	if !f.done && len(p) > 0 {
+		f.done = true
+		p = append([]byte(nil), p...)
+		p[0] ^= 0xff
+	}
+	return f.File.Write(p)
+}
+
+func TestCompactionVerifyOutputs(t *testing.T) {
+	fs := &corruptingStorage{Storage: storage.NewMem()}
+	d, err := Open("", &db.Options{
+		Storage:                 fs,
+		VerifyCompactionOutputs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Two overlapping tables in L0 are merged by the compaction, rather than
+	// moved.
+	for j := 0; j < 2; j++ {
+		for i := j; i < 100; i += 2 {
+			key := []byte(fmt.Sprintf("%03d", i))
+			if err := d.Set(key, key, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tables := func() (string, []string) {
+		d.mu.Lock()
+		s := d.mu.versions.currentVersion().String()
+		d.mu.Unlock()
+		ls, err := fs.List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, name := range ls {
+			if strings.HasSuffix(name, ".sst") {
+				files = append(files, name)
+			}
+		}
+		sort.Strings(files)
+		return s, files
+	}
+	version, files := tables()
+
+	// A corrupt output fails verification, aborting the compaction. The output
+	// is removed and the input is retained.
+	atomic.StoreInt32(&fs.corrupt, 1)
+	err = d.Compact([]byte("000"), []byte("100"))
+	if err == nil || !strings.Contains(err.Error(), "failed verification") {
+		t.Fatalf("expected verification failure, but found %v", err)
+	}
+	if v, f := tables(); v != version || strings.Join(f, " ") != strings.Join(files, " ") {
+		t.Fatalf("expected\n%s%s\nbut found\n%s%s", version, files, v, f)
+	}
+	if v, err := d.Get([]byte("050")); err != nil || string(v) != "050" {
+		t.Fatalf("expected 050, but found %s (%v)", v, err)
+	}
+
+	// A valid output passes verification.
+	atomic.StoreInt32(&fs.corrupt, 0)
+	if err := d.Compact([]byte("000"), []byte("100")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := tables(); v == version {
+		t.Fatalf("expected the compaction to be committed")
+	}
+	if v, err := d.Get([]byte("050")); err != nil || string(v) != "050" {
+		t.Fatalf("expected 050, but found %s (%v)", v, err)
+	}
+}
+
+func TestCompactionTombstoneDensity(t *testing.T) {
+	for _, threshold := range []float64{0, 0.5} {
+		t.Run(fmt.Sprint(threshold), func(t *testing.T) {
+			d, err := Open("", &db.Options{
+				Storage:                   storage.NewMem(),
+				TombstoneDensityThreshold: threshold,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			// L0 holds a table of sets, and a table which deletes most of them.
+			// Neither is large enough for L0 to exceed its size target.
+			key := func(i int) []byte {
+				return []byte(fmt.Sprintf("%03d", i))
+			}
+			for i := 0; i < 100; i++ {
+				if err := d.Set(key(i), key(i), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 10; i < 100; i++ {
+				if err := d.Delete(key(i), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			// layout returns the number of tables in each level and the number
+			// of deletions they hold.
+			layout := func() string {
+				d.mu.Lock()
+				current := d.mu.versions.currentVersion()
+				current.ref()
+				d.mu.Unlock()
+				defer current.unref()
+				var buf bytes.Buffer
+				var deletions uint64
+				for level := range current.files {
+					if n := len(current.files[level]); n > 0 {
+						fmt.Fprintf(&buf, "L%d:%d ", level, n)
+					}
+					for i := range current.files[level] {
+						err := d.tableCache.withReader(&current.files[level][i], func(r *sstable.Reader) error {
+							deletions += r.Properties.NumDeletions
+							return nil
+						})
+						if err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+				fmt.Fprintf(&buf, "deletions:%d", deletions)
+				return buf.String()
+			}
+
+			if threshold == 0 {
+				// No compaction is scheduled, as L0 is under its size target.
+				d.mu.Lock()
+				compacting := d.mu.compact.compacting
+				d.mu.Unlock()
+				if compacting {
+					t.Fatalf("expected no compaction")
+				}
+				if s := layout(); s != "L0:2 deletions:90" {
+					t.Fatalf("expected L0:2 deletions:90, but found %s", s)
+				}
+				return
+			}
+
+			// The table of deletions is marked for compaction, which compacts
+			// L0 and drops the tombstones.
+			err = try(time.Millisecond, 10*time.Second, func() error {
+				if s := layout(); s != "L1:1 deletions:0" {
+					return fmt.Errorf("expected L1:1 deletions:0, but found %s", s)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				v, err := d.Get(key(i))
+				if i < 10 && (err != nil || !bytes.Equal(v, key(i))) {
+					t.Fatalf("%s: expected %s, but found %s (%v)", key(i), key(i), v, err)
+				}
+				if i >= 10 && err != db.ErrNotFound {
+					t.Fatalf("%s: expected not found, but found %s (%v)", key(i), v, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFlushMaxFlushLevel(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:       storage.NewMem(),
+		MaxFlushLevel: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// layout returns the user key bounds of the tables in each level.
+	layout := func() string {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		current := d.mu.versions.currentVersion()
+		var buf bytes.Buffer
+		for level := range current.files {
+			for _, f := range current.files[level] {
+				fmt.Fprintf(&buf, "L%d:%s-%s ", level, f.smallest.UserKey, f.largest.UserKey)
+			}
+		}
+		return strings.TrimSpace(buf.String())
+	}
+	load := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Data which overlaps no table is flushed into the deepest permitted level.
+	load("a", "b", "c")
+	if s := layout(); s != "L4:a-c" {
+		t.Fatalf("expected L4:a-c, but found %s", s)
+	}
+	load("x", "y")
+	if s := layout(); s != "L4:a-c L4:x-y" {
+		t.Fatalf("expected L4:a-c L4:x-y, but found %s", s)
+	}
+	// Data overlapping a table is flushed into the level above it.
+	load("b", "d")
+	if s := layout(); s != "L3:b-d L4:a-c L4:x-y" {
+		t.Fatalf("expected L3:b-d L4:a-c L4:x-y, but found %s", s)
+	}
+	load("c")
+	if s := layout(); s != "L2:c-c L3:b-d L4:a-c L4:x-y" {
+		t.Fatalf("expected L2:c-c L3:b-d L4:a-c L4:x-y, but found %s", s)
+	}
+
+	for _, k := range []string{"a", "b", "c", "d", "x", "y"} {
+		v, err := d.Get([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != k {
+			t.Fatalf("%s: expected %s, but found %s", k, k, v)
+		}
+	}
+}
+
+// manifestSyncBlockingStorage blocks the syncs of the manifest while block is
+// set, signaling blocked and waiting for unblock.
+type manifestSyncBlockingStorage struct {
+	storage.Storage
+	block   int32
+	blocked chan struct{}
+	unblock chan struct{}
+}
+
+func (fs *manifestSyncBlockingStorage) Create(name string) (storage.File, error) {
+	f, err := fs.Storage.Create(name)
+	if err != nil || !strings.Contains(name, "MANIFEST") {
+		return f, err
+	}
+	return &manifestSyncBlockingFile{File: f, fs: fs}, nil
+}
+
+type manifestSyncBlockingFile struct {
+	storage.File
+	fs *manifestSyncBlockingStorage
+}
+
+func (f *manifestSyncBlockingFile) Sync() error {
+	if atomic.CompareAndSwapInt32(&f.fs.block, 1, 0) {
+		f.fs.blocked <- struct{}{}
+		<-f.fs.unblock
+	}
+	return f.File.Sync()
+}
+
+func TestFlushMaxFlushLevelHoldsCompaction(t *testing.T) {
+	fs := &manifestSyncBlockingStorage{
+		Storage: storage.NewMem(),
+		blocked: make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+	var begun int32
+	d, err := Open("", &db.Options{
+		Storage:       fs,
+		MaxFlushLevel: 4,
+		EventListener: &db.EventListener{
+			CompactionBegin: func(db.CompactionInfo) {
+				atomic.StoreInt32(&begun, 1)
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, k := range []string{"x", "a"} {
+		if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+		if k == "x" {
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	atomic.StoreInt32(&fs.block, 1)
+	flushErr := make(chan error, 1)
+	go func() {
+		flushErr <- d.Flush()
+	}()
+	<-fs.blocked
+
+	// The flush is persisting its version edit, with the mutex dropped. A
+	// compaction requested meanwhile is held off until the edit has been
+	// applied, as it would not see the flushed table. The compacted range
+	// does not overlap the flushed memtable, which it would otherwise wait
+	// for.
+	compactErr := make(chan error, 1)
+	go func() {
+		compactErr <- d.Compact([]byte("x"), []byte("y"))
+	}()
+	if err := try(100*time.Microsecond, 20*time.Second, func() error {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if len(d.mu.compact.manual) == 0 && atomic.LoadInt32(&begun) == 0 {
+			return fmt.Errorf("expected the manual compaction to be queued")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	begunDuringFlush := atomic.LoadInt32(&begun) != 0
+
+	close(fs.unblock)
+	if err := <-flushErr; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-compactErr; err != nil {
+		t.Fatal(err)
+	}
+	if begunDuringFlush {
+		t.Fatalf("expected the compaction to wait for the flush")
+	}
+	if atomic.LoadInt32(&begun) == 0 {
+		t.Fatalf("expected the compaction to run once the flush was applied")
+	}
+}
+
+func TestCompactionOutputChecksums(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		CompactionOutputChecksums: true,
+		Storage:                   mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Create two overlapping L0 tables, which are written without checksums,
+	// and compact them into L1.
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 100; j++ {
+			key := []byte(fmt.Sprintf("%03d", j))
+			if err := d.Set(key, []byte(fmt.Sprint(i)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact([]byte("000"), []byte("999")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Decode the version edits logged to the manifest.
+	checksums := make(map[uint64]uint32)
+	d.mu.Lock()
+	manifestFileNum := d.mu.versions.manifestFileNumber
+	d.mu.Unlock()
+	f, err := mem.Open(dbFilename("", fileTypeManifest, manifestFileNum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rr := record.NewReader(f)
+	for {
+		r, err := rr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var ve versionEdit
+		if err := ve.decode(r); err != nil {
+			t.Fatal(err)
+		}
+		for _, nf := range ve.newFiles {
+			if nf.meta.hasChecksum {
+				checksums[nf.meta.fileNum] = nf.meta.checksum
+			}
+		}
+	}
+
+	d.mu.Lock()
+	files := d.mu.versions.currentVersion().files[1]
+	d.mu.Unlock()
+	if len(files) == 0 {
+		t.Fatalf("expected compaction output in L1")
+	}
+	for _, meta := range files {
+		checksum, ok := checksums[meta.fileNum]
+		if !ok {
+			t.Fatalf("%d: expected the table to be recorded in the manifest with a checksum", meta.fileNum)
+		}
+		if !meta.hasChecksum || checksum != meta.checksum {
+			t.Fatalf("%d: expected a recorded checksum of %08x, but found %08x", meta.fileNum, meta.checksum, checksum)
+		}
+		f, err := mem.Open(dbFilename("", fileTypeTable, meta.fileNum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(len(b)) != meta.size {
+			t.Fatalf("%d: expected %d bytes, but found %d", meta.fileNum, meta.size, len(b))
+		}
+		if c := crc.New(b).Value(); c != checksum {
+			t.Fatalf("%d: expected a checksum of %08x, but the file has a checksum of %08x", meta.fileNum, checksum, c)
+		}
+	}
+}
+
+func TestCompactionLatencyGuard(t *testing.T) {
+	open := func(t *testing.T, idleInterval time.Duration) *DB {
+		d, err := Open("", &db.Options{
+			CompactionLatencyGuard: &db.CompactionLatencyGuard{
+				SLO:          10 * time.Millisecond,
+				Hysteresis:   5 * time.Millisecond,
+				IdleInterval: idleInterval,
+			},
+			L0CompactionThreshold: 2,
+			Storage:               storage.NewMem(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	numL0 := func(d *DB) int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.mu.versions.currentVersion().files[0])
+	}
+	// spike simulates a foreground latency spike, and then creates two
+	// overlapping L0 tables, which need to be compacted.
+	spike := func(t *testing.T, d *DB) {
+		for i := 0; i < 100; i++ {
+			d.recordLatency(50 * time.Millisecond)
+		}
+		for i := 0; i < 2; i++ {
+			for _, k := range []string{"a", "b"} {
+				if err := d.Set([]byte(k), []byte(fmt.Sprint(i)), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expectPaused := func(t *testing.T, d *DB) {
+		time.Sleep(20 * time.Millisecond)
+		if n := numL0(d); n != 2 {
+			t.Fatalf("expected compactions to be paused with 2 L0 tables, but found %d", n)
+		}
+		if m := d.Metrics(); !m.Compact.LatencyPaused || m.Compact.LatencyPauseCount != 1 {
+			t.Fatalf("expected compactions to be paused once, but found paused=%t count=%d",
+				m.Compact.LatencyPaused, m.Compact.LatencyPauseCount)
+		}
+	}
+	expectResumed := func(t *testing.T, d *DB) {
+		for start := time.Now(); numL0(d) != 0; time.Sleep(time.Millisecond) {
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("expected compactions to resume, but found %d L0 tables", numL0(d))
+			}
+		}
+		if m := d.Metrics(); m.Compact.LatencyPaused {
+			t.Fatalf("expected compactions to be resumed")
+		}
+	}
+
+	t.Run("recovery", func(t *testing.T) {
+		d := open(t, time.Hour)
+		defer d.Close()
+		spike(t, d)
+		expectPaused(t, d)
+		if l := d.Metrics().Compact.ForegroundLatency; l <= 10*time.Millisecond {
+			t.Fatalf("expected a foreground latency above the SLO, but found %s", l)
+		}
+
+		// A latency within the hysteresis band does not resume compactions.
+		for i := 0; i < 100; i++ {
+			d.recordLatency(7 * time.Millisecond)
+		}
+		expectPaused(t, d)
+
+		// A latency below the band does.
+		for i := 0; i < 100; i++ {
+			d.recordLatency(time.Millisecond)
+		}
+		expectResumed(t, d)
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		// Compactions resume once the foreground operations cease.
+		d := open(t, 10*time.Millisecond)
+		defer d.Close()
+		spike(t, d)
+		if n := numL0(d); n != 2 {
+			t.Fatalf("expected compactions to be paused with 2 L0 tables, but found %d", n)
+		}
+		expectResumed(t, d)
+	})
+}
+
+func TestCompactionValueBlockDedup(t *testing.T) {
+	// The flushed tables in L0 store every value, and the tables written by
+	// compactions into lower levels dedup the values.
+	d, err := Open("", &db.Options{
+		Levels: []db.LevelOptions{
+			{ValueBlockThreshold: 64},
+			{ValueBlockThreshold: 64, ValueBlockDedup: 16},
+		},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The keys share a handful of large, incompressible values, which span
+	// many value blocks.
+	rng := rand.New(rand.NewSource(0))
+	values := make([][]byte, 8)
+	for i := range values {
+		values[i] = make([]byte, 1000)
+		rng.Read(values[i])
+	}
+	const n = 500
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%04d", i))
+	}
+	value := func(i int) []byte {
+		return values[i%len(values)]
+	}
+
+	// Create two overlapping L0 tables and compact them.
+	for j := 0; j < 2; j++ {
+		for i := 0; i < n; i++ {
+			if err := d.Set(key(i), value(i+1-j), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each L0 table holds one version of each key.
+	tableSize := d.Metrics().Levels[0].Size / 2
+	if err := d.Compact(key(0), key(n)); err != nil {
+		t.Fatal(err)
+	}
+	m := d.Metrics()
+	if m.Levels[0].NumFiles != 0 {
+		t.Fatalf("expected L0 to be compacted, but found %d tables", m.Levels[0].NumFiles)
+	}
+	var size uint64
+	for level := 1; level < numLevels; level++ {
+		size += m.Levels[level].Size
+	}
+	if size >= tableSize/10 {
+		t.Fatalf("expected compaction output size (%d) to be less than a tenth of %d", size, tableSize)
+	}
+
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	d.mu.Unlock()
+	var dedups uint64
+	for level := 1; level < numLevels; level++ {
+		files := current.files[level]
+		for i := range files {
+			err := d.tableCache.withReader(&files[i], func(r *sstable.Reader) error {
+				dedups += r.Properties.NumValueDedups
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if dedups < n-uint64(len(values)) {
+		t.Fatalf("expected at least %d deduped values, but found %d", n-len(values), dedups)
+	}
+
+	// The deduped values read back correctly, forward, backward and by key.
+	iter := d.NewIter(nil)
+	i := 0
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if !bytes.Equal(iter.Key(), key(i)) || !bytes.Equal(iter.Value(), value(i)) {
+			t.Fatalf("%s: unexpected value for %s", key(i), iter.Key())
+		}
+		i++
+	}
+	if i != n {
+		t.Fatalf("expected %d keys, but found %d", n, i)
+	}
+	for valid := iter.Last(); valid; valid = iter.Prev() {
+		i--
+		if !bytes.Equal(iter.Key(), key(i)) || !bytes.Equal(iter.Value(), value(i)) {
+			t.Fatalf("%s: unexpected value for %s", key(i), iter.Key())
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 7, 8, 250, n - 1} {
+		v, err := d.Get(key(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, value(i)) {
+			t.Fatalf("%s: unexpected value", key(i))
+		}
+	}
+}
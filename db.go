@@ -6,6 +6,7 @@
 package pebble // import "github.com/petermattis/pebble"
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -16,6 +17,7 @@ import (
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/arenaskl"
 	"github.com/petermattis/pebble/internal/record"
+	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/storage"
 )
 
@@ -127,9 +129,12 @@ type DB struct {
 	equal     db.Equal
 	merge     db.Merge
 	inlineKey db.InlineKey
+	// abbreviatedKey is used by the merging iterator of DB iterators.
+	abbreviatedKey db.AbbreviatedKey
 
-	tableCache tableCache
-	newIters   tableNewIters
+	tableCache  tableCache
+	newIters    tableNewIters
+	newGetIters tableNewIters
 
 	commit   *commitPipeline
 	fileLock io.Closer
@@ -147,6 +152,10 @@ type DB struct {
 	compactController *controller
 	flushController   *controller
 
+	// latencyGuard, if non-nil, pauses the automatic compactions during
+	// foreground latency spikes. See db.Options.CompactionLatencyGuard.
+	latencyGuard *latencyGuard
+
 	// TODO(peter): describe exactly what this mutex protects. So far: every
 	// field in the struct.
 	mu struct {
@@ -154,11 +163,17 @@ type DB struct {
 
 		closed    bool
 		nextJobID int
+		// deferred is set while a DB opened by the fast path for empty DBs has
+		// not been written to disk. See db.Options.FastOpenEmpty.
+		deferred bool
 
 		versions versionSet
 
 		log struct {
 			number uint64
+			// size is the number of bytes written to the log. See
+			// Options.MaxWALSize.
+			size int64
 			*record.LogWriter
 		}
 
@@ -182,6 +197,22 @@ type DB struct {
 			compacting     bool
 			pendingOutputs map[uint64]struct{}
 			manual         []*manualCompaction
+			// latencyTimer is the pending idle check of the latency guard, if
+			// any.
+			latencyTimer *time.Timer
+			// rebuildFilters is set while some tables have not been checked for
+			// a filter written with a different policy than the one configured
+			// for their level. filtersChecked holds the file numbers of the
+			// tables which have been. See Options.RebuildFilters.
+			rebuildFilters bool
+			filtersChecked map[uint64]struct{}
+		}
+
+		// writeStall holds the number of writes stalled by makeRoomForWrite and
+		// the cumulative duration of the stalls.
+		writeStall struct {
+			count    int64
+			duration time.Duration
 		}
 
 		// The list of active snapshots.
@@ -198,10 +229,102 @@ var _ Writer = (*DB)(nil)
 // The caller should not modify the contents of the returned slice, but it is
 // safe to modify the contents of the argument after Get returns.
 func (d *DB) Get(key []byte) ([]byte, error) {
-	return d.getInternal(key, nil /* batch */, nil /* snapshot */)
+	return d.getInternal(key, nil /* batch */, nil /* snapshot */, nil /* opts */)
+}
+
+// GetWithContext is like Get, but the lookup is abandoned once ctx is done,
+// returning the context error. The context is checked before each table and
+// data block is read, so a lookup is abandoned without waiting for the reads
+// of the tables it has yet to consult.
+func (d *DB) GetWithContext(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.getInternal(key, nil /* batch */, nil /* snapshot */, &db.IterOptions{Context: ctx})
+}
+
+// GetWithOptions is like Get, but reads the DB with the given options. Only
+// the options which apply to the lookup of a single key are honored: Context,
+// as for GetWithContext, and DisableChecksums. The other options, such as the
+// bounds, are ignored.
+func (d *DB) GetWithOptions(key []byte, opts *db.IterOptions) ([]byte, error) {
+	if ctx := opts.GetContext(); ctx != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return d.getInternal(key, nil /* batch */, nil /* snapshot */, opts)
+}
+
+// KV is a key/value pair returned by GetRange and Iterator.NextN.
+type KV struct {
+	Key   []byte
+	Value []byte
 }
 
-func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, error) {
+// GetRange returns the key/value pairs in the range [start,end) in sorted
+// order. At most maxCount pairs are returned, and the pairs stop once the
+// total size of their keys and values reaches maxBytes, so the last pair may
+// take the size past maxBytes. A limit of zero is unlimited.
+//
+// The returned keys and values are copies which the caller may modify. For
+// large ranges, prefer iterating with NewIter.
+func (d *DB) GetRange(start, end []byte, maxCount, maxBytes int) ([]KV, error) {
+	iter := d.NewIter(&db.IterOptions{
+		LowerBound: start,
+		UpperBound: end,
+	})
+	var kvs []KV
+	var size int
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if maxCount > 0 && len(kvs) >= maxCount {
+			break
+		}
+		if maxBytes > 0 && size >= maxBytes {
+			break
+		}
+		key, value := iter.Key(), iter.Value()
+		buf := make([]byte, len(key)+len(value))
+		copy(buf, key)
+		copy(buf[len(key):], value)
+		kvs = append(kvs, KV{Key: buf[:len(key):len(key)], Value: buf[len(key):]})
+		size += len(buf)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return kvs, nil
+}
+
+// MultiGet gets the values for the given keys, as of a single point in time.
+// The value and error for keys[i] are returned in values[i] and errs[i], where
+// the error is ErrNotFound if the DB does not contain the key. Each key is
+// looked up independently, so an error reading a table, such as a corrupt
+// block, only fails the keys whose lookup needed the table while the other
+// keys return their values.
+//
+// The caller should not modify the contents of the returned values, but it is
+// safe to modify the contents of the keys after MultiGet returns.
+func (d *DB) MultiGet(keys [][]byte) (values [][]byte, errs []error) {
+	s := d.NewSnapshot()
+	defer s.Close()
+	values = make([][]byte, len(keys))
+	errs = make([]error, len(keys))
+	for i := range keys {
+		values[i], errs[i] = s.Get(keys[i])
+	}
+	return values, errs
+}
+
+func (d *DB) getInternal(
+	key []byte, b *Batch, s *Snapshot, opts *db.IterOptions,
+) ([]byte, error) {
+	if d.latencyGuard != nil {
+		start := time.Now()
+		defer func() {
+			d.recordLatency(time.Since(start))
+		}()
+	}
 	var seqNum uint64
 	d.mu.Lock()
 	if s != nil {
@@ -218,14 +341,25 @@ func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, error) {
 	d.mu.Unlock()
 
 	var buf struct {
-		dbi Iterator
-		get getIter
+		dbi  Iterator
+		get  getIter
+		opts db.IterOptions
 	}
 
 	get := &buf.get
 	get.cmp = d.cmp
 	get.equal = d.equal
-	get.newIters = d.newIters
+	get.newIters = d.newGetIters
+	// Only the options which apply to the lookup of a single key are passed to
+	// the tables. A context which can never be canceled is not checked.
+	if ctx := opts.GetContext(); ctx != nil && ctx.Done() != nil {
+		buf.opts.Context = ctx
+		get.opts = &buf.opts
+	}
+	if opts.GetDisableChecksums() {
+		buf.opts.DisableChecksums = true
+		get.opts = &buf.opts
+	}
 	get.snapshot = seqNum
 	get.key = key
 	get.batch = b
@@ -248,6 +382,10 @@ func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, error) {
 		}
 		return nil, db.ErrNotFound
 	}
+	if d.opts.CacheAllocator != nil {
+		// The block holding the value may be freed once the iterator is closed.
+		return append([]byte(nil), i.Value()...), nil
+	}
 	return i.Value(), nil
 }
 
@@ -285,6 +423,21 @@ func (d *DB) DeleteRange(start, end []byte, opts *db.WriteOptions) error {
 	return d.Apply(b, opts)
 }
 
+// DeletePrefix deletes all of the keys (and values) which have the specified
+// prefix. The range tombstone end key is computed using
+// Comparer.RangeEndSentinel.
+//
+// It is safe to modify the contents of the arguments after DeletePrefix
+// returns.
+func (d *DB) DeletePrefix(prefix []byte, opts *db.WriteOptions) error {
+	b := newBatch(d)
+	defer b.release()
+	if err := b.DeletePrefix(prefix, opts); err != nil {
+		return err
+	}
+	return d.Apply(b, opts)
+}
+
 // Merge adds an action to the DB that merges the value at key with the new
 // value. The details of the merge are dependent upon the configured merge
 // operator.
@@ -304,8 +457,19 @@ func (d *DB) Merge(key, value []byte, opts *db.WriteOptions) error {
 //
 // It is safe to modify the contents of the arguments after Apply returns.
 func (d *DB) Apply(batch *Batch, opts *db.WriteOptions) error {
+	if d.latencyGuard != nil {
+		start := time.Now()
+		defer func() {
+			d.recordLatency(time.Since(start))
+		}()
+	}
 	if int(batch.memTableSize) >= d.largeBatchThreshold {
+		// The flushable batch retains the batch data, so the pending
+		// SetNoCopy arguments need to be copied into it.
+		batch.encodeNoCopy()
 		batch.flushable = newFlushableBatch(batch, d.opts.Comparer)
+	} else if t := d.opts.MemTableHugeValueThreshold; t > 0 {
+		batch.flushAfterCommit = batch.hasValueAtLeast(t)
 	}
 	err := d.commit.Commit(batch, opts.GetSync())
 	if err == nil {
@@ -332,7 +496,16 @@ func (d *DB) commitApply(b *Batch, mem *memTable) error {
 		d.maybeScheduleFlush()
 		d.mu.Unlock()
 	}
-	return nil
+	if b.flushAfterCommit {
+		// The batch contains a huge value. Flush the memtable unless it has
+		// already been rotated by a concurrent write.
+		d.mu.Lock()
+		if d.mu.mem.mutable == mem {
+			err = d.makeRoomForWrite(nil)
+		}
+		d.mu.Unlock()
+	}
+	return err
 }
 
 func (d *DB) commitSync() error {
@@ -369,10 +542,17 @@ func (d *DB) commitWrite(b *Batch) (*memTable, error) {
 		return d.mu.mem.mutable, nil
 	}
 
-	_, err := d.mu.log.WriteRecord(b.data)
+	var size int64
+	var err error
+	if len(b.noCopy) > 0 {
+		size, err = d.mu.log.WriteRecordParts(b.logParts())
+	} else {
+		size, err = d.mu.log.WriteRecord(b.data)
+	}
 	if err != nil {
 		panic(err)
 	}
+	d.mu.log.size = size
 	return d.mu.mem.mutable, err
 }
 
@@ -415,6 +595,13 @@ func (d *DB) newIterInternal(
 	dbi.equal = d.equal
 	dbi.merge = d.merge
 	dbi.version = current
+	dbi.copyValues = d.opts.CacheAllocator != nil
+	dbi.allVersions = o.GetAllVersions()
+	if o.GetLazyMerge() && !dbi.allVersions {
+		dbi.lazy = &LazyMergeValue{}
+	}
+	dbi.initPrefix(d.opts.Comparer.RangeEndSentinel, d.opts.PrefixExtractor)
+	dbi.initTenant()
 
 	iters := buf.iters[:0]
 	rangeDelIters := buf.rangeDelIters[:0]
@@ -435,7 +622,7 @@ func (d *DB) newIterInternal(
 	// The level 0 files need to be added from newest to oldest.
 	for i := len(current.files[0]) - 1; i >= 0; i-- {
 		f := &current.files[0][i]
-		iter, rangeDelIter, err := d.newIters(f)
+		iter, rangeDelIter, err := d.newIters(f, o)
 		if err != nil {
 			dbi.err = err
 			return dbi
@@ -475,8 +662,13 @@ func (d *DB) newIterInternal(
 		rangeDelIters = rangeDelIters[1:]
 	}
 
-	buf.merging.init(d.cmp, iters...)
+	buf.merging.init(d.cmp, d.abbreviatedKey, iters...)
 	buf.merging.snapshot = seqNum
+	buf.merging.checkOrdering = o.GetCheckKeyOrdering()
+	buf.merging.ctx = o.GetContext()
+	if o.GetCompareCache() {
+		buf.merging.enableCompareCache()
+	}
 	dbi.iter = &buf.merging
 	return dbi
 }
@@ -537,11 +729,30 @@ func (d *DB) Close() error {
 	if d.mu.closed {
 		return nil
 	}
+	if d.mu.deferred && !d.mu.mem.mutable.empty() {
+		// The writes to a DB opened by the fast path for empty DBs are
+		// persisted by a flush, which writes its manifest.
+		d.mu.Unlock()
+		err := d.Flush()
+		d.mu.Lock()
+		if err != nil {
+			return err
+		}
+	}
 	for d.mu.compact.compacting || d.mu.compact.flushing {
 		d.mu.compact.cond.Wait()
 	}
+	if t := d.mu.compact.latencyTimer; t != nil {
+		t.Stop()
+		d.mu.compact.latencyTimer = nil
+	}
 	err := d.tableCache.Close()
 	err = firstError(err, d.mu.log.Close())
+	if d.mu.deferred {
+		// A DB opened by the fast path for empty DBs which was never written to
+		// is left empty, as its WAL holds nothing to recover.
+		err = firstError(err, d.opts.Storage.Remove(dbFilename(d.dirname, fileTypeLog, d.mu.log.number)))
+	}
 	err = firstError(err, d.fileLock.Close())
 	d.commit.Close()
 	d.mu.closed = true
@@ -564,8 +775,57 @@ func (d *DB) Close() error {
 	return err
 }
 
+// WarmCache reads the data blocks of the tables overlapping the key range
+// [start,end) into the block cache so that subsequent reads of the range are
+// served from memory. The amount of data read is bounded by the size of the
+// cache, as loading more would only evict blocks loaded earlier. Values are not
+// returned and the memtables are not consulted. Does nothing if the DB is
+// configured without a cache.
+func (d *DB) WarmCache(start, end []byte) error {
+	budget := d.opts.Cache.MaxSize()
+	if budget == 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	current.ref()
+	d.mu.Unlock()
+	defer current.unref()
+
+	for level := 0; level < numLevels && budget > 0; level++ {
+		files := current.overlaps(level, d.cmp, start, end)
+		for i := range files {
+			err := d.tableCache.withReader(&files[i], func(r *sstable.Reader) error {
+				n, err := r.WarmCache(start, end, budget)
+				budget -= n
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Compact the specified range of keys in the database.
 func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
+	return d.compactRange(start, end, nil)
+}
+
+// CompactWithFilters compacts the specified range of keys in the database as
+// Compact does, without merging the data blocks of the input tables whose
+// block properties do not intersect every filter. The point operations of
+// such a block are copied to the output unchanged, along with all of their
+// versions. Only the blocks of the input tables which no other input table
+// overlaps are filtered. The blocks of the other input tables are merged as by
+// Compact. See Options.BlockPropertyCollectors.
+func (d *DB) CompactWithFilters(start, end []byte, filters []db.BlockPropertyFilter) error {
+	return d.compactRange(start, end, filters)
+}
+
+func (d *DB) compactRange(start, end []byte, filters []db.BlockPropertyFilter) error {
 	iStart := db.MakeInternalKey(start, db.InternalKeySeqNumMax, db.InternalKeyKindMax)
 	iEnd := db.MakeInternalKey(end, 0, 0)
 	meta := []*fileMetadata{&fileMetadata{smallest: iStart, largest: iEnd}}
@@ -609,10 +869,11 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 
 	for level := 0; level < maxLevelWithFiles; level++ {
 		manual := &manualCompaction{
-			done:  make(chan error, 1),
-			level: level,
-			start: iStart,
-			end:   iEnd,
+			done:    make(chan error, 1),
+			level:   level,
+			start:   iStart,
+			end:     iEnd,
+			filters: filters,
 		}
 		if err := d.manualCompact(manual); err != nil {
 			return err
@@ -621,6 +882,65 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 	return nil
 }
 
+// CompactWithinLevel merges the longest run of adjacent small tables in the
+// specified level into fewer tables of up to the target file size of the
+// level. The data is not moved to the next level. A table is small if it is
+// less than half of the target file size. Levels cluttered with many small
+// tables, such as from frequent flushes, can be compacted repeatedly to reduce
+// their number of tables. Level 0 tables overlap each other and cannot be
+// compacted within their level.
+func (d *DB) CompactWithinLevel(level int) error {
+	if level <= 0 || level >= numLevels {
+		return fmt.Errorf("pebble: invalid level %d for a compaction within a level", level)
+	}
+	return d.manualCompact(&manualCompaction{
+		done:       make(chan error, 1),
+		level:      level,
+		intraLevel: true,
+	})
+}
+
+// CompactToFile writes the live data in the key range [start,end) to a single
+// table at path, which is created using Options.Storage and is not part of
+// the DB. The data is fully resolved as by an Iterator: only the newest
+// version of each key is written, merge operands are combined and deleted
+// keys are elided. Every key is written as a set with a sequence number of
+// zero, using the options of the bottom level. The table is not split
+// regardless of the target file size, and is empty if the range contains no
+// data.
+func (d *DB) CompactToFile(start, end []byte, path string) (err error) {
+	file, err := d.opts.Storage.Create(path)
+	if err != nil {
+		return err
+	}
+	w := sstable.NewWriter(file, d.opts, d.opts.Level(numLevels-1))
+	defer func() {
+		if w != nil {
+			w.Close()
+		}
+		if err != nil {
+			d.opts.Storage.Remove(path)
+		}
+	}()
+
+	iter := d.NewIter(&db.IterOptions{
+		LowerBound: start,
+		UpperBound: end,
+	})
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if err := w.Set(iter.Key(), iter.Value()); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	err = w.Close()
+	w = nil
+	return err
+}
+
 func (d *DB) manualCompact(manual *manualCompaction) error {
 	d.mu.Lock()
 	d.mu.compact.manual = append(d.mu.compact.manual, manual)
@@ -642,6 +962,31 @@ func (d *DB) Flush() error {
 	return nil
 }
 
+// FormatMajorVersion returns the format version of the DB, as recorded in its
+// MANIFEST. See db.Options.MinFormatVersion.
+func (d *DB) FormatMajorVersion() db.FormatMajorVersion {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.mu.versions.formatVersion
+}
+
+// RangeTombstoneFragments returns the number of fragmented range deletion
+// tombstones currently held in memory by the memtables for iteration. See
+// Options.MaxRangeTombstoneFragments.
+func (d *DB) RangeTombstoneFragments() int {
+	d.mu.Lock()
+	queue := d.mu.mem.queue
+	d.mu.Unlock()
+
+	var n int
+	for _, f := range queue {
+		if m, ok := f.(*memTable); ok {
+			n += m.rangeDelFragments()
+		}
+	}
+	return n
+}
+
 // AsyncFlush asynchronously flushes the memtable to stable storage.
 //
 // TODO(peter): untested
@@ -668,14 +1013,34 @@ func (d *DB) throttleWrite() {
 	d.mu.Lock()
 }
 
+// stallWrite waits for a flush or compaction to make room for a write, and
+// records the stall in the write stall metrics. Stalled is set after the first
+// wait of a write, so that each stalled write is counted once.
+//
+// d.mu must be held when calling this.
+func (d *DB) stallWrite(stalled *bool) {
+	if !*stalled {
+		*stalled = true
+		d.mu.writeStall.count++
+	}
+	start := time.Now()
+	d.mu.compact.cond.Wait()
+	d.mu.writeStall.duration += time.Since(start)
+}
+
 func (d *DB) makeRoomForWrite(b *Batch) error {
-	force := b == nil || b.flushable != nil
+	// A log which has grown past Options.MaxWALSize is rotated by switching
+	// the memtable, which allows the log to be removed once the memtable has
+	// been flushed.
+	force := b == nil || b.flushable != nil ||
+		(d.opts.MaxWALSize > 0 && d.mu.log.size >= d.opts.MaxWALSize)
+	var stalled bool
 	for {
 		if d.mu.mem.switching {
 			d.mu.mem.cond.Wait()
 			continue
 		}
-		if b != nil && b.flushable == nil {
+		if b != nil && b.flushable == nil && !force {
 			err := d.mu.mem.mutable.prepare(b)
 			if err == nil {
 				return nil
@@ -690,13 +1055,13 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 			// We have filled up the current memtable, but the previous one is still
 			// being compacted, so we wait.
 			// fmt.Printf("memtable stop writes threshold\n")
-			d.mu.compact.cond.Wait()
+			d.stallWrite(&stalled)
 			continue
 		}
 		if len(d.mu.versions.currentVersion().files[0]) > d.opts.L0StopWritesThreshold {
 			// There are too many level-0 files, so we wait.
 			// fmt.Printf("L0 stop writes threshold\n")
-			d.mu.compact.cond.Wait()
+			d.stallWrite(&stalled)
 			continue
 		}
 
@@ -736,6 +1101,7 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		// have been applied.
 		if !d.opts.DisableWAL {
 			d.mu.log.number = newLogNumber
+			d.mu.log.size = 0
 			d.mu.log.LogWriter = record.NewLogWriter(newLogFile)
 		}
 		imm := d.mu.mem.mutable
@@ -0,0 +1,85 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package db
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ChangeRecord is a resolved record written by a compaction. The key contains
+// the sequence number and kind of the record.
+type ChangeRecord struct {
+	Key   InternalKey
+	Value []byte
+}
+
+// ChangeConsumer receives a copy of the resolved records written by
+// compactions, in the order they are written. This allows an external system,
+// such as a changefeed, to observe the logical stream of compaction output.
+//
+// The records of a compaction are copied as they are written, buffered in
+// memory, and sent once the compaction has been committed to the manifest,
+// table by table, with the point records of each table followed by its range
+// tombstones. The records of a compaction which fails are never sent, so a
+// compaction which is retried does not send its records twice. Delivery is at
+// most once: records are lost if the process exits between the commit of a
+// compaction and the sending of its records, and are otherwise only dropped
+// as described below. Trivial moves of tables to a lower level, which write
+// no records, send none.
+//
+// A slow consumer throttles compactions for at most MaxWait per record. If the
+// consumer does not keep up, records are dropped and counted rather than
+// blocking compactions indefinitely.
+type ChangeConsumer struct {
+	// dropped is updated atomically. It is the first field in the struct to
+	// ensure 64-bit alignment on 32-bit platforms.
+	dropped uint64
+
+	// C receives the records. The records are copies and may be retained by the
+	// consumer. The channel is never closed by pebble.
+	C chan ChangeRecord
+
+	// MaxWait is the maximum duration a compaction waits for space in C before
+	// dropping a record. A zero value drops records as soon as C is full.
+	MaxWait time.Duration
+}
+
+// Dropped returns the number of records which were dropped because the
+// consumer did not keep up.
+func (c *ChangeConsumer) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Send copies the specified record and pushes it to the consumer, waiting at
+// most MaxWait for the consumer to accept it. Returns false if the record was
+// dropped.
+func (c *ChangeConsumer) Send(key InternalKey, value []byte) bool {
+	return c.SendRecord(ChangeRecord{
+		Key:   key.Clone(),
+		Value: append([]byte(nil), value...),
+	})
+}
+
+// SendRecord is like Send, but pushes the record to the consumer without
+// copying it. The caller must not modify the record afterwards.
+func (c *ChangeConsumer) SendRecord(r ChangeRecord) bool {
+	select {
+	case c.C <- r:
+		return true
+	default:
+	}
+	if c.MaxWait > 0 {
+		t := time.NewTimer(c.MaxWait)
+		defer t.Stop()
+		select {
+		case c.C <- r:
+			return true
+		case <-t.C:
+		}
+	}
+	atomic.AddUint64(&c.dropped, 1)
+	return false
+}
@@ -27,6 +27,14 @@ type Equal func(a, b []byte) bool
 // determine if the two keys are actually equal.
 type InlineKey func(key []byte) uint64
 
+// AbbreviatedKey returns a fixed length prefix of a user key such that
+// AbbreviatedKey(a) < AbbreviatedKey(b) implies a < b and AbbreviatedKey(a) >
+// AbbreviatedKey(b) implies a > b. If AbbreviatedKey(a) == AbbreviatedKey(b)
+// an additional comparison is required to order the two keys. Abbreviated
+// keys allow most comparisons between keys to be resolved with a single
+// integer comparison, such as in the heap of a merging iterator.
+type AbbreviatedKey func(key []byte) uint64
+
 // Separator appends a sequence of bytes x to dst such that
 // a <= x && x < b, where 'less than' is consistent with Compare.
 // It returns the enlarged slice, like the built-in append function.
@@ -49,14 +57,23 @@ type Separator func(dst, a, b []byte) []byte
 // key, though it is valid to pass a nil.
 type Successor func(dst, a []byte) []byte
 
+// RangeEndSentinel returns the smallest key that is greater than every key
+// with the specified prefix, for use as the exclusive end key of a range
+// tombstone which deletes all of the keys with the prefix. Returns nil if no
+// such key exists (e.g. if the prefix consists solely of 0xff bytes for a
+// byte-wise ordering).
+type RangeEndSentinel func(prefix []byte) []byte
+
 // Comparer defines a total ordering over the space of []byte keys: a 'less
 // than' relationship.
 type Comparer struct {
-	Compare   Compare
-	Equal     Equal
-	InlineKey InlineKey
-	Separator Separator
-	Successor Successor
+	Compare          Compare
+	Equal            Equal
+	InlineKey        InlineKey
+	AbbreviatedKey   AbbreviatedKey
+	Separator        Separator
+	Successor        Successor
+	RangeEndSentinel RangeEndSentinel
 
 	// Name is the name of the comparer.
 	//
@@ -66,6 +83,22 @@ type Comparer struct {
 	Name string
 }
 
+// bytewiseAbbreviatedKey returns the first 8 bytes of the key as a big-endian
+// uint64. Shorter keys are padded with zero bytes, which preserves the
+// bytewise ordering.
+func bytewiseAbbreviatedKey(key []byte) uint64 {
+	var v uint64
+	n := 8
+	if n > len(key) {
+		n = len(key)
+	}
+	for _, b := range key[:n] {
+		v <<= 8
+		v |= uint64(b)
+	}
+	return v << uint(8*(8-n))
+}
+
 // DefaultComparer is the default implementation of the Comparer interface.
 // It uses the natural ordering, consistent with bytes.Compare.
 var DefaultComparer = &Comparer{
@@ -84,6 +117,7 @@ var DefaultComparer = &Comparer{
 		}
 		return v
 	},
+	AbbreviatedKey: bytewiseAbbreviatedKey,
 
 	Separator: func(dst, a, b []byte) []byte {
 		i, n := SharedPrefixLen(a, b), len(dst)
@@ -130,6 +164,17 @@ var DefaultComparer = &Comparer{
 		return append(dst, a...)
 	},
 
+	RangeEndSentinel: func(prefix []byte) []byte {
+		for i := len(prefix) - 1; i >= 0; i-- {
+			if prefix[i] != 0xff {
+				end := append([]byte(nil), prefix[:i+1]...)
+				end[i]++
+				return end
+			}
+		}
+		return nil
+	},
+
 	// This name is part of the C++ Level-DB implementation's default file
 	// format, and should not be changed.
 	Name: "leveldb.BytewiseComparator",
@@ -147,3 +192,23 @@ func SharedPrefixLen(a, b []byte) int {
 	}
 	return i
 }
+
+// PrefixExtractor extracts the prefix of a user key. Keys which share a prefix
+// must sort contiguously according to the Comparer.
+type PrefixExtractor struct {
+	// Extract returns the prefix of key. The returned prefix must be a prefix
+	// of key.
+	Extract func(key []byte) []byte
+
+	// PrefixEqual returns true if the prefixes a and b are equal. It is used as
+	// the stop condition for prefix iteration and is called for every key
+	// visited during a prefix scan. Extractors which produce fixed-length
+	// prefixes can use bytes.Equal, avoiding calls to an expensive Comparer.
+	//
+	// If nil, prefixes are compared using Comparer.Compare.
+	PrefixEqual func(a, b []byte) bool
+
+	// Name is the name of the prefix extractor. It is recorded in the
+	// properties of the sstables written.
+	Name string
+}
@@ -49,3 +49,47 @@ func TestDefAppendSeparator(t *testing.T) {
 		})
 	}
 }
+
+func TestDefRangeEndSentinel(t *testing.T) {
+	testCases := []struct {
+		prefix string
+		want   string
+		ok     bool
+	}{
+		{"", "", false},
+		{"a", "b", true},
+		{"ab", "ac", true},
+		{"a\xff", "b", true},
+		{"a\xff\xff", "b", true},
+		{"\xff", "", false},
+		{"\xff\xff", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run("", func(t *testing.T) {
+			got := DefaultComparer.RangeEndSentinel([]byte(tc.prefix))
+			if (got != nil) != tc.ok || string(got) != tc.want {
+				t.Errorf("prefix = %q: got %q, want %q", tc.prefix, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDefAbbreviatedKey(t *testing.T) {
+	keys := []string{
+		"", "\x00", "a", "a\x00", "ab", "abcdefgh", "abcdefghi", "abcdefgz", "b",
+		"ba", "\xff", "\xff\xff\xff\xff\xff\xff\xff\xff\xff",
+	}
+	for i := range keys {
+		for j := range keys {
+			a, b := []byte(keys[i]), []byte(keys[j])
+			x, y := DefaultComparer.AbbreviatedKey(a), DefaultComparer.AbbreviatedKey(b)
+			c := DefaultComparer.Compare(a, b)
+			if (x < y && c >= 0) || (x > y && c <= 0) {
+				t.Errorf("%q (%x) vs %q (%x): inconsistent with Compare (%d)", a, x, b, y, c)
+			}
+		}
+	}
+	if v := DefaultComparer.AbbreviatedKey([]byte("ab")); v != 0x6162000000000000 {
+		t.Errorf("expected 0x6162000000000000, but found %x", v)
+	}
+}
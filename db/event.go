@@ -20,6 +20,11 @@ type TableInfo struct {
 	SmallestSeqNum uint64
 	// LargestSeqNum is the largest sequence number in the table.
 	LargestSeqNum uint64
+	// Checksum is the checksum of the whole file, if HasChecksum is set. See
+	// Options.CompactionOutputChecksums.
+	Checksum uint32
+	// HasChecksum is true if a checksum of the whole file was recorded.
+	HasChecksum bool
 }
 
 // CompactionInfo contains the info for a compaction event.
@@ -79,6 +84,16 @@ type TableIngestInfo struct {
 	Err          error
 }
 
+// RangeTombstoneLimitInfo contains the info for a range tombstone limit
+// event.
+type RangeTombstoneLimitInfo struct {
+	// Fragments is the number of fragmented range tombstones held in memory by
+	// the memtable.
+	Fragments int
+	// Limit is the configured soft limit (Options.MaxRangeTombstoneFragments).
+	Limit int
+}
+
 // EventListener contains a set of functions that will be invoked when various
 // significant DB events occur. Note that the functions should not run for an
 // excessive amount of time as they are invokved synchronously by the DB and
@@ -105,6 +120,11 @@ type EventListener struct {
 	// installed.
 	FlushEnd func(FlushInfo)
 
+	// RangeTombstoneLimitExceeded is invoked when the number of fragmented range
+	// tombstones held in memory by a memtable exceeds
+	// Options.MaxRangeTombstoneFragments.
+	RangeTombstoneLimitExceeded func(RangeTombstoneLimitInfo)
+
 	// TableDeleted is invoked after a table has been deleted.
 	TableDeleted func(TableDeleteInfo)
 
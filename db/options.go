@@ -6,7 +6,9 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/storage"
@@ -38,10 +40,10 @@ func (c Compression) String() string {
 // FilterType is the level at which to apply a filter: block or table.
 type FilterType int
 
-// The available filter types.
+// The available filter types. The zero value is TableFilter.
 const (
-	BlockFilter FilterType = iota
-	TableFilter
+	TableFilter FilterType = iota
+	BlockFilter
 )
 
 func (t FilterType) String() string {
@@ -54,6 +56,125 @@ func (t FilterType) String() string {
 	return "unknown"
 }
 
+// MemTableType is the in-memory representation of a memtable.
+type MemTableType int
+
+// The available memtable representations.
+const (
+	// SkiplistMemTable stores the entries of a memtable in a single skiplist.
+	SkiplistMemTable MemTableType = iota
+	// HashSkiplistMemTable partitions the entries of a memtable into buckets by
+	// a hash of the prefix of their user key, as defined by
+	// Options.PrefixExtractor (or the entire user key if there is none), and
+	// stores each bucket in its own skiplist. A point lookup only searches the
+	// skiplist of its bucket. Iteration over the memtable, including a flush,
+	// must merge the skiplists of all of the buckets, which makes range scans
+	// significantly slower than with SkiplistMemTable.
+	HashSkiplistMemTable
+)
+
+func (t MemTableType) String() string {
+	switch t {
+	case SkiplistMemTable:
+		return "skiplist"
+	case HashSkiplistMemTable:
+		return "hash_skiplist"
+	}
+	return "unknown"
+}
+
+// DuplicateKeyPolicy specifies how a table writer handles a point entry with
+// the same user key and sequence number as the entry preceding it, which
+// indicates a bug upstream of the writer.
+type DuplicateKeyPolicy int
+
+// The available duplicate key policies. The zero value is DuplicateKeyError.
+const (
+	// DuplicateKeyError fails the table with an error.
+	DuplicateKeyError DuplicateKeyPolicy = iota
+	// DuplicateKeyKeepFirst drops the duplicate, keeping the entry which was
+	// added first.
+	DuplicateKeyKeepFirst
+)
+
+func (p DuplicateKeyPolicy) String() string {
+	switch p {
+	case DuplicateKeyError:
+		return "error"
+	case DuplicateKeyKeepFirst:
+		return "keep_first"
+	}
+	return "unknown"
+}
+
+// MemTableFactory specifies how the memtables of a DB are constructed. See
+// Options.MemTableFactory.
+type MemTableFactory struct {
+	// Type is the in-memory representation of the memtables.
+	Type MemTableType
+
+	// HashBuckets is the number of buckets of a HashSkiplistMemTable. Each
+	// bucket allocates a pair of skiplist sentinel nodes, of a few hundred
+	// bytes, from the memtable. It is ignored by other memtable types.
+	//
+	// The default value is 64.
+	HashBuckets int
+}
+
+// EnsureDefaults ensures that the default values for all of the options have
+// been initialized. It is valid to call EnsureDefaults on a nil receiver. A
+// non-nil result will always be returned.
+func (f *MemTableFactory) EnsureDefaults() *MemTableFactory {
+	if f == nil {
+		f = &MemTableFactory{}
+	}
+	if f.HashBuckets <= 0 {
+		f.HashBuckets = 64
+	}
+	return f
+}
+
+// CompactionLatencyGuard configures the pausing of background compactions
+// while the latency of foreground operations exceeds a target. See
+// Options.CompactionLatencyGuard.
+type CompactionLatencyGuard struct {
+	// SLO is the foreground latency above which background compactions are
+	// paused. The foreground latency is a moving average of the latencies of
+	// the reads performed by DB.Get and the writes performed by DB.Apply.
+	SLO time.Duration
+
+	// Hysteresis is the width of the band below SLO which the foreground
+	// latency must fall through before paused compactions resume: compactions
+	// resume once the latency is at most SLO-Hysteresis. It keeps compactions
+	// from being paused and resumed repeatedly while the latency hovers around
+	// SLO.
+	//
+	// The default value is 0, which resumes compactions as soon as the latency
+	// is back within SLO.
+	Hysteresis time.Duration
+
+	// IdleInterval is the period with which paused compactions check for the
+	// absence of foreground operations. The moving average of the foreground
+	// latency is halved for each interval in which no foreground operation
+	// completes, so that compactions resume when the foreground load ceases.
+	//
+	// The default value is 1s.
+	IdleInterval time.Duration
+}
+
+// EnsureDefaults ensures that the default values for all of the options have
+// been initialized. It is valid to call EnsureDefaults on a nil receiver. A
+// non-nil result will always be returned.
+func (g *CompactionLatencyGuard) EnsureDefaults() *CompactionLatencyGuard {
+	if g == nil {
+		g = &CompactionLatencyGuard{}
+	}
+	if g.IdleInterval <= 0 {
+		g.IdleInterval = time.Second
+	}
+	return g
+}
+
 // FilterWriter provides an interface for creating filter blocks. See
 // FilterPolicy for more details about filters.
 type FilterWriter interface {
@@ -91,6 +212,17 @@ type FilterPolicy interface {
 	NewWriter(ftype FilterType) FilterWriter
 }
 
+// SizedFilterPolicy is implemented by a FilterPolicy whose filters can be
+// sized by the number of bits used per key. See LevelOptions.FilterBitsPerKey.
+type SizedFilterPolicy interface {
+	FilterPolicy
+
+	// WithBitsPerKey returns a filter policy with the same name which uses
+	// approximately bitsPerKey bits per key. The filters it writes must be
+	// readable by the original policy.
+	WithBitsPerKey(bitsPerKey int) FilterPolicy
+}
+
 func filterPolicyName(p FilterPolicy) string {
 	if p == nil {
 		return "none"
@@ -98,6 +230,36 @@ func filterPolicyName(p FilterPolicy) string {
 	return p.Name()
 }
 
+// BlockPropertyCollector accumulates a property of the keys in each data block
+// of a table, such as the range of the timestamps encoded in the keys. The
+// encoded property of each block is stored in the index entry of the block,
+// where it is consulted by a BlockPropertyFilter of the same name. See
+// Options.BlockPropertyCollectors.
+type BlockPropertyCollector interface {
+	// Name names the property. It is written to the table properties, and must
+	// match the name of the filters applied to the property.
+	Name() string
+
+	// Add adds a key and its value to the current data block.
+	Add(key InternalKey, value []byte) error
+
+	// FinishDataBlock appends to dst the encoded property of the keys added
+	// since the last call, and resets the collector for the next data block.
+	FinishDataBlock(dst []byte) ([]byte, error)
+}
+
+// BlockPropertyFilter decides from the property encoded by a
+// BlockPropertyCollector of the same name whether a data block may hold keys
+// of interest. See pebble.DB.CompactWithFilters.
+type BlockPropertyFilter interface {
+	// Name names the property the filter is applied to.
+	Name() string
+
+	// Intersects returns whether the data block with the encoded property may
+	// hold keys of interest.
+	Intersects(prop []byte) (bool, error)
+}
+
 // TableFormat specifies the format version for sstables. The legacy LevelDB
 // format is format version 0.
 type TableFormat uint32
@@ -108,10 +270,46 @@ type TableFormat uint32
 const (
 	TableFormatRocksDBv2 TableFormat = iota
 	TableFormatLevelDB
+	// TableFormatPebblev1 extends TableFormatRocksDBv2 with the block
+	// properties stored in the index entries of the data blocks (see
+	// Options.BlockPropertyCollectors). Its tables cannot be read by RocksDB,
+	// nor by versions of pebble which predate the format.
+	TableFormatPebblev1
+)
+
+// FormatMajorVersion is the version of the on-disk format of a DB as a whole,
+// which is recorded in its MANIFEST. A DB whose format version is newer than
+// FormatNewest is refused by Open, so that a binary does not misinterpret a
+// DB written in a format it does not understand. See
+// Options.MinFormatVersion.
+type FormatMajorVersion uint64
+
+// The available format versions.
+const (
+	// FormatMostCompatible is the format of a DB whose MANIFEST records no
+	// format version, which can be read by any version of pebble, as well as
+	// by LevelDB and RocksDB tooling.
+	FormatMostCompatible FormatMajorVersion = iota
+	// FormatVersioned is the format of a DB whose MANIFEST records its format
+	// version. Versions of pebble which predate format versions refuse to open
+	// such a DB as having a corrupt MANIFEST.
+	FormatVersioned
+	// FormatNewest is the newest format version supported.
+	FormatNewest = FormatVersioned
 )
 
 // LevelOptions holds the optional per-level parameters.
 type LevelOptions struct {
+	// BlockAlignment, if positive, pads each data block with zero bytes so that
+	// the following block starts at a multiple of BlockAlignment bytes from the
+	// start of the table. Every data block then starts at an aligned offset,
+	// which suits backends using direct I/O, at the cost of the space used by
+	// the padding. Readers locate blocks through the index and are unaffected
+	// by the padding.
+	//
+	// The default value is 0, which disables the padding.
+	BlockAlignment int
+
 	// BlockRestartInterval is the number of keys between restart points
 	// for delta encoding of keys.
 	//
@@ -151,10 +349,109 @@ type LevelOptions struct {
 	// memory proportional to the number of keys in an sstable to create, but
 	// avoids the index lookup when determining if a key is present. Table-level
 	// filters should be preferred except under constrained memory situations.
+	// A table carries exactly one filter, of the chosen type.
+	//
+	// The default value is TableFilter, as in RocksDB.
 	FilterType FilterType
 
+	// FilterBitsPerKey, if positive, overrides the number of bits per key used
+	// by the filters written to tables at this level. It requires FilterPolicy
+	// to implement SizedFilterPolicy, and is ignored otherwise. In particular,
+	// the policies of bloom.FilterPolicyForFPRate are sized by their false
+	// positive rate, which takes precedence over this option. The deeper
+	// levels hold most of the keys and benefit the most from an accurate
+	// filter, while the tables in the upper levels are rewritten frequently
+	// and might be better served by smaller filters. Reads are unaffected as
+	// the filter data is self-describing.
+	//
+	// The default value means to use the bits per key of FilterPolicy.
+	FilterBitsPerKey int
+
+	// FilterCompression defines the compression to use for the filter block.
+	// Filters are consulted on the read path for every lookup, so compressing
+	// them is only worthwhile for cold tables where the space savings outweigh
+	// the cost of decompressing the filter when it is loaded into the cache.
+	//
+	// The default value (DefaultCompression) leaves the filter uncompressed.
+	FilterCompression Compression
+
 	// The target file size for the level.
 	TargetFileSize int64
+
+	// ValueDedup causes a value which is identical to the value of the previous
+	// entry in a data block to be stored as a back-reference rather than
+	// repeating the value bytes. This targets datasets where adjacent keys
+	// frequently share a value, such as a default. Tables written with this
+	// option cannot be read by RocksDB or LevelDB.
+	//
+	// The default value is false.
+	ValueDedup bool
+
+	// SeqNumDelta causes the sequence number of an entry in a data block whose
+	// user key is identical to that of the previous entry to be stored as the
+	// difference from the sequence number of the previous entry, rather than
+	// as part of a full 8-byte trailer. This shrinks the blocks of datasets
+	// holding many versions of each key. Tables written with this option
+	// cannot be read by RocksDB or LevelDB.
+	//
+	// The default value is false.
+	SeqNumDelta bool
+
+	// ValueFilterPolicy defines a filter algorithm which is applied to the
+	// values, rather than the keys, of the sets written to tables at this
+	// level. The table-level filter over the values can be queried with
+	// sstable.Reader.MayContainValue to determine whether a table might contain
+	// a key with a given value, such as in a deduplication pipeline.
+	//
+	// The default value means to use no value filter.
+	ValueFilterPolicy FilterPolicy
+
+	// BlockInternalFilter causes a filter over the user keys of each restart
+	// interval of a data block to be stored in the block, in addition to the
+	// filter of FilterType. Once the data block holding a key has been located,
+	// a lookup consults the filter of the restart interval the key would be in
+	// and skips scanning the interval if the key is ruled out. It is ignored if
+	// FilterPolicy is nil. Tables written with this option cannot be read by
+	// RocksDB or LevelDB, or tailed by sstable.TailReader.
+	//
+	// The default value is false.
+	BlockInternalFilter bool
+
+	// ValueBlockThreshold, if positive, causes the values of at least this
+	// many bytes to be stored in value blocks separate from the data blocks,
+	// with the data block entry holding a reference to the value. The value
+	// blocks are compressed like data blocks, and a value block is only read
+	// and decompressed once a value it holds is requested, so scans which
+	// only consult the keys do not pay for the large values. Tables written
+	// with this option cannot be read by RocksDB or LevelDB, or tailed by
+	// sstable.TailReader.
+	//
+	// The default value (0) stores all values in the data blocks.
+	ValueBlockThreshold int
+
+	// ValueBlockDedup, if positive, causes a value stored in a value block
+	// which is identical to one of the ValueBlockDedup most recently stored
+	// distinct values of the table to be stored as a reference to the earlier
+	// copy, which may lie in another value block, rather than repeating the
+	// value. The values are identified by their SHA-256 hashes. This shrinks
+	// the tables written by compactions of data in which many keys share
+	// large values. It is ignored if ValueBlockThreshold is not positive.
+	//
+	// The default value (0) stores every value.
+	ValueBlockDedup int
+
+	// PageIndexPageSize, if positive, causes a sparse page index to be written
+	// alongside the index block, with an entry for each page of this many
+	// bytes in which a data block starts. An entry maps the page to the first
+	// key stored in it and the data blocks starting in it, which allows
+	// sstable.Reader.GetAligned to locate the data block which may hold a key
+	// and read it with a single page-aligned read, without consulting the
+	// index block. This suits backends using direct I/O, which require reads
+	// to be aligned, and is typically combined with a BlockAlignment equal to
+	// the page size.
+	//
+	// The default value is 0, which writes no page index.
+	PageIndexPageSize int
 }
 
 // EnsureDefaults ensures that the default values for all of the options have
@@ -176,6 +473,9 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 	if o.Compression <= DefaultCompression || o.Compression >= nCompression {
 		o.Compression = SnappyCompression
 	}
+	if o.FilterCompression <= DefaultCompression || o.FilterCompression >= nCompression {
+		o.FilterCompression = NoCompression
+	}
 	if o.TargetFileSize <= 0 {
 		o.TargetFileSize = 2 << 20 // 2 MB
 	}
@@ -186,6 +486,18 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 // apply to the DB at large; per-query options are defined by the ReadOptions
 // and WriteOptions types.
 type Options struct {
+	// BlockPropertyCollectors creates the collectors of the block properties
+	// stored in the index entries of the data blocks of the tables written by
+	// the DB. Each function is called once per table. The properties allow
+	// compactions given block property filters to copy the data blocks which
+	// cannot hold keys of interest to their output without merging them (see
+	// pebble.DB.CompactWithFilters). Block
+	// properties are only stored in tables written with TableFormatPebblev1,
+	// and the collectors are ignored for the other formats.
+	//
+	// The default value is nil, which stores no block properties.
+	BlockPropertyCollectors []func() BlockPropertyCollector
+
 	// Sync sstables and the WAL periodically in order to smooth out writes to
 	// disk. This option does not provide any persistency guarantee, but is used
 	// to avoid latency spikes if the OS automatically decides to write out a
@@ -197,6 +509,27 @@ type Options struct {
 	// TODO(peter): provide a cache interface.
 	Cache *cache.Cache
 
+	// CacheEvictionPolicy is the eviction policy of the block cache created by
+	// EnsureDefaults when Cache is nil and CacheSize is set. cache.LRU strictly
+	// orders the values by recency, at the cost of reordering an entry on
+	// every hit, while cache.ClockPro only sets a reference bit on a hit. It is
+	// ignored if Cache is set, as the policy of a cache is chosen by
+	// cache.NewWithPolicy.
+	//
+	// The default value is cache.ClockPro.
+	CacheEvictionPolicy cache.EvictionPolicy
+
+	// CacheSize is the size of the block cache created by EnsureDefaults when
+	// Cache is nil, using CacheEvictionPolicy. It is ignored if Cache is set.
+	//
+	// The default value is 0, which creates no block cache.
+	CacheSize int64
+
+	// ChangeConsumer, if non-nil, receives a copy of the resolved records
+	// written by compactions. See ChangeConsumer for the back-pressure
+	// semantics.
+	ChangeConsumer *ChangeConsumer
+
 	// Comparer defines a total ordering over the space of []byte keys: a 'less
 	// than' relationship. The same comparison algorithm must be used for reads
 	// and writes over the lifetime of the DB.
@@ -220,6 +553,22 @@ type Options struct {
 	// flushes, compactions, and table deletion.
 	EventListener *EventListener
 
+	// KeyRewriter, if non-nil, rewrites the user keys emitted by compactions,
+	// such as to re-encode a key prefix as part of an online migration. The
+	// rewriter must preserve the ordering of keys: a compaction fails if the
+	// rewritten keys are not strictly increasing, or if a rewritten key overlaps
+	// a table in any level which is not part of the compaction. The keys are
+	// verified before they are written. The bounds of range tombstones are
+	// rewritten as well. Keys are only rewritten when a
+	// table is compacted, so the tables which have not yet been compacted
+	// retain the original keys, and tables are never moved to the next level
+	// without being rewritten. A compaction only rewrites keys if no table
+	// below its output level overlaps its key range, so that the rewritten keys
+	// do not expose older versions of the original keys in lower levels.
+	//
+	// The default value is nil, which leaves the keys unchanged.
+	KeyRewriter func(key []byte) ([]byte, error)
+
 	// The number of files necessary to trigger an L0 compaction.
 	L0CompactionThreshold int
 
@@ -245,6 +594,29 @@ type Options struct {
 	// The default logger uses the Go standard library log package.
 	Logger Logger
 
+	// MaxRangeTombstoneFragments is a soft limit on the number of fragmented
+	// range deletion tombstones a memtable holds in memory for iteration.
+	// Overlapping range tombstones are fragmented at their overlap points, so a
+	// pathological workload can materialize many more fragments than it wrote
+	// tombstones. Exceeding the limit does not cause an error: the
+	// RangeTombstoneLimitExceeded event is invoked, once per memtable, so that
+	// the operator can flush or compact the affected range.
+	//
+	// The default value (0) disables the limit.
+	MaxRangeTombstoneFragments int
+
+	// MaxIndexAndFilterMemory, if positive, is a hard limit on the memory used
+	// by the index and filter blocks of all open tables. The index and filter
+	// blocks are then pinned in memory outside of the block cache, and the
+	// least recently used blocks are unpinned when the limit is exceeded. An
+	// unpinned block is read again (possibly from the block cache) the next
+	// time it is needed. The limit is shared by all of the tables opened with
+	// these options.
+	//
+	// The default value (0) leaves the index and filter blocks in the block
+	// cache.
+	MaxIndexAndFilterMemory int64
+
 	// MaxOpenFiles is a soft limit on the number of open files that can be
 	// used by the DB.
 	//
@@ -269,16 +641,322 @@ type Options struct {
 	// The default merger concatenates values.
 	Merger *Merger
 
+	// OutputPartitioner, if non-nil, partitions the output of compactions by
+	// the user key. A compaction finishes its current output table and starts
+	// a new one whenever the partition of the next key differs from that of
+	// the previous key, and does not otherwise split its output, so every
+	// table written by a compaction contains the keys of a single partition.
+	// The partition must be non-decreasing in key order (e.g. a shard derived
+	// from a key prefix). Tables flushed from the memtable are not
+	// partitioned.
+	//
+	// The default value is nil, which splits compaction output by size.
+	OutputPartitioner func(key []byte) int
+
+	// PrefixExtractor defines the prefix of user keys used by prefix iteration
+	// (see IterOptions.Prefix).
+	//
+	// The default value treats IterOptions.Prefix as a byte-wise prefix of the
+	// user key.
+	PrefixExtractor *PrefixExtractor
+
 	// Storage maps file names to byte storage.
 	//
-	// The default value uses the underlying operating system's file system.
+	// The default value uses the underlying operating system's file system, or
+	// an in-memory file system if InMemory is set.
 	Storage storage.Storage
 
 	// TableFormat specifies the format version for sstables. The default is
 	// TableFormatRocksDBv2 which creates RocksDB compatible sstables. Use
 	// TableFormatLevelDB to create LevelDB compatible sstable which can be used
-	// by a wider range of tools and libraries.
+	// by a wider range of tools and libraries, or TableFormatPebblev1 to store
+	// block properties.
 	TableFormat TableFormat
+
+	// ZeroSeqNums causes compactions to the bottom of the LSM to zero the
+	// sequence numbers of keys which are not needed by any snapshot. Keys with
+	// identical trailers compress better in the index and data blocks.
+	//
+	// The default value is false.
+	ZeroSeqNums bool
+
+	// VerifyFilterChecksums causes the checksum of a filter block to be
+	// verified when the filter is retrieved from the block cache, not only when
+	// it is read from disk. A corrupted filter block then results in an error
+	// rather than silent false negatives. Enabling this option adds a checksum
+	// computation to every filter lookup. Compressed filter blocks are verified
+	// as well, at the cost of reading the filter block an extra time when the
+	// table is opened.
+	//
+	// The default value is false.
+	VerifyFilterChecksums bool
+
+	// VerifyBlockKeyOrder causes table iterators to verify that the keys decoded
+	// from each index and data block are ordered, returning an error when a key
+	// is less than the key preceding it. This catches corruption which yields a
+	// block with a valid checksum but misordered keys, such as a bug in the
+	// writer, at the cost of an additional key comparison for every key
+	// iterated over.
+	//
+	// The default value is false.
+	VerifyBlockKeyOrder bool
+
+	// MemTableHugeValueThreshold, if positive, causes the memtable to be flushed
+	// immediately after a write containing a set or merge whose value is at
+	// least this many bytes. The write is applied to the WAL and memtable as
+	// usual, and the memtable is then rotated so that a single huge value does
+	// not hold memtable memory and delay the writes which follow it. Batches
+	// which are too large for the memtable are already flushed on their own.
+	//
+	// The default value is 0, which disables forced flushes.
+	MemTableHugeValueThreshold int
+
+	// RetainVersions is the number of the most recent versions of each user
+	// key which are retained by flushes and compactions, rather than being
+	// collapsed into the newest version. Sets, deletions and merges each count
+	// as a version, and the retained versions are preserved as if a snapshot
+	// separated each of them: merges are not merged across them and deletions
+	// are not elided while an older version is retained. Range deletions still
+	// drop the versions they cover. The older versions can be read with a
+	// StreamIter.
+	//
+	// The default value is 0, which retains only the versions required by the
+	// open snapshots.
+	RetainVersions int
+
+	// BlockLatencyStats causes table readers to record histograms of the
+	// latencies of their block reads, retrievable with
+	// sstable.Reader.LatencyStats. Measuring the latencies reads the clock up
+	// to three times per block read, including for reads served by the block
+	// cache.
+	//
+	// The default value is false.
+	BlockLatencyStats bool
+
+	// BulkIndexRead causes table readers to read the metaindex and index
+	// blocks, which are adjacent at the end of a table, with a single I/O when
+	// the table is opened, rather than reading each of them separately. The
+	// index block is then loaded into the block cache as part of opening the
+	// table, instead of on its first use. This speeds up the cold start of
+	// tables with large index blocks. The reads of data blocks are unaffected.
+	//
+	// The default value is false.
+	BulkIndexRead bool
+
+	// MinLevelForFilters is the shallowest level of the LSM at which flushes
+	// and compactions write filters, as configured by LevelOptions.FilterPolicy,
+	// for their output tables. Tables written to the levels above it, which are
+	// small and short-lived, are written without a filter, saving the CPU and
+	// space spent on building it. Lookups in such tables are served by their
+	// index blocks alone. Tables written by other means, such as those ingested,
+	// are unaffected.
+	//
+	// The default value is 0, which writes filters at every level.
+	MinLevelForFilters int
+
+	// MemTableFactory specifies the in-memory representation of the memtables.
+	// A HashSkiplistMemTable speeds up point lookups in workloads which rarely
+	// scan the memtable, at the expense of iteration.
+	//
+	// The default value is nil, which uses a SkiplistMemTable.
+	MemTableFactory *MemTableFactory
+
+	// MaxWALSize, if positive, is the size in bytes past which the WAL is
+	// rotated. The next write switches to a new WAL along with a new memtable,
+	// so that each WAL only holds the writes of a single memtable and is
+	// removed once that memtable has been flushed. This bounds the amount of
+	// the WAL replayed by recovery, and the size of the WAL files archived, at
+	// the expense of flushing memtables before they are full.
+	//
+	// The default value (0) only rotates the WAL when the memtable is full.
+	MaxWALSize int64
+
+	// CacheAllocator, if non-nil, allocates the memory of the data blocks read
+	// by table iterators and added to the block cache, in place of the Go
+	// heap. A block is freed once it has been evicted from the cache and is no
+	// longer in use by an iterator, which reduces the garbage collection
+	// overhead of a large cache. The values returned by DB.Get are copied out
+	// of the cache when an allocator is set. Blocks read by other means, such
+	// as the index and filter blocks, are still allocated on the Go heap.
+	//
+	// The default value is nil, which allocates all blocks on the Go heap.
+	CacheAllocator cache.Allocator
+
+	// IgnoreComparerMismatch causes table readers to open tables whose
+	// recorded comparer name differs from the name of Comparer. By default such
+	// a table is rejected, as its keys are not ordered by Comparer and reads
+	// would return wrong results. Tooling which only inspects the raw bytes of
+	// a table can set this to open tables written with any comparer.
+	//
+	// The default value is false.
+	IgnoreComparerMismatch bool
+
+	// BottomLevelSkipThreshold, if positive, is the size in bytes of a table
+	// in the bottom level above which compactions avoid rewriting it. When
+	// picking the table to compact into the bottom level, a table whose
+	// compaction would include such a large bottom level table is passed over
+	// in favor of one whose compaction would not, so that the large table is
+	// only rewritten once every table of the level above overlaps one. This
+	// reduces the write amplification of merging small amounts of data into
+	// the bottom level, which holds most of the data.
+	//
+	// The default value is 0, which picks tables regardless of their overlap
+	// with the bottom level.
+	BottomLevelSkipThreshold int64
+
+	// InMemory causes the DB to be stored entirely in memory, with no disk
+	// involved: the WAL, the tables and the manifest are files in an
+	// in-memory file system, created by EnsureDefaults if Storage is nil.
+	// Flushes and compactions run as they do on disk, and reads behave
+	// identically. The contents of the DB are lost once the file system is
+	// released; reopening the DB with the same, defaulted, Options reopens the
+	// same file system. This is intended for caches and tests.
+	//
+	// The default value is false.
+	InMemory bool
+
+	// RebuildFilters causes the tables whose filter was written with a
+	// different filter policy than the one configured for their level, or
+	// without a filter, to be rewritten in the background. The rewritten
+	// tables carry filters written with the configured policy, which existing
+	// tables otherwise only gain once they are compacted. This eases migrating
+	// a DB to a new FilterPolicy. The tables are checked lazily, one at a
+	// time, and rewritten as low priority compactions which only run when no
+	// other compaction is needed. Tables in L0 are rewritten by their regular
+	// compaction, and levels without a filter policy are left as is.
+	//
+	// The default value is false.
+	RebuildFilters bool
+
+	// DuplicateKeyPolicy specifies how the table writer handles a point entry
+	// with the same user key and sequence number as the previous entry, such as
+	// when a flushed memtable is found to hold two such entries. Such a pair
+	// would otherwise produce a malformed table.
+	//
+	// The default value is DuplicateKeyError.
+	DuplicateKeyPolicy DuplicateKeyPolicy
+
+	// VerifyCompactionOutputs causes each table written by a compaction to be
+	// re-read before the compaction is committed, verifying the checksums of
+	// its data blocks, the ordering of its keys and that its keys lie within
+	// the bounds recorded for it in the manifest. A table which fails
+	// verification aborts the compaction, whose outputs are removed and whose
+	// inputs are retained. This catches writer bugs at the cost of reading back
+	// every compaction output.
+	//
+	// The default value is false.
+	VerifyCompactionOutputs bool
+
+	// MaxManifestSize, if positive, is the size in bytes past which the
+	// manifest is rolled over. The next version edit is then written to a new
+	// manifest, following a snapshot of the current version, and the CURRENT
+	// file is atomically switched to the new manifest. Opening a DB replays the
+	// edits of its current manifest, so this bounds the time spent replaying
+	// the edits of a long-running DB.
+	//
+	// The default value (0) never rolls the manifest over while the DB is open.
+	MaxManifestSize int64
+
+	// TombstoneDensityThreshold, if positive, marks a table written by a flush
+	// or compaction for compaction if the fraction of its point entries which
+	// are deletions exceeds the threshold. A marked table is compacted once no
+	// level exceeds its size target, and is rewritten rather than moved to the
+	// next level, so that its tombstones are dropped once no lower level
+	// holds data they delete. This reclaims the space and the read cost of
+	// tombstone-heavy tables in levels which are under their size target.
+	//
+	// The default value (0) does not mark tables by their tombstone density.
+	TombstoneDensityThreshold float64
+
+	// MaxFlushLevel, if positive, allows a flush to place its table directly
+	// into a level below L0, as an ingestion does. The table is placed into
+	// the lowest level, no deeper than MaxFlushLevel, such that neither it nor
+	// any higher level holds a table overlapping the key range of the flushed
+	// data. This suits bulk loads of sorted, non-overlapping data, which then
+	// skip the compactions cascading out of L0. The table is written with the
+	// LevelOptions of L0 regardless of its level, and is placed into L0 while
+	// a compaction is running.
+	//
+	// The default value (0) flushes into L0.
+	MaxFlushLevel int
+
+	// MemoizeGetBlock causes each table reader to retain the decompressed data
+	// block read by its most recent point lookup, such as DB.Get or
+	// sstable.Reader.GetValueLen. A lookup landing in the same data block as
+	// the previous one then skips the block cache lookup and the
+	// decompression of the block, which speeds up sequences of lookups of
+	// adjacent keys. The retained block is replaced by the block of the next
+	// lookup landing in a different block. It is ignored if CacheAllocator is
+	// set.
+	//
+	// The default value is false.
+	MemoizeGetBlock bool
+
+	// CompactionOutputChecksums causes a compaction to compute the checksum of
+	// the whole of each table it writes, as the table is written, and to record
+	// it in the version edit installing the table. The checksum is the CRC-32
+	// (Castagnoli) of the file contents, as computed by internal/crc, and lets a
+	// receiver of a table copied out of the DB verify that the copy matches the
+	// table described by the MANIFEST. The checksum is reported by
+	// TableInfo.Checksum and TableInfo.HasChecksum. Tables written by flushes
+	// and ingestions have no checksum recorded.
+	//
+	// The default value is false.
+	CompactionOutputChecksums bool
+
+	// MinFormatVersion is the format version with which a new DB is created.
+	// When an existing DB with an older format version is opened, its format
+	// version is upgraded to MinFormatVersion, after which the DB can no
+	// longer be opened by binaries which do not support that format version.
+	// The format version of a DB is never downgraded. Open returns an error if
+	// MinFormatVersion is newer than FormatNewest.
+	//
+	// The default value is FormatMostCompatible.
+	MinFormatVersion FormatMajorVersion
+
+	// CompactionLatencyGuard, if non-nil, pauses the automatic background
+	// compactions while the latency of foreground reads and writes exceeds
+	// its SLO, and resumes them once the latency recovers, so that compactions
+	// do not compete with the foreground operations for I/O during latency
+	// spikes. A compaction which is running when the latency spikes is not
+	// interrupted. Manual compactions and flushes are never paused, and
+	// neither are compactions once the number of L0 tables exceeds
+	// L0SlowdownWritesThreshold, as the writes are then throttled until L0 is
+	// compacted. The current state is reported by DB.Metrics.
+	//
+	// The default value is nil, which never pauses compactions.
+	CompactionLatencyGuard *CompactionLatencyGuard
+
+	// FastOpenEmpty causes Open to take a fast path when the DB directory is
+	// empty or does not exist, which initializes the new DB in memory and only
+	// creates its WAL, rather than also writing its manifest and OPTIONS file.
+	// The manifest and OPTIONS file are written by the first flush (or
+	// ingestion), and Close flushes the DB if it has not been flushed. The
+	// writes are logged to the WAL as usual, so synced writes are durable: if
+	// the DB crashes before its first flush, Open replays the WAL into a newly
+	// created DB. This suits ephemeral DBs, such as those created by tests.
+	//
+	// The default value is false.
+	FastOpenEmpty bool
+
+	// WarmTableCacheLevels lists the levels whose tables are opened by Open,
+	// so that the first reads of those tables do not pay the latency of
+	// opening them. The index and filter blocks of each table are read as
+	// well, and are pinned in memory if MaxIndexAndFilterMemory is set, or
+	// loaded into the block cache otherwise. Warming stops once the table
+	// cache is full, or once the blocks read reach the pinned memory budget
+	// (or the size of the block cache), so that the tables warmed last do not
+	// evict those warmed first. The levels are warmed in the order
+	// listed, which typically starts with the bottom level, as it holds most
+	// of the data.
+	//
+	// The default value is nil, which leaves the tables to be opened on
+	// demand.
+	WarmTableCacheLevels []int
+
+	// pinned is the budget for MaxIndexAndFilterMemory. It is created by
+	// EnsureDefaults.
+	pinned *cache.Pinned
 }
 
 // EnsureDefaults ensures that the default values for all options are set if a
@@ -290,6 +968,9 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.BytesPerSync <= 0 {
 		o.BytesPerSync = 512 << 10
 	}
+	if o.Cache == nil && o.CacheSize > 0 {
+		o.Cache = cache.NewWithPolicy(o.CacheSize, o.CacheEvictionPolicy)
+	}
 	if o.Comparer == nil {
 		o.Comparer = DefaultComparer
 	}
@@ -324,6 +1005,9 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.Logger == nil {
 		o.Logger = defaultLogger{}
 	}
+	if o.MaxIndexAndFilterMemory > 0 && o.pinned == nil {
+		o.pinned = cache.NewPinned(o.MaxIndexAndFilterMemory)
+	}
 	if o.MaxOpenFiles == 0 {
 		o.MaxOpenFiles = 1000
 	}
@@ -337,11 +1021,22 @@ func (o *Options) EnsureDefaults() *Options {
 		o.Merger = DefaultMerger
 	}
 	if o.Storage == nil {
-		o.Storage = storage.Default
+		if o.InMemory {
+			o.Storage = storage.NewMem()
+		} else {
+			o.Storage = storage.Default
+		}
 	}
 	return o
 }
 
+// PinnedIndexAndFilterMemory returns the budget for the index and filter
+// blocks pinned in memory by the tables opened with these options, or nil if
+// MaxIndexAndFilterMemory is not set. See MaxIndexAndFilterMemory.
+func (o *Options) PinnedIndexAndFilterMemory() *cache.Pinned {
+	return o.pinned
+}
+
 // Level returns the LevelOptions for the specified level.
 func (o *Options) Level(level int) LevelOptions {
 	if level < len(o.Levels) {
@@ -411,6 +1106,95 @@ type IterOptions struct {
 	//
 	// TODO(peter): unimplemented.
 	TableFilter func(userProps map[string]string) bool
+	// Prefix restricts iteration to the keys whose prefix, as determined by
+	// Options.PrefixExtractor, is equal to Prefix. Positioning operations are
+	// confined to the keys with the prefix: First and Last position the
+	// iterator at the first and last key with the prefix, SeekGE and SeekLT
+	// treat the prefix as the lower and upper bound of the target key, and
+	// iteration stops at the first key with a different prefix in either
+	// direction. The keys with the prefix are assumed to sort at or after the
+	// prefix itself and before the Comparer.RangeEndSentinel of the prefix. If
+	// the comparer does not define RangeEndSentinel, Last and SeekLT step back
+	// over the keys which sort after the keys with the prefix.
+	Prefix []byte
+	// DisableChecksums disables the verification of the checksums of the data
+	// blocks read from disk by the iterator. Checksums are verified by default,
+	// which catches corruption of the underlying storage at the cost of
+	// computing a CRC over every block read. Disabling verification is
+	// intended for trusted storage. A block read without verification is
+	// cached separately from the verified blocks, and is only served from the
+	// cache to the reads which disable verification as well. Index, filter and
+	// meta blocks are always verified. Gets honor the option when it is passed
+	// to GetWithOptions.
+	DisableChecksums bool
+	// ValueFilter, if non-nil, restricts iteration to the keys for which it
+	// returns true. The filter is passed the user key and the resolved value,
+	// after any merge operands have been merged, and is never passed a deleted
+	// key. The key and value must not be retained or modified by the filter.
+	// Keys which are filtered out are skipped by the iterator in both
+	// directions, although they are still read.
+	ValueFilter func(key, value []byte) bool
+	// CheckKeyOrdering enables a consistency check of the versions of each key
+	// visited by the iterator. Newer versions of a key are required to have
+	// larger sequence numbers than, and to reside in the same or a higher level
+	// of the LSM than, older versions. A violation indicates a bug, such as a
+	// compaction or ingestion which placed a newer version of a key below an
+	// older one, and is reported via Iterator.Error.
+	CheckKeyOrdering bool
+	// CompareCache causes the iterator to cache the results of the key
+	// comparisons made while merging the memtables and levels of the LSM. A
+	// result is retained until one of the two compared sources advances, which
+	// avoids repeating comparisons between sources as entries are sifted
+	// through the merge heap. The cache is sized quadratically in the number
+	// of sources, and benefits iteration over long keys which share long
+	// prefixes, for which comparisons are expensive.
+	CompareCache bool
+	// LazyMerge causes the iterator to defer merging the merge operands of a
+	// key when iterating forward. The operands are collected, and the merge is
+	// performed only when the value is retrieved, so that callers which only
+	// check for the existence of keys skip the merge. See
+	// pebble.Iterator.LazyValue.
+	LazyMerge bool
+	// AllVersions causes the iterator to return every version of each key
+	// visible at the iterator's snapshot, rather than only the newest. The
+	// versions of a key are returned in decreasing sequence number order when
+	// iterating forward, and deletions and the individual merge operands are
+	// returned as distinct versions. The sequence number and kind of the
+	// current version are available from pebble.Iterator.InternalKey. Keys
+	// covered by range deletions are not returned. ValueFilter is applied to
+	// the versions other than deletions, and LazyMerge is ignored.
+	AllVersions bool
+	// TenantPrefix, if non-nil, confines the iterator to the keys with the
+	// given byte-wise prefix, as a safety invariant for multi-tenant DBs which
+	// holds regardless of the bounds set by the caller. Seeks are clamped to
+	// the keys with the prefix, and iteration stops at their boundaries. Should
+	// the iterator be positioned at a key without the prefix nonetheless, which
+	// would indicate a bug, the key is not returned and the iterator is
+	// invalidated with an error retrievable via pebble.Iterator.Error. The
+	// prefix must sort before the keys with the prefix, and its byte-wise
+	// successor after them, as with Prefix.
+	TenantPrefix []byte
+	// Context, if non-nil, allows the iteration to be canceled. Once the
+	// context is done, the iterator is invalidated before the next data block
+	// or table is read, or the next step through the merge of the levels, and
+	// the context error is returned by pebble.Iterator.Error.
+	Context context.Context
+}
+
+// GetContext returns the Context or nil if the receiver is nil.
+func (o *IterOptions) GetContext() context.Context {
+	if o == nil {
+		return nil
+	}
+	return o.Context
+}
+
+// GetTenantPrefix returns the TenantPrefix or nil if the receiver is nil.
+func (o *IterOptions) GetTenantPrefix() []byte {
+	if o == nil {
+		return nil
+	}
+	return o.TenantPrefix
 }
 
 // GetLowerBound returns the LowerBound or nil if the receiver is nil.
@@ -421,6 +1205,56 @@ func (o *IterOptions) GetLowerBound() []byte {
 	return o.LowerBound
 }
 
+// GetCheckKeyOrdering returns the CheckKeyOrdering or false if the receiver is
+// nil.
+func (o *IterOptions) GetCheckKeyOrdering() bool {
+	if o == nil {
+		return false
+	}
+	return o.CheckKeyOrdering
+}
+
+// GetCompareCache returns the CompareCache or false if the receiver is nil.
+func (o *IterOptions) GetCompareCache() bool {
+	if o == nil {
+		return false
+	}
+	return o.CompareCache
+}
+
+// GetLazyMerge returns the LazyMerge or false if the receiver is nil.
+func (o *IterOptions) GetLazyMerge() bool {
+	if o == nil {
+		return false
+	}
+	return o.LazyMerge
+}
+
+// GetAllVersions returns the AllVersions or false if the receiver is nil.
+func (o *IterOptions) GetAllVersions() bool {
+	if o == nil {
+		return false
+	}
+	return o.AllVersions
+}
+
+// GetDisableChecksums returns the DisableChecksums or false if the receiver is
+// nil.
+func (o *IterOptions) GetDisableChecksums() bool {
+	if o == nil {
+		return false
+	}
+	return o.DisableChecksums
+}
+
+// GetPrefix returns the Prefix or nil if the receiver is nil.
+func (o *IterOptions) GetPrefix() []byte {
+	if o == nil {
+		return nil
+	}
+	return o.Prefix
+}
+
 // GetUpperBound returns the UpperBound or nil if the receiver is nil.
 func (o *IterOptions) GetUpperBound() []byte {
 	if o == nil {
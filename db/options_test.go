@@ -6,6 +6,8 @@ package db
 
 import (
 	"testing"
+
+	"github.com/petermattis/pebble/cache"
 )
 
 func TestLevelOptions(t *testing.T) {
@@ -56,7 +58,7 @@ func TestOptionsString(t *testing.T) {
   block_size=4096
   compression=Snappy
   filter_policy=none
-  filter_type=block
+  filter_type=table
   target_file_size=2097152
 `
 
@@ -66,3 +68,34 @@ func TestOptionsString(t *testing.T) {
 		t.Fatalf("expected\n%s\nbut found\n%s", expected, v)
 	}
 }
+
+func TestOptionsCacheEvictionPolicy(t *testing.T) {
+	testCases := []struct {
+		opts     *Options
+		size     int64
+		expected cache.EvictionPolicy
+	}{
+		{&Options{CacheSize: 1 << 20}, 1 << 20, cache.ClockPro},
+		{&Options{CacheSize: 1 << 20, CacheEvictionPolicy: cache.LRU}, 1 << 20, cache.LRU},
+		{&Options{CacheSize: 1 << 20, CacheEvictionPolicy: cache.ClockPro}, 1 << 20, cache.ClockPro},
+		// An explicit cache is used as is.
+		{&Options{Cache: cache.New(2 << 20), CacheSize: 1 << 20, CacheEvictionPolicy: cache.LRU}, 2 << 20, cache.ClockPro},
+	}
+	for _, c := range testCases {
+		opts := c.opts.EnsureDefaults()
+		if opts.Cache == nil {
+			t.Fatalf("expected a cache")
+		}
+		if size := opts.Cache.MaxSize(); size != c.size {
+			t.Fatalf("expected a cache of size %d, but found %d", c.size, size)
+		}
+		if policy := opts.Cache.Policy(); policy != c.expected {
+			t.Fatalf("expected the %s policy, but found %s", c.expected, policy)
+		}
+	}
+
+	// No cache is created by default.
+	if opts := (&Options{}).EnsureDefaults(); opts.Cache != nil {
+		t.Fatalf("expected no cache")
+	}
+}
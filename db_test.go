@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -467,6 +468,66 @@ func TestLargeBatch(t *testing.T) {
 	}
 }
 
+func TestMemTableHugeValueThreshold(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:                    storage.NewMem(),
+		MemTableHugeValueThreshold: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifyLSM := func(expected string) func() error {
+		return func() error {
+			d.mu.Lock()
+			s := d.mu.versions.currentVersion().String()
+			d.mu.Unlock()
+			if expected != s {
+				return fmt.Errorf("expected %s, but found %s", expected, s)
+			}
+			return nil
+		}
+	}
+
+	// Values below the threshold remain in the memtable.
+	if err := d.Set([]byte("a"), bytes.Repeat([]byte("a"), 99), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Merge([]byte("b"), bytes.Repeat([]byte("b"), 99), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyLSM("")(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A huge value flushes the memtable, including the preceding writes.
+	if err := d.Set([]byte("c"), bytes.Repeat([]byte("c"), 100), nil); err != nil {
+		t.Fatal(err)
+	}
+	err = try(100*time.Microsecond, 20*time.Second, verifyLSM("0: a-c\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if _, err := d.Get([]byte(k)); err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+	}
+
+	// The first write to a new memtable triggers a flush as well.
+	if err := d.Merge([]byte("d"), bytes.Repeat([]byte("d"), 200), nil); err != nil {
+		t.Fatal(err)
+	}
+	err = try(100*time.Microsecond, 20*time.Second, verifyLSM("0: a-c d-d\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGetMerge(t *testing.T) {
 	d, err := Open("", &db.Options{
 		Storage: storage.NewMem(),
@@ -505,6 +566,227 @@ func TestGetMerge(t *testing.T) {
 	}
 }
 
+func TestGetRange(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Write the keys in a shuffled order, spreading them between a table and
+	// the memtable, delete every third key and overwrite one.
+	for _, i := range rand.Perm(100) {
+		key := []byte(fmt.Sprintf("%03d", i))
+		if err := d.Set(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+		if i == 50 {
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 100; i += 3 {
+		if err := d.Delete([]byte(fmt.Sprintf("%03d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Set([]byte("010"), []byte("ten"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		start, end         string
+		maxCount, maxBytes int
+		expected           string
+	}{
+		{"000", "008", 0, 0, "001:001 002:002 004:004 005:005 007:007"},
+		{"009", "012", 0, 0, "010:ten 011:011"},
+		{"000", "100", 3, 0, "001:001 002:002 004:004"},
+		{"000", "100", 0, 12, "001:001 002:002"},
+		{"000", "100", 0, 13, "001:001 002:002 004:004"},
+		{"000", "100", 1, 13, "001:001"},
+		{"050", "050", 0, 0, ""},
+		{"a", "b", 0, 0, ""},
+	}
+	for _, c := range testCases {
+		kvs, err := d.GetRange([]byte(c.start), []byte(c.end), c.maxCount, c.maxBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		for i, kv := range kvs {
+			if i > 0 {
+				buf.WriteString(" ")
+				if bytes.Compare(kvs[i-1].Key, kv.Key) >= 0 {
+					t.Fatalf("keys out of order: %s, %s", kvs[i-1].Key, kv.Key)
+				}
+			}
+			fmt.Fprintf(&buf, "%s:%s", kv.Key, kv.Value)
+		}
+		if s := buf.String(); s != c.expected {
+			t.Fatalf("%s-%s: expected %q, but found %q", c.start, c.end, c.expected, s)
+		}
+	}
+
+	// The full range is sorted.
+	kvs, err := d.GetRange(nil, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 66 {
+		t.Fatalf("expected 66 pairs, but found %d", len(kvs))
+	}
+	for i := 1; i < len(kvs); i++ {
+		if bytes.Compare(kvs[i-1].Key, kvs[i].Key) >= 0 {
+			t.Fatalf("keys out of order: %s, %s", kvs[i-1].Key, kvs[i].Key)
+		}
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	fs := &corruptingStorage{Storage: storage.NewMem()}
+	d, err := Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The keys with the prefix "b" are written to a table whose data block is
+	// corrupt, and those with the prefix "a" to a readable table.
+	for _, prefix := range []string{"a", "b"} {
+		if prefix == "b" {
+			atomic.StoreInt32(&fs.corrupt, 1)
+		}
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("%s%03d", prefix, i))
+			if err := d.Set(key, key, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	atomic.StoreInt32(&fs.corrupt, 0)
+	if err := d.Set([]byte("c"), []byte("c"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := [][]byte{[]byte("a010"), []byte("b010"), []byte("a999"), []byte("c"), []byte("d")}
+	values, errs := d.MultiGet(keys)
+	if len(values) != len(keys) || len(errs) != len(keys) {
+		t.Fatalf("expected %d results, but found %d values and %d errors", len(keys), len(values), len(errs))
+	}
+	for i, key := range keys {
+		switch string(key) {
+		case "a010", "c":
+			if errs[i] != nil || !bytes.Equal(values[i], key) {
+				t.Fatalf("%s: expected %s, but found %s (%v)", key, key, values[i], errs[i])
+			}
+		case "b010":
+			if errs[i] == nil || errs[i] == db.ErrNotFound {
+				t.Fatalf("%s: expected a corruption error, but found %s (%v)", key, values[i], errs[i])
+			}
+		default:
+			if errs[i] != db.ErrNotFound {
+				t.Fatalf("%s: expected not found, but found %s (%v)", key, values[i], errs[i])
+			}
+		}
+	}
+}
+
+func TestGetDisableChecksums(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		Storage: mem,
+		Levels: []db.LevelOptions{{
+			Compression: db.NoCompression,
+		}},
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), bytes.Repeat([]byte("v"), 20), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the value in the table, leaving the data block decodable.
+	ls, err := mem.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range ls {
+		if !strings.HasSuffix(name, ".sst") {
+			continue
+		}
+		f, err := mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, stat.Size())
+		if _, err := f.ReadAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		data[bytes.Index(data, []byte("vvvv"))] = 'x'
+		if f, err = mem.Create(name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The unverified gets come first, and must not populate the block cache
+	// with the corrupt block for the verified gets which follow them.
+	expected := "x" + strings.Repeat("v", 19)
+	disable := &db.IterOptions{DisableChecksums: true}
+	if v, err := d.GetWithOptions([]byte("a"), disable); err != nil || string(v) != expected {
+		t.Fatalf("expected %s, but found %s (%v)", expected, v, err)
+	}
+	s := d.NewSnapshot()
+	defer s.Close()
+	if v, err := s.GetWithOptions([]byte("a"), disable); err != nil || string(v) != expected {
+		t.Fatalf("expected %s, but found %s (%v)", expected, v, err)
+	}
+
+	const mismatch = "pebble/table: invalid table (checksum mismatch)"
+	if _, err := d.Get([]byte("a")); err == nil || err.Error() != mismatch {
+		t.Fatalf("expected %s, but found %v", mismatch, err)
+	}
+	if _, err := d.GetWithOptions([]byte("a"), &db.IterOptions{}); err == nil || err.Error() != mismatch {
+		t.Fatalf("expected %s, but found %v", mismatch, err)
+	}
+	if _, err := s.Get([]byte("a")); err == nil || err.Error() != mismatch {
+		t.Fatalf("expected %s, but found %v", mismatch, err)
+	}
+}
+
 func TestIterLeak(t *testing.T) {
 	for _, leak := range []bool{true, false} {
 		t.Run(fmt.Sprintf("leak=%t", leak), func(t *testing.T) {
@@ -598,3 +880,267 @@ func TestCacheEvict(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestWarmCache(t *testing.T) {
+	cache := cache.New(10 << 20)
+	d, err := Open("", &db.Options{
+		Cache:   cache,
+		Levels:  []db.LevelOptions{{BlockSize: 256}},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Set(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.WarmCache([]byte("0100"), []byte("0200")); err != nil {
+		t.Fatal(err)
+	}
+	if size := cache.Size(); size == 0 {
+		t.Fatalf("expected non-zero cache size")
+	}
+
+	// Reads within the warmed range are served from the cache.
+	hits, misses := cache.Hits(), cache.Misses()
+	iter := d.NewIter(nil)
+	n := 0
+	for iter.SeekGE([]byte("0100")); iter.Valid() && string(iter.Key()) < "0200"; iter.Next() {
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 100 {
+		t.Fatalf("expected 100 keys, but found %d", n)
+	}
+	if m := cache.Misses(); m != misses {
+		t.Fatalf("expected no cache misses, but found %d", m-misses)
+	}
+	if h := cache.Hits(); h == hits {
+		t.Fatalf("expected cache hits")
+	}
+
+	// Reads outside of the warmed range are not.
+	if _, err := d.Get([]byte("0900")); err != nil {
+		t.Fatal(err)
+	}
+	if m := cache.Misses(); m == misses {
+		t.Fatalf("expected a cache miss")
+	}
+}
+
+// recyclingAllocator is a cache.Allocator which recycles fixed size slabs. A
+// slab is scribbled over when it is freed, to catch uses after free.
+type recyclingAllocator struct {
+	mu     sync.Mutex
+	size   int
+	free   [][]byte
+	allocs int
+	slabs  int
+	frees  int
+}
+
+func (a *recyclingAllocator) Alloc(n int) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n > a.size {
+		panic(fmt.Sprintf("allocation of %d bytes larger than slab", n))
+	}
+	a.allocs++
+	if len(a.free) > 0 {
+		b := a.free[len(a.free)-1]
+		a.free = a.free[:len(a.free)-1]
+		return b[:n]
+	}
+	a.slabs++
+	return make([]byte, n, a.size)
+}
+
+func (a *recyclingAllocator) Free(b []byte) {
+	for j := range b {
+		b[j] = 0xff
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.frees++
+	a.free = append(a.free, b[:0])
+}
+
+func TestCacheAllocator(t *testing.T) {
+	alloc := &recyclingAllocator{size: 4 << 10}
+	d, err := Open("", &db.Options{
+		Cache:          cache.New(64 << 10),
+		CacheAllocator: alloc,
+		Levels:         []db.LevelOptions{{BlockSize: 256}},
+		Storage:        storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	const n = 20000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%05d", i))
+		if err := d.Set(key, []byte(fmt.Sprintf("value-%05d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The blocks are evicted and freed as reads cycle through the table, but
+	// the values remain intact while in use.
+	for pass := 0; pass < 2; pass++ {
+		iter := d.NewIter(nil)
+		i := 0
+		for iter.First(); iter.Valid(); iter.Next() {
+			if e, a := fmt.Sprintf("%05d:value-%05d", i, i), fmt.Sprintf("%s:%s", iter.Key(), iter.Value()); e != a {
+				t.Fatalf("expected %s, but found %s", e, a)
+			}
+			i++
+		}
+		for iter.Last(); iter.Valid(); iter.Prev() {
+			i--
+			if e, a := fmt.Sprintf("%05d:value-%05d", i, i), fmt.Sprintf("%s:%s", iter.Key(), iter.Value()); e != a {
+				t.Fatalf("expected %s, but found %s", e, a)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if i != 0 {
+			t.Fatalf("expected %d keys in each direction", n)
+		}
+	}
+	var values [][]byte
+	for i := 0; i < n; i += 7 {
+		v, err := d.Get([]byte(fmt.Sprintf("%05d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, v)
+	}
+	for j, v := range values {
+		if e := fmt.Sprintf("value-%05d", j*7); string(v) != e {
+			t.Fatalf("expected %s, but found %s", e, v)
+		}
+	}
+
+	alloc.mu.Lock()
+	defer alloc.mu.Unlock()
+	if alloc.frees == 0 {
+		t.Fatalf("expected evicted blocks to be freed")
+	}
+	if alloc.slabs >= alloc.allocs {
+		t.Fatalf("expected freed slabs to be reused, but found %d slabs for %d allocations",
+			alloc.slabs, alloc.allocs)
+	}
+}
+
+func TestGetMemoizeBlock(t *testing.T) {
+	// reads returns the number of reads of tables by sequential gets, which
+	// cross the boundaries of the data blocks. The table has no block cache,
+	// so each get reads its data block from the file unless it finds it
+	// memoized.
+	reads := func(memoize bool) int32 {
+		fs := &slowStorage{Storage: storage.NewMem()}
+		d, err := Open("", &db.Options{
+			Levels:          []db.LevelOptions{{BlockSize: 1024}},
+			MemoizeGetBlock: memoize,
+			Storage:         fs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		const n = 1000
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("%04d", i))
+			if err := d.Set(key, []byte(fmt.Sprintf("value-%04d", i)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		get := func(i int) {
+			v, err := d.Get([]byte(fmt.Sprintf("%04d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e := fmt.Sprintf("value-%04d", i); string(v) != e {
+				t.Fatalf("memoize=%t: expected %s, but found %s", memoize, e, v)
+			}
+		}
+		get(0)
+		start := atomic.LoadInt32(&fs.reads)
+		for i := 0; i < n; i++ {
+			get(i)
+		}
+		reads := atomic.LoadInt32(&fs.reads) - start
+
+		// Gets in a random order replace the memoized block as they move
+		// between data blocks.
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for _, i := range rng.Perm(n) {
+			get(i)
+		}
+		return reads
+	}
+
+	// The memoized gets read each of the data blocks once, rather than once
+	// for each key.
+	plain, memoized := reads(false), reads(true)
+	if plain-memoized < 900 {
+		t.Fatalf("expected the memoized gets to skip most reads, but found %d reads, and %d without memoization",
+			memoized, plain)
+	}
+}
+
+func BenchmarkDBSequentialGet(b *testing.B) {
+	for _, memoize := range []bool{false, true} {
+		b.Run(fmt.Sprintf("memoize=%t", memoize), func(b *testing.B) {
+			d, err := Open("", &db.Options{
+				MemoizeGetBlock: memoize,
+				Storage:         storage.NewMem(),
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer d.Close()
+
+			var keys [][]byte
+			for i := 0; i < 10000; i++ {
+				key := []byte(fmt.Sprintf("%08d", i))
+				keys = append(keys, key)
+				if err := d.Set(key, key, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := d.Flush(); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := d.Get(keys[i%len(keys)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -17,6 +17,7 @@ type getIter struct {
 	cmp          db.Compare
 	equal        db.Equal
 	newIters     tableNewIters
+	opts         *db.IterOptions
 	snapshot     uint64
 	key          []byte
 	iter         internalIterator
@@ -118,7 +119,11 @@ func (g *getIter) Next() bool {
 		// Create iterators from memtables from newest to oldest.
 		if n := len(g.mem); n > 0 {
 			m := g.mem[n-1]
-			g.iter = m.newIter(nil)
+			if mem, ok := m.(*memTable); ok {
+				g.iter = mem.newPointIter(g.key)
+			} else {
+				g.iter = m.newIter(nil)
+			}
 			g.rangeDelIter = m.newRangeDelIter(nil)
 			g.mem = g.mem[:n-1]
 			g.valid = g.iter.SeekGE(g.key)
@@ -129,11 +134,17 @@ func (g *getIter) Next() bool {
 			// Create iterators from L0 from newest to oldest.
 			if n := len(g.l0); n > 0 {
 				l := &g.l0[n-1]
-				g.iter, g.rangeDelIter, g.err = g.newIters(l)
+				g.l0 = g.l0[:n-1]
+				if g.cmp(g.key, l.smallest.UserKey) < 0 || g.cmp(g.key, l.largest.UserKey) > 0 {
+					// The table does not contain the key, nor a range tombstone
+					// covering it, and is not read. This also confines an error
+					// reading the table to the keys within its bounds.
+					continue
+				}
+				g.iter, g.rangeDelIter, g.err = g.newIters(l, g.opts)
 				if g.err != nil {
 					return false
 				}
-				g.l0 = g.l0[:n-1]
 				g.valid = g.iter.SeekGE(g.key)
 				continue
 			}
@@ -148,7 +159,7 @@ func (g *getIter) Next() bool {
 			continue
 		}
 
-		g.levelIter.init(nil, g.cmp, g.newIters, g.version.files[g.level])
+		g.levelIter.init(g.opts, g.cmp, g.newIters, g.version.files[g.level])
 		g.levelIter.initRangeDel(&g.rangeDelIter)
 		g.level++
 		g.iter = &g.levelIter
@@ -30,6 +30,7 @@ func ingestLoad1(opts *db.Options, path string, fileNum uint64) (*fileMetadata,
 	meta := &fileMetadata{}
 	meta.fileNum = fileNum
 	meta.size = uint64(stat.Size())
+	meta.epoch = r.Epoch()
 	meta.smallest = db.InternalKey{}
 	meta.largest = db.InternalKey{}
 	smallestSet, largestSet := false, false
@@ -353,6 +354,9 @@ func (d *DB) ingestApply(meta []*fileMetadata) (*versionEdit, error) {
 		ve.newFiles[i].level = ingestTargetLevel(d.cmp, current, m)
 		ve.newFiles[i].meta = *m
 	}
+	if err := d.persistDeferred(); err != nil {
+		return nil, err
+	}
 	if err := d.mu.versions.logAndApply(ve); err != nil {
 		return nil, err
 	}
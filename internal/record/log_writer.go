@@ -281,12 +281,61 @@ func (w *LogWriter) WriteRecord(p []byte) (int64, error) {
 	return offset, w.err
 }
 
+// WriteRecordParts writes a complete record whose contents are the
+// concatenation of parts, copying each part directly into the log. Returns
+// the offset just past the end of the record.
+func (w *LogWriter) WriteRecordParts(parts [][]byte) (int64, error) {
+	if w.err != nil {
+		return -1, w.err
+	}
+
+	var n, off int
+	for _, p := range parts {
+		n += len(p)
+	}
+	for i := 0; n > 0; i++ {
+		parts, off, n = w.emitFragmentParts(i, parts, off, n)
+	}
+
+	offset := w.blockNumber*blockSize + int64(w.block.written)
+	return offset, w.err
+}
+
 func (w *LogWriter) emitFragment(n int, p []byte) []byte {
 	b := w.block
 	i := b.written
-	first := n == 0
-	last := blockSize-i-headerSize >= int32(len(p))
+	w.setChunkType(i, n == 0, blockSize-i-headerSize >= int32(len(p)))
+	r := copy(b.buf[i+headerSize:], p)
+	w.finishFragment(i, i+int32(headerSize+r))
+	return p[r:]
+}
+
+// emitFragmentParts is emitFragment for a record whose n remaining bytes are
+// those of parts, starting at offset off of the first part.
+func (w *LogWriter) emitFragmentParts(
+	n int, parts [][]byte, off, remaining int,
+) ([][]byte, int, int) {
+	b := w.block
+	i := b.written
+	w.setChunkType(i, n == 0, blockSize-i-headerSize >= int32(remaining))
+	j := i + headerSize
+	for len(parts) > 0 && j < blockSize {
+		r := copy(b.buf[j:], parts[0][off:])
+		j += int32(r)
+		remaining -= r
+		if off += r; off < len(parts[0]) {
+			break
+		}
+		parts, off = parts[1:], 0
+	}
+	w.finishFragment(i, j)
+	return parts, off, remaining
+}
 
+// setChunkType sets the chunk type of the fragment starting at offset i of
+// the current block.
+func (w *LogWriter) setChunkType(i int32, first, last bool) {
+	b := w.block
 	if last {
 		if first {
 			b.buf[i+6] = fullChunkType
@@ -300,11 +349,14 @@ func (w *LogWriter) emitFragment(n int, p []byte) []byte {
 			b.buf[i+6] = middleChunkType
 		}
 	}
+}
 
-	r := copy(b.buf[i+headerSize:], p)
-	j := i + int32(headerSize+r)
+// finishFragment writes the header of the fragment occupying offsets [i,j) of
+// the current block, and queues the block for flushing once it is full.
+func (w *LogWriter) finishFragment(i, j int32) {
+	b := w.block
 	binary.LittleEndian.PutUint32(b.buf[i+0:i+4], crc.New(b.buf[i+6:j]).Value())
-	binary.LittleEndian.PutUint16(b.buf[i+4:i+6], uint16(r))
+	binary.LittleEndian.PutUint16(b.buf[i+4:i+6], uint16(j-i-headerSize))
 	atomic.StoreInt32(&b.written, j)
 
 	if blockSize-b.written <= headerSize {
@@ -316,5 +368,4 @@ func (w *LogWriter) emitFragment(n int, p []byte) []byte {
 		atomic.StoreInt32(&b.written, j)
 		w.queueBlock()
 	}
-	return p[r:]
 }
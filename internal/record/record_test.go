@@ -763,6 +763,47 @@ func TestNoLastRecordOffset(t *testing.T) {
 	}
 }
 
+func TestLogWriterRecordParts(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var records [][][]byte
+	for i := 0; i < 50; i++ {
+		parts := make([][]byte, rng.Intn(5)+1)
+		for j := range parts {
+			n := rng.Intn(3)
+			if n > 0 {
+				n = rng.Intn(2 * blockSize)
+			}
+			parts[j] = []byte(big(fmt.Sprintf("%d.%d.", i, j), n))
+		}
+		records = append(records, parts)
+	}
+
+	var want, got bytes.Buffer
+	w0, w1 := NewLogWriter(&want), NewLogWriter(&got)
+	for i, parts := range records {
+		off0, err := w0.WriteRecord(bytes.Join(parts, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		off1, err := w1.WriteRecordParts(parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if off0 != off1 {
+			t.Fatalf("record #%d: got offset %d, want %d", i, off1, off0)
+		}
+	}
+	if err := w0.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want.Bytes(), got.Bytes()) {
+		t.Fatalf("WriteRecordParts and WriteRecord produced different logs")
+	}
+}
+
 func BenchmarkRecordWrite(b *testing.B) {
 	for _, size := range []int{8, 16, 32, 64, 128} {
 		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
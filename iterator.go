@@ -5,6 +5,7 @@
 package pebble
 
 import (
+	"bytes"
 	"fmt"
 
 	"github.com/petermattis/pebble/db"
@@ -46,18 +47,139 @@ type Iterator struct {
 	valid     bool
 	iterValid bool
 	pos       iterPos
+	// copyValues is set if the values of the underlying iterator may be freed
+	// once it is repositioned, in which case a value retained while the
+	// iterator steps backward is copied. See db.Options.CacheAllocator.
+	copyValues bool
+	// lazy, if non-nil, collects the merge operands of the current key when
+	// iterating forward, which are merged on demand. See
+	// db.IterOptions.LazyMerge.
+	lazy *LazyMergeValue
+	// The prefix for prefix iteration (see db.IterOptions.Prefix), along with
+	// the functions used to extract and compare the prefix of each key.
+	prefix        []byte
+	prefixExtract func(key []byte) []byte
+	prefixEqual   func(a, b []byte) bool
+	// prefixEnd is the smallest key greater than every key with the prefix,
+	// as determined by Comparer.RangeEndSentinel. Nil if there is no such key,
+	// or the comparer does not define RangeEndSentinel.
+	prefixEnd []byte
+	// allVersions causes every version of each key to be returned, with the
+	// trailer of the current version in trailer. See db.IterOptions.AllVersions.
+	allVersions bool
+	trailer     uint64
+	// tenant is the prefix which all of the keys returned by the iterator are
+	// required to have, and tenantEnd its immediate byte-wise successor. See
+	// db.IterOptions.TenantPrefix.
+	tenant    []byte
+	tenantEnd []byte
+	// nextNBuf holds the copies of the key/value pairs returned by NextN.
+	nextNBuf []byte
+}
+
+// initPrefix configures prefix iteration from the iterator options. The upper
+// bound of the keys with the prefix is determined by rangeEnd, which is the
+// Comparer.RangeEndSentinel of the DB, if non-nil.
+func (i *Iterator) initPrefix(rangeEnd db.RangeEndSentinel, pe *db.PrefixExtractor) {
+	i.prefix = i.opts.GetPrefix()
+	if i.prefix == nil {
+		return
+	}
+	if rangeEnd != nil {
+		i.prefixEnd = rangeEnd(i.prefix)
+	}
+	if pe != nil && pe.Extract != nil {
+		i.prefixExtract = pe.Extract
+	} else {
+		n := len(i.prefix)
+		i.prefixExtract = func(key []byte) []byte {
+			if len(key) > n {
+				return key[:n]
+			}
+			return key
+		}
+	}
+	if pe != nil && pe.PrefixEqual != nil {
+		i.prefixEqual = pe.PrefixEqual
+	} else {
+		cmp := i.cmp
+		i.prefixEqual = func(a, b []byte) bool {
+			return cmp(a, b) == 0
+		}
+	}
+}
+
+// initTenant configures the tenant prefix from the iterator options.
+func (i *Iterator) initTenant() {
+	i.tenant = i.opts.GetTenantPrefix()
+	if i.tenant != nil {
+		i.tenantEnd = db.DefaultComparer.RangeEndSentinel(i.tenant)
+	}
+}
+
+// checkTenant verifies that the key the iterator is positioned at, if any,
+// has the tenant prefix. The seeks are clamped to the keys with the tenant
+// prefix, and iteration stops at the boundaries of those keys, so a key
+// without the prefix indicates a bug. Such a key is never returned; the
+// iterator is invalidated and the violation is reported via Error.
+func (i *Iterator) checkTenant(valid bool) bool {
+	if !valid || i.tenant == nil || bytes.HasPrefix(i.key, i.tenant) {
+		return valid
+	}
+	i.err = fmt.Errorf("pebble: iterator positioned at key %q outside of tenant prefix %q",
+		i.key, i.tenant)
+	i.valid = false
+	i.iterValid = false
+	return false
+}
+
+// iterFirst positions the underlying iterator at its first entry, or at the
+// first entry with the tenant prefix if there is one.
+func (i *Iterator) iterFirst() bool {
+	if i.tenant != nil {
+		return i.iter.SeekGE(i.tenant)
+	}
+	return i.iter.First()
+}
+
+// iterLast positions the underlying iterator at its last entry, or at the last
+// entry with the tenant prefix if there is one.
+func (i *Iterator) iterLast() bool {
+	if i.tenantEnd != nil {
+		return i.iter.SeekLT(i.tenantEnd)
+	}
+	return i.iter.Last()
+}
+
+// pastTenantEnd returns true if key sorts after the keys with the tenant
+// prefix, at which forward iteration stops.
+func (i *Iterator) pastTenantEnd(key []byte) bool {
+	return i.tenantEnd != nil && i.cmp(key, i.tenantEnd) >= 0
+}
+
+// beforeTenant returns true if key sorts before the keys with the tenant
+// prefix, at which reverse iteration stops.
+func (i *Iterator) beforeTenant(key []byte) bool {
+	return i.tenant != nil && i.cmp(key, i.tenant) < 0
 }
 
 func (i *Iterator) findNextEntry() bool {
 	upperBound := i.opts.GetUpperBound()
 	i.valid = false
 	i.pos = iterPosCur
+	i.lazy.reset()
 
 	for i.iterValid {
 		key := i.iter.Key()
 		if upperBound != nil && i.cmp(key.UserKey, upperBound) >= 0 {
 			break
 		}
+		if i.prefix != nil && !i.prefixEqual(i.prefixExtract(key.UserKey), i.prefix) {
+			break
+		}
+		if i.pastTenantEnd(key.UserKey) {
+			break
+		}
 
 		switch key.Kind() {
 		case db.InternalKeyKindDelete:
@@ -102,7 +224,7 @@ func (i *Iterator) nextUserKey() {
 			}
 		}
 	} else {
-		i.iterValid = i.iter.First()
+		i.iterValid = i.iterFirst()
 	}
 }
 
@@ -110,12 +232,25 @@ func (i *Iterator) findPrevEntry() bool {
 	lowerBound := i.opts.GetLowerBound()
 	i.valid = false
 	i.pos = iterPosCur
+	i.lazy.reset()
 
 	for i.iterValid {
 		key := i.iter.Key()
 		if lowerBound != nil && i.cmp(key.UserKey, lowerBound) < 0 {
 			break
 		}
+		if i.beforeTenant(key.UserKey) {
+			break
+		}
+		if i.prefix != nil && !i.prefixEqual(i.prefixExtract(key.UserKey), i.prefix) {
+			if i.cmp(key.UserKey, i.prefix) < 0 {
+				break
+			}
+			// The key sorts after the keys with the prefix, which can only happen
+			// if there is no prefixEnd to position the iterator below.
+			i.iterValid = i.iter.Prev()
+			continue
+		}
 
 		if i.valid {
 			if !i.equal(key.UserKey, i.key) {
@@ -141,7 +276,7 @@ func (i *Iterator) findPrevEntry() bool {
 		case db.InternalKeyKindSet:
 			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 			i.key = i.keyBuf
-			i.value = i.iter.Value()
+			i.value = i.prevValue()
 			i.valid = true
 			i.iterValid = i.iter.Prev()
 			continue
@@ -150,7 +285,7 @@ func (i *Iterator) findPrevEntry() bool {
 			if !i.valid {
 				i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 				i.key = i.keyBuf
-				i.value = i.iter.Value()
+				i.value = i.prevValue()
 				i.valid = true
 			} else {
 				// The existing value is either stored in valueBuf2 or the underlying
@@ -180,6 +315,38 @@ func (i *Iterator) findPrevEntry() bool {
 	return false
 }
 
+// prevValue returns the value of the underlying iterator, which is retained
+// while the underlying iterator steps backward. The value is copied into
+// valueBuf2, where a merged value is also kept, if the underlying iterator
+// may invalidate it.
+func (i *Iterator) prevValue() []byte {
+	if !i.copyValues {
+		return i.iter.Value()
+	}
+	i.valueBuf2 = append(i.valueBuf2[:0], i.iter.Value()...)
+	return i.valueBuf2
+}
+
+// nextVersion advances the underlying iterator past the current version. Like
+// nextUserKey, it positions an exhausted underlying iterator at its first
+// entry.
+func (i *Iterator) nextVersion() {
+	if i.iterValid {
+		i.iterValid = i.iter.Next()
+	} else {
+		i.iterValid = i.iterFirst()
+	}
+}
+
+// prevVersion is nextVersion in the reverse direction.
+func (i *Iterator) prevVersion() {
+	if i.iterValid {
+		i.iterValid = i.iter.Prev()
+	} else {
+		i.iterValid = i.iterLast()
+	}
+}
+
 func (i *Iterator) prevUserKey() {
 	if i.iterValid {
 		if !i.valid {
@@ -193,16 +360,147 @@ func (i *Iterator) prevUserKey() {
 			}
 		}
 	} else {
-		i.iterValid = i.iter.Last()
+		i.iterValid = i.iterLast()
+	}
+}
+
+// findNextVersion positions the iterator at the first version at or after the
+// position of the underlying iterator, skipping the versions rejected by the
+// ValueFilter. See db.IterOptions.AllVersions.
+func (i *Iterator) findNextVersion() bool {
+	upperBound := i.opts.GetUpperBound()
+	i.valid = false
+	i.pos = iterPosCur
+
+	for ; i.iterValid; i.iterValid = i.iter.Next() {
+		key := i.iter.Key()
+		if upperBound != nil && i.cmp(key.UserKey, upperBound) >= 0 {
+			break
+		}
+		if i.prefix != nil && !i.prefixEqual(i.prefixExtract(key.UserKey), i.prefix) {
+			break
+		}
+		if i.pastTenantEnd(key.UserKey) {
+			break
+		}
+		if i.setVersion(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// findPrevVersion is findNextVersion in the reverse direction.
+func (i *Iterator) findPrevVersion() bool {
+	lowerBound := i.opts.GetLowerBound()
+	i.valid = false
+	i.pos = iterPosCur
+
+	for ; i.iterValid; i.iterValid = i.iter.Prev() {
+		key := i.iter.Key()
+		if lowerBound != nil && i.cmp(key.UserKey, lowerBound) < 0 {
+			break
+		}
+		if i.beforeTenant(key.UserKey) {
+			break
+		}
+		if i.prefix != nil && !i.prefixEqual(i.prefixExtract(key.UserKey), i.prefix) {
+			if i.cmp(key.UserKey, i.prefix) < 0 {
+				break
+			}
+			// The key sorts after the keys with the prefix. See findPrevEntry.
+			continue
+		}
+		if i.setVersion(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// setVersion makes the version at the position of the underlying iterator the
+// current one, returning false if it is a range deletion or is rejected by the
+// ValueFilter.
+func (i *Iterator) setVersion(key db.InternalKey) bool {
+	switch key.Kind() {
+	case db.InternalKeyKindRangeDelete:
+		// Range deletions are treated as no-ops. See the comments in levelIter
+		// for more details.
+		return false
+	case db.InternalKeyKindDelete, db.InternalKeyKindSet, db.InternalKeyKindMerge:
+	default:
+		i.err = fmt.Errorf("invalid internal key kind: %d", key.Kind())
+		i.iterValid = false
+		return false
+	}
+	i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
+	i.key = i.keyBuf
+	i.trailer = key.Trailer
+	i.value = i.iter.Value()
+	i.valid = true
+	return key.Kind() == db.InternalKeyKindDelete || i.matches()
+}
+
+// findNextMatchingEntry is findNextEntry, skipping the entries rejected by the
+// ValueFilter.
+//
+// TODO(peter): the filter is applied to each resolved entry, so a block of
+// rejected entries is still read and decoded. Record a per-block summary of
+// the values in the index entries written by the sstable writer and consult
+// it to skip whole data blocks the filter rejects.
+func (i *Iterator) findNextMatchingEntry() bool {
+	if i.allVersions {
+		return i.checkTenant(i.findNextVersion())
 	}
+	for i.findNextEntry() {
+		if i.matches() {
+			return i.checkTenant(true)
+		}
+		if i.pos == iterPosCur {
+			i.nextUserKey()
+		}
+	}
+	return false
+}
+
+// findPrevMatchingEntry is findPrevEntry, skipping the entries rejected by the
+// ValueFilter.
+func (i *Iterator) findPrevMatchingEntry() bool {
+	if i.allVersions {
+		return i.checkTenant(i.findPrevVersion())
+	}
+	for i.findPrevEntry() {
+		if i.matches() {
+			return i.checkTenant(true)
+		}
+		// The underlying iterator is positioned at the previous user key, from
+		// which findPrevEntry continues.
+	}
+	return false
+}
+
+// matches returns true if the current entry passes the ValueFilter.
+func (i *Iterator) matches() bool {
+	if i.opts == nil || i.opts.ValueFilter == nil || i.opts.ValueFilter(i.key, i.Value()) {
+		return true
+	}
+	i.valid = false
+	return false
 }
 
 func (i *Iterator) mergeNext(key db.InternalKey) bool {
 	// Save the current key and value.
 	i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
-	i.valueBuf = append(i.valueBuf[:0], i.iter.Value()...)
-	i.key, i.value = i.keyBuf, i.valueBuf
+	i.key = i.keyBuf
 	i.valid = true
+	if i.lazy != nil {
+		i.lazy.init(i.key, i.merge)
+		i.lazy.add(i.iter.Value())
+		i.value = nil
+	} else {
+		i.valueBuf = append(i.valueBuf[:0], i.iter.Value()...)
+		i.value = i.valueBuf
+	}
 
 	// Loop looking for older values for this key and merging them.
 	for {
@@ -230,12 +528,20 @@ func (i *Iterator) mergeNext(key db.InternalKey) bool {
 
 		case db.InternalKeyKindSet:
 			// We've hit a Set value. Merge with the existing value and return.
+			if i.lazy != nil {
+				i.lazy.add(i.iter.Value())
+				return true
+			}
 			i.value = i.merge(i.key, i.value, i.iter.Value(), nil)
 			return true
 
 		case db.InternalKeyKindMerge:
 			// We've hit another Merge value. Merge with the existing value and
 			// continue looping.
+			if i.lazy != nil {
+				i.lazy.add(i.iter.Value())
+				continue
+			}
 			i.value = i.merge(i.key, i.value, i.iter.Value(), nil)
 			i.valueBuf = i.value[:0]
 			continue
@@ -258,9 +564,18 @@ func (i *Iterator) SeekGE(key []byte) bool {
 	if lowerBound := i.opts.GetLowerBound(); lowerBound != nil && i.cmp(key, lowerBound) < 0 {
 		key = lowerBound
 	}
+	if i.prefix != nil && i.cmp(key, i.prefix) < 0 {
+		// Keys with the prefix sort at or after the prefix itself.
+		key = i.prefix
+	}
+	if i.beforeTenant(key) {
+		key = i.tenant
+	} else if i.pastTenantEnd(key) {
+		key = i.tenantEnd
+	}
 
 	i.iterValid = i.iter.SeekGE(key)
-	return i.findNextEntry()
+	return i.findNextMatchingEntry()
 }
 
 // SeekLT moves the iterator to the last key/value pair whose key is less than
@@ -274,9 +589,17 @@ func (i *Iterator) SeekLT(key []byte) bool {
 	if upperBound := i.opts.GetUpperBound(); upperBound != nil && i.cmp(key, upperBound) >= 0 {
 		key = upperBound
 	}
+	if i.prefixEnd != nil && i.cmp(key, i.prefixEnd) > 0 {
+		key = i.prefixEnd
+	}
+	if i.pastTenantEnd(key) {
+		key = i.tenantEnd
+	} else if i.beforeTenant(key) {
+		key = i.tenant
+	}
 
 	i.iterValid = i.iter.SeekLT(key)
-	return i.findPrevEntry()
+	return i.findPrevMatchingEntry()
 }
 
 // First moves the iterator the the first key/value pair. Returns true if the
@@ -286,12 +609,19 @@ func (i *Iterator) First() bool {
 		return false
 	}
 
+	if i.prefix != nil {
+		// Keys with the prefix sort at or after the prefix itself.
+		return i.SeekGE(i.prefix)
+	}
 	if lowerBound := i.opts.GetLowerBound(); lowerBound != nil {
 		return i.SeekGE(lowerBound)
 	}
+	if i.tenant != nil {
+		return i.SeekGE(i.tenant)
+	}
 
 	i.iterValid = i.iter.First()
-	return i.findNextEntry()
+	return i.findNextMatchingEntry()
 }
 
 // Last moves the iterator the the last key/value pair. Returns true if the
@@ -301,12 +631,18 @@ func (i *Iterator) Last() bool {
 		return false
 	}
 
+	if i.prefixEnd != nil {
+		return i.SeekLT(i.prefixEnd)
+	}
 	if upperBound := i.opts.GetUpperBound(); upperBound != nil {
 		return i.SeekLT(upperBound)
 	}
+	if i.tenantEnd != nil {
+		return i.SeekLT(i.tenantEnd)
+	}
 
 	i.iterValid = i.iter.Last()
-	return i.findPrevEntry()
+	return i.findPrevMatchingEntry()
 }
 
 // Next moves the iterator to the next key/value pair. Returns true if the
@@ -315,15 +651,145 @@ func (i *Iterator) Next() bool {
 	if i.err != nil {
 		return false
 	}
+	if i.allVersions {
+		i.nextVersion()
+		return i.findNextVersion()
+	}
 	switch i.pos {
 	case iterPosCur:
 		i.nextUserKey()
 	case iterPosPrev:
+		// The underlying iterator is positioned at the previous user key.
+		// Clearing i.valid makes nextUserKey skip the user key the underlying
+		// iterator is positioned at, rather than the current one.
+		i.valid = false
 		i.nextUserKey()
 		i.nextUserKey()
 	case iterPosNext:
 	}
-	return i.findNextEntry()
+	return i.findNextMatchingEntry()
+}
+
+// NextN moves the iterator forward over up to len(dst) key/value pairs,
+// filling dst with each of them in turn, as if by successive calls to Next.
+// It returns the number of pairs filled, which is less than len(dst) once the
+// iterator is exhausted or reaches its upper bound, along with any
+// accumulated error. The iterator is left positioned at the last pair filled,
+// or exhausted. Unlike Next, NextN does not move an iterator which is not
+// positioned at a pair, such as an exhausted one, and fills nothing. An empty
+// dst leaves the iterator where it is. For a plain forward scan, NextN steps
+// through the merged levels directly, without the per-call checks and
+// bookkeeping of Next.
+//
+// The keys and values filled are copies held in a buffer owned by the
+// iterator, and remain valid until the next call to NextN. They are copied as
+// the underlying iterators reuse their key buffers from one entry to the next,
+// and may release the data blocks holding their values as they move on. The
+// caller should not modify their contents.
+func (i *Iterator) NextN(dst []KV) (int, error) {
+	if !i.valid || len(dst) == 0 {
+		return 0, i.Error()
+	}
+	if i.pos == iterPosPrev || i.allVersions || i.lazy != nil || i.prefix != nil || i.tenant != nil ||
+		(i.opts != nil && i.opts.ValueFilter != nil) {
+		return i.nextNSlow(dst)
+	}
+
+	upperBound := i.opts.GetUpperBound()
+	iter := i.iter
+	buf := i.nextNBuf[:0]
+	// key is the user key whose remaining versions are skipped before looking
+	// for the next entry, if skip is set.
+	key, skip := i.key, i.pos == iterPosCur
+	var n int
+	for n < len(dst) {
+		if skip {
+			for {
+				i.iterValid = iter.Next()
+				if !i.iterValid || !i.equal(key, iter.Key().UserKey) {
+					break
+				}
+			}
+		}
+		if !i.iterValid {
+			break
+		}
+		ikey := iter.Key()
+		if upperBound != nil && i.cmp(ikey.UserKey, upperBound) >= 0 {
+			break
+		}
+		switch ikey.Kind() {
+		case db.InternalKeyKindSet:
+			start := len(buf)
+			buf = append(buf, ikey.UserKey...)
+			buf = append(buf, iter.Value()...)
+			mid, end := start+len(ikey.UserKey), len(buf)
+			dst[n] = KV{Key: buf[start:mid:mid], Value: buf[mid:end:end]}
+			n++
+			key, skip = dst[n-1].Key, true
+			continue
+
+		case db.InternalKeyKindDelete:
+			i.keyBuf = append(i.keyBuf[:0], ikey.UserKey...)
+			key, skip = i.keyBuf, true
+			continue
+
+		case db.InternalKeyKindRangeDelete:
+			// Range deletions are treated as no-ops. See the comments in levelIter
+			// for more details.
+			i.iterValid = iter.Next()
+			skip = false
+			continue
+		}
+
+		// A merge, or an invalid kind, is left to findNextEntry.
+		if !i.findNextEntry() {
+			break
+		}
+		start := len(buf)
+		buf = append(buf, i.key...)
+		buf = append(buf, i.value...)
+		mid, end := start+len(i.key), len(buf)
+		dst[n] = KV{Key: buf[start:mid:mid], Value: buf[mid:end:end]}
+		n++
+		key, skip = dst[n-1].Key, i.pos == iterPosCur
+	}
+	i.nextNBuf = buf
+
+	if n < len(dst) {
+		i.valid = false
+		i.pos = iterPosCur
+		return n, i.Error()
+	}
+	// Leave the iterator positioned at the last pair, as Next would.
+	i.keyBuf = append(i.keyBuf[:0], key...)
+	i.key = i.keyBuf
+	i.value = dst[n-1].Value
+	i.valid = true
+	if skip {
+		i.pos = iterPosCur
+	} else {
+		i.pos = iterPosNext
+	}
+	return n, nil
+}
+
+// nextNSlow is NextN for the iterators whose options call for the checks of
+// Next on each step, filling dst by calling Next.
+func (i *Iterator) nextNSlow(dst []KV) (int, error) {
+	buf := i.nextNBuf[:0]
+	var n int
+	for n < len(dst) && i.Next() {
+		key, value := i.key, i.Value()
+		start := len(buf)
+		buf = append(buf, key...)
+		buf = append(buf, value...)
+		mid, end := start+len(key), len(buf)
+		dst[n] = KV{Key: buf[start:mid:mid], Value: buf[mid:end:end]}
+		n++
+	}
+	i.nextNBuf = buf
+	return n, i.Error()
 }
 
 // Prev moves the iterator to the previous key/value pair. Returns true if the
@@ -332,15 +798,22 @@ func (i *Iterator) Prev() bool {
 	if i.err != nil {
 		return false
 	}
+	if i.allVersions {
+		i.prevVersion()
+		return i.findPrevVersion()
+	}
 	switch i.pos {
 	case iterPosCur:
 		i.prevUserKey()
 	case iterPosNext:
+		// The underlying iterator is positioned at the next user key. See
+		// Next.
+		i.valid = false
 		i.prevUserKey()
 		i.prevUserKey()
 	case iterPosPrev:
 	}
-	return i.findPrevEntry()
+	return i.findPrevMatchingEntry()
 }
 
 // Key returns the key of the current key/value pair, or nil if done. The
@@ -354,9 +827,41 @@ func (i *Iterator) Key() []byte {
 // caller should not modify the contents of the returned slice, and its
 // contents may change on the next call to Next.
 func (i *Iterator) Value() []byte {
+	if i.lazy.active() {
+		return i.lazy.Value()
+	}
 	return i.value
 }
 
+// InternalKey returns the key of the current key/value pair along with its
+// sequence number and kind. It is only meaningful for an iterator created
+// with db.IterOptions.AllVersions, which returns each version of a key as a
+// distinct key/value pair; the caller should not modify the returned user key,
+// which is the slice returned by Key.
+func (i *Iterator) InternalKey() db.InternalKey {
+	if !i.valid {
+		return db.InternalKey{}
+	}
+	return db.InternalKey{UserKey: i.key, Trailer: i.trailer}
+}
+
+// LazyValue returns the value of the current key/value pair as a
+// LazyMergeValue, whose merge operands are only merged when its value is
+// retrieved. It requires db.IterOptions.LazyMerge, and returns nil otherwise
+// or if the iterator is not positioned at a valid key/value pair. The merge is
+// only deferred when iterating forward; the value of a key found by Prev or
+// Last, or which has no merge operands, is already resolved. The returned
+// LazyMergeValue is invalidated by the next call to Next.
+func (i *Iterator) LazyValue() *LazyMergeValue {
+	if i.lazy == nil || !i.valid {
+		return nil
+	}
+	if !i.lazy.active() {
+		i.lazy.resolved(i.value)
+	}
+	return i.lazy
+}
+
 // Valid returns true if the iterator is positioned at a valid key/value pair
 // and false otherwise.
 func (i *Iterator) Valid() bool {
@@ -365,6 +870,9 @@ func (i *Iterator) Valid() bool {
 
 // Error returns any accumulated error.
 func (i *Iterator) Error() error {
+	if i.err == nil && i.iter != nil {
+		return i.iter.Error()
+	}
 	return i.err
 }
 
@@ -382,3 +890,93 @@ func (i *Iterator) Close() error {
 	}
 	return i.err
 }
+
+// LazyMergeValue is the value of a key whose merge operands have been
+// collected but not yet merged. See Iterator.LazyValue.
+//
+// The operands are copied out of the underlying blocks as they are collected,
+// so they remain valid until the value is forced or released.
+type LazyMergeValue struct {
+	key   []byte
+	merge db.Merge
+	// buf holds the operands, from newest to oldest. ends holds the offset in
+	// buf of the end of each operand.
+	buf      []byte
+	ends     []int
+	value    []byte
+	valueBuf []byte
+	// state is one of the lazy* constants.
+	state int
+}
+
+const (
+	lazyEmpty = iota
+	lazyPending
+	lazyForced
+)
+
+func (v *LazyMergeValue) init(key []byte, merge db.Merge) {
+	v.key = key
+	v.merge = merge
+	v.buf = v.buf[:0]
+	v.ends = v.ends[:0]
+	v.state = lazyPending
+}
+
+func (v *LazyMergeValue) add(operand []byte) {
+	v.buf = append(v.buf, operand...)
+	v.ends = append(v.ends, len(v.buf))
+}
+
+func (v *LazyMergeValue) resolved(value []byte) {
+	v.value = value
+	v.state = lazyForced
+}
+
+func (v *LazyMergeValue) reset() {
+	if v != nil {
+		v.state = lazyEmpty
+	}
+}
+
+// active returns whether v holds the value of the current key.
+func (v *LazyMergeValue) active() bool {
+	return v != nil && v.state != lazyEmpty
+}
+
+// NumOperands returns the number of operands collected for the key, including
+// the value of a set which ends the chain, or 0 if the value has been forced
+// or released.
+func (v *LazyMergeValue) NumOperands() int {
+	if v.state != lazyPending {
+		return 0
+	}
+	return len(v.ends)
+}
+
+// Value forces the value, merging the operands through the merger from newest
+// to oldest, and returns the merged value. Subsequent calls return the same
+// value without merging again. The caller should not modify the contents of
+// the returned slice. Value returns nil after Release.
+func (v *LazyMergeValue) Value() []byte {
+	if v.state != lazyPending {
+		return v.value
+	}
+	// The newest operand is copied, as the merger may append to it.
+	v.value = append(v.valueBuf[:0], v.buf[:v.ends[0]]...)
+	for j := 1; j < len(v.ends); j++ {
+		v.value = v.merge(v.key, v.value, v.buf[v.ends[j-1]:v.ends[j]], nil)
+	}
+	v.valueBuf = v.value[:0]
+	v.state = lazyForced
+	return v.value
+}
+
+// Release releases the operands without merging them. It is not necessary to
+// release a value which has been forced.
+func (v *LazyMergeValue) Release() {
+	v.buf = v.buf[:0]
+	v.ends = v.ends[:0]
+	v.value = nil
+	v.state = lazyForced
+}
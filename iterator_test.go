@@ -6,16 +6,20 @@ package pebble
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/datadriven"
+	"github.com/petermattis/pebble/storage"
 )
 
 var testKeyValuePairs = []string{
@@ -243,19 +247,22 @@ func TestIterator(t *testing.T) {
 	var keys []db.InternalKey
 	var vals [][]byte
 
-	newIter := func(seqNum uint64, opts *db.IterOptions) *Iterator {
+	newIter := func(seqNum uint64, opts *db.IterOptions, rangeEnd db.RangeEndSentinel) *Iterator {
 		cmp := db.DefaultComparer.Compare
 		equal := db.DefaultComparer.Equal
 		// NB: Use a mergingIter to filter entries newer than seqNum.
 		iter := newMergingIter(cmp, &fakeIter{keys: keys, vals: vals})
 		iter.snapshot = seqNum
-		return &Iterator{
+		i := &Iterator{
 			opts:  opts,
 			cmp:   cmp,
 			equal: equal,
 			merge: db.DefaultMerger.Merge,
 			iter:  iter,
 		}
+		i.initPrefix(rangeEnd, nil)
+		i.initTenant()
+		return i
 	}
 
 	datadriven.RunTest(t, "testdata/iterator", func(d *datadriven.TestData) string {
@@ -273,6 +280,7 @@ func TestIterator(t *testing.T) {
 		case "iter":
 			var seqNum int
 			var opts db.IterOptions
+			rangeEnd := db.DefaultComparer.RangeEndSentinel
 
 			for _, arg := range d.CmdArgs {
 				if len(arg.Vals) != 1 {
@@ -289,12 +297,23 @@ func TestIterator(t *testing.T) {
 					opts.LowerBound = []byte(arg.Vals[0])
 				case "upper":
 					opts.UpperBound = []byte(arg.Vals[0])
+				case "prefix":
+					opts.Prefix = []byte(arg.Vals[0])
+				case "tenant":
+					opts.TenantPrefix = []byte(arg.Vals[0])
+				case "range-end":
+					// range-end=none iterates as with a comparer which does not
+					// define RangeEndSentinel.
+					if arg.Vals[0] != "none" {
+						return fmt.Sprintf("%s: unknown range-end: %s", d.Cmd, arg.Vals[0])
+					}
+					rangeEnd = nil
 				default:
 					return fmt.Sprintf("%s: unknown arg: %s", d.Cmd, arg.Key)
 				}
 			}
 
-			iter := newIter(uint64(seqNum), &opts)
+			iter := newIter(uint64(seqNum), &opts, rangeEnd)
 			defer iter.Close()
 			return runIterCmd(d, iter)
 
@@ -304,8 +323,536 @@ func TestIterator(t *testing.T) {
 	})
 }
 
+// seekIgnoringIter is an internalIterator whose seeks position it at its first
+// or last entry regardless of the seek key, for testing the handling of
+// buggy internal iterators.
+type seekIgnoringIter struct {
+	*fakeIter
+}
+
+func (i seekIgnoringIter) SeekGE(key []byte) bool {
+	return i.First()
+}
+
+func (i seekIgnoringIter) SeekLT(key []byte) bool {
+	return i.Last()
+}
+
+func TestIteratorTenantPrefix(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	keys := []string{
+		"", "t0", "t0/a", "t1", "t1.", "t1/", "t1/a", "t1/b", "t1/c", "t10", "t1\xff",
+		"t2", "t2/a", "\xff\xff",
+	}
+	for _, k := range keys {
+		if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The seek targets and bounds include keys of other tenants, and bounds
+	// excluding the tenant entirely.
+	const tenant = "t1/"
+	targets := append(keys, "a", "t1/bb", "t1/\xff", "t1/\xff\xff", "t10/a", "z")
+	bounds := [][2]string{
+		{"", ""}, {"a", "z"}, {"t0", "t2"}, {"t1/b", "t2"}, {"t0", "t1/b"}, {"t2", "t3"},
+		{"", "t1"},
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, b := range bounds {
+		opts := &db.IterOptions{TenantPrefix: []byte(tenant)}
+		if b[0] != "" {
+			opts.LowerBound = []byte(b[0])
+		}
+		if b[1] != "" {
+			opts.UpperBound = []byte(b[1])
+		}
+		// expected returns the keys with the tenant prefix within the bounds.
+		var expected []string
+		for _, k := range keys {
+			if strings.HasPrefix(k, tenant) && (b[0] == "" || k >= b[0]) && (b[1] == "" || k < b[1]) {
+				expected = append(expected, k)
+			}
+		}
+		sort.Strings(expected)
+
+		iter := d.NewIter(opts)
+		for j := 0; j < 1000; j++ {
+			var valid bool
+			var pos int // the index in expected of the expected key
+			target := targets[rng.Intn(len(targets))]
+			switch rng.Intn(6) {
+			case 0:
+				valid = iter.First()
+				pos = 0
+			case 1:
+				valid = iter.Last()
+				pos = len(expected) - 1
+			case 2:
+				valid = iter.SeekGE([]byte(target))
+				pos = sort.SearchStrings(expected, target)
+			case 3:
+				valid = iter.SeekLT([]byte(target))
+				pos = sort.SearchStrings(expected, target) - 1
+			default:
+				continue
+			}
+			// Step around the position reached.
+			for k := 0; k < 3; k++ {
+				if pos >= 0 && pos < len(expected) {
+					if !valid || string(iter.Key()) != expected[pos] {
+						t.Fatalf("bounds %q: expected %q, but found %q (%t)", b, expected[pos], iter.Key(), valid)
+					}
+				} else if valid {
+					t.Fatalf("bounds %q: expected no key, but found %q", b, iter.Key())
+				}
+				if valid && !strings.HasPrefix(string(iter.Key()), tenant) {
+					t.Fatalf("bounds %q: key %q outside of the tenant prefix", b, iter.Key())
+				}
+				if !valid || rng.Intn(2) == 0 {
+					break
+				}
+				if rng.Intn(2) == 0 {
+					valid = iter.Next()
+					pos++
+				} else {
+					valid = iter.Prev()
+					pos--
+				}
+			}
+			if err := iter.Error(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An internal iterator ignoring the seek keys would yield keys without the
+	// tenant prefix, which are not returned.
+	f := &fakeIter{}
+	for _, k := range []string{"a", "b/a", "b/b", "c"} {
+		f.keys = append(f.keys, db.MakeInternalKey([]byte(k), 1, db.InternalKeyKindSet))
+		f.vals = append(f.vals, []byte(k))
+	}
+	for _, op := range []string{"first", "last", "seek-ge", "seek-lt"} {
+		iter := &Iterator{
+			opts:  &db.IterOptions{TenantPrefix: []byte("b/")},
+			cmp:   db.DefaultComparer.Compare,
+			equal: db.DefaultComparer.Equal,
+			merge: db.DefaultMerger.Merge,
+			iter:  seekIgnoringIter{f},
+		}
+		iter.initPrefix(db.DefaultComparer.RangeEndSentinel, nil)
+		iter.initTenant()
+		var valid bool
+		switch op {
+		case "first":
+			valid = iter.First()
+		case "last":
+			valid = iter.Last()
+		case "seek-ge":
+			valid = iter.SeekGE([]byte("b/b"))
+		case "seek-lt":
+			valid = iter.SeekLT([]byte("b/b"))
+		}
+		if valid {
+			t.Fatalf("%s: expected no key, but found %q", op, iter.Key())
+		}
+		if err := iter.Error(); err == nil || !strings.Contains(err.Error(), "outside of tenant prefix") {
+			t.Fatalf("%s: expected a tenant prefix error, but found %v", op, err)
+		}
+		if iter.Next() || iter.Prev() {
+			t.Fatalf("%s: expected the iterator to remain invalid", op)
+		}
+	}
+}
+
+func TestIteratorValueFilter(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The merge operands of "c" only match the filter once merged, and "d" and
+	// "e" are deleted by a point and range deletion respectively.
+	b := d.NewBatch()
+	b.Set([]byte("a"), []byte("keep-a"), nil)
+	b.Set([]byte("b"), []byte("drop-b"), nil)
+	b.Merge([]byte("c"), []byte("ep-c"), nil)
+	b.Merge([]byte("c"), []byte("ke"), nil)
+	b.Set([]byte("d"), []byte("keep-d"), nil)
+	b.Delete([]byte("d"), nil)
+	b.Set([]byte("e"), []byte("keep-e"), nil)
+	b.DeleteRange([]byte("e"), []byte("f"), nil)
+	b.Set([]byte("f"), []byte("keep-f"), nil)
+	b.Set([]byte("g"), []byte("drop-g"), nil)
+	if err := d.Apply(b, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var filtered []string
+	iter := d.NewIter(&db.IterOptions{
+		ValueFilter: func(key, value []byte) bool {
+			filtered = append(filtered, string(key))
+			return bytes.HasPrefix(value, []byte("keep"))
+		},
+	})
+	defer iter.Close()
+
+	testCases := []struct {
+		op       func() bool
+		expected string
+	}{
+		{iter.First, "a:keep-a"},
+		{iter.Next, "c:keep-c"},
+		{iter.Next, "f:keep-f"},
+		{iter.Next, "."},
+		{iter.Last, "f:keep-f"},
+		{iter.Prev, "c:keep-c"},
+		{iter.Prev, "a:keep-a"},
+		{iter.Prev, "."},
+		{func() bool { return iter.SeekGE([]byte("b")) }, "c:keep-c"},
+		{iter.Prev, "a:keep-a"},
+		{iter.Next, "c:keep-c"},
+		{iter.Next, "f:keep-f"},
+		{iter.Prev, "c:keep-c"},
+		{func() bool { return iter.SeekLT([]byte("c")) }, "a:keep-a"},
+	}
+	for j, c := range testCases {
+		var found string
+		if c.op() {
+			found = fmt.Sprintf("%s:%s", iter.Key(), iter.Value())
+		} else {
+			found = "."
+		}
+		if c.expected != found {
+			t.Fatalf("%d: expected %s, but found %s", j, c.expected, found)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range filtered {
+		if key == "d" || key == "e" {
+			t.Fatalf("deleted key %s was passed to the filter", key)
+		}
+	}
+}
+
+func TestIteratorAllVersions(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	set := func(key, value string) {
+		if err := d.Set([]byte(key), []byte(value), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The versions are spread across a table and the memtable, and the first
+	// snapshot preserves the versions older than it across the flush.
+	set("a", "a1")
+	set("b", "b1")
+	s1 := d.NewSnapshot()
+	defer s1.Close()
+	set("a", "a2")
+	if err := d.Delete([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	set("c", "c1")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set("a", "a3")
+	s2 := d.NewSnapshot()
+	defer s2.Close()
+	set("a", "a4")
+
+	version := func(iter *Iterator) string {
+		k := iter.InternalKey()
+		return fmt.Sprintf("%s:%s=%s", k.UserKey, k.Kind(), iter.Value())
+	}
+	iter := s2.NewIter(&db.IterOptions{AllVersions: true})
+	var versions []string
+	var prev db.InternalKey
+	for iter.First(); iter.Valid(); iter.Next() {
+		versions = append(versions, version(iter))
+		k := iter.InternalKey()
+		if string(k.UserKey) == string(prev.UserKey) && k.SeqNum() >= prev.SeqNum() {
+			t.Fatalf("expected decreasing sequence numbers, but found %s after %s", k, prev)
+		}
+		prev = db.InternalKey{UserKey: append([]byte(nil), k.UserKey...), Trailer: k.Trailer}
+	}
+	const expected = "a:SET=a3,a:SET=a2,a:SET=a1,b:DEL=,b:SET=b1,c:SET=c1"
+	if s := strings.Join(versions, ","); s != expected {
+		t.Fatalf("expected %s, but found %s", expected, s)
+	}
+
+	// Iterating backward returns the versions in the reverse order.
+	versions = versions[:0]
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		versions = append([]string{version(iter)}, versions...)
+	}
+	if s := strings.Join(versions, ","); s != expected {
+		t.Fatalf("expected %s, but found %s", expected, s)
+	}
+
+	// Seeking positions the iterator at the newest version of the key, and
+	// switching direction steps between the versions.
+	if !iter.SeekGE([]byte("b")) || version(iter) != "b:DEL=" {
+		t.Fatalf("expected b:DEL=, but found %s", version(iter))
+	}
+	if !iter.Prev() || version(iter) != "a:SET=a1" {
+		t.Fatalf("expected a:SET=a1, but found %s", version(iter))
+	}
+	if !iter.Next() || !iter.Next() || version(iter) != "b:SET=b1" {
+		t.Fatalf("expected b:SET=b1, but found %s", version(iter))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIteratorLazyMerge(t *testing.T) {
+	var merges int
+	d, err := Open("", &db.Options{
+		Merger: &db.Merger{
+			Merge: func(key, oldValue, newValue, buf []byte) []byte {
+				merges++
+				return db.DefaultMerger.Merge(key, oldValue, newValue, buf)
+			},
+			Name: db.DefaultMerger.Name,
+		},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The merge chain of "b" ends in a set, and is spread across the memtable
+	// and several tables.
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("b"), []byte("base"), nil); err != nil {
+		t.Fatal(err)
+	}
+	const n = 50
+	for i := 0; i < n; i++ {
+		if err := d.Merge([]byte("b"), []byte(fmt.Sprint(i%10)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 9 {
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, v := range []string{"x", "y", "z"} {
+		if err := d.Merge([]byte("c"), []byte(v), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := make(map[string]string)
+	iter := d.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		expected[string(iter.Key())] = string(iter.Value())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 3 {
+		t.Fatalf("expected 3 keys, but found %v", expected)
+	}
+
+	// Iterating without retrieving the values skips the merges.
+	merges = 0
+	iter = d.NewIter(&db.IterOptions{LazyMerge: true})
+	defer iter.Close()
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+		if iter.LazyValue() == nil {
+			t.Fatalf("%s: expected a lazy value", iter.Key())
+		}
+	}
+	if s := strings.Join(keys, ","); s != "a,b,c" {
+		t.Fatalf("expected a,b,c, but found %s", s)
+	}
+	if merges != 0 {
+		t.Fatalf("expected no merges, but found %d", merges)
+	}
+
+	// Forcing the values merges the operands. Compactions may have merged
+	// some of the operands of "b" already.
+	var expectedMerges int
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		v := iter.LazyValue()
+		if ops := v.NumOperands(); ops > 1 {
+			expectedMerges += ops - 1
+		} else if key != "a" {
+			t.Fatalf("%s: expected a merge chain, but found %d operands", key, ops)
+		}
+		if value := string(v.Value()); value != expected[key] {
+			t.Fatalf("%s: expected %s, but found %s", key, expected[key], value)
+		}
+		if value := string(iter.Value()); value != expected[key] {
+			t.Fatalf("%s: expected %s, but found %s", key, expected[key], value)
+		}
+	}
+	if merges != expectedMerges {
+		t.Fatalf("expected %d merges, but found %d", expectedMerges, merges)
+	}
+
+	// A released value is not merged, and values found iterating backward are
+	// already resolved.
+	merges = 0
+	if !iter.SeekGE([]byte("c")) {
+		t.Fatalf("expected c")
+	}
+	iter.LazyValue().Release()
+	if merges != 0 || iter.Value() != nil {
+		t.Fatalf("expected a released value to not be merged")
+	}
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		key := string(iter.Key())
+		if value := string(iter.LazyValue().Value()); value != expected[key] {
+			t.Fatalf("%s: expected %s, but found %s", key, expected[key], value)
+		}
+	}
+}
+
+func TestIteratorNextN(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The keys are spread across several tables and the memtable, with
+	// deleted, overwritten and merged keys.
+	const n = 1000
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < 4; i++ {
+		for j := 0; j < n; j++ {
+			key := []byte(fmt.Sprintf("%04d", j))
+			var err error
+			switch rng.Intn(5) {
+			case 0:
+				continue
+			case 1:
+				err = d.Delete(key, nil)
+			case 2:
+				err = d.Merge(key, []byte(fmt.Sprintf("+%d", i)), nil)
+			default:
+				err = d.Set(key, []byte(fmt.Sprintf("%04d.%d", j, i)), nil)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i < 3 {
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, opts := range []*db.IterOptions{
+		nil,
+		{LowerBound: []byte("0100"), UpperBound: []byte("0900")},
+	} {
+		var expected []string
+		iter := d.NewIter(opts)
+		for valid := iter.First(); valid; valid = iter.Next() {
+			expected = append(expected, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, batch := range []int{1, 7, 256, 2 * n} {
+			// With an odd batch, the calls to NextN are interleaved with calls
+			// to Next.
+			mixed := batch%2 == 1
+			iter := d.NewIter(opts)
+			dst := make([]KV, batch)
+			var found []string
+			var valid bool
+			if valid = iter.First(); valid {
+				found = append(found, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+				// An empty batch leaves the iterator in place.
+				key := string(iter.Key())
+				if m, err := iter.NextN(nil); m != 0 || err != nil {
+					t.Fatalf("batch=%d: expected nothing from an empty batch, but found %d (%v)", batch, m, err)
+				}
+				if !iter.Valid() || string(iter.Key()) != key {
+					t.Fatalf("batch=%d: expected the iterator at %s after an empty batch", batch, key)
+				}
+			}
+			for valid {
+				m, err := iter.NextN(dst)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, kv := range dst[:m] {
+					found = append(found, fmt.Sprintf("%s:%s", kv.Key, kv.Value))
+				}
+				if m < batch {
+					// The iterator stops at exhaustion.
+					if iter.Valid() {
+						t.Fatalf("batch=%d: expected an exhausted iterator after a short batch", batch)
+					}
+					break
+				}
+				// The iterator is positioned at the last pair filled.
+				if last := dst[m-1]; !bytes.Equal(iter.Key(), last.Key) || !bytes.Equal(iter.Value(), last.Value) {
+					t.Fatalf("batch=%d: expected the iterator at %s:%s, but found %s:%s",
+						batch, last.Key, last.Value, iter.Key(), iter.Value())
+				}
+				if mixed {
+					if valid = iter.Next(); valid {
+						found = append(found, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+					}
+				}
+			}
+			if m, err := iter.NextN(dst); m != 0 || err != nil {
+				t.Fatalf("batch=%d: expected nothing from an exhausted iterator, but found %d (%v)", batch, m, err)
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := strings.Join(found, " "), strings.Join(expected, " "); got != want {
+				t.Fatalf("batch=%d: expected\n%s\nbut found\n%s", batch, want, got)
+			}
+		}
+	}
+}
+
 func BenchmarkIteratorSeekGE(b *testing.B) {
-	m, keys := buildMemTable(b)
+	m, keys := buildMemTable(b, nil)
 	iter := &Iterator{
 		cmp:  db.DefaultComparer.Compare,
 		iter: m.newIter(nil),
@@ -320,7 +867,7 @@ func BenchmarkIteratorSeekGE(b *testing.B) {
 }
 
 func BenchmarkIteratorNext(b *testing.B) {
-	m, _ := buildMemTable(b)
+	m, _ := buildMemTable(b, nil)
 	iter := &Iterator{
 		cmp:  db.DefaultComparer.Compare,
 		iter: m.newIter(nil),
@@ -336,7 +883,7 @@ func BenchmarkIteratorNext(b *testing.B) {
 }
 
 func BenchmarkIteratorPrev(b *testing.B) {
-	m, _ := buildMemTable(b)
+	m, _ := buildMemTable(b, nil)
 	iter := &Iterator{
 		cmp:  db.DefaultComparer.Compare,
 		iter: m.newIter(nil),
@@ -350,3 +897,229 @@ func BenchmarkIteratorPrev(b *testing.B) {
 		iter.Prev()
 	}
 }
+
+func BenchmarkIteratorPrefix(b *testing.B) {
+	m, _ := buildMemTable(b, nil)
+	// heavyCompare simulates an expensive custom comparer.
+	heavyCompare := func(a, b []byte) int {
+		var sum int
+		for i := 0; i < 64; i++ {
+			sum += int(a[0]) + i
+		}
+		if sum < 0 {
+			return 0
+		}
+		return bytes.Compare(a, b)
+	}
+	// The keys are 8 digit numbers: a 5 byte prefix selects 1000 keys.
+	prefix := []byte("00001")
+	extract := func(key []byte) []byte {
+		if len(key) > len(prefix) {
+			return key[:len(prefix)]
+		}
+		return key
+	}
+
+	for _, pe := range []*db.PrefixExtractor{
+		{Extract: extract},
+		{Extract: extract, PrefixEqual: bytes.Equal},
+	} {
+		b.Run(fmt.Sprintf("prefix-equal=%t", pe.PrefixEqual != nil), func(b *testing.B) {
+			iter := &Iterator{
+				opts:  &db.IterOptions{Prefix: prefix},
+				cmp:   heavyCompare,
+				equal: bytes.Equal,
+				iter:  m.newIter(nil),
+			}
+			iter.initPrefix(db.DefaultComparer.RangeEndSentinel, pe)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !iter.Valid() {
+					iter.First()
+				}
+				iter.Next()
+			}
+		})
+	}
+}
+
+// slowStorage wraps a Storage, delaying each read of a table. onRead, if
+// non-nil, is invoked with the number of reads of tables so far before each
+// read.
+type slowStorage struct {
+	storage.Storage
+	delay  time.Duration
+	reads  int32
+	onRead func(reads int32)
+}
+
+func (fs *slowStorage) Open(name string) (storage.File, error) {
+	f, err := fs.Storage.Open(name)
+	if err != nil || !strings.HasSuffix(name, ".sst") {
+		return f, err
+	}
+	return &slowFile{File: f, fs: fs}, nil
+}
+
+type slowFile struct {
+	storage.File
+	fs *slowStorage
+}
+
+func (f *slowFile) ReadAt(p []byte, off int64) (int, error) {
+	reads := atomic.AddInt32(&f.fs.reads, 1)
+	if f.fs.onRead != nil {
+		f.fs.onRead(reads)
+	}
+	time.Sleep(f.fs.delay)
+	return f.File.ReadAt(p, off)
+}
+
+func TestIteratorContext(t *testing.T) {
+	fs := &slowStorage{Storage: storage.NewMem(), delay: time.Millisecond}
+	d, err := Open("", &db.Options{
+		Levels:  []db.LevelOptions{{BlockSize: 256}},
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The two tables in L0 hold the even and odd keys respectively, and span
+	// many data blocks.
+	const n = 1000
+	for j := 0; j < 2; j++ {
+		for i := j; i < n; i += 2 {
+			key := []byte(fmt.Sprintf("%04d", i))
+			if err := d.Set(key, key, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A scan canceled in the middle stops before reading another data block,
+	// and returns the context error.
+	ctx, cancel := context.WithCancel(context.Background())
+	const cancelAt = 20
+	fs.onRead = func(reads int32) {
+		if reads == cancelAt {
+			cancel()
+		}
+	}
+	atomic.StoreInt32(&fs.reads, 0)
+	iter := d.NewIter(&db.IterOptions{Context: ctx})
+	var count int
+	for valid := iter.First(); valid; valid = iter.Next() {
+		count++
+	}
+	if err := iter.Error(); err != context.Canceled {
+		t.Fatalf("expected %v, but found %v", context.Canceled, err)
+	}
+	if err := iter.Close(); err != nil && err != context.Canceled {
+		t.Fatal(err)
+	}
+	if count == 0 || count >= n {
+		t.Fatalf("expected the scan to stop part way, but found %d keys", count)
+	}
+	if reads := atomic.LoadInt32(&fs.reads); reads != cancelAt {
+		t.Fatalf("expected %d reads, but found %d", cancelAt, reads)
+	}
+
+	// The tables are open, and a get reads a data block of each table. The get
+	// is canceled during the read of the newer table, and does not read the
+	// older table holding the key.
+	ctx, cancel = context.WithCancel(context.Background())
+	fs.onRead = func(reads int32) {
+		cancel()
+	}
+	atomic.StoreInt32(&fs.reads, 0)
+	if _, err := d.GetWithContext(ctx, []byte("0500")); err != context.Canceled {
+		t.Fatalf("expected %v, but found %v", context.Canceled, err)
+	}
+	if reads := atomic.LoadInt32(&fs.reads); reads != 1 {
+		t.Fatalf("expected 1 read, but found %d", reads)
+	}
+
+	// A get with a context which is already done does not read any tables.
+	fs.onRead = nil
+	atomic.StoreInt32(&fs.reads, 0)
+	if _, err := d.GetWithContext(ctx, []byte("0500")); err != context.Canceled {
+		t.Fatalf("expected %v, but found %v", context.Canceled, err)
+	}
+	if reads := atomic.LoadInt32(&fs.reads); reads != 0 {
+		t.Fatalf("expected no reads, but found %d", reads)
+	}
+
+	// The get succeeds without cancellation.
+	v, err := d.GetWithContext(context.Background(), []byte("0500"))
+	if err != nil || string(v) != "0500" {
+		t.Fatalf("expected 0500, but found %s (%v)", v, err)
+	}
+}
+
+func BenchmarkIteratorNextN(b *testing.B) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+
+	// A large scan over keys spread across several tables.
+	const n = 100000
+	for i := 0; i < 4; i++ {
+		for j := i; j < n; j += 4 {
+			key := []byte(fmt.Sprintf("%08d", j))
+			if err := d.Set(key, key, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// Each op steps over 256 keys, restarting the scan when it is exhausted.
+	const batch = 256
+	b.Run("Next", func(b *testing.B) {
+		iter := d.NewIter(nil)
+		defer iter.Close()
+		iter.First()
+		var size int
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < batch; j++ {
+				if !iter.Next() {
+					iter.First()
+				}
+				size += len(iter.Key()) + len(iter.Value())
+			}
+		}
+	})
+	b.Run("NextN", func(b *testing.B) {
+		iter := d.NewIter(nil)
+		defer iter.Close()
+		iter.First()
+		dst := make([]KV, batch)
+		var size int
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m, err := iter.NextN(dst)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if m < batch {
+				iter.First()
+			}
+			for _, kv := range dst[:m] {
+				size += len(kv.Key) + len(kv.Value)
+			}
+		}
+	})
+}
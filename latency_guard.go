@@ -0,0 +1,144 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// latencyGuard tracks the latency of foreground operations and decides
+// whether background compactions are paused. See
+// db.Options.CompactionLatencyGuard.
+type latencyGuard struct {
+	slo          time.Duration
+	resume       time.Duration
+	idleInterval time.Duration
+	mu           struct {
+		sync.Mutex
+		// latency is the moving average of the foreground latencies.
+		latency time.Duration
+		// ops is the number of foreground operations completed since the last
+		// idle check.
+		ops int64
+	}
+	// paused is 1 while compactions are paused. It is only modified while
+	// DB.mu is held, but is read atomically by record.
+	paused int32
+	// pauses is the number of times compactions have been paused. Protected
+	// by DB.mu.
+	pauses int64
+}
+
+func newLatencyGuard(o *db.CompactionLatencyGuard) *latencyGuard {
+	o = o.EnsureDefaults()
+	g := &latencyGuard{
+		slo:          o.SLO,
+		resume:       o.SLO - o.Hysteresis,
+		idleInterval: o.IdleInterval,
+	}
+	if g.resume < 0 {
+		g.resume = 0
+	}
+	return g
+}
+
+// record adds the latency of a foreground operation to the moving average.
+// Returns true if compactions are paused and the latency has recovered, in
+// which case the caller should reschedule them.
+func (g *latencyGuard) record(latency time.Duration) bool {
+	g.mu.Lock()
+	g.mu.latency += (latency - g.mu.latency) / 8
+	g.mu.ops++
+	recovered := g.mu.latency <= g.resume
+	g.mu.Unlock()
+	return recovered && atomic.LoadInt32(&g.paused) == 1
+}
+
+// latency returns the moving average of the foreground latencies.
+func (g *latencyGuard) latency() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.mu.latency
+}
+
+// idle halves the moving average of the foreground latencies if no foreground
+// operation completed since the last call.
+func (g *latencyGuard) idle() {
+	g.mu.Lock()
+	if g.mu.ops == 0 {
+		g.mu.latency /= 2
+	}
+	g.mu.ops = 0
+	g.mu.Unlock()
+}
+
+// update decides whether compactions are paused given the current latency:
+// they are paused once the latency exceeds the SLO, and resume once it falls
+// back to the bottom of the hysteresis band. DB.mu must be held.
+func (g *latencyGuard) update() bool {
+	latency := g.latency()
+	paused := atomic.LoadInt32(&g.paused) == 1
+	if paused {
+		paused = latency > g.resume
+	} else if latency > g.slo {
+		paused = true
+		g.pauses++
+	}
+	g.setPaused(paused)
+	return paused
+}
+
+// setPaused records whether compactions are paused. DB.mu must be held.
+func (g *latencyGuard) setPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&g.paused, v)
+}
+
+// recordLatency adds the latency of a foreground operation to the latency
+// guard, resuming the compactions it paused if the latency has recovered.
+func (d *DB) recordLatency(latency time.Duration) {
+	if d.latencyGuard.record(latency) {
+		d.mu.Lock()
+		d.maybeScheduleCompaction()
+		d.mu.Unlock()
+	}
+}
+
+// pauseCompaction returns true if the latency guard pauses the automatic
+// compactions, in which case an idle check is scheduled to notice the absence
+// of foreground operations.
+//
+// d.mu must be held when calling this.
+func (d *DB) pauseCompaction() bool {
+	g := d.latencyGuard
+	if g == nil {
+		return false
+	}
+	if len(d.mu.versions.currentVersion().files[0]) > d.opts.L0SlowdownWritesThreshold {
+		// The writes are throttled until L0 is compacted.
+		g.setPaused(false)
+		return false
+	}
+	if !g.update() {
+		return false
+	}
+	if d.mu.compact.latencyTimer == nil {
+		d.mu.compact.latencyTimer = time.AfterFunc(g.idleInterval, func() {
+			g.idle()
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.mu.compact.latencyTimer = nil
+			d.maybeScheduleCompaction()
+		})
+	}
+	return true
+}
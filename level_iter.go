@@ -11,8 +11,8 @@ import (
 )
 
 // tableNewIters creates a new point and range-del iterator for the given file
-// number.
-type tableNewIters func(meta *fileMetadata) (internalIterator, internalIterator, error)
+// number. The options, which may be nil, are passed to the point iterator.
+type tableNewIters func(meta *fileMetadata, opts *db.IterOptions) (internalIterator, internalIterator, error)
 
 // levelIter provides a merged view of the sstables in a level.
 //
@@ -136,8 +136,13 @@ func (l *levelIter) loadFile(index, dir int) bool {
 			}
 		}
 
+		if ctx := l.opts.GetContext(); ctx != nil {
+			if l.err = ctx.Err(); l.err != nil {
+				return false
+			}
+		}
 		var rangeDelIter internalIterator
-		l.iter, rangeDelIter, l.err = l.newIters(f)
+		l.iter, rangeDelIter, l.err = l.newIters(f, l.opts)
 		if l.err != nil || l.iter == nil {
 			return false
 		}
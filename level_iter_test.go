@@ -24,7 +24,7 @@ func TestLevelIter(t *testing.T) {
 	var iters []*fakeIter
 	var files []fileMetadata
 
-	newIters := func(meta *fileMetadata) (internalIterator, internalIterator, error) {
+	newIters := func(meta *fileMetadata, _ *db.IterOptions) (internalIterator, internalIterator, error) {
 		f := *iters[meta.fileNum]
 		return &f, nil, nil
 	}
@@ -86,7 +86,7 @@ func TestLevelIterBoundaries(t *testing.T) {
 	var readers []*sstable.Reader
 	var files []fileMetadata
 
-	newIters := func(meta *fileMetadata) (internalIterator, internalIterator, error) {
+	newIters := func(meta *fileMetadata, _ *db.IterOptions) (internalIterator, internalIterator, error) {
 		return readers[meta.fileNum].NewIter(nil), nil, nil
 	}
 
@@ -243,7 +243,7 @@ func BenchmarkLevelIterSeekGE(b *testing.B) {
 					b.Run(fmt.Sprintf("count=%d", count),
 						func(b *testing.B) {
 							readers, files, keys := buildLevelIterTables(b, blockSize, restartInterval, count)
-							newIters := func(meta *fileMetadata) (internalIterator, internalIterator, error) {
+							newIters := func(meta *fileMetadata, _ *db.IterOptions) (internalIterator, internalIterator, error) {
 								return readers[meta.fileNum].NewIter(nil), nil, nil
 							}
 							l := newLevelIter(nil, db.DefaultComparer.Compare, newIters, files)
@@ -269,7 +269,7 @@ func BenchmarkLevelIterNext(b *testing.B) {
 					b.Run(fmt.Sprintf("count=%d", count),
 						func(b *testing.B) {
 							readers, files, _ := buildLevelIterTables(b, blockSize, restartInterval, count)
-							newIters := func(meta *fileMetadata) (internalIterator, internalIterator, error) {
+							newIters := func(meta *fileMetadata, _ *db.IterOptions) (internalIterator, internalIterator, error) {
 								return readers[meta.fileNum].NewIter(nil), nil, nil
 							}
 							l := newLevelIter(nil, db.DefaultComparer.Compare, newIters, files)
@@ -297,7 +297,7 @@ func BenchmarkLevelIterPrev(b *testing.B) {
 					b.Run(fmt.Sprintf("count=%d", count),
 						func(b *testing.B) {
 							readers, files, _ := buildLevelIterTables(b, blockSize, restartInterval, count)
-							newIters := func(meta *fileMetadata) (internalIterator, internalIterator, error) {
+							newIters := func(meta *fileMetadata, _ *db.IterOptions) (internalIterator, internalIterator, error) {
 								return readers[meta.fileNum].NewIter(nil), nil, nil
 							}
 							l := newLevelIter(nil, db.DefaultComparer.Compare, newIters, files)
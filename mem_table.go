@@ -26,9 +26,15 @@ func memTableEntrySize(keyBytes, valueBytes int) uint32 {
 // explicitly compacting a memTable into a separate DB (whether in-memory or
 // on-disk) when appropriate.
 type memTable struct {
-	cmp         db.Compare
-	equal       db.Equal
+	cmp   db.Compare
+	equal db.Equal
+	arena *arenaskl.Arena
+	// The point entries are stored in skl, unless the memtable is a
+	// db.HashSkiplistMemTable, in which case they are stored in the bucket of
+	// buckets selected by a hash of the prefix of their user key.
 	skl         arenaskl.Skiplist
+	buckets     []arenaskl.Skiplist
+	prefix      func(key []byte) []byte
 	rangeDelSkl arenaskl.Skiplist
 	emptySize   uint32
 	reserved    uint32
@@ -39,7 +45,14 @@ type memTable struct {
 		count uint32
 		sync.RWMutex
 		vals []rangedel.Tombstone
+		// warned is set once the RangeTombstoneLimitExceeded event has been
+		// invoked for this memtable.
+		warned bool
 	}
+	// The soft limit on the number of fragmented tombstones and the listener to
+	// notify when it is exceeded. See Options.MaxRangeTombstoneFragments.
+	maxRangeTombstoneFragments int
+	eventListener              *db.EventListener
 }
 
 // newMemTable returns a new MemTable.
@@ -50,14 +63,45 @@ func newMemTable(o *db.Options) *memTable {
 		equal:     o.Comparer.Equal,
 		refs:      1,
 		flushedCh: make(chan struct{}),
+
+		maxRangeTombstoneFragments: o.MaxRangeTombstoneFragments,
+		eventListener:              o.EventListener,
+	}
+	m.arena = arenaskl.NewArena(uint32(o.MemTableSize), 0)
+	if f := o.MemTableFactory; f != nil && f.Type == db.HashSkiplistMemTable {
+		f = f.EnsureDefaults()
+		m.buckets = make([]arenaskl.Skiplist, f.HashBuckets)
+		for i := range m.buckets {
+			m.buckets[i].Reset(m.arena, m.cmp)
+		}
+		if o.PrefixExtractor != nil {
+			m.prefix = o.PrefixExtractor.Extract
+		}
+	} else {
+		m.skl.Reset(m.arena, m.cmp)
 	}
-	arena := arenaskl.NewArena(uint32(o.MemTableSize), 0)
-	m.skl.Reset(arena, m.cmp)
-	m.rangeDelSkl.Reset(arena, m.cmp)
-	m.emptySize = arena.Size()
+	m.rangeDelSkl.Reset(m.arena, m.cmp)
+	m.emptySize = m.arena.Size()
 	return m
 }
 
+// list returns the skiplist holding the point entries for the user key.
+func (m *memTable) list(key []byte) *arenaskl.Skiplist {
+	if m.buckets == nil {
+		return &m.skl
+	}
+	if m.prefix != nil {
+		key = m.prefix(key)
+	}
+	// FNV-1a.
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return &m.buckets[h%uint32(len(m.buckets))]
+}
+
 func (m *memTable) ref() {
 	atomic.AddInt32(&m.refs, 1)
 }
@@ -84,7 +128,7 @@ func (m *memTable) readyForFlush() bool {
 // Get gets the value for the given key. It returns ErrNotFound if the DB does
 // not contain the key.
 func (m *memTable) get(key []byte) (value []byte, err error) {
-	it := m.skl.NewIter()
+	it := m.list(key).NewIter()
 	if !it.SeekGE(key) {
 		return nil, db.ErrNotFound
 	}
@@ -103,7 +147,7 @@ func (m *memTable) get(key []byte) (value []byte, err error) {
 // that prepare is not thread-safe, while apply is. The caller must call
 // unref() after the batch has been applied.
 func (m *memTable) prepare(batch *Batch) error {
-	a := m.skl.Arena()
+	a := m.arena
 	if atomic.LoadInt32(&m.refs) == 1 {
 		// If there are no other concurrent apply operations, we can update the
 		// reserved bytes setting to accurately reflect how many bytes of been
@@ -136,6 +180,10 @@ func (m *memTable) apply(batch *Batch, seqNum uint64) error {
 			err = m.rangeDelSkl.Add(ikey, value)
 			atomic.AddUint32(&m.tombstones.count, 1)
 			invalidateTombstones = true
+		} else if m.buckets != nil {
+			// The splice cached by an Inserter is only valid for a single
+			// skiplist.
+			err = m.list(ukey).Add(ikey, value)
 		} else {
 			err = ins.Add(&m.skl, ikey, value)
 		}
@@ -143,6 +191,19 @@ func (m *memTable) apply(batch *Batch, seqNum uint64) error {
 			return err
 		}
 	}
+	for _, e := range batch.noCopy {
+		ikey := db.MakeInternalKey(e.key, seqNum, db.InternalKeyKindSet)
+		var err error
+		if m.buckets != nil {
+			err = m.list(e.key).Add(ikey, e.value)
+		} else {
+			err = ins.Add(&m.skl, ikey, e.value)
+		}
+		if err != nil {
+			return err
+		}
+		seqNum++
+	}
 	if seqNum != startSeqNum+uint64(batch.count()) {
 		panic("pebble: inconsistent batch count")
 	}
@@ -154,14 +215,39 @@ func (m *memTable) apply(batch *Batch, seqNum uint64) error {
 	return nil
 }
 
+// rangeDelFragments returns the number of fragmented range tombstones cached
+// by the memtable.
+func (m *memTable) rangeDelFragments() int {
+	m.tombstones.RLock()
+	defer m.tombstones.RUnlock()
+	return len(m.tombstones.vals)
+}
+
 // newIter returns an iterator that is unpositioned (Iterator.Valid() will
 // return false). The iterator can be positioned via a call to SeekGE,
 // SeekLT, First or Last.
 func (m *memTable) newIter(*db.IterOptions) internalIterator {
+	if m.buckets != nil {
+		iters := make([]internalIterator, len(m.buckets))
+		for i := range m.buckets {
+			it := m.buckets[i].NewIter()
+			iters[i] = &it
+		}
+		return newMergingIter(m.cmp, iters...)
+	}
 	it := m.skl.NewIter()
 	return &it
 }
 
+// newPointIter returns an unpositioned iterator which is only guaranteed to
+// contain the entries for the user key, to be positioned by a call to SeekGE
+// with the key. For a db.HashSkiplistMemTable, these are found in a single
+// bucket.
+func (m *memTable) newPointIter(key []byte) internalIterator {
+	it := m.list(key).NewIter()
+	return &it
+}
+
 func (m *memTable) newRangeDelIter(*db.IterOptions) internalIterator {
 	if atomic.LoadUint32(&m.tombstones.count) == 0 {
 		return nil
@@ -193,7 +279,20 @@ func (m *memTable) newRangeDelIter(*db.IterOptions) internalIterator {
 		if len(m.tombstones.vals) < len(tombstones) {
 			m.tombstones.vals = tombstones
 		}
+		warn := false
+		if m.maxRangeTombstoneFragments > 0 && len(tombstones) > m.maxRangeTombstoneFragments &&
+			!m.tombstones.warned {
+			m.tombstones.warned = true
+			warn = true
+		}
 		m.tombstones.Unlock()
+
+		if warn && m.eventListener != nil && m.eventListener.RangeTombstoneLimitExceeded != nil {
+			m.eventListener.RangeTombstoneLimitExceeded(db.RangeTombstoneLimitInfo{
+				Fragments: len(tombstones),
+				Limit:     m.maxRangeTombstoneFragments,
+			})
+		}
 	}
 
 	return rangedel.NewIter(m.cmp, tombstones)
@@ -205,5 +304,5 @@ func (m *memTable) close() error {
 
 // empty returns whether the MemTable has no key/value pairs.
 func (m *memTable) empty() bool {
-	return m.skl.Size() == m.emptySize
+	return m.arena.Size() == m.emptySize
 }
@@ -33,7 +33,7 @@ func (m *memTable) set(key db.InternalKey, value []byte) error {
 		m.tombstones.Unlock()
 		return nil
 	}
-	return m.skl.Add(key, value)
+	return m.list(key.UserKey).Add(key, value)
 }
 
 // count returns the number of entries in a DB.
@@ -283,8 +283,95 @@ func TestMemTableDeleteRange(t *testing.T) {
 	})
 }
 
-func buildMemTable(b *testing.B) (*memTable, [][]byte) {
-	m := newMemTable(nil)
+func TestMemTableHashSkiplist(t *testing.T) {
+	testCases := []struct {
+		name   string
+		prefix *db.PrefixExtractor
+	}{
+		{"key", nil},
+		{"prefix", &db.PrefixExtractor{
+			Extract: func(key []byte) []byte { return key[:1] },
+		}},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newMemTable(&db.Options{
+				MemTableFactory: &db.MemTableFactory{
+					Type:        db.HashSkiplistMemTable,
+					HashBuckets: 7,
+				},
+				PrefixExtractor: c.prefix,
+			})
+			if !m.empty() {
+				t.Fatalf("expected an empty memtable")
+			}
+
+			// Apply a batch setting N keys and then deleting every third one.
+			const N = 1000
+			b := newBatch(nil)
+			for i := 0; i < N; i++ {
+				key := strconv.Itoa(i)
+				b.Set([]byte(key), []byte(key), nil)
+			}
+			for i := 0; i < N; i += 3 {
+				b.Delete([]byte(strconv.Itoa(i)), nil)
+			}
+			if err := m.prepare(b); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.apply(b, 1); err != nil {
+				t.Fatal(err)
+			}
+			m.unref()
+
+			for i := 0; i < N; i++ {
+				key := strconv.Itoa(i)
+				v, err := m.get([]byte(key))
+				if i%3 == 0 {
+					if err != db.ErrNotFound {
+						t.Fatalf("%s: expected not found, but found %q (%v)", key, v, err)
+					}
+				} else if err != nil || string(v) != key {
+					t.Fatalf("%s: expected %s, but found %q (%v)", key, key, v, err)
+				}
+			}
+
+			// Iteration merges the buckets into the order of the internal keys in
+			// both directions.
+			const expected = N + (N+2)/3
+			iter := m.newIter(nil)
+			var n int
+			var prev db.InternalKey
+			for valid := iter.First(); valid; valid = iter.Next() {
+				if n > 0 && db.InternalCompare(m.cmp, prev, iter.Key()) >= 0 {
+					t.Fatalf("forward: %s follows %s", iter.Key(), prev)
+				}
+				prev = iter.Key().Clone()
+				n++
+			}
+			if n != expected {
+				t.Fatalf("forward: expected %d entries, but found %d", expected, n)
+			}
+			n = 0
+			for valid := iter.Last(); valid; valid = iter.Prev() {
+				if n > 0 && db.InternalCompare(m.cmp, prev, iter.Key()) <= 0 {
+					t.Fatalf("reverse: %s follows %s", iter.Key(), prev)
+				}
+				prev = iter.Key().Clone()
+				n++
+			}
+			if n != expected {
+				t.Fatalf("reverse: expected %d entries, but found %d", expected, n)
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func buildMemTable(b *testing.B, o *db.Options) (*memTable, [][]byte) {
+	m := newMemTable(o)
 	var keys [][]byte
 	var ikey db.InternalKey
 	for i := 0; ; i++ {
@@ -299,7 +386,7 @@ func buildMemTable(b *testing.B) (*memTable, [][]byte) {
 }
 
 func BenchmarkMemTableIterSeekGE(b *testing.B) {
-	m, keys := buildMemTable(b)
+	m, keys := buildMemTable(b, nil)
 	iter := m.newIter(nil)
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 
@@ -310,7 +397,7 @@ func BenchmarkMemTableIterSeekGE(b *testing.B) {
 }
 
 func BenchmarkMemTableIterNext(b *testing.B) {
-	m, _ := buildMemTable(b)
+	m, _ := buildMemTable(b, nil)
 	iter := m.newIter(nil)
 
 	b.ResetTimer()
@@ -323,7 +410,7 @@ func BenchmarkMemTableIterNext(b *testing.B) {
 }
 
 func BenchmarkMemTableIterPrev(b *testing.B) {
-	m, _ := buildMemTable(b)
+	m, _ := buildMemTable(b, nil)
 	iter := m.newIter(nil)
 
 	b.ResetTimer()
@@ -334,3 +421,19 @@ func BenchmarkMemTableIterPrev(b *testing.B) {
 		iter.Prev()
 	}
 }
+
+func BenchmarkMemTableGet(b *testing.B) {
+	for _, typ := range []db.MemTableType{db.SkiplistMemTable, db.HashSkiplistMemTable} {
+		b.Run(typ.String(), func(b *testing.B) {
+			m, keys := buildMemTable(b, &db.Options{
+				MemTableFactory: &db.MemTableFactory{Type: typ},
+			})
+			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.get(keys[rng.Intn(len(keys))])
+			}
+		})
+	}
+}
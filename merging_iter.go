@@ -6,6 +6,7 @@ package pebble
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 
 	"github.com/petermattis/pebble/db"
@@ -170,6 +171,18 @@ type mergingIter struct {
 	rangeDelIters []internalIterator
 	heap          mergingIterHeap
 	err           error
+	// ctx, if non-nil, is checked on each step through the merge, which may
+	// skip many deleted or invisible entries. See db.IterOptions.Context.
+	ctx context.Context
+
+	// checkOrdering enables verification of the ordering of the versions of
+	// each user key across levels (see checkKeyOrdering). The last* fields
+	// describe the previous entry visited by the check.
+	checkOrdering bool
+	lastValid     bool
+	lastLevel     int
+	lastKey       db.InternalKey
+	lastKeyBuf    []byte
 }
 
 // mergingIter implements the internalIterator interface.
@@ -185,27 +198,43 @@ var _ internalIterator = (*mergingIter)(nil)
 // None of the iters may be nil.
 func newMergingIter(cmp db.Compare, iters ...internalIterator) *mergingIter {
 	m := &mergingIter{}
-	m.init(cmp, iters...)
+	m.init(cmp, nil /* abbreviatedKey */, iters...)
 	return m
 }
 
-func (m *mergingIter) init(cmp db.Compare, iters ...internalIterator) {
+// init initializes the merging iterator. If abbreviatedKey is non-nil, it is
+// used to speed up the comparisons between the keys in the heap.
+func (m *mergingIter) init(
+	cmp db.Compare, abbreviatedKey db.AbbreviatedKey, iters ...internalIterator,
+) {
 	m.snapshot = db.InternalKeySeqNumMax
 	m.iters = iters
 	m.heap.cmp = cmp
+	m.heap.abbreviatedKey = abbreviatedKey
 	m.heap.items = make([]mergingIterItem, 0, len(iters))
 	m.initMinHeap()
 }
 
+// enableCompareCache causes the merging iterator to cache the results of the
+// comparisons between the keys of its child iterators (see
+// mergingIterCompareCache). The cache holds an entry for each pair of
+// children, and is intended for merging many children with long keys, for
+// which the comparisons dominate the cost of iteration.
+func (m *mergingIter) enableCompareCache() {
+	m.heap.compareCache = newMergingIterCompareCache(len(m.iters))
+}
+
 func (m *mergingIter) initHeap() {
+	m.lastValid = false
 	m.heap.items = m.heap.items[:0]
 	for i, t := range m.iters {
 		if t.Valid() {
-			m.heap.items = append(m.heap.items, mergingIterItem{
-				index: i,
-				key:   t.Key(),
-				value: t.Value(),
-			})
+			m.heap.items = append(m.heap.items, mergingIterItem{index: i})
+			m.heap.setKey(&m.heap.items[len(m.heap.items)-1], t.Key(), t.Value())
+		} else if err := t.Error(); err != nil && m.err == nil {
+			// An iterator which failed to position (e.g. on encountering a corrupt
+			// entry) must not be silently dropped from the merge.
+			m.err = err
 		}
 	}
 	m.heap.init()
@@ -339,11 +368,45 @@ func (m *mergingIter) switchToMaxHeap() {
 	m.initMaxHeap()
 }
 
+// checkKeyOrdering verifies that the entry at the top of the heap is ordered
+// correctly with respect to the previously visited entry. Newer versions of a
+// user key must only exist at higher levels of the LSM (lower indexes in
+// m.iters), so the versions of a user key visited during forward iteration
+// must have strictly descending sequence numbers and non-decreasing levels. An
+// entry violating this invariant indicates a bug which placed a newer version
+// of a key below an older one (e.g. in compaction or ingestion), and is
+// reported via m.err. Range deletion keys are ignored as the boundary keys
+// materialized by levelIter carry the maximum sequence number.
+func (m *mergingIter) checkKeyOrdering(item *mergingIterItem) {
+	if item.key.Kind() == db.InternalKeyKindRangeDelete {
+		return
+	}
+	if m.lastValid && m.heap.cmp(m.lastKey.UserKey, item.key.UserKey) == 0 {
+		newer, newerLevel := m.lastKey, m.lastLevel
+		older, olderLevel := item.key, item.index
+		if m.dir == -1 {
+			newer, newerLevel, older, olderLevel = older, olderLevel, newer, newerLevel
+		}
+		if newer.SeqNum() == older.SeqNum() && newerLevel > olderLevel {
+			newer, newerLevel, older, olderLevel = older, olderLevel, newer, newerLevel
+		}
+		if newer.SeqNum() <= older.SeqNum() || newerLevel > olderLevel {
+			m.err = fmt.Errorf("pebble: key ordering anomaly: %s at level %d, %s at level %d",
+				newer, newerLevel, older, olderLevel)
+			return
+		}
+	}
+	m.lastValid = true
+	m.lastLevel = item.index
+	m.lastKeyBuf = append(m.lastKeyBuf[:0], item.key.UserKey...)
+	m.lastKey = db.InternalKey{UserKey: m.lastKeyBuf, Trailer: item.key.Trailer}
+}
+
 func (m *mergingIter) nextEntry(item *mergingIterItem) {
 	oldTopLevel := item.index
 	iter := m.iters[item.index]
 	if iter.Next() {
-		item.key, item.value = iter.Key(), iter.Value()
+		m.heap.setKey(item, iter.Key(), iter.Value())
 		if m.heap.len() > 1 {
 			m.heap.fix(0)
 		}
@@ -393,9 +456,27 @@ func (m *mergingIter) isNextEntryDeleted(item *mergingIterItem) bool {
 	return false
 }
 
+// canceled returns true and sets m.err to the context error if the context of
+// the iterator is done.
+func (m *mergingIter) canceled() bool {
+	if m.ctx == nil {
+		return false
+	}
+	m.err = m.ctx.Err()
+	return m.err != nil
+}
+
 func (m *mergingIter) findNextEntry() bool {
 	for m.heap.len() > 0 && m.err == nil {
+		if m.canceled() {
+			break
+		}
 		item := &m.heap.items[0]
+		if m.checkOrdering {
+			if m.checkKeyOrdering(item); m.err != nil {
+				break
+			}
+		}
 		if m.rangeDelIters != nil && m.isNextEntryDeleted(item) {
 			continue
 		}
@@ -411,7 +492,7 @@ func (m *mergingIter) prevEntry(item *mergingIterItem) {
 	oldTopLevel := item.index
 	iter := m.iters[item.index]
 	if iter.Prev() {
-		item.key, item.value = iter.Key(), iter.Value()
+		m.heap.setKey(item, iter.Key(), iter.Value())
 		if m.heap.len() > 1 {
 			m.heap.fix(0)
 		}
@@ -463,7 +544,15 @@ func (m *mergingIter) isPrevEntryDeleted(item *mergingIterItem) bool {
 
 func (m *mergingIter) findPrevEntry() bool {
 	for m.heap.len() > 0 && m.err == nil {
+		if m.canceled() {
+			break
+		}
 		item := &m.heap.items[0]
+		if m.checkOrdering {
+			if m.checkKeyOrdering(item); m.err != nil {
+				break
+			}
+		}
 		if m.rangeDelIters != nil && m.isPrevEntryDeleted(item) {
 			continue
 		}
@@ -635,6 +724,7 @@ func (m *mergingIter) Close() error {
 	m.iters = nil
 	m.rangeDelIters = nil
 	m.heap.items = nil
+	m.heap.compareCache = nil
 	return m.err
 }
 
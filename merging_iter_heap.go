@@ -10,10 +10,65 @@ type mergingIterItem struct {
 	index int
 	key   db.InternalKey
 	value []byte
+	// abbrev is the abbreviated user key, if the heap has an abbreviatedKey
+	// function. See mergingIterHeap.setKey.
+	abbrev uint64
+	// gen identifies the position of the child iterator, and changes whenever
+	// the item's key is set. See mergingIterCompareCache.
+	gen uint64
+}
+
+// mergingIterCompareCache caches the results of the user key comparisons
+// between the items of a mergingIterHeap. A result is keyed on the positions
+// of the two child iterators compared, so that it is invalidated when either
+// child is advanced. Sifting an item through the heap compares it against
+// siblings whose relative order was determined by earlier sifts, and those
+// comparisons are served from the cache.
+type mergingIterCompareCache struct {
+	n       int
+	entries []mergingIterCompareCacheEntry
+}
+
+type mergingIterCompareCacheEntry struct {
+	agen, bgen uint64
+	c          int
+}
+
+func newMergingIterCompareCache(n int) *mergingIterCompareCache {
+	return &mergingIterCompareCache{
+		n:       n,
+		entries: make([]mergingIterCompareCacheEntry, n*n),
+	}
+}
+
+// compare returns the comparison of the user keys of a and b, computing it
+// with cmp if the cache does not hold the result for the current positions of
+// their child iterators.
+func (c *mergingIterCompareCache) compare(cmp db.Compare, a, b *mergingIterItem) int {
+	flip := false
+	if a.index > b.index {
+		a, b, flip = b, a, true
+	}
+	e := &c.entries[a.index*c.n+b.index]
+	if e.agen != a.gen || e.bgen != b.gen {
+		e.agen, e.bgen, e.c = a.gen, b.gen, cmp(a.key.UserKey, b.key.UserKey)
+	}
+	if flip {
+		return -e.c
+	}
+	return e.c
 }
 
 type mergingIterHeap struct {
-	cmp     db.Compare
+	cmp db.Compare
+	// abbreviatedKey, if non-nil, is used to resolve most comparisons between
+	// items with a single integer comparison.
+	abbreviatedKey db.AbbreviatedKey
+	// compareCache, if non-nil, caches the user key comparisons between items.
+	compareCache *mergingIterCompareCache
+	// gen is the generation assigned to the last item whose key was set. The
+	// generations start at 1 so that they never match an unset cache entry.
+	gen     uint64
 	reverse bool
 	items   []mergingIterItem
 }
@@ -22,9 +77,33 @@ func (h *mergingIterHeap) len() int {
 	return len(h.items)
 }
 
+// setKey sets the key and value of the item, along with its abbreviated key.
+func (h *mergingIterHeap) setKey(item *mergingIterItem, key db.InternalKey, value []byte) {
+	item.key, item.value = key, value
+	h.gen++
+	item.gen = h.gen
+	if h.abbreviatedKey != nil {
+		item.abbrev = h.abbreviatedKey(key.UserKey)
+	}
+}
+
 func (h *mergingIterHeap) less(i, j int) bool {
+	if h.abbreviatedKey != nil {
+		if a, b := h.items[i].abbrev, h.items[j].abbrev; a != b {
+			if h.reverse {
+				return a > b
+			}
+			return a < b
+		}
+	}
 	ikey, jkey := h.items[i].key, h.items[j].key
-	if c := h.cmp(ikey.UserKey, jkey.UserKey); c != 0 {
+	var c int
+	if h.compareCache != nil {
+		c = h.compareCache.compare(h.cmp, &h.items[i], &h.items[j])
+	} else {
+		c = h.cmp(ikey.UserKey, jkey.UserKey)
+	}
+	if c != 0 {
 		if h.reverse {
 			return c > 0
 		}
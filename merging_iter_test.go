@@ -5,8 +5,10 @@
 package pebble
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -35,6 +37,38 @@ func TestMergingIter(t *testing.T) {
 	})
 }
 
+func TestMergingIterAbbreviatedKey(t *testing.T) {
+	newFunc := func(iters ...internalIterator) internalIterator {
+		m := &mergingIter{}
+		m.init(db.DefaultComparer.Compare, db.DefaultComparer.AbbreviatedKey, iters...)
+		return m
+	}
+	testIterator(t, newFunc, func(r *rand.Rand) [][]string {
+		splits := make([][]string, 1+r.Intn(2+len(testKeyValuePairs)))
+		for _, kv := range testKeyValuePairs {
+			j := r.Intn(len(splits))
+			splits[j] = append(splits[j], kv)
+		}
+		return splits
+	})
+}
+
+func TestMergingIterCompareCache(t *testing.T) {
+	newFunc := func(iters ...internalIterator) internalIterator {
+		m := newMergingIter(db.DefaultComparer.Compare, iters...)
+		m.enableCompareCache()
+		return m
+	}
+	testIterator(t, newFunc, func(r *rand.Rand) [][]string {
+		splits := make([][]string, 1+r.Intn(2+len(testKeyValuePairs)))
+		for _, kv := range testKeyValuePairs {
+			j := r.Intn(len(splits))
+			splits[j] = append(splits[j], kv)
+		}
+		return splits
+	})
+}
+
 func TestMergingIterSeek(t *testing.T) {
 	var def string
 	datadriven.RunTest(t, "testdata/merging_iter_seek", func(d *datadriven.TestData) string {
@@ -124,6 +158,157 @@ func TestMergingIterNextPrev(t *testing.T) {
 	}
 }
 
+func TestMergingIterCheckKeyOrdering(t *testing.T) {
+	testCases := []struct {
+		levels  []string
+		forward string
+		reverse string
+		err     string
+	}{
+		{
+			levels: []string{
+				"a.SET.2 b.SET.2",
+				"a.SET.1 b.SET.1 c.SET.1",
+			},
+			forward: "a#2,1 a#1,1 b#2,1 b#1,1 c#1,1",
+			reverse: "c#1,1 b#1,1 b#2,1 a#1,1 a#2,1",
+		},
+		{
+			// A newer version of "b" placed below an older one.
+			levels: []string{
+				"a.SET.1 b.SET.1",
+				"b.SET.5 c.SET.5",
+			},
+			forward: "a#1,1 b#5,1",
+			reverse: "c#5,1 b#1,1",
+			err:     "pebble: key ordering anomaly: b#5,1 at level 1, b#1,1 at level 0",
+		},
+		{
+			// Versions with the same sequence number at different levels.
+			levels: []string{
+				"a.SET.3",
+				"a.SET.3",
+			},
+			forward: "a#3,1",
+			reverse: "a#3,1",
+			err:     "pebble: key ordering anomaly: a#3,1 at level 0, a#3,1 at level 1",
+		},
+		{
+			// An out of order version within a single level.
+			levels: []string{
+				"a.SET.1 a.SET.2",
+			},
+			forward: "a#1,1",
+			reverse: "a#2,1",
+			err:     "pebble: key ordering anomaly: a#1,1 at level 0, a#2,1 at level 0",
+		},
+		{
+			// Range deletion keys, such as the boundary keys materialized by
+			// levelIter, are ignored.
+			levels: []string{
+				"b.SET.5",
+				"b.RANGEDEL.72057594037927935",
+			},
+			forward: "b#72057594037927935,15 b#5,1",
+			reverse: "b#5,1 b#72057594037927935,15",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			newIter := func() *mergingIter {
+				iters := make([]internalIterator, len(c.levels))
+				for i := range c.levels {
+					f := &fakeIter{}
+					for _, key := range strings.Fields(c.levels[i]) {
+						f.keys = append(f.keys, db.ParseInternalKey(key))
+						f.vals = append(f.vals, nil)
+					}
+					iters[i] = f
+				}
+				m := newMergingIter(db.DefaultComparer.Compare, iters...)
+				m.checkOrdering = true
+				return m
+			}
+
+			for _, dir := range []string{"forward", "reverse"} {
+				iter := newIter()
+				var keys []string
+				if dir == "forward" {
+					for valid := iter.First(); valid; valid = iter.Next() {
+						keys = append(keys, iter.Key().String())
+					}
+				} else {
+					for valid := iter.Last(); valid; valid = iter.Prev() {
+						keys = append(keys, iter.Key().String())
+					}
+				}
+				expected := c.forward
+				if dir == "reverse" {
+					expected = c.reverse
+				}
+				if got := strings.Join(keys, " "); expected != got {
+					t.Fatalf("%s: expected %q, but found %q", dir, expected, got)
+				}
+				var errStr string
+				if err := iter.Error(); err != nil {
+					errStr = err.Error()
+				}
+				if c.err != errStr {
+					t.Fatalf("%s: expected error %q, but found %q", dir, c.err, errStr)
+				}
+				iter.Close()
+			}
+		})
+	}
+}
+
+func TestMergingIterUnknownKeyKind(t *testing.T) {
+	mem := storage.NewMem()
+	f, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, db.LevelOptions{})
+	if err := w.Add(db.MakeInternalKey([]byte("b"), 1, db.InternalKeyKind(7)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := sstable.NewReader(f, 0, nil)
+	defer r.Close()
+
+	const expectedErr = `pebble/table: invalid table (unknown internal key kind 7 for key "b")`
+	for _, dir := range []string{"forward", "reverse"} {
+		fake := &fakeIter{}
+		for _, key := range []string{"a.SET.2", "c.SET.2"} {
+			fake.keys = append(fake.keys, db.ParseInternalKey(key))
+			fake.vals = append(fake.vals, nil)
+		}
+		// The table iterator fails to position, which must not cause the merging
+		// iterator to silently skip its entries.
+		iter := newMergingIter(db.DefaultComparer.Compare, fake, r.NewIter(nil))
+		var valid bool
+		if dir == "forward" {
+			valid = iter.SeekGE([]byte("b"))
+		} else {
+			valid = iter.SeekLT([]byte("c"))
+		}
+		if valid {
+			t.Fatalf("%s: expected an invalid iterator, but found %s", dir, iter.Key())
+		}
+		if err := iter.Error(); err == nil || err.Error() != expectedErr {
+			t.Fatalf("%s: expected error %q, but found %v", dir, expectedErr, err)
+		}
+		iter.Close()
+	}
+}
+
 func buildMergingIterTables(
 	b *testing.B, blockSize, restartInterval, count int,
 ) ([]*sstable.Reader, [][]byte) {
@@ -243,6 +428,107 @@ func BenchmarkMergingIterNext(b *testing.B) {
 	}
 }
 
+func BenchmarkMergingIterAbbreviatedKey(b *testing.B) {
+	// Many children holding long keys which differ within their first 8 bytes,
+	// for which the heap comparisons are dominated by the comparer.
+	const count = 16
+	const keyLen = 64
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var keys [][]byte
+	for i := 0; i < 100000; i++ {
+		key := make([]byte, keyLen)
+		for j := range key {
+			key[j] = 'a' + byte(rng.Intn(26))
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	iters := make([]*fakeIter, count)
+	for i := range iters {
+		iters[i] = &fakeIter{}
+	}
+	for _, key := range keys {
+		f := iters[rng.Intn(count)]
+		f.keys = append(f.keys, db.MakeInternalKey(key, 0, db.InternalKeyKindSet))
+		f.vals = append(f.vals, nil)
+	}
+
+	for _, abbreviated := range []bool{false, true} {
+		b.Run(fmt.Sprintf("abbreviated=%t", abbreviated), func(b *testing.B) {
+			var abbreviatedKey db.AbbreviatedKey
+			if abbreviated {
+				abbreviatedKey = db.DefaultComparer.AbbreviatedKey
+			}
+			children := make([]internalIterator, count)
+			for i := range iters {
+				children[i] = iters[i]
+			}
+			m := &mergingIter{}
+			m.init(db.DefaultComparer.Compare, abbreviatedKey, children...)
+			m.First()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !m.Next() {
+					m.First()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMergingIterCompareCache(b *testing.B) {
+	// Many children holding long keys which share a long prefix, for which the
+	// comparisons dominate the cost of iteration.
+	const count = 32
+	const keyLen = 256
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	prefix := bytes.Repeat([]byte("a"), keyLen-8)
+	var keys [][]byte
+	for i := 0; i < 100000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("%s%08d", prefix, i)))
+	}
+	iters := make([]*fakeIter, count)
+	for i := range iters {
+		iters[i] = &fakeIter{}
+	}
+	for _, key := range keys {
+		f := iters[rng.Intn(count)]
+		f.keys = append(f.keys, db.MakeInternalKey(key, 0, db.InternalKeyKindSet))
+		f.vals = append(f.vals, nil)
+	}
+
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%t", cached), func(b *testing.B) {
+			var comparisons int
+			cmp := func(a, b []byte) int {
+				comparisons++
+				return bytes.Compare(a, b)
+			}
+			children := make([]internalIterator, count)
+			for i := range iters {
+				children[i] = iters[i]
+			}
+			m := newMergingIter(cmp, children...)
+			if cached {
+				m.enableCompareCache()
+			}
+			m.First()
+
+			comparisons = 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !m.Next() {
+					m.First()
+				}
+			}
+			b.ReportMetric(float64(comparisons)/float64(b.N), "cmps/op")
+		})
+	}
+}
+
 func BenchmarkMergingIterPrev(b *testing.B) {
 	const blockSize = 32 << 10
 
@@ -0,0 +1,84 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LevelMetrics holds the metrics for a level of the LSM.
+type LevelMetrics struct {
+	// The number of tables in the level.
+	NumFiles int
+	// The total size in bytes of the tables in the level.
+	Size uint64
+}
+
+// Metrics holds metrics for the DB. See DB.Metrics.
+type Metrics struct {
+	Compact struct {
+		// EstimatedDebt is an estimate of the number of bytes which need to be
+		// compacted for the LSM to reach a stable shape, in which L0 is below its
+		// compaction threshold and no other level is larger than its target
+		// size. A growing debt indicates that compactions are falling behind the
+		// writes, which eventually stalls the writes.
+		EstimatedDebt uint64
+		// ForegroundLatency is the moving average of the latencies of the
+		// foreground reads and writes, as tracked by
+		// db.Options.CompactionLatencyGuard. It is zero if no latency guard is
+		// configured.
+		ForegroundLatency time.Duration
+		// LatencyPaused is true while the automatic compactions are paused by
+		// the latency guard, and LatencyPauseCount is the number of times they
+		// have been paused.
+		LatencyPaused     bool
+		LatencyPauseCount int64
+	}
+
+	TableCache struct {
+		// Size is the number of tables open in the table cache.
+		Size int
+		// Hits and Misses are the number of lookups of tables which were and
+		// were not open in the table cache, respectively.
+		Hits   int64
+		Misses int64
+	}
+
+	WriteStall struct {
+		// The number of writes which were stalled waiting for a memtable to be
+		// flushed or for L0 to be compacted.
+		Count int64
+		// The cumulative duration of the stalls.
+		Duration time.Duration
+	}
+
+	Levels [numLevels]LevelMetrics
+}
+
+// Metrics returns the current metrics of the DB.
+func (d *DB) Metrics() *Metrics {
+	m := &Metrics{}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p := d.mu.versions.picker; p != nil {
+		m.Compact.EstimatedDebt = p.estimatedDebt
+	}
+	if g := d.latencyGuard; g != nil {
+		m.Compact.ForegroundLatency = g.latency()
+		m.Compact.LatencyPaused = atomic.LoadInt32(&g.paused) == 1
+		m.Compact.LatencyPauseCount = g.pauses
+	}
+	m.TableCache.Size, m.TableCache.Hits, m.TableCache.Misses = d.tableCache.metrics()
+	m.WriteStall.Count = d.mu.writeStall.count
+	m.WriteStall.Duration = d.mu.writeStall.duration
+	current := d.mu.versions.currentVersion()
+	for level := range m.Levels {
+		m.Levels[level].NumFiles = len(current.files[level])
+		m.Levels[level].Size = totalSize(current.files[level])
+	}
+	return m
+}
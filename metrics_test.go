@@ -0,0 +1,133 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestMetricsCompactionDebt(t *testing.T) {
+	d, err := Open("", &db.Options{
+		L0CompactionThreshold: 4,
+		Storage:               storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Prevent compactions from being scheduled while L0 is built up.
+	d.mu.Lock()
+	d.mu.compact.compacting = true
+	d.mu.Unlock()
+
+	var prevDebt uint64
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 100; j++ {
+			key := []byte(fmt.Sprintf("%03d", j))
+			if err := d.Set(key, key, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		m := d.Metrics()
+		if n := m.Levels[0].NumFiles; n != i+1 {
+			t.Fatalf("expected %d tables in L0, but found %d", i+1, n)
+		}
+		debt := m.Compact.EstimatedDebt
+		if i+1 < 4 {
+			if debt != 0 {
+				t.Fatalf("%d: expected no debt below the L0 compaction threshold, but found %d", i, debt)
+			}
+		} else if debt <= prevDebt {
+			t.Fatalf("%d: expected the debt to grow from %d, but found %d", i, prevDebt, debt)
+		} else if debt < m.Levels[0].Size {
+			t.Fatalf("%d: expected the debt to include the L0 size %d, but found %d",
+				i, m.Levels[0].Size, debt)
+		}
+		prevDebt = debt
+	}
+
+	d.mu.Lock()
+	d.mu.compact.compacting = false
+	d.mu.Unlock()
+	if err := d.Compact([]byte("000"), []byte("999")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := d.Metrics()
+	if n := m.Levels[0].NumFiles; n != 0 {
+		t.Fatalf("expected no tables in L0, but found %d", n)
+	}
+	if debt := m.Compact.EstimatedDebt; debt != 0 {
+		t.Fatalf("expected no debt after compaction, but found %d", debt)
+	}
+	if m.WriteStall.Count != 0 || m.WriteStall.Duration != 0 {
+		t.Fatalf("expected no write stalls, but found %d (%s)", m.WriteStall.Count, m.WriteStall.Duration)
+	}
+}
+
+func TestMetricsWriteStall(t *testing.T) {
+	d, err := Open("", &db.Options{
+		L0CompactionThreshold: 2,
+		L0StopWritesThreshold: 2,
+		Storage:               storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Prevent compactions from being scheduled while L0 is built up past the
+	// stop writes threshold.
+	d.mu.Lock()
+	d.mu.compact.compacting = true
+	d.mu.Unlock()
+
+	flush := func(i int) error {
+		if err := d.Set([]byte(fmt.Sprint(i)), nil, nil); err != nil {
+			return err
+		}
+		return d.Flush()
+	}
+	for i := 0; i < 3; i++ {
+		if err := flush(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The next flush stalls until L0 is compacted.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- flush(3)
+	}()
+	for d.Metrics().WriteStall.Count == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	d.mu.Lock()
+	d.mu.compact.compacting = false
+	d.maybeScheduleCompaction()
+	d.mu.Unlock()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	m := d.Metrics()
+	if m.WriteStall.Count != 1 {
+		t.Fatalf("expected 1 write stall, but found %d", m.WriteStall.Count)
+	}
+	if m.WriteStall.Duration <= 0 {
+		t.Fatalf("expected a positive write stall duration, but found %s", m.WriteStall.Duration)
+	}
+}
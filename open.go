@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -16,6 +17,7 @@ import (
 	"github.com/petermattis/pebble/internal/arenaskl"
 	"github.com/petermattis/pebble/internal/rate"
 	"github.com/petermattis/pebble/internal/record"
+	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/storage"
 )
 
@@ -23,6 +25,7 @@ func createDB(dirname string, opts *db.Options) (retErr error) {
 	const manifestFileNum = 1
 	ve := versionEdit{
 		comparatorName: opts.Comparer.Name,
+		formatVersion:  opts.MinFormatVersion,
 		nextFileNumber: manifestFileNum + 1,
 	}
 	manifestFilename := dbFilename(dirname, fileTypeManifest, manifestFileNum)
@@ -59,6 +62,15 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	const defaultBurst = 1 << 20                  // 1 MB
 
 	opts = opts.EnsureDefaults()
+	if opts.MinFormatVersion > db.FormatNewest {
+		return nil, fmt.Errorf("pebble: MinFormatVersion %d is newer than the newest supported format version %d",
+			opts.MinFormatVersion, db.FormatNewest)
+	}
+	for _, level := range opts.WarmTableCacheLevels {
+		if level < 0 || level >= numLevels {
+			return nil, fmt.Errorf("pebble: invalid WarmTableCacheLevels level %d", level)
+		}
+	}
 	d := &DB{
 		dirname:           dirname,
 		opts:              opts,
@@ -66,6 +78,7 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		equal:             opts.Comparer.Equal,
 		merge:             opts.Merger.Merge,
 		inlineKey:         opts.Comparer.InlineKey,
+		abbreviatedKey:    opts.Comparer.AbbreviatedKey,
 		commitController:  newController(rate.NewLimiter(defaultRateLimit, defaultBurst)),
 		compactController: newController(rate.NewLimiter(defaultRateLimit, defaultBurst)),
 		flushController:   newController(rate.NewLimiter(rate.Inf, defaultBurst)),
@@ -79,6 +92,7 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	}
 	d.tableCache.init(dirname, opts.Storage, d.opts, tableCacheSize)
 	d.newIters = d.tableCache.newIters
+	d.newGetIters = d.tableCache.newGetIters
 	d.commit = newCommitPipeline(commitEnv{
 		mu:            &d.mu.Mutex,
 		logSeqNum:     &d.mu.versions.logSeqNum,
@@ -88,6 +102,9 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		sync:          d.commitSync,
 		write:         d.commitWrite,
 	})
+	if opts.CompactionLatencyGuard != nil {
+		d.latencyGuard = newLatencyGuard(opts.CompactionLatencyGuard)
+	}
 	d.mu.nextJobID = 1
 	d.mu.mem.cond.L = &d.mu.Mutex
 	d.mu.mem.mutable = newMemTable(d.opts)
@@ -117,6 +134,19 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	}()
 
 	if _, err := fs.Stat(dbFilename(dirname, fileTypeCurrent, 0)); os.IsNotExist(err) {
+		if opts.FastOpenEmpty {
+			empty, err := isEmptyDir(fs, dirname)
+			if err != nil {
+				return nil, err
+			}
+			if empty {
+				if err := d.openEmpty(); err != nil {
+					return nil, err
+				}
+				d.fileLock, fileLock = fileLock, nil
+				return d, nil
+			}
+		}
 		// Create the DB if it did not already exist.
 		if err := createDB(dirname, opts); err != nil {
 			return nil, err
@@ -175,25 +205,32 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	}
 	d.mu.log.LogWriter = record.NewLogWriter(logFile)
 
+	// Upgrade the format version of an older DB. The new manifest records the
+	// format version from its snapshot of the version set.
+	if d.mu.versions.formatVersion < opts.MinFormatVersion {
+		d.mu.versions.formatVersion = opts.MinFormatVersion
+	}
+
 	// Write a new manifest to disk.
 	if err := d.mu.versions.logAndApply(&ve); err != nil {
 		return nil, err
 	}
 
 	// Write the current options to disk.
-	d.optionsFileNum = d.mu.versions.nextFileNum()
-	optionsFile, err := fs.Create(dbFilename(dirname, fileTypeOptions, d.optionsFileNum))
-	if err != nil {
+	if err := d.writeOptionsFile(); err != nil {
 		return nil, err
 	}
-	if _, err := optionsFile.Write([]byte(opts.String())); err != nil {
-		return nil, err
-	}
-	optionsFile.Close()
 
 	jobID := d.mu.nextJobID
 	d.mu.nextJobID++
 	d.deleteObsoleteFiles(jobID)
+	if opts.RebuildFilters {
+		d.mu.compact.rebuildFilters = true
+		d.mu.compact.filtersChecked = make(map[uint64]struct{})
+	}
+	if err := d.warmTableCache(); err != nil {
+		return nil, err
+	}
 	d.maybeScheduleFlush()
 	d.maybeScheduleCompaction()
 
@@ -201,6 +238,112 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	return d, nil
 }
 
+// warmTableCache opens the tables of the levels listed by
+// Options.WarmTableCacheLevels, reading their index and filter blocks.
+//
+// d.mu must be held when calling this.
+func (d *DB) warmTableCache() error {
+	if len(d.opts.WarmTableCacheLevels) == 0 {
+		return nil
+	}
+	// Without a block cache, the blocks read are not retained and do not count
+	// against any budget.
+	budget := int64(math.MaxInt64)
+	if p := d.opts.PinnedIndexAndFilterMemory(); p != nil {
+		budget = p.MaxSize()
+	} else if d.opts.Cache != nil {
+		budget = d.opts.Cache.MaxSize()
+	}
+	var warmed int
+	var loaded int64
+	current := d.mu.versions.currentVersion()
+	for _, level := range d.opts.WarmTableCacheLevels {
+		files := current.files[level]
+		for i := range files {
+			if warmed == d.tableCache.size {
+				return nil
+			}
+			err := d.tableCache.withReader(&files[i], func(r *sstable.Reader) error {
+				n, err := r.WarmIndexAndFilter()
+				loaded += n
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			warmed++
+			if loaded >= budget {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// isEmptyDir returns true if the directory holds no files other than the
+// LOCK file.
+func isEmptyDir(fs storage.Storage, dirname string) (bool, error) {
+	ls, err := fs.List(dirname)
+	if err != nil {
+		return false, err
+	}
+	for _, filename := range ls {
+		if ft, _, ok := parseDBFilename(filename); !ok || ft != fileTypeLock {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// openEmpty initializes a new, empty DB in memory, deferring the creation of
+// its manifest and OPTIONS file until it is first flushed. Only the WAL is
+// created. Should the DB not be flushed before a crash, the directory holds
+// just the WAL, which Open replays into a newly created DB. See
+// db.Options.FastOpenEmpty.
+//
+// d.mu must be held when calling this.
+func (d *DB) openEmpty() error {
+	if err := d.mu.versions.create(d.dirname, d.opts, &d.mu.Mutex); err != nil {
+		return err
+	}
+	d.mu.log.number = d.mu.versions.nextFileNum()
+	logFile, err := d.opts.Storage.Create(dbFilename(d.dirname, fileTypeLog, d.mu.log.number))
+	if err != nil {
+		return err
+	}
+	d.mu.log.LogWriter = record.NewLogWriter(logFile)
+	d.mu.deferred = true
+	return nil
+}
+
+// persistDeferred writes the OPTIONS file of a DB opened by openEmpty ahead of
+// the first version edit, which creates its manifest.
+//
+// d.mu must be held when calling this.
+func (d *DB) persistDeferred() error {
+	if !d.mu.deferred {
+		return nil
+	}
+	if err := d.writeOptionsFile(); err != nil {
+		return err
+	}
+	d.mu.deferred = false
+	return nil
+}
+
+// writeOptionsFile writes the current options to disk.
+func (d *DB) writeOptionsFile() error {
+	d.optionsFileNum = d.mu.versions.nextFileNum()
+	optionsFile, err := d.opts.Storage.Create(dbFilename(d.dirname, fileTypeOptions, d.optionsFileNum))
+	if err != nil {
+		return err
+	}
+	if _, err := optionsFile.Write([]byte(d.opts.String())); err != nil {
+		return err
+	}
+	return optionsFile.Close()
+}
+
 // replayWAL replays the edits in the specified log file.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
@@ -5,14 +5,21 @@
 package pebble
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/record"
+	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/storage"
 )
 
@@ -163,3 +170,667 @@ func TestOpenCloseOpenClose(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenMaxWALSize(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		MaxWALSize:                  4 << 10,
+		MemTableStopWritesThreshold: 1000,
+		Storage:                     mem,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numLogs := func() int {
+		ls, err := mem.List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for _, s := range ls {
+			if ft, _, ok := parseDBFilename(s); ok && ft == fileTypeLog {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Prevent the memtables from being flushed, so that the data is only held
+	// by the WALs.
+	d.mu.Lock()
+	d.mu.compact.flushing = true
+	d.mu.Unlock()
+
+	const numKeys = 100
+	value := []byte(strings.Repeat("x", 1000))
+	for i := 0; i < numKeys; i++ {
+		if err := d.Set([]byte(strconv.Itoa(i)), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each WAL holds at most 5 of the writes, the last of which takes it past
+	// the maximum size.
+	if n := numLogs(); n < numKeys/5 {
+		t.Fatalf("expected at least %d WALs, but found %d", numKeys/5, n)
+	}
+
+	d.mu.Lock()
+	d.mu.compact.flushing = false
+	d.mu.compact.cond.Broadcast()
+	d.mu.Unlock()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recovery replays the chain of WALs, whose data is then held by tables.
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numKeys; i++ {
+		if v, err := d.Get([]byte(strconv.Itoa(i))); err != nil || string(v) != string(value) {
+			t.Fatalf("%d: expected %d bytes, but found %d (%v)", i, len(value), len(v), err)
+		}
+	}
+	if n := numLogs(); n != 1 {
+		t.Fatalf("expected 1 WAL, but found %d", n)
+	}
+
+	// The rotated WALs are removed once their data has been flushed.
+	for i := 0; i < numKeys; i++ {
+		if err := d.Set([]byte(strconv.Itoa(i)), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// The obsolete files are deleted asynchronously with respect to Flush.
+	for start := time.Now(); numLogs() != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("expected 1 WAL, but found %d", numLogs())
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenMaxManifestSize(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		MaxManifestSize: 1 << 10,
+		Storage:         mem,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := func() []string {
+		ls, err := mem.List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, s := range ls {
+			if ft, _, ok := parseDBFilename(s); ok && ft == fileTypeManifest {
+				names = append(names, s)
+			}
+		}
+		return names
+	}
+	// numEdits returns the number of version edits in the current manifest.
+	numEdits := func() int {
+		f, err := mem.Open(dbFilename("", fileTypeCurrent, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err = mem.Open(strings.TrimSpace(string(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var n int
+		rr := record.NewReader(f)
+		for {
+			if _, err := rr.Next(); err == io.EOF {
+				return n
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			n++
+		}
+	}
+
+	// Each flush logs a version edit.
+	const numFlushes = 50
+	for i := 0; i < numFlushes; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("%03d", i)), []byte("x"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The obsolete manifests are deleted asynchronously with respect to the
+	// rollover.
+	for start := time.Now(); len(manifests()) != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("expected 1 manifest, but found %s", manifests())
+		}
+	}
+	if m := manifests(); m[0] == dbFilename("", fileTypeManifest, 1) {
+		t.Fatalf("expected the manifest to be rolled over, but found %s", m)
+	}
+	if n := numEdits(); n >= numFlushes {
+		t.Fatalf("expected fewer than %d edits in the current manifest, but found %d", numFlushes, n)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the DB replays the current manifest, which holds a snapshot of
+	// the tables written before the rollover.
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numFlushes; i++ {
+		if v, err := d.Get([]byte(fmt.Sprintf("%03d", i))); err != nil || string(v) != "x" {
+			t.Fatalf("%d: expected x, but found %s (%v)", i, v, err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenFormatVersion(t *testing.T) {
+	mem := storage.NewMem()
+	open := func(opts *db.Options) *DB {
+		opts.Storage = mem
+		d, err := Open("", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	check := func(opts *db.Options, expected db.FormatMajorVersion) {
+		d := open(opts)
+		if v := d.FormatMajorVersion(); v != expected {
+			t.Fatalf("expected format version %d, but found %d", expected, v)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An older DB is upgraded, and is not downgraded.
+	check(&db.Options{}, db.FormatMostCompatible)
+	check(&db.Options{MinFormatVersion: db.FormatVersioned}, db.FormatVersioned)
+	check(&db.Options{}, db.FormatVersioned)
+
+	// A new DB is created with the configured format version.
+	d, err := Open("new", &db.Options{
+		MinFormatVersion: db.FormatVersioned,
+		Storage:          mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d.FormatMajorVersion(); v != db.FormatVersioned {
+		t.Fatalf("expected format version %d, but found %d", db.FormatVersioned, v)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open("", &db.Options{
+		MinFormatVersion: db.FormatNewest + 1,
+		Storage:          mem,
+	}); err == nil || !strings.Contains(err.Error(), "MinFormatVersion") {
+		t.Fatalf("expected an unsupported MinFormatVersion to be refused, but found %v", err)
+	}
+
+	// Simulate a newer binary upgrading the DB by appending a version edit
+	// which records a newer format version to the current manifest.
+	current, err := mem.Open(dbFilename("", fileTypeCurrent, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := ioutil.ReadAll(current)
+	current.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestName := strings.TrimSpace(string(name))
+	f, err := mem.Open(manifestName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records [][]byte
+	rr := record.NewReader(f)
+	for {
+		r, err := rr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	f.Close()
+	f, err = mem.Create(manifestName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := record.NewWriter(f)
+	for _, rec := range records {
+		rw, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rw.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rw, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ve := versionEdit{formatVersion: db.FormatNewest + 1}
+	if err := ve.encode(rw); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// The DB is refused, whatever format version is configured.
+	for _, v := range []db.FormatMajorVersion{db.FormatMostCompatible, db.FormatNewest} {
+		_, err := Open("", &db.Options{
+			MinFormatVersion: v,
+			Storage:          mem,
+		})
+		if err == nil {
+			t.Fatalf("expected a DB with a newer format version to be refused")
+		}
+		expected := fmt.Sprintf("format version %d is newer than the newest supported format version %d",
+			db.FormatNewest+1, db.FormatNewest)
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q, but found %q", expected, err)
+		}
+	}
+}
+
+func TestOpenFastOpenEmpty(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		FastOpenEmpty: true,
+		Storage:       mem,
+	}
+	// list returns the files in the directory, other than the LOCK file.
+	list := func(dirname string) string {
+		ls, err := mem.List(dirname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, s := range ls {
+			if ft, _, ok := parseDBFilename(s); !ok || ft != fileTypeLock {
+				names = append(names, s)
+			}
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+	get := func(d *DB, key string) string {
+		v, err := d.Get([]byte(key))
+		if err == db.ErrNotFound {
+			return "<not found>"
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(v)
+	}
+
+	// A fast-opened DB writes nothing but its LOCK file and WAL until it is
+	// flushed.
+	d, err := Open("a", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"1", "2", "3"} {
+		if err := d.Set([]byte(k), []byte("v"+k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Delete([]byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := list("a"); s != "000003.log" {
+		t.Fatalf("expected only the WAL, but found %s", s)
+	}
+	if v := get(d, "1"); v != "v1" {
+		t.Fatalf("expected v1, but found %s", v)
+	}
+	if v := get(d, "2"); v != "<not found>" {
+		t.Fatalf("expected 2 to be deleted, but found %s", v)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s := list("a"); !strings.Contains(s, "CURRENT") || !strings.Contains(s, "MANIFEST-") ||
+		!strings.Contains(s, "OPTIONS-") || !strings.Contains(s, ".sst") {
+		t.Fatalf("expected the DB to be written by the flush, but found %s", s)
+	}
+	if err := d.Set([]byte("4"), []byte("v4"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The writes after the flush were logged to the WAL. Reopening an existing
+	// DB does not take the fast path.
+	d, err = Open("a", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, expected := range map[string]string{"1": "v1", "2": "<not found>", "3": "v3", "4": "v4"} {
+		if v := get(d, k); v != expected {
+			t.Fatalf("%s: expected %s, but found %s", k, expected, v)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing a fast-opened DB which was not flushed persists its writes.
+	d, err = Open("b", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("1"), []byte("v1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err = Open("b", &db.Options{Storage: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := get(d, "1"); v != "v1" {
+		t.Fatalf("expected v1, but found %s", v)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fast-opened DB which was never written to leaves an empty DB.
+	d, err = Open("c", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := list("c"); s != "" {
+		t.Fatalf("expected no files, but found %s", s)
+	}
+	d, err = Open("c", &db.Options{Storage: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := get(d, "1"); v != "<not found>" {
+		t.Fatalf("expected an empty DB, but found %s", v)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A synced write to a fast-opened DB survives a crash before the first
+	// flush. The crashed DB is abandoned without being closed, and the WAL it
+	// leaves behind is replayed into a newly created DB.
+	crashed, err := Open("d", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.Set([]byte("1"), []byte("v1"), db.Sync); err != nil {
+		t.Fatal(err)
+	}
+	d, err = Open("d", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := get(d, "1"); v != "v1" {
+		t.Fatalf("expected v1, but found %s", v)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkOpenEmpty(b *testing.B) {
+	for _, fast := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fast=%t", fast), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				d, err := Open("", &db.Options{
+					FastOpenEmpty: fast,
+					Storage:       storage.NewMem(),
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := d.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenWarmTableCache(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{Storage: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The ingested tables do not overlap, and are placed in L6. The flushed
+	// table is placed in L0.
+	for i, prefix := range []string{"a", "b", "c"} {
+		path := fmt.Sprintf("ext%d", i)
+		f, err := mem.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, nil, db.LevelOptions{})
+		for j := 0; j < 10; j++ {
+			if err := w.Set([]byte(fmt.Sprintf("%s%d", prefix, j)), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Ingest([]string{path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Set([]byte("b5"), []byte("w"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	m := d.Metrics()
+	if n0, n6 := m.Levels[0].NumFiles, m.Levels[6].NumFiles; n0 != 1 || n6 != 3 {
+		t.Fatalf("expected 1 table in L0 and 3 tables in L6, but found %d and %d", n0, n6)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(levels []int) *DB {
+		d, err := Open("", &db.Options{
+			Storage:              mem,
+			WarmTableCacheLevels: levels,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	check := func(d *DB, size int, hits, misses int64) {
+		t.Helper()
+		m := d.Metrics()
+		if m.TableCache.Size != size || m.TableCache.Hits != hits || m.TableCache.Misses != misses {
+			t.Fatalf("expected table cache size %d, hits %d and misses %d, but found %d, %d and %d",
+				size, hits, misses, m.TableCache.Size, m.TableCache.Hits, m.TableCache.Misses)
+		}
+	}
+
+	// Without warming, no tables are open until they are read.
+	d = open(nil)
+	check(d, 0, 0, 0)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tables of L6 are open immediately after open, and serve reads
+	// without being opened again.
+	d = open([]int{6})
+	check(d, 3, 0, 3)
+	if v, err := d.Get([]byte("c3")); err != nil || string(v) != "v" {
+		t.Fatalf("expected v, but found %s (%v)", v, err)
+	}
+	check(d, 3, 1, 3)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d = open([]int{6, 0})
+	check(d, 4, 0, 4)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Warming stops once the index and filter blocks read reach the pinned
+	// memory budget.
+	d, err = Open("", &db.Options{
+		MaxIndexAndFilterMemory: 1,
+		Storage:                 mem,
+		WarmTableCacheLevels:    []int{6},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(d, 1, 0, 1)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open("", &db.Options{
+		Storage:              mem,
+		WarmTableCacheLevels: []int{numLevels},
+	}); err == nil {
+		t.Fatalf("expected an invalid level error")
+	}
+}
+
+func TestOpenInMemory(t *testing.T) {
+	run := func(dirname string, opts *db.Options) string {
+		d, err := Open(dirname, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			key := []byte(fmt.Sprintf("%04d", (i*7)%1000))
+			switch i % 5 {
+			case 0, 1, 2:
+				err = d.Set(key, []byte(fmt.Sprint(i)), nil)
+			case 3:
+				err = d.Merge(key, []byte(fmt.Sprint(i)), nil)
+			case 4:
+				err = d.Delete(key, nil)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%500 == 499 {
+				if err := d.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := d.DeleteRange([]byte("0100"), []byte("0200"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Compact([]byte("0"), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The contents are read after reopening the DB, which recovers them
+		// from the manifest and tables.
+		d, err = Open(dirname, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		var buf strings.Builder
+		iter := d.NewIter(nil)
+		for iter.First(); iter.Valid(); iter.Next() {
+			fmt.Fprintf(&buf, "%s:%s\n", iter.Key(), iter.Value())
+		}
+		for iter.Last(); iter.Valid(); iter.Prev() {
+			fmt.Fprintf(&buf, "%s\n", iter.Key())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"0000", "0150", "0999"} {
+			v, err := d.Get([]byte(key))
+			fmt.Fprintf(&buf, "get %s: %s %v\n", key, v, err)
+		}
+		return buf.String()
+	}
+
+	dir, err := ioutil.TempDir("", "pebble-in-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	onDisk := run(filepath.Join(dir, "disk"), &db.Options{})
+	inMemory := run(filepath.Join(dir, "memory"), &db.Options{InMemory: true})
+	if onDisk != inMemory {
+		t.Fatalf("expected the in-memory DB to match the on-disk DB:\n%s\nbut found\n%s",
+			onDisk, inMemory)
+	}
+	if strings.Count(inMemory, "\n") < 100 {
+		t.Fatalf("expected the DB to hold keys, but found\n%s", inMemory)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "memory")); !os.IsNotExist(err) {
+		t.Fatalf("expected the in-memory DB to not be written to disk, but found %v", err)
+	}
+}
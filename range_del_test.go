@@ -232,6 +232,139 @@ func TestRangeDelCompactionTruncation(t *testing.T) {
 	}
 }
 
+// Verify that DeletePrefix deletes exactly the keys with the prefix, and that
+// the sentinel end key is handled consistently by flushes and compactions.
+func TestDeletePrefix(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	keys := func() string {
+		iter := d.NewIter(nil)
+		defer iter.Close()
+		var buf bytes.Buffer
+		var sep string
+		for iter.First(); iter.Valid(); iter.Next() {
+			fmt.Fprintf(&buf, "%s%q", sep, iter.Key())
+			sep = " "
+		}
+		return buf.String()
+	}
+	expectKeys := func(expected string) {
+		t.Helper()
+		if actual := keys(); expected != actual {
+			t.Fatalf("expected %s, but found %s", expected, actual)
+		}
+	}
+
+	for _, key := range []string{"a", "ab", "ab\x00", "abc", "ab\xff\xff", "ac", "b"} {
+		if err := d.Set([]byte(key), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeletePrefix([]byte("ab"), nil); err != nil {
+		t.Fatal(err)
+	}
+	const expected = `"a" "ac" "b"`
+	expectKeys(expected)
+
+	// The tombstone is flushed to an sstable...
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(expected)
+
+	// ...and compacted together with the deleted keys.
+	if err := d.Compact([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(expected)
+
+	// Keys written after the deletion are visible.
+	if err := d.Set([]byte("abd"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(`"a" "abd" "ac" "b"`)
+
+	// A prefix consisting solely of 0xff bytes has no range end sentinel.
+	if err := d.DeletePrefix([]byte("\xff"), nil); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+}
+
+func TestRangeTombstoneFragmentLimit(t *testing.T) {
+	const limit = 100
+	var events []db.RangeTombstoneLimitInfo
+	d, err := Open("", &db.Options{
+		Storage:                    storage.NewMem(),
+		MaxRangeTombstoneFragments: limit,
+		EventListener: &db.EventListener{
+			RangeTombstoneLimitExceeded: func(info db.RangeTombstoneLimitInfo) {
+				events = append(events, info)
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Write overlapping range tombstones, each of which overlaps the next 50
+	// tombstones. Fragmenting them produces roughly 50 fragments per tombstone.
+	const n = 50
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%04d", i))
+	}
+	for i := 0; i < n; i++ {
+		if err := d.DeleteRange(key(i), key(i+n), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Set(key(2*n), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fragments := d.RangeTombstoneFragments(); fragments != 0 {
+		t.Fatalf("expected no fragments before iteration, but found %d", fragments)
+	}
+
+	for i := 0; i < 2; i++ {
+		iter := d.NewIter(nil)
+		if !iter.First() || string(iter.Key()) != string(key(2*n)) {
+			t.Fatalf("expected %s to be the only visible key", key(2*n))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fragments := d.RangeTombstoneFragments()
+	if fragments <= limit {
+		t.Fatalf("expected more than %d fragments, but found %d", limit, fragments)
+	}
+	// The event is only invoked once per memtable.
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, but found %d", len(events))
+	}
+	if expected := (db.RangeTombstoneLimitInfo{Fragments: fragments, Limit: limit}); expected != events[0] {
+		t.Fatalf("expected %+v, but found %+v", expected, events[0])
+	}
+
+	// Flushing the memtable releases the fragments.
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if fragments := d.RangeTombstoneFragments(); fragments != 0 {
+		t.Fatalf("expected no fragments after flush, but found %d", fragments)
+	}
+}
+
 func BenchmarkRangeDelIterate(b *testing.B) {
 	for _, entries := range []int{10, 1000, 100000} {
 		b.Run(fmt.Sprintf("entries=%d", entries), func(b *testing.B) {
@@ -27,7 +27,18 @@ var _ Reader = (*Snapshot)(nil)
 // The caller should not modify the contents of the returned slice, but it is
 // safe to modify the contents of the argument after Get returns.
 func (s *Snapshot) Get(key []byte) ([]byte, error) {
-	return s.db.getInternal(key, nil /* batch */, s)
+	return s.db.getInternal(key, nil /* batch */, s, nil /* opts */)
+}
+
+// GetWithOptions is like Get, but reads the DB with the given options. See
+// DB.GetWithOptions for the options which are honored.
+func (s *Snapshot) GetWithOptions(key []byte, opts *db.IterOptions) ([]byte, error) {
+	if ctx := opts.GetContext(); ctx != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return s.db.getInternal(key, nil /* batch */, s, opts)
 }
 
 // NewIter returns an iterator that is unpositioned (Iterator.Valid() will
@@ -5,8 +5,10 @@
 package sstable
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"unsafe"
 
 	"github.com/petermattis/pebble/db"
@@ -30,27 +32,96 @@ type blockWriter struct {
 	curValue        []byte
 	prevKey         []byte
 	tmp             [50]byte
+	// valueDedup enables the encoding of a value which is identical to the
+	// value of the previous entry as a back-reference. See store.
+	valueDedup bool
+	// seqNumDelta enables the encoding of the trailer of an entry whose user
+	// key is identical to that of the previous entry as a sequence number
+	// delta. See store. delta holds the encoding of the current delta.
+	seqNumDelta bool
+	delta       [binary.MaxVarintLen64 + 1]byte
+	// filter, if non-nil, accumulates a filter over the user keys of each
+	// restart interval, which finish appends to the block after the restart
+	// points. See LevelOptions.BlockInternalFilter.
+	filter        db.FilterWriter
+	filterData    []byte
+	filterOffsets []uint32
 }
 
 func (w *blockWriter) store(keySize int, value []byte) {
 	shared := 0
-	if w.nEntries%w.restartInterval == 0 {
+	restart := w.nEntries%w.restartInterval == 0
+	if restart {
 		w.restarts = append(w.restarts, uint32(len(w.buf)))
 	} else {
 		shared = db.SharedPrefixLen(w.curKey, w.prevKey)
 	}
 
-	n := binary.PutUvarint(w.tmp[0:], uint64(shared))
-	n += binary.PutUvarint(w.tmp[n:], uint64(keySize-shared))
-	n += binary.PutUvarint(w.tmp[n:], uint64(len(value)))
+	valueLen := uint64(len(value))
+	backRef := false
+	if w.valueDedup {
+		// The value length is shifted left by one bit. A set low bit indicates
+		// that the value is identical to the value of the previous entry and is
+		// not stored. The entry at a restart point always stores its value so
+		// that it can be decoded without the previous entry.
+		if !restart && bytes.Equal(value, w.curValue) {
+			valueLen = 1
+			backRef = true
+		} else {
+			valueLen <<= 1
+		}
+	}
+
+	key := w.curKey[shared:]
+	sharedLen := uint64(shared)
+	if w.seqNumDelta {
+		// The shared length is shifted left by one bit. A set low bit indicates
+		// that the entry shares the user key of the previous entry, and that the
+		// unshared bytes of the key hold the difference between the sequence
+		// number of the previous entry and that of the entry, followed by the
+		// kind of the entry. The entry at a restart point always stores its full
+		// key, and as the shared length at a restart point is 0, its encoding is
+		// unaffected.
+		sharedLen <<= 1
+		if !restart {
+			if delta, ok := w.encodeSeqNumDelta(); ok {
+				key = delta
+				sharedLen = uint64(keySize-8)<<1 | 1
+			}
+		}
+	}
+
+	n := binary.PutUvarint(w.tmp[0:], sharedLen)
+	n += binary.PutUvarint(w.tmp[n:], uint64(len(key)))
+	n += binary.PutUvarint(w.tmp[n:], valueLen)
 	w.buf = append(w.buf, w.tmp[:n]...)
-	w.buf = append(w.buf, w.curKey[shared:]...)
-	w.buf = append(w.buf, value...)
-	w.curValue = w.buf[len(w.buf)-len(value):]
+	w.buf = append(w.buf, key...)
+	if !backRef {
+		w.buf = append(w.buf, value...)
+		w.curValue = w.buf[len(w.buf)-len(value):]
+	}
 
 	w.nEntries++
 }
 
+// encodeSeqNumDelta returns the encoding of the trailer of curKey relative to
+// the trailer of prevKey. Returns false if the user keys of curKey and prevKey
+// differ, or if the sequence number of curKey is larger than that of prevKey.
+func (w *blockWriter) encodeSeqNumDelta() ([]byte, bool) {
+	n := len(w.curKey) - 8
+	if n < 0 || len(w.prevKey) != len(w.curKey) || !bytes.Equal(w.curKey[:n], w.prevKey[:n]) {
+		return nil, false
+	}
+	cur := binary.LittleEndian.Uint64(w.curKey[n:])
+	prev := binary.LittleEndian.Uint64(w.prevKey[n:])
+	if cur>>8 > prev>>8 {
+		return nil, false
+	}
+	m := binary.PutUvarint(w.delta[:], prev>>8-cur>>8)
+	w.delta[m] = byte(cur)
+	return w.delta[:m+1], true
+}
+
 func (w *blockWriter) add(key db.InternalKey, value []byte) {
 	w.curKey, w.prevKey = w.prevKey, w.curKey
 
@@ -61,9 +132,23 @@ func (w *blockWriter) add(key db.InternalKey, value []byte) {
 	w.curKey = w.curKey[:size]
 	key.Encode(w.curKey)
 
+	if w.filter != nil {
+		if w.nEntries%w.restartInterval == 0 {
+			w.finishFilter()
+		}
+		w.filter.AddKey(key.UserKey)
+	}
 	w.store(size, value)
 }
 
+// finishFilter finishes the filter of the current restart interval, if any.
+func (w *blockWriter) finishFilter() {
+	if w.nEntries > 0 {
+		w.filterData = w.filter.Finish(w.filterData)
+	}
+	w.filterOffsets = append(w.filterOffsets, uint32(len(w.filterData)))
+}
+
 func (w *blockWriter) finish() []byte {
 	// Write the restart points to the buffer.
 	if w.nEntries == 0 {
@@ -82,6 +167,20 @@ func (w *blockWriter) finish() []byte {
 	}
 	binary.LittleEndian.PutUint32(tmp4, uint32(len(w.restarts)))
 	w.buf = append(w.buf, tmp4...)
+
+	if w.filter != nil {
+		// The filters are followed by their offsets, the last of which is the
+		// end of the final filter, and the length of the filter section.
+		w.finishFilter()
+		start := len(w.buf)
+		w.buf = append(w.buf, w.filterData...)
+		for _, x := range w.filterOffsets {
+			binary.LittleEndian.PutUint32(tmp4, x)
+			w.buf = append(w.buf, tmp4...)
+		}
+		binary.LittleEndian.PutUint32(tmp4, uint32(len(w.buf)-start))
+		w.buf = append(w.buf, tmp4...)
+	}
 	return w.buf
 }
 
@@ -89,6 +188,8 @@ func (w *blockWriter) reset() {
 	w.nEntries = 0
 	w.buf = w.buf[:0]
 	w.restarts = w.restarts[:0]
+	w.filterData = w.filterData[:0]
+	w.filterOffsets = w.filterOffsets[:0]
 }
 
 func (w *blockWriter) estimatedSize() int {
@@ -116,6 +217,27 @@ type blockIter struct {
 	cached       []blockEntry
 	cachedBuf    []byte
 	err          error
+	// valueDedup indicates that the block was written with value
+	// back-references (see blockWriter.store). Entries must then be decoded in
+	// order from a restart point, as a back-reference refers to the value of the
+	// previously decoded entry.
+	valueDedup bool
+	// seqNumDelta indicates that the block was written with sequence number
+	// deltas (see blockWriter.store). As with valueDedup, entries must then be
+	// decoded in order from a restart point.
+	seqNumDelta bool
+	// validateOrder causes the iterator to verify that each key decoded is not
+	// less than the key preceding it in the block, returning an error on a
+	// violation. See db.Options.VerifyBlockKeyOrder.
+	validateOrder bool
+	prevKey       db.InternalKey
+	// inBlockFilters indicates that the block was written with a filter per
+	// restart interval following its restart points (see blockWriter.finish),
+	// which init strips from the block. The filters are consulted by seekExact
+	// if filterPolicy is non-nil.
+	inBlockFilters bool
+	filterPolicy   db.FilterPolicy
+	filters        []byte
 }
 
 func newBlockIter(cmp db.Compare, block block) (*blockIter, error) {
@@ -124,6 +246,17 @@ func newBlockIter(cmp db.Compare, block block) (*blockIter, error) {
 }
 
 func (i *blockIter) init(cmp db.Compare, block block, globalSeqNum uint64) error {
+	if i.inBlockFilters {
+		var n int
+		if len(block) >= 4 {
+			n = int(binary.LittleEndian.Uint32(block[len(block)-4:]))
+		}
+		if len(block) < 4 || n > len(block)-4 {
+			return errors.New("pebble/table: invalid table (corrupt in-block filter)")
+		}
+		i.filters = block[len(block)-4-n : len(block)-4]
+		block = block[:len(block)-4-n]
+	}
 	numRestarts := int(binary.LittleEndian.Uint32(block[len(block)-4:]))
 	if numRestarts == 0 {
 		return errors.New("pebble/table: invalid table (block has no restart points)")
@@ -144,18 +277,61 @@ func (i *blockIter) init(cmp db.Compare, block block, globalSeqNum uint64) error
 	return nil
 }
 
+// RestartPoints returns the offsets of the restart points within the block,
+// in increasing order. The returned slice is a copy. Intended for
+// introspection by tooling.
+func (i *blockIter) RestartPoints() []uint32 {
+	points := make([]uint32, i.numRestarts)
+	for j := range points {
+		points[j] = binary.LittleEndian.Uint32(i.data[i.restarts+4*j:])
+	}
+	return points
+}
+
 func (i *blockIter) readEntry() {
 	ptr := unsafe.Pointer(uintptr(i.ptr) + uintptr(i.offset))
 	shared, ptr := decodeVarint(ptr)
 	unshared, ptr := decodeVarint(ptr)
 	value, ptr := decodeVarint(ptr)
-	i.key = append(i.key[:shared], getBytes(ptr, int(unshared))...)
+	if i.seqNumDelta && shared&1 != 0 {
+		i.readSeqNumDelta(int(shared>>1), getBytes(ptr, int(unshared)))
+	} else {
+		if i.seqNumDelta {
+			shared >>= 1
+		}
+		i.key = append(i.key[:shared], getBytes(ptr, int(unshared))...)
+	}
 	i.key = i.key[:len(i.key):len(i.key)]
 	ptr = unsafe.Pointer(uintptr(ptr) + uintptr(unshared))
+	if i.valueDedup {
+		if value&1 != 0 {
+			// The value is identical to the value of the previous entry, which is
+			// still in i.val.
+			i.nextOffset = int(uintptr(ptr) - uintptr(i.ptr))
+			return
+		}
+		value >>= 1
+	}
 	i.val = getBytes(ptr, int(value))
 	i.nextOffset = int(uintptr(ptr)-uintptr(i.ptr)) + int(value)
 }
 
+// readSeqNumDelta reconstructs the trailer of the current entry, which shares
+// the userKeyLen bytes of the user key of the previous entry still in i.key,
+// from the trailer of the previous entry and the encoded delta.
+func (i *blockIter) readSeqNumDelta(userKeyLen int, delta []byte) {
+	d, n := binary.Uvarint(delta)
+	if len(i.key) != userKeyLen+8 || n <= 0 || n != len(delta)-1 {
+		if i.err == nil {
+			i.err = errors.New("pebble/table: invalid table (corrupt sequence number delta)")
+		}
+		i.key = i.key[:0]
+		return
+	}
+	prev := binary.LittleEndian.Uint64(i.key[userKeyLen:])
+	binary.LittleEndian.PutUint64(i.key[userKeyLen:], (prev>>8-d)<<8|uint64(delta[n]))
+}
+
 func (i *blockIter) decodeInternalKey(key []byte) {
 	i.ikey = db.DecodeInternalKey(key)
 	if i.globalSeqNum != 0 {
@@ -174,6 +350,11 @@ func (i *blockIter) clearCache() {
 }
 
 func (i *blockIter) cacheEntry() {
+	if i.validateOrder && len(i.cached) > 0 && i.err == nil {
+		// The cached entries are a run of consecutive entries, so the previous
+		// cached entry precedes the current one in the block.
+		i.checkOrder(db.DecodeInternalKey(i.cached[len(i.cached)-1].key), db.DecodeInternalKey(i.key))
+	}
 	i.cachedBuf = append(i.cachedBuf, i.key...)
 	i.cached = append(i.cached, blockEntry{
 		offset: i.offset,
@@ -182,9 +363,70 @@ func (i *blockIter) cacheEntry() {
 	})
 }
 
+// checkOrder sets i.err if key, which immediately follows prev in the block,
+// is less than prev.
+func (i *blockIter) checkOrder(prev, key db.InternalKey) {
+	if db.InternalCompare(i.cmp, key, prev) < 0 {
+		i.err = fmt.Errorf("pebble/table: invalid table (block key %s out of order after %s)", key, prev)
+	}
+}
+
+// orderViolated returns true and invalidates the iterator if checkOrder found
+// a key out of order.
+func (i *blockIter) orderViolated() bool {
+	if i.validateOrder && i.err != nil {
+		i.offset = -1
+		i.nextOffset = i.restarts
+		return true
+	}
+	return false
+}
+
+// unknownKind returns an error and invalidates the iterator if the entry it is
+// positioned at has an internal key kind unknown to this reader.
+func (i *blockIter) unknownKind() error {
+	switch kind := i.ikey.Kind(); kind {
+	case db.InternalKeyKindDelete, db.InternalKeyKindSet, db.InternalKeyKindMerge,
+		db.InternalKeyKindRangeDelete:
+		return nil
+	default:
+		i.offset = -1
+		i.nextOffset = i.restarts
+		return fmt.Errorf("pebble/table: invalid table (unknown internal key kind %d for key %q)",
+			kind, i.ikey.UserKey)
+	}
+}
+
+// mayContain returns false if the filter of the restart interval at index
+// rules out the block containing key in that interval.
+func (i *blockIter) mayContain(index int, key []byte) bool {
+	n := 4 * (i.numRestarts + 1)
+	if i.filterPolicy == nil || len(i.filters) < n {
+		return true
+	}
+	data, offsets := i.filters[:len(i.filters)-n], i.filters[len(i.filters)-n:]
+	start := binary.LittleEndian.Uint32(offsets[4*index:])
+	end := binary.LittleEndian.Uint32(offsets[4*index+4:])
+	if start >= end || uint64(end) > uint64(len(data)) {
+		return true
+	}
+	return i.filterPolicy.MayContain(db.BlockFilter, data[start:end], key)
+}
+
 // SeekGE implements internalIterator.SeekGE, as documented in the pebble
 // package.
 func (i *blockIter) SeekGE(key []byte) bool {
+	return i.seekGE(key, false /* exact */)
+}
+
+// seekExact is like SeekGE, but is only used to find the newest entry for key.
+// If the block has in-block filters, the iterator may then be positioned past
+// entries smaller than those for key without scanning them.
+func (i *blockIter) seekExact(key []byte) bool {
+	return i.seekGE(key, true /* exact */)
+}
+
+func (i *blockIter) seekGE(key []byte, exact bool) bool {
 	ikey := db.MakeSearchKey(key)
 
 	// Find the index of the smallest restart point whose key is > the key
@@ -219,6 +461,19 @@ func (i *blockIter) SeekGE(key []byte) bool {
 		// => answer is index.
 	}
 
+	if exact && index > 0 && !i.mayContain(index-1, key) {
+		// The key is not in the restart interval at index-1, so its newest entry
+		// can only be the first entry of the following interval.
+		if index == i.numRestarts {
+			i.offset = -1
+			i.nextOffset = i.restarts
+			return false
+		}
+		i.offset = int(binary.LittleEndian.Uint32(i.data[i.restarts+4*index:]))
+		i.loadEntry()
+		return true
+	}
+
 	// Since keys are strictly increasing, if index > 0 then the restart point at
 	// index-1 will be the largest whose key is <= the key sought.  If index ==
 	// 0, then all keys in this block are larger than the key sought, and offset
@@ -297,6 +552,9 @@ func (i *blockIter) SeekLT(key []byte) bool {
 		i.offset = i.nextOffset
 		i.loadEntry()
 		i.cacheEntry()
+		if i.orderViolated() {
+			return false
+		}
 
 		if i.cmp(i.ikey.UserKey, ikey.UserKey) >= 0 {
 			// The current key is greater than or equal to our search key. Back up to
@@ -342,6 +600,9 @@ func (i *blockIter) Last() bool {
 		i.readEntry()
 		i.cacheEntry()
 	}
+	if i.orderViolated() {
+		return false
+	}
 
 	i.decodeInternalKey(i.key)
 	return true
@@ -350,11 +611,23 @@ func (i *blockIter) Last() bool {
 // Next implements internalIterator.Next, as documented in the pebble
 // package.
 func (i *blockIter) Next() bool {
+	validate := i.validateOrder && i.Valid()
+	if validate {
+		// The key is overwritten by loadEntry.
+		i.prevKey.UserKey = append(i.prevKey.UserKey[:0], i.ikey.UserKey...)
+		i.prevKey.Trailer = i.ikey.Trailer
+	}
 	i.offset = i.nextOffset
 	if !i.Valid() {
 		return false
 	}
 	i.loadEntry()
+	if validate {
+		i.checkOrder(i.prevKey, i.ikey)
+		if i.orderViolated() {
+			return false
+		}
+	}
 	return true
 }
 
@@ -366,6 +639,10 @@ func (i *blockIter) Prev() bool {
 		e := &i.cached[n-1]
 		i.offset = e.offset
 		i.val = e.val
+		// A subsequent Next decodes the following entry relative to i.key, which
+		// must hold the key of the current entry. The key is copied as i.key must
+		// not alias cachedBuf, which is overwritten when the cache is cleared.
+		i.key = append(i.key[:0], e.key...)
 		i.decodeInternalKey(e.key)
 		i.cached = i.cached[:n]
 		return true
@@ -378,6 +655,12 @@ func (i *blockIter) Prev() bool {
 	}
 
 	targetOffset := i.offset
+	if i.validateOrder {
+		// The key at targetOffset is overwritten by readEntry. It follows the last
+		// entry read below.
+		i.prevKey.UserKey = append(i.prevKey.UserKey[:0], i.ikey.UserKey...)
+		i.prevKey.Trailer = i.ikey.Trailer
+	}
 	var index int
 
 	{
@@ -414,6 +697,12 @@ func (i *blockIter) Prev() bool {
 		i.readEntry()
 		i.cacheEntry()
 	}
+	if i.validateOrder && i.err == nil {
+		i.checkOrder(db.DecodeInternalKey(i.key), i.prevKey)
+	}
+	if i.orderViolated() {
+		return false
+	}
 
 	i.decodeInternalKey(i.key)
 	return true
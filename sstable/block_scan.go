@@ -0,0 +1,248 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/crc"
+)
+
+// dataBlockScanner finds the data blocks of a table without the help of the
+// index block. The data blocks are contiguous from the start of the file, and
+// the end of a block is found by scanning forward for a block trailer whose
+// checksum matches the preceding bytes. Each candidate block is verified to
+// contain point records ordered after those of the previous block, which
+// rejects the meta blocks following the data blocks, as well as the
+// vanishingly unlikely coincidental checksum match.
+type dataBlockScanner struct {
+	cmp        db.Compare
+	valueDedup bool
+	// seqNumDelta indicates that the data blocks store sequence number deltas.
+	// See LevelOptions.SeqNumDelta.
+	seqNumDelta bool
+	// inBlockFilters causes the filters stored in the data blocks to be
+	// stripped from the blocks found. See LevelOptions.BlockInternalFilter.
+	inBlockFilters bool
+	// lastKey is the last key of the last data block found. It is only valid
+	// if found is true.
+	lastKey db.InternalKey
+	found   bool
+}
+
+// next looks for a complete data block at the start of b, considering blocks
+// of at most maxLen bytes if maxLen is positive. If one is found, the decoded
+// block and its length (excluding the trailer) are returned.
+func (s *dataBlockScanner) next(b []byte, maxLen int) (block, int, bool) {
+	var c crc.CRC
+	for n := 0; n+blockTrailerLen <= len(b); n++ {
+		if maxLen > 0 && n > maxLen {
+			break
+		}
+		// c is the checksum of b[:n].
+		if blockType := b[n]; blockType == noCompressionBlockType ||
+			blockType == snappyCompressionBlockType {
+			checksum := binary.LittleEndian.Uint32(b[n+1:])
+			if c.Update(b[n:n+1]).Value() == checksum {
+				if data, ok := s.verify(b[:n], blockType); ok {
+					return data, n, true
+				}
+			}
+		}
+		c = c.Update(b[n : n+1])
+	}
+	return nil, 0, false
+}
+
+// verify decodes the candidate block and verifies that it is a data block
+// containing point records ordered after those of the previous block. If so,
+// the decoded block is returned and lastKey is updated.
+func (s *dataBlockScanner) verify(b []byte, blockType byte) (block, bool) {
+	if blockType == snappyCompressionBlockType {
+		decoded, err := snappy.Decode(nil, b)
+		if err != nil {
+			return nil, false
+		}
+		b = decoded
+	}
+	if len(b) < 4 {
+		return nil, false
+	}
+	if s.inBlockFilters {
+		n := int(binary.LittleEndian.Uint32(b[len(b)-4:]))
+		if n > len(b)-8 {
+			return nil, false
+		}
+		b = b[:len(b)-4-n]
+	}
+	numRestarts := binary.LittleEndian.Uint32(b[len(b)-4:])
+	if numRestarts == 0 || uint64(numRestarts) >= uint64(len(b)/4) {
+		return nil, false
+	}
+	restarts := len(b) - 4*(1+int(numRestarts))
+	if binary.LittleEndian.Uint32(b[restarts:]) != 0 {
+		return nil, false
+	}
+	for j := 1; j < int(numRestarts); j++ {
+		prev := binary.LittleEndian.Uint32(b[restarts+4*(j-1):])
+		if cur := binary.LittleEndian.Uint32(b[restarts+4*j:]); cur <= prev || int(cur) >= restarts {
+			return nil, false
+		}
+	}
+
+	iter, err := newBlockIter(s.cmp, b)
+	if err != nil {
+		return nil, false
+	}
+	iter.valueDedup = s.valueDedup
+	iter.seqNumDelta = s.seqNumDelta
+	prev := s.lastKey.Clone()
+	first, empty := !s.found, true
+	for valid := iter.First(); valid; valid = iter.Next() {
+		key := iter.Key()
+		switch key.Kind() {
+		case db.InternalKeyKindDelete, db.InternalKeyKindSet, db.InternalKeyKindMerge:
+		default:
+			return nil, false
+		}
+		if !first && db.InternalCompare(s.cmp, prev, key) >= 0 {
+			return nil, false
+		}
+		// The key returned by the block iterator is overwritten by Next.
+		prev.UserKey = append(prev.UserKey[:0], key.UserKey...)
+		prev.Trailer = key.Trailer
+		first, empty = false, false
+	}
+	if iter.Error() != nil || empty {
+		// An empty data block is only written for a table without any point
+		// records.
+		return nil, false
+	}
+	s.lastKey, s.found = prev, true
+	return b, true
+}
+
+// recoverScanWindow is the number of bytes scanned for the end of a data block
+// by RecoverScan before any data block has been found.
+const recoverScanWindow = 64 << 10
+
+// RecoverScan salvages the point records of a table whose index block (or
+// footer) is corrupt by scanning the data blocks sequentially from the start
+// of the file and calling fn for each record in order. A corrupt data block
+// is skipped by resynchronizing on the next data block whose checksum and
+// contents are valid. The key and value passed to fn are only valid for the
+// duration of the call, and an error returned by fn stops the scan.
+//
+// RecoverScan returns the number of bytes which were skipped because they
+// could not be decoded as data blocks. If the properties cannot be read, the
+// meta blocks following the data blocks are included in that count. Range
+// deletion tombstones are not recovered. The data blocks are read into memory
+// in their entirety. The values stored in the value blocks of a table written
+// with LevelOptions.ValueBlockThreshold are only recovered if the properties
+// and the value index block are readable.
+func (r *Reader) RecoverScan(fn func(key db.InternalKey, value []byte) error) (skipped uint64, err error) {
+	if r.file == nil {
+		return 0, r.err
+	}
+	stat, err := r.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := uint64(stat.Size())
+	s := dataBlockScanner{cmp: r.compare}
+	var alignment int
+	var values *valueBlockReader
+	// valueBlocks maps the offsets of the value blocks to their lengths. The
+	// value blocks are interspersed with the data blocks, and are skipped by
+	// the scan.
+	var valueBlocks map[uint64]uint64
+	if r.err == nil && r.Properties.DataSize > 0 && r.Properties.DataSize <= size {
+		// The properties are readable, so the data blocks are known to end at
+		// DataSize.
+		size = r.Properties.DataSize
+		s.valueDedup = r.Properties.ValueDedup
+		s.seqNumDelta = r.Properties.SeqNumDelta
+		s.inBlockFilters = r.Properties.BlockInternalFilter
+		alignment = int(r.Properties.BlockAlignment)
+		if r.Properties.ValueBlocks {
+			values = &valueBlockReader{reader: r, verifyChecksum: true, noCache: true}
+			if valueBlocks, err = r.valueBlockLengths(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	b := make([]byte, size)
+	n, err := r.file.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	b = b[:n]
+
+	window := recoverScanWindow
+	maxLen := 0
+	// skipValueBlocks skips the value blocks at offset, and the padding
+	// following them.
+	skipValueBlocks := func(offset int) int {
+		for {
+			length, ok := valueBlocks[uint64(offset)]
+			if !ok {
+				break
+			}
+			offset += int(length + r.trailerLen)
+		}
+		if alignment > 0 {
+			offset += (alignment - offset%alignment) % alignment
+		}
+		return offset
+	}
+	for offset := 0; offset+blockTrailerLen <= len(b); {
+		if _, ok := valueBlocks[uint64(offset)]; ok {
+			// The data block preceding the value blocks was corrupt.
+			offset = skipValueBlocks(offset)
+			continue
+		}
+		data, length, ok := s.next(b[offset:], window)
+		if !ok {
+			// The block at offset is corrupt. Scanning forward for its end (or the
+			// end of the next block) is bounded by the window, which limits the
+			// cost of retrying at each subsequent offset.
+			offset++
+			skipped++
+			continue
+		}
+		if length > maxLen {
+			maxLen = length
+			if 2*maxLen > window {
+				window = 2 * maxLen
+			}
+		}
+		iter, err := newBlockIter(r.compare, data)
+		if err != nil {
+			return skipped, err
+		}
+		iter.valueDedup = s.valueDedup
+		iter.seqNumDelta = s.seqNumDelta
+		for valid := iter.First(); valid; valid = iter.Next() {
+			value := iter.Value()
+			if values != nil {
+				if value, err = values.value(value); err != nil {
+					return skipped, err
+				}
+			}
+			if err := fn(iter.Key(), value); err != nil {
+				return skipped, err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return skipped, err
+		}
+		// Skip the value blocks and padding following the block.
+		offset = skipValueBlocks(offset + length + int(r.trailerLen))
+	}
+	return skipped, nil
+}
@@ -15,6 +15,7 @@ import (
 
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/datadriven"
+	"github.com/petermattis/pebble/storage"
 )
 
 func TestBlockWriter(t *testing.T) {
@@ -40,6 +41,158 @@ func TestBlockWriter(t *testing.T) {
 	}
 }
 
+func TestBlockRestartPoints(t *testing.T) {
+	for _, restartInterval := range []int{1, 4, 16} {
+		t.Run(fmt.Sprintf("restart=%d", restartInterval), func(t *testing.T) {
+			w := &blockWriter{restartInterval: restartInterval}
+			for i := 0; i < 50; i++ {
+				w.add(db.MakeInternalKey([]byte(fmt.Sprintf("key%03d", i)), 0, db.InternalKeyKindSet), nil)
+			}
+			expected := append([]uint32(nil), w.restarts...)
+			if n := (50 + restartInterval - 1) / restartInterval; n != len(expected) {
+				t.Fatalf("expected %d restart points, but found %d", n, len(expected))
+			}
+
+			iter, err := newBlockIter(bytes.Compare, w.finish())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := iter.RestartPoints(); fmt.Sprint(expected) != fmt.Sprint(actual) {
+				t.Fatalf("expected %d, but found %d", expected, actual)
+			}
+
+			// Every restart point must be the start of an entry with no shared
+			// key prefix.
+			for _, offset := range expected {
+				if iter.data[offset] != 0 {
+					t.Fatalf("restart point %d has a shared key prefix", offset)
+				}
+			}
+		})
+	}
+}
+
+func TestBlockIterValidateOrder(t *testing.T) {
+	for _, restartInterval := range []int{1, 2, 16} {
+		t.Run(fmt.Sprintf("restart=%d", restartInterval), func(t *testing.T) {
+			// The block writer doesn't verify the key order, which allows a
+			// misordered block to be crafted.
+			w := &blockWriter{restartInterval: restartInterval}
+			for _, key := range []string{"a", "b", "d", "c", "e", "f"} {
+				w.add(db.MakeInternalKey([]byte(key), 0, db.InternalKeyKindSet), nil)
+			}
+			b := w.finish()
+
+			const expected = "block key c#0,1 out of order after d#0,1"
+			check := func(iter *blockIter, valid bool, found string) {
+				t.Helper()
+				err := iter.Error()
+				if err == nil || !strings.Contains(err.Error(), expected) {
+					t.Fatalf("expected %q, but found %v", expected, err)
+				}
+				if valid || iter.Valid() {
+					t.Fatalf("expected the iterator to be invalid after %s", found)
+				}
+			}
+
+			// Without validation, the misordered keys are returned.
+			iter, err := newBlockIter(bytes.Compare, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for valid := iter.First(); valid; valid = iter.Next() {
+				keys = append(keys, string(iter.Key().UserKey))
+			}
+			if s := strings.Join(keys, ""); s != "abdcef" || iter.Error() != nil {
+				t.Fatalf("expected abdcef, but found %s (%v)", s, iter.Error())
+			}
+
+			// Forward iteration.
+			iter, _ = newBlockIter(bytes.Compare, b)
+			iter.validateOrder = true
+			keys = keys[:0]
+			valid := iter.First()
+			for ; valid; valid = iter.Next() {
+				keys = append(keys, string(iter.Key().UserKey))
+			}
+			check(iter, valid, strings.Join(keys, ""))
+			if s := strings.Join(keys, ""); s != "abd" {
+				t.Fatalf("expected abd, but found %s", s)
+			}
+
+			// Reverse iteration.
+			iter, _ = newBlockIter(bytes.Compare, b)
+			iter.validateOrder = true
+			keys = keys[:0]
+			valid = iter.Last()
+			for ; valid; valid = iter.Prev() {
+				keys = append(keys, string(iter.Key().UserKey))
+			}
+			check(iter, valid, strings.Join(keys, ""))
+		})
+	}
+}
+
+func TestBlockIterPrevNext(t *testing.T) {
+	w := &blockWriter{restartInterval: 16}
+	for _, key := range []string{"apple", "apricot", "banana"} {
+		w.add(db.MakeInternalKey([]byte(key), 0, db.InternalKeyKindSet), nil)
+	}
+	iter, err := newBlockIter(bytes.Compare, w.finish())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Prev is served from the entries cached by Last, and Next then decodes
+	// "apricot" relative to the key of "apple".
+	iter.Last()
+	iter.Prev()
+	iter.Prev()
+	if !iter.Next() || string(iter.Key().UserKey) != "apricot" {
+		t.Fatalf("expected apricot, but found %s", iter.Key().UserKey)
+	}
+}
+
+func TestReaderRestartPoints(t *testing.T) {
+	mem := storage.NewMem()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const restartInterval = 4
+	w := NewWriter(f0, nil, db.LevelOptions{BlockRestartInterval: restartInterval})
+	for i := 0; i < 10; i++ {
+		if err := w.Set([]byte(fmt.Sprintf("key%03d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, 0, nil)
+	defer r.Close()
+
+	// The table contains a single data block at offset 0. An entry at a restart
+	// point is 17 bytes: 3 bytes of varints and the 14 byte internal key. The
+	// other entries share a 5 byte prefix with the previous key and are 12
+	// bytes.
+	points, err := r.RestartPoints(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "[0 53 106]"; expected != fmt.Sprint(points) {
+		t.Fatalf("expected %s, but found %d", expected, points)
+	}
+	if _, err := r.RestartPoints(1); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+}
+
 func TestBlockIter(t *testing.T) {
 	// k is a block that maps three keys "apple", "apricot", "banana" to empty strings.
 	k := block([]byte(
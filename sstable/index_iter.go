@@ -0,0 +1,141 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"errors"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// twoLevelIndexType is the IndexType property of a table whose index block
+// holds the handles of second-level index blocks, which in turn hold the
+// handles of the data blocks. Such tables are written by RocksDB with
+// partitioned indexes.
+const twoLevelIndexType = 2
+
+// IndexIter iterates over the index entries of a table, in key order. Each
+// entry is the separator key of a data block, which is greater than or equal
+// to the last key in the block and less than the first key in the next block,
+// and the handle of the block. The index entries of second-level index blocks
+// are yielded in place of the entries of the top-level index. No data blocks
+// are read.
+//
+// The iterator is initially positioned before the first entry.
+type IndexIter struct {
+	reader *Reader
+	// top is the top-level index of a two-level index. It is unused otherwise.
+	top      blockIter
+	twoLevel bool
+	index    blockIter
+	// started is true once the first entry of index has been visited.
+	started bool
+	valid   bool
+	handle  BlockHandle
+	err     error
+}
+
+// NewIndexIter returns an iterator over the index entries of the table. It is
+// intended for tooling which maps the key space of a table to the offsets of
+// its data blocks.
+func (r *Reader) NewIndexIter() *IndexIter {
+	if r.err != nil {
+		return &IndexIter{err: r.err}
+	}
+	i := &IndexIter{
+		reader:   r,
+		twoLevel: r.Properties.IndexType == twoLevelIndexType,
+	}
+	index, err := r.readIndex()
+	if err != nil {
+		i.err = err
+		return i
+	}
+	if i.twoLevel {
+		if i.err = i.top.init(r.compare, index, r.Properties.GlobalSeqNum); i.err == nil {
+			i.loadPartition(i.top.First())
+		}
+		return i
+	}
+	i.err = i.index.init(r.compare, index, r.Properties.GlobalSeqNum)
+	return i
+}
+
+// loadPartition loads the second-level index block at the current top-level
+// index position, if valid is true. It returns false if there is no such
+// block or it could not be read.
+func (i *IndexIter) loadPartition(valid bool) bool {
+	if !valid {
+		i.err = i.top.err
+		return false
+	}
+	h, n := decodeBlockHandle(i.top.Value())
+	if n == 0 || n != len(i.top.Value()) {
+		i.err = errors.New("pebble/table: corrupt index entry")
+		return false
+	}
+	b, _, err := i.reader.readBlock(h)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	if i.err = i.index.init(i.reader.compare, b, i.reader.Properties.GlobalSeqNum); i.err != nil {
+		return false
+	}
+	i.started = false
+	return true
+}
+
+// Next advances the iterator to the next index entry, returning false if the
+// iteration is exhausted or an error is encountered.
+func (i *IndexIter) Next() bool {
+	for i.err == nil {
+		if i.started {
+			i.valid = i.index.Next()
+		} else {
+			i.valid = i.index.First()
+			i.started = true
+		}
+		if i.valid {
+			h, _, ok := i.reader.decodeIndexEntry(i.index.Value())
+			if !ok {
+				i.err = errors.New("pebble/table: corrupt index entry")
+				break
+			}
+			i.handle = BlockHandle{Offset: h.offset, Length: h.length}
+			return true
+		}
+		if i.err = i.index.err; i.err != nil || !i.twoLevel || !i.loadPartition(i.top.Next()) {
+			break
+		}
+	}
+	i.valid = false
+	return false
+}
+
+// Key returns the separator key of the current index entry.
+func (i *IndexIter) Key() db.InternalKey {
+	return i.index.Key()
+}
+
+// Handle returns the handle of the data block of the current index entry.
+func (i *IndexIter) Handle() BlockHandle {
+	return i.handle
+}
+
+// Valid returns true if the iterator is positioned at an index entry.
+func (i *IndexIter) Valid() bool {
+	return i.valid
+}
+
+// Error returns any accumulated error.
+func (i *IndexIter) Error() error {
+	return i.err
+}
+
+// Close closes the iterator, returning any accumulated error.
+func (i *IndexIter) Close() error {
+	return i.err
+}
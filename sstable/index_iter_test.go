@@ -0,0 +1,161 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/crc"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestIndexIter(t *testing.T) {
+	fs := storage.NewMem()
+	f, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{
+		BlockSize: 256,
+	})
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("%05d", i))
+		if err := w.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+
+	// The handles cover the data region contiguously, and each separator is
+	// at least the last key of its block and less than the first key of the
+	// next block.
+	type entry struct {
+		sep    string
+		handle BlockHandle
+	}
+	var entries []entry
+	var n int
+	var offset uint64
+	var prevSep db.InternalKey
+	iter := r.NewIndexIter()
+	for iter.Next() {
+		entries = append(entries, entry{iter.Key().String(), iter.Handle()})
+		h := iter.Handle()
+		if h.Offset != offset {
+			t.Fatalf("%d: expected block at offset %d, but found %d", n, offset, h.Offset)
+		}
+		offset = h.Offset + h.Length + blockTrailerLen
+
+		b, _, err := r.readBlock(blockHandle{h.Offset, h.Length})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := newBlockIter(r.compare, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sep := iter.Key()
+		if !data.Last() || db.InternalCompare(r.compare, data.Key(), sep) > 0 {
+			t.Fatalf("%d: expected separator %s to be at least the last key %s", n, sep, data.Key())
+		}
+		if n > 0 && (!data.First() || db.InternalCompare(r.compare, prevSep, data.Key()) >= 0) {
+			t.Fatalf("%d: expected separator %s to be less than the first key %s", n, prevSep, data.Key())
+		}
+		prevSep = sep.Clone()
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if offset != r.Properties.DataSize {
+		t.Fatalf("expected the blocks to end at %d, but found %d", r.Properties.DataSize, offset)
+	}
+	if n != int(r.Properties.NumDataBlocks) || n < 2 {
+		t.Fatalf("expected %d blocks, but found %d", r.Properties.NumDataBlocks, n)
+	}
+
+	// Split the index into second-level index blocks, appended to a copy of
+	// the table, and substitute a top-level index over them. The iterator
+	// yields the same entries from the two-level index.
+	f, err = fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err := r.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexIter, err := newBlockIter(r.compare, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top := blockWriter{restartInterval: 1}
+	part := blockWriter{restartInterval: 1}
+	var tmp [2 * binary.MaxVarintLen64]byte
+	finishPart := func() {
+		h := blockHandle{offset: uint64(len(buf))}
+		buf = append(buf, part.finish()...)
+		h.length = uint64(len(buf)) - h.offset
+		trailer := [blockTrailerLen]byte{noCompressionBlockType}
+		binary.LittleEndian.PutUint32(trailer[1:], crc.New(buf[h.offset:]).Update(trailer[:1]).Value())
+		buf = append(buf, trailer[:]...)
+		top.add(db.DecodeInternalKey(part.curKey), tmp[:encodeBlockHandle(tmp[:], h)])
+		part.reset()
+	}
+	for valid := indexIter.First(); valid; valid = indexIter.Next() {
+		part.add(indexIter.Key(), indexIter.Value())
+		if part.nEntries == 3 {
+			finishPart()
+		}
+	}
+	if part.nEntries > 0 {
+		finishPart()
+	}
+	f2, err := fs.Create("two-level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f2.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if f2, err = fs.Open("two-level"); err != nil {
+		t.Fatal(err)
+	}
+	r.file = f2
+	r.tailIndex = top.finish()
+	r.Properties.IndexType = twoLevelIndexType
+
+	var twoLevel []entry
+	iter = r.NewIndexIter()
+	for iter.Next() {
+		twoLevel = append(twoLevel, entry{iter.Key().String(), iter.Handle()})
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, twoLevel) {
+		t.Fatalf("expected\n%v\nbut found\n%v", entries, twoLevel)
+	}
+}
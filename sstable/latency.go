@@ -0,0 +1,84 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// NumLatencyBuckets is the number of buckets in a LatencyHistogram.
+const NumLatencyBuckets = 24
+
+// LatencyHistogram is a histogram of latencies with exponentially sized
+// buckets. Bucket 0 counts latencies below 1µs, and bucket i > 0 counts
+// latencies in [2^(i-1)µs, 2^iµs). The last bucket also counts all larger
+// latencies.
+type LatencyHistogram struct {
+	Buckets [NumLatencyBuckets]uint64
+}
+
+// LatencyBucketUpperBound returns the exclusive upper bound of the latencies
+// counted by bucket i of a LatencyHistogram. The last bucket is unbounded,
+// but its nominal upper bound is returned.
+func LatencyBucketUpperBound(i int) time.Duration {
+	return time.Duration(1<<uint(i)) * time.Microsecond
+}
+
+// Count returns the number of latencies recorded by the histogram.
+func (h *LatencyHistogram) Count() uint64 {
+	var n uint64
+	for _, c := range h.Buckets {
+		n += c
+	}
+	return n
+}
+
+func (h *LatencyHistogram) record(d time.Duration) {
+	i := 0
+	if d > 0 {
+		i = bits.Len64(uint64(d / time.Microsecond))
+	}
+	if i >= NumLatencyBuckets {
+		i = NumLatencyBuckets - 1
+	}
+	atomic.AddUint64(&h.Buckets[i], 1)
+}
+
+func (h *LatencyHistogram) load() LatencyHistogram {
+	var s LatencyHistogram
+	for i := range h.Buckets {
+		s.Buckets[i] = atomic.LoadUint64(&h.Buckets[i])
+	}
+	return s
+}
+
+// LatencyStats holds histograms of the latencies of the block reads performed
+// by a Reader, including reads of the index, filter and meta blocks.
+type LatencyStats struct {
+	// CacheHit holds the latencies of block reads which were served by the
+	// block cache.
+	CacheHit LatencyHistogram
+	// CacheMiss holds the latencies of block reads which missed the block
+	// cache, from the cache lookup until the block has been checksummed,
+	// decompressed and inserted into the cache.
+	CacheMiss LatencyHistogram
+	// IOWait holds the latencies of the file reads performed for the block
+	// reads which missed the block cache.
+	IOWait LatencyHistogram
+}
+
+// LatencyStats returns a snapshot of the block read latency histograms of the
+// reader. The histograms are empty unless db.Options.BlockLatencyStats is
+// enabled. The histograms are updated with atomic increments and the snapshot
+// is not taken atomically, so concurrent reads may be partially reflected.
+func (r *Reader) LatencyStats() LatencyStats {
+	return LatencyStats{
+		CacheHit:  r.latency.CacheHit.load(),
+		CacheMiss: r.latency.CacheMiss.load(),
+		IOWait:    r.latency.IOWait.load(),
+	}
+}
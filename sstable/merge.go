@@ -0,0 +1,214 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/bytealloc"
+	"github.com/petermattis/pebble/internal/rangedel"
+)
+
+// mergeInput is the current position of one of the tables being merged.
+type mergeInput struct {
+	iter  *Iterator
+	valid bool
+}
+
+// mergeState holds the state for merging the point records of a set of
+// tables in internal key order.
+type mergeState struct {
+	cmp    db.Compare
+	inputs []mergeInput
+	// cur is the index of the input positioned at the smallest key, or -1 if
+	// all of the inputs are exhausted.
+	cur int
+}
+
+func (m *mergeState) findSmallest() {
+	m.cur = -1
+	for i := range m.inputs {
+		if !m.inputs[i].valid {
+			continue
+		}
+		if m.cur == -1 || db.InternalCompare(m.cmp,
+			m.inputs[i].iter.Key(), m.inputs[m.cur].iter.Key()) < 0 {
+			m.cur = i
+		}
+	}
+}
+
+func (m *mergeState) first() bool {
+	for i := range m.inputs {
+		m.inputs[i].valid = m.inputs[i].iter.First()
+	}
+	m.findSmallest()
+	return m.cur != -1
+}
+
+func (m *mergeState) next() bool {
+	in := &m.inputs[m.cur]
+	in.valid = in.iter.Next()
+	m.findSmallest()
+	return m.cur != -1
+}
+
+func (m *mergeState) key() db.InternalKey {
+	return m.inputs[m.cur].iter.Key()
+}
+
+func (m *mergeState) value() []byte {
+	return m.inputs[m.cur].iter.Value()
+}
+
+func (m *mergeState) close() error {
+	var err error
+	for i := range m.inputs {
+		if err1 := m.inputs[i].iter.Close(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// Merge merges the contents of the specified tables into the output table,
+// independent of the DB and version machinery. This is equivalent to a
+// compaction of the input tables in the absence of snapshots: for every user
+// key only the newest record is retained, records covered by a newer range
+// deletion tombstone are dropped, and merge operands are combined using
+// o.Merger. The records are ordered using o.Comparer, which must be the
+// comparer the input tables were written with.
+//
+// Point and range deletion tombstones are retained in the output as they may
+// shadow records in tables that were not part of the merge. The output
+// writer is not closed.
+//
+// The inputs are merged with a linear scan for the smallest key, which is
+// appropriate for offline tooling merging a handful of tables.
+func Merge(readers []*Reader, out *Writer, o *db.Options) error {
+	o = o.EnsureDefaults()
+	cmp := o.Comparer.Compare
+	merge := o.Merger.Merge
+
+	// Range tombstones are buffered and fragmented up front so that point
+	// records can be checked against them.
+	var alloc bytealloc.A
+	var unfragmented []rangedel.Tombstone
+	for _, r := range readers {
+		iter := r.NewRangeDelIter(nil)
+		if iter == nil {
+			continue
+		}
+		for valid := iter.First(); valid; valid = iter.Next() {
+			var t rangedel.Tombstone
+			alloc, t.Start.UserKey = alloc.Copy(iter.Key().UserKey)
+			alloc, t.End = alloc.Copy(iter.Value())
+			t.Start.Trailer = iter.Key().Trailer
+			unfragmented = append(unfragmented, t)
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	sort.Slice(unfragmented, func(i, j int) bool {
+		return db.InternalCompare(cmp, unfragmented[i].Start, unfragmented[j].Start) < 0
+	})
+	var tombstones []rangedel.Tombstone
+	frag := rangedel.Fragmenter{
+		Cmp: cmp,
+		Emit: func(fragmented []rangedel.Tombstone) {
+			// The fragments are sorted by decreasing sequence number and share the
+			// same bounds. With no snapshots to preserve, only the newest is needed.
+			tombstones = append(tombstones, fragmented[0])
+		},
+	}
+	for _, t := range unfragmented {
+		frag.Add(t.Start, t.End)
+	}
+	frag.Finish()
+	rangeDelIter := rangedel.NewIter(cmp, tombstones)
+	deleted := func(key db.InternalKey) bool {
+		if len(tombstones) == 0 {
+			return false
+		}
+		t := rangedel.Get(cmp, rangeDelIter, key.UserKey, db.InternalKeySeqNumMax)
+		return t.Deletes(key.SeqNum())
+	}
+
+	m := &mergeState{cmp: cmp}
+	for _, r := range readers {
+		m.inputs = append(m.inputs, mergeInput{iter: r.NewIter(nil)})
+	}
+
+	var keyBuf []byte
+	var value []byte
+	valid := m.first()
+	for valid {
+		key := m.key()
+		keyBuf = append(keyBuf[:0], key.UserKey...)
+		key.UserKey = keyBuf
+
+		// skip, when set, causes the remaining (older) records for the current
+		// user key to be discarded.
+		skip := true
+		switch key.Kind() {
+		case db.InternalKeyKindSet, db.InternalKeyKindDelete:
+			if !deleted(key) {
+				if err := out.Add(key, m.value()); err != nil {
+					m.close()
+					return err
+				}
+			}
+
+		case db.InternalKeyKindMerge:
+			if deleted(key) {
+				break
+			}
+			value = append(value[:0], m.value()...)
+			for {
+				if valid = m.next(); !valid || cmp(keyBuf, m.key().UserKey) != 0 {
+					skip = false
+					break
+				}
+				older := m.key()
+				if older.Kind() == db.InternalKeyKindDelete || deleted(older) {
+					break
+				}
+				value = merge(keyBuf, value, m.value(), nil)
+				if older.Kind() == db.InternalKeyKindSet {
+					// MERGE+SET -> SET, which shadows records in tables that were not
+					// part of the merge.
+					key.SetKind(db.InternalKeyKindSet)
+					break
+				}
+			}
+			if err := out.Add(key, value); err != nil {
+				m.close()
+				return err
+			}
+
+		default:
+			m.close()
+			return fmt.Errorf("pebble/table: invalid internal key kind: %d", key.Kind())
+		}
+
+		if skip {
+			for valid = m.next(); valid && cmp(keyBuf, m.key().UserKey) == 0; valid = m.next() {
+			}
+		}
+	}
+	if err := m.close(); err != nil {
+		return err
+	}
+
+	for _, t := range tombstones {
+		if err := out.Add(t.Start, t.End); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestMerge(t *testing.T) {
+	fs := storage.NewMem()
+
+	// build writes a table containing the specified records. Each record is of
+	// the form <key>.<kind>.<seqnum>:<value>. The records must be sorted.
+	build := func(name string, records ...string) *Reader {
+		f0, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, nil, db.LevelOptions{})
+		for _, r := range records {
+			j := strings.Index(r, ":")
+			if err := w.Add(db.ParseInternalKey(r[:j]), []byte(r[j+1:])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f1, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewReader(f1, 0, nil)
+	}
+
+	readers := []*Reader{
+		build("1",
+			"a.SET.1:a1",
+			"b.SET.2:b1",
+			"c.MERGE.3:c1",
+			"d.SET.4:d1",
+			"e.SET.5:e1",
+			"f.SET.6:f1",
+			"h.MERGE.7:h1",
+		),
+		build("2",
+			"a.SET.10:a2",
+			"c.MERGE.11:c2",
+			"d.DEL.12:",
+			"e.RANGEDEL.13:g",
+			"h.SET.14:h2",
+		),
+		build("3",
+			"b.RANGEDEL.22:c",
+			"c.MERGE.20:c3",
+			"f.SET.21:f3",
+			"g.MERGE.23:g3",
+			"h.MERGE.24:h3",
+		),
+	}
+
+	f, err := fs.Create("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{})
+	if err := Merge(readers, w, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range readers {
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err = fs.Open("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+
+	var points []string
+	iter := r.NewIter(nil)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		points = append(points, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"a#10,1:a2",
+		"c#20,2:c3c2c1",
+		"d#12,0:",
+		"f#21,1:f3",
+		"g#23,2:g3",
+		"h#24,1:h3h2",
+	}, " ")
+	if actual := strings.Join(points, " "); expected != actual {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, actual)
+	}
+
+	var tombstones []string
+	rangeDelIter := r.NewRangeDelIter(nil)
+	if rangeDelIter == nil {
+		t.Fatalf("expected range tombstones")
+	}
+	for valid := rangeDelIter.First(); valid; valid = rangeDelIter.Next() {
+		tombstones = append(tombstones, fmt.Sprintf("%s-%s", rangeDelIter.Key(), rangeDelIter.Value()))
+	}
+	if err := rangeDelIter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected = "b#22,15-c e#13,15-g"
+	if actual := strings.Join(tombstones, " "); expected != actual {
+		t.Fatalf("expected %s, but found %s", expected, actual)
+	}
+}
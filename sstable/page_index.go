@@ -0,0 +1,265 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/crc"
+)
+
+// metaPageIndexName is the name of the meta block holding the page index of a
+// table written with LevelOptions.PageIndexPageSize. The page index holds an
+// entry for each page of the table in which a data block starts. The key of
+// an entry is the first key of the first data block starting in the page, and
+// its value the handles of the data blocks starting in the page, in order.
+const metaPageIndexName = "pebble.page.index"
+
+var errCorruptPageIndex = errors.New("pebble/table: corrupt page index entry")
+
+// pageIndexWriter accumulates the page index of a table. See
+// LevelOptions.PageIndexPageSize.
+type pageIndexWriter struct {
+	pageSize uint64
+	block    blockWriter
+	// firstKey is the first key of the data block being built.
+	firstKey db.InternalKey
+	// pageKey is the key of the entry for the current page, and handles holds
+	// the handles of the data blocks which start in the current page.
+	pageKey db.InternalKey
+	page    uint64
+	handles []byte
+	tmp     [2 * binary.MaxVarintLen64]byte
+}
+
+// setFirstKey records the first key of the data block being built.
+func (w *pageIndexWriter) setFirstKey(key db.InternalKey) {
+	w.firstKey.UserKey = append(w.firstKey.UserKey[:0], key.UserKey...)
+	w.firstKey.Trailer = key.Trailer
+}
+
+// addBlock records the handle of the data block whose first key was passed to
+// setFirstKey.
+func (w *pageIndexWriter) addBlock(bh blockHandle) {
+	if page := bh.offset / w.pageSize; len(w.handles) == 0 || page != w.page {
+		w.finishPage()
+		w.page = page
+		w.pageKey.UserKey = append(w.pageKey.UserKey[:0], w.firstKey.UserKey...)
+		w.pageKey.Trailer = w.firstKey.Trailer
+	}
+	n := encodeBlockHandle(w.tmp[:], bh)
+	w.handles = append(w.handles, w.tmp[:n]...)
+}
+
+// finishPage adds the entry for the current page, if any, to the page index.
+func (w *pageIndexWriter) finishPage() {
+	if len(w.handles) > 0 {
+		w.block.add(w.pageKey, w.handles)
+		w.handles = w.handles[:0]
+	}
+}
+
+// finish returns the contents of the page index block.
+func (w *pageIndexWriter) finish() []byte {
+	w.finishPage()
+	return w.block.finish()
+}
+
+// pageWindow is a page-aligned region of a table holding a run of data
+// blocks.
+type pageWindow struct {
+	offset, length uint64
+	// handles are the handles of the data blocks starting in the first page of
+	// the window, which the window covers in full.
+	handles []blockHandle
+}
+
+// decodePageWindow decodes the value of a page index entry.
+func decodePageWindow(v []byte, pageSize, trailerLen uint64) (pageWindow, error) {
+	var w pageWindow
+	for len(v) > 0 {
+		bh, n := decodeBlockHandle(v)
+		if n == 0 {
+			return pageWindow{}, errCorruptPageIndex
+		}
+		w.handles = append(w.handles, bh)
+		v = v[n:]
+	}
+	if len(w.handles) == 0 {
+		return pageWindow{}, errCorruptPageIndex
+	}
+	last := w.handles[len(w.handles)-1]
+	w.offset = w.handles[0].offset - w.handles[0].offset%pageSize
+	end := last.offset + last.length + trailerLen
+	end += (pageSize - end%pageSize) % pageSize
+	w.length = end - w.offset
+	return w, nil
+}
+
+// pageWindowIter iterates over the page windows of a table, as recorded by its
+// page index.
+type pageWindowIter struct {
+	reader *Reader
+	index  *blockIter
+}
+
+// seek positions the iterator at the window holding the data block which may
+// contain the newest entry for key: the window of the last page whose first
+// key is less than key, or the first window if there is no such page.
+func (i *pageWindowIter) seek(key []byte) bool {
+	if i.index.SeekLT(key) {
+		return true
+	}
+	return i.index.First()
+}
+
+func (i *pageWindowIter) next() bool {
+	return i.index.Next()
+}
+
+func (i *pageWindowIter) window() (pageWindow, error) {
+	return decodePageWindow(i.index.Value(), i.reader.Properties.PageIndexPageSize, i.reader.trailerLen)
+}
+
+func (r *Reader) newPageWindowIter() (*pageWindowIter, error) {
+	if r.pageIndex.bh.length == 0 || r.Properties.PageIndexPageSize == 0 {
+		return nil, errors.New("pebble/table: table has no page index")
+	}
+	b, err := r.readWeakCachedBlock(&r.pageIndex)
+	if err != nil {
+		return nil, err
+	}
+	index, err := newBlockIter(r.compare, b)
+	if err != nil {
+		return nil, err
+	}
+	return &pageWindowIter{reader: r, index: index}, nil
+}
+
+// PageWindow returns the page-aligned region of the table to read to find the
+// newest entry for key, as determined by the page index written for
+// LevelOptions.PageIndexPageSize. The region starts and ends on page
+// boundaries, as required by direct I/O, and holds the data block which may
+// contain key in full. The end of the region may lie past the end of the file
+// if the region includes the last page. The newest entry for a key whose
+// versions span data blocks may lie in the following region, which GetAligned
+// reads when needed. Returns an error if the table has no page index.
+func (r *Reader) PageWindow(key []byte) (offset, length uint64, err error) {
+	if r.err != nil {
+		return 0, 0, r.err
+	}
+	i, err := r.newPageWindowIter()
+	if err != nil {
+		return 0, 0, err
+	}
+	if !i.seek(key) {
+		return 0, 0, db.ErrNotFound
+	}
+	w, err := i.window()
+	if err != nil {
+		return 0, 0, err
+	}
+	return w.offset, w.length, nil
+}
+
+// GetAligned returns the value of the newest entry for key in the table, like
+// Get, locating the data block through the page index rather than the index
+// block and reading it with a single page-aligned read of the region returned
+// by PageWindow. The blocks read are not added to the block cache. Returns
+// db.ErrNotFound if the table holds no entry for the key, and an error if the
+// table has no page index.
+func (r *Reader) GetAligned(key []byte) ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.tableFilter != nil {
+		data, err := r.readFilter()
+		if err != nil {
+			return nil, err
+		}
+		if !r.tableFilter.mayContain(data, key) {
+			return nil, db.ErrNotFound
+		}
+	}
+	i, err := r.newPageWindowIter()
+	if err != nil {
+		return nil, err
+	}
+	var data blockIter
+	data.valueDedup = r.Properties.ValueDedup
+	data.seqNumDelta = r.Properties.SeqNumDelta
+	data.validateOrder = r.verifyKeyOrder
+	data.inBlockFilters = r.Properties.BlockInternalFilter
+	data.filterPolicy = r.blockInternalFilterPolicy
+	for valid := i.seek(key); valid; valid = i.next() {
+		w, err := i.window()
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, w.length)
+		// The window may extend past the end of the file.
+		n, err := r.file.ReadAt(buf, int64(w.offset))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = buf[:n]
+		for _, bh := range w.handles {
+			b, err := r.decodeWindowBlock(buf, w.offset, bh)
+			if err != nil {
+				return nil, err
+			}
+			if err := data.init(r.compare, b, r.Properties.GlobalSeqNum); err != nil {
+				return nil, err
+			}
+			if !data.SeekGE(key) {
+				if err := data.Error(); err != nil {
+					return nil, err
+				}
+				// The newest entry for key, if any, is in a later block.
+				continue
+			}
+			if r.compare(key, data.Key().UserKey) != 0 {
+				return nil, db.ErrNotFound
+			}
+			if !r.Properties.ValueBlocks {
+				return data.Value(), nil
+			}
+			v := &valueBlockReader{reader: r, verifyChecksum: true, noCache: true}
+			return v.value(data.Value())
+		}
+	}
+	if err := i.index.Error(); err != nil {
+		return nil, err
+	}
+	return nil, db.ErrNotFound
+}
+
+// decodeWindowBlock verifies and decompresses the block with the given handle
+// from the contents of a page window read at offset.
+func (r *Reader) decodeWindowBlock(window []byte, offset uint64, bh blockHandle) (block, error) {
+	start := bh.offset - offset
+	if bh.offset < offset || start+bh.length+r.trailerLen > uint64(len(window)) {
+		return nil, errCorruptPageIndex
+	}
+	b := window[start : start+bh.length+r.trailerLen]
+	checksum0 := binary.LittleEndian.Uint32(b[bh.length+1:])
+	checksum1 := crc.New(b[:bh.length+1]).Value()
+	if checksum0 != checksum1 {
+		return nil, errors.New("pebble/table: invalid table (checksum mismatch)")
+	}
+	switch blockType := b[bh.length]; blockType {
+	case noCompressionBlockType:
+		return b[:bh.length:bh.length], nil
+	case snappyCompressionBlockType:
+		return snappy.Decode(nil, b[:bh.length])
+	default:
+		return nil, fmt.Errorf("pebble/table: unknown block compression: %d", blockType)
+	}
+}
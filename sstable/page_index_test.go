@@ -0,0 +1,148 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/cache"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+// readRecordingFile records the offsets and lengths of its reads.
+type readRecordingFile struct {
+	storage.File
+	reads []blockHandle
+}
+
+func (f *readRecordingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reads = append(f.reads, blockHandle{offset: uint64(off), length: uint64(len(p))})
+	return f.File.ReadAt(p, off)
+}
+
+func TestPageIndex(t *testing.T) {
+	const pageSize = 4096
+	// Each key has three versions, which may span data blocks and pages.
+	const n = 2000
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%05d", i))
+	}
+	value := func(i, version int) []byte {
+		return []byte(fmt.Sprintf("%05d.%d", i, version))
+	}
+
+	for _, alignment := range []int{0, pageSize} {
+		t.Run(fmt.Sprintf("alignment=%d", alignment), func(t *testing.T) {
+			lo := db.LevelOptions{
+				BlockAlignment:    alignment,
+				BlockSize:         1024,
+				PageIndexPageSize: pageSize,
+			}
+			fs := storage.NewMem()
+			f, err := fs.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, nil, lo)
+			for i := 0; i < n; i++ {
+				for version := 3; version > 0; version-- {
+					ikey := db.MakeInternalKey(key(i), uint64(version), db.InternalKeyKindSet)
+					if err := w.Add(ikey, value(i, version)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = fs.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rf := &readRecordingFile{File: f}
+			r := NewReader(rf, 0, &db.Options{
+				Cache:  cache.New(1 << 20),
+				Levels: []db.LevelOptions{lo},
+			})
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if r.Properties.PageIndexPageSize != pageSize {
+				t.Fatalf("expected a page size of %d, but found %d", pageSize, r.Properties.PageIndexPageSize)
+			}
+			if _, ok := r.MetaBlocks()[metaPageIndexName]; !ok {
+				t.Fatalf("expected a %s meta block", metaPageIndexName)
+			}
+
+			for i := 0; i < n; i++ {
+				// The window holds the data block which the index block locates
+				// for the key.
+				i0, err := r.seekKey(key(i), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				bh, _ := decodeBlockHandle(i0.index.Value())
+				if err := i0.Close(); err != nil {
+					t.Fatal(err)
+				}
+				offset, length, err := r.PageWindow(key(i))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if offset%pageSize != 0 || length%pageSize != 0 {
+					t.Fatalf("%s: unaligned window [%d,%d)", key(i), offset, offset+length)
+				}
+				if bh.offset < offset || bh.offset+bh.length > offset+length {
+					// The newest version is in the following window.
+					offset2, length2, err := r.PageWindow(append(key(i), 0))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if offset2 < offset+length || bh.offset < offset2 ||
+						bh.offset+bh.length > offset2+length2 {
+						t.Fatalf("%s: block [%d,%d) is not in window [%d,%d) or the following window",
+							key(i), bh.offset, bh.offset+bh.length, offset, offset+length)
+					}
+				}
+
+				// GetAligned returns the newest version of the key, reading the
+				// data blocks with page-aligned reads alone.
+				rf.reads = rf.reads[:0]
+				v, err := r.GetAligned(key(i))
+				if err != nil {
+					t.Fatalf("%s: %v", key(i), err)
+				}
+				if !bytes.Equal(v, value(i, 3)) {
+					t.Fatalf("%s: expected %s, but found %s", key(i), value(i, 3), v)
+				}
+				if len(rf.reads) == 0 {
+					t.Fatalf("%s: expected the window to be read", key(i))
+				}
+				for _, read := range rf.reads {
+					if read.offset == r.pageIndex.bh.offset {
+						continue
+					}
+					if read.offset == r.index.bh.offset {
+						t.Fatalf("%s: unexpected read of the index block", key(i))
+					}
+					if read.offset%pageSize != 0 || read.length%pageSize != 0 {
+						t.Fatalf("%s: unaligned read [%d,%d)", key(i), read.offset, read.offset+read.length)
+					}
+				}
+			}
+
+			for _, k := range []string{"", "00000.5", "99999"} {
+				if _, err := r.GetAligned([]byte(k)); err != db.ErrNotFound {
+					t.Fatalf("%q: expected not found, but found %v", k, err)
+				}
+			}
+		})
+	}
+}
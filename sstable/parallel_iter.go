@@ -0,0 +1,197 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// parallelIterReadahead is the number of blocks each worker of a ParallelIter
+// reads ahead of the iteration.
+const parallelIterReadahead = 2
+
+type parallelBlock struct {
+	data block
+	err  error
+}
+
+// ParallelIter iterates forward over all of the entries of a table, in key
+// order, while worker goroutines read and decompress its data blocks ahead of
+// the iteration. The data blocks are divided into contiguous ranges, one per
+// worker, so that the iteration consumes the blocks read by each worker in
+// turn. The blocks are not added to the block cache, as a full scan would
+// otherwise evict the blocks in use by other readers.
+//
+// The iterator is initially positioned before the first entry. Close must be
+// called to stop the workers, even if the iteration is exhausted.
+type ParallelIter struct {
+	reader *Reader
+	// parts holds the blocks read by each worker, in order. The blocks of
+	// parts[cur] are being consumed.
+	parts []chan parallelBlock
+	cur   int
+	data  blockIter
+	// values, if non-nil, resolves the values stored in the data blocks of a
+	// table with value blocks, which are not added to the block cache either.
+	values *valueBlockReader
+	err    error
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewParallelIter returns an iterator over the entries of the table which
+// reads the data blocks with numWorkers goroutines. It is intended for full
+// scans of large tables, such as a bulk export, where reading the blocks
+// serially would leave the storage device underutilized.
+func (r *Reader) NewParallelIter(numWorkers int) *ParallelIter {
+	if r.err != nil {
+		return &ParallelIter{err: r.err}
+	}
+	i := &ParallelIter{
+		reader: r,
+		done:   make(chan struct{}),
+	}
+	i.data.valueDedup = r.Properties.ValueDedup
+	i.data.seqNumDelta = r.Properties.SeqNumDelta
+	i.data.inBlockFilters = r.Properties.BlockInternalFilter
+	if r.Properties.ValueBlocks {
+		i.values = &valueBlockReader{reader: r, verifyChecksum: true, noCache: true}
+	}
+
+	index, err := r.readIndex()
+	if err != nil {
+		i.err = err
+		return i
+	}
+	iter, err := newBlockIter(r.compare, index)
+	if err != nil {
+		i.err = err
+		return i
+	}
+	var handles []blockHandle
+	for valid := iter.First(); valid; valid = iter.Next() {
+		bh, _, ok := r.decodeIndexEntry(iter.Value())
+		if !ok {
+			i.err = errors.New("pebble/table: corrupt index entry")
+			return i
+		}
+		handles = append(handles, bh)
+	}
+
+	if numWorkers > len(handles) {
+		numWorkers = len(handles)
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	i.parts = make([]chan parallelBlock, numWorkers)
+	for w := range i.parts {
+		i.parts[w] = make(chan parallelBlock, parallelIterReadahead)
+		i.wg.Add(1)
+		go i.read(i.parts[w], handles[w*len(handles)/numWorkers:(w+1)*len(handles)/numWorkers])
+	}
+	return i
+}
+
+// read reads the data blocks of a worker's range, in order, stopping after an
+// error or when the iterator is closed.
+func (i *ParallelIter) read(part chan<- parallelBlock, handles []blockHandle) {
+	defer i.wg.Done()
+	defer close(part)
+	for _, bh := range handles {
+		data, _, err := i.reader.readBlockInternal(bh, true /* verifyChecksum */, false /* addToCache */)
+		select {
+		case part <- parallelBlock{data: data, err: err}:
+		case <-i.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Next advances the iterator to the next entry, returning whether the
+// iterator is positioned at a valid entry.
+func (i *ParallelIter) Next() bool {
+	if i.err != nil {
+		return false
+	}
+	if i.data.Next() {
+		return i.checkKind()
+	}
+	if i.data.err != nil {
+		i.err = i.data.err
+		return false
+	}
+	for i.cur < len(i.parts) {
+		b, ok := <-i.parts[i.cur]
+		if !ok {
+			i.cur++
+			continue
+		}
+		if b.err != nil {
+			i.err = b.err
+			return false
+		}
+		if i.err = i.data.init(i.reader.compare, b.data, i.reader.Properties.GlobalSeqNum); i.err != nil {
+			return false
+		}
+		if i.data.First() {
+			return i.checkKind()
+		}
+	}
+	return false
+}
+
+func (i *ParallelIter) checkKind() bool {
+	if err := i.data.unknownKind(); err != nil {
+		i.err = err
+		return false
+	}
+	return true
+}
+
+// Key returns the key of the current entry.
+func (i *ParallelIter) Key() db.InternalKey {
+	return i.data.Key()
+}
+
+// Value returns the value of the current entry. A value stored in a value
+// block is read on demand, and an error reading it is returned by Error.
+func (i *ParallelIter) Value() []byte {
+	if i.values == nil {
+		return i.data.Value()
+	}
+	v, err := i.values.value(i.data.Value())
+	if err != nil {
+		i.err = err
+	}
+	return v
+}
+
+// Valid returns whether the iterator is positioned at a valid entry.
+func (i *ParallelIter) Valid() bool {
+	return i.err == nil && i.data.Valid()
+}
+
+// Error returns any error encountered during the iteration.
+func (i *ParallelIter) Error() error {
+	return i.err
+}
+
+// Close stops the workers and returns any error encountered during the
+// iteration.
+func (i *ParallelIter) Close() error {
+	if i.done != nil {
+		close(i.done)
+		i.wg.Wait()
+		i.done = nil
+	}
+	return i.err
+}
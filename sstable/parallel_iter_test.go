@@ -0,0 +1,83 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestParallelIter(t *testing.T) {
+	fs := storage.NewMem()
+	f, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{
+		BlockSize: 256,
+	})
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("%05d", i))
+		if i%7 == 0 {
+			err = w.Delete(key)
+		} else {
+			err = w.Set(key, []byte(fmt.Sprintf("value-%d", i)))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+
+	var expected []string
+	iter := r.NewIter(nil)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		expected = append(expected, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, numWorkers := range []int{0, 1, 2, 3, 8, 100000} {
+		t.Run(fmt.Sprint(numWorkers), func(t *testing.T) {
+			iter := r.NewParallelIter(numWorkers)
+			var n int
+			for iter.Next() {
+				if n >= len(expected) {
+					t.Fatalf("unexpected entry %s", iter.Key())
+				}
+				if e, a := expected[n], fmt.Sprintf("%s:%s", iter.Key(), iter.Value()); e != a {
+					t.Fatalf("%d: expected %s, but found %s", n, e, a)
+				}
+				n++
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n != len(expected) {
+				t.Fatalf("expected %d entries, but found %d", len(expected), n)
+			}
+
+			// Closing the iterator before it is exhausted stops the workers.
+			iter = r.NewParallelIter(numWorkers)
+			for j := 0; j < 10 && iter.Next(); j++ {
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
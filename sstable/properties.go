@@ -51,12 +51,24 @@ func init() {
 // automatically populated during sstable creation and load from the properties
 // meta block when an sstable is opened.
 type Properties struct {
+	// The alignment of the data blocks, which are padded to a multiple of the
+	// alignment. 0 if the data blocks are not padded. See
+	// LevelOptions.BlockAlignment.
+	BlockAlignment uint64 `prop:"pebble.block.alignment"`
+	// The names of the block properties stored in the index entries of the
+	// data blocks, in the order in which they are stored, formatted as
+	// "[name1,name2,...]". Empty if the index entries store no block
+	// properties. See db.Options.BlockPropertyCollectors.
+	BlockPropertyNames string `prop:"pebble.block.property.names"`
 	// ID of column family for this SST file, corresponding to the CF identified
 	// by column_family_name.
 	ColumnFamilyID uint64 `prop:"rocksdb.column.family.id"`
 	// Name of the column family with which this SST file is associated. Empty if
 	// the column family is unknown.
 	ColumnFamilyName string `prop:"rocksdb.column.family.name"`
+	// A short human-readable label for the table, such as the job which
+	// produced it. Empty if no comment was set. See Writer.SetComment.
+	Comment string `prop:"pebble.comment"`
 	// The name of the comparator used in this table.
 	ComparatorName string `prop:"rocksdb.comparator"`
 	// The compression algorithm used to compress blocks.
@@ -115,6 +127,26 @@ type Properties struct {
 	TopLevelIndexSize uint64 `prop:"rocksdb.top-level.index.size"`
 	// User collected properties.
 	UserProperties map[string]string
+	// Whether the data blocks store values identical to the value of the
+	// previous entry as back-references. See LevelOptions.ValueDedup.
+	ValueDedup bool `prop:"pebble.value.dedup"`
+	// Whether the data blocks store the sequence numbers of entries sharing the
+	// user key of the previous entry as deltas. See LevelOptions.SeqNumDelta.
+	SeqNumDelta bool `prop:"pebble.seqnum.delta"`
+	// Whether the data blocks store a filter for each restart interval. See
+	// LevelOptions.BlockInternalFilter.
+	BlockInternalFilter bool `prop:"pebble.block.internal.filter"`
+	// Whether the values in the data blocks are tagged as either stored inline
+	// or in a value block. See LevelOptions.ValueBlockThreshold.
+	ValueBlocks bool `prop:"pebble.value.blocks"`
+	// The number of value blocks in this table.
+	NumValueBlocks uint64 `prop:"pebble.num.value.blocks"`
+	// The number of values stored as references to an identical value stored
+	// earlier in a value block. See LevelOptions.ValueBlockDedup.
+	NumValueDedups uint64 `prop:"pebble.num.value.dedups"`
+	// The size of the pages indexed by the page index. 0 if the table has no
+	// page index. See LevelOptions.PageIndexPageSize.
+	PageIndexPageSize uint64 `prop:"pebble.page.index.page.size"`
 	// ValueOffsets map from property name to byte offset of the property value
 	// within the file. Only set if the properties have been loaded from a file.
 	ValueOffsets map[string]uint64
@@ -242,10 +274,19 @@ func (p *Properties) save(w *rawBlockWriter) {
 		m[k] = []byte(v)
 	}
 
+	if p.BlockAlignment != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.BlockAlignment), p.BlockAlignment)
+	}
+	if p.BlockPropertyNames != "" {
+		p.saveString(m, unsafe.Offsetof(p.BlockPropertyNames), p.BlockPropertyNames)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.ColumnFamilyID), p.ColumnFamilyID)
 	if p.ColumnFamilyName != "" {
 		p.saveString(m, unsafe.Offsetof(p.ColumnFamilyName), p.ColumnFamilyName)
 	}
+	if p.Comment != "" {
+		p.saveString(m, unsafe.Offsetof(p.Comment), p.Comment)
+	}
 	if p.ComparatorName != "" {
 		p.saveString(m, unsafe.Offsetof(p.ComparatorName), p.ComparatorName)
 	}
@@ -291,6 +332,27 @@ func (p *Properties) save(w *rawBlockWriter) {
 	}
 	p.saveUvarint(m, unsafe.Offsetof(p.RawKeySize), p.RawKeySize)
 	p.saveUvarint(m, unsafe.Offsetof(p.RawValueSize), p.RawValueSize)
+	if p.ValueDedup {
+		p.saveBool(m, unsafe.Offsetof(p.ValueDedup), p.ValueDedup)
+	}
+	if p.SeqNumDelta {
+		p.saveBool(m, unsafe.Offsetof(p.SeqNumDelta), p.SeqNumDelta)
+	}
+	if p.BlockInternalFilter {
+		p.saveBool(m, unsafe.Offsetof(p.BlockInternalFilter), p.BlockInternalFilter)
+	}
+	if p.ValueBlocks {
+		p.saveBool(m, unsafe.Offsetof(p.ValueBlocks), p.ValueBlocks)
+	}
+	if p.NumValueBlocks != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.NumValueBlocks), p.NumValueBlocks)
+	}
+	if p.NumValueDedups != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.NumValueDedups), p.NumValueDedups)
+	}
+	if p.PageIndexPageSize != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.PageIndexPageSize), p.PageIndexPageSize)
+	}
 	p.saveUint32(m, unsafe.Offsetof(p.Version), p.Version)
 	p.saveBool(m, unsafe.Offsetof(p.WholeKeyFiltering), p.WholeKeyFiltering)
 
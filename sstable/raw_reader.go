@@ -0,0 +1,110 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"errors"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+// RawReader reads a table regardless of the comparer it was written with, for
+// tooling such as dump and diff tools which operate on arbitrary tables. The
+// comparer name recorded by the table is not checked against
+// Options.Comparer. As the keys of the table may not be ordered by
+// Options.Comparer, a RawReader only supports full forward scans of the
+// point records of the table: it does not support seeks, nor iterating
+// backward, whose results depend on the ordering of the keys. Options.Comparer
+// is still used where the order of the keys is verified, notably by
+// Options.VerifyBlockKeyOrder, which should not be set unless the comparer is
+// known to match the table.
+type RawReader struct {
+	reader *Reader
+}
+
+// NewRawReader returns a new raw reader for the table in the file. Closing
+// the reader will close the file.
+func NewRawReader(f storage.File, fileNum uint64, o *db.Options) (*RawReader, error) {
+	opts := *o.EnsureDefaults()
+	opts.IgnoreComparerMismatch = true
+	r := NewReader(f, fileNum, &opts)
+	if r.err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, r.err
+	}
+	return &RawReader{reader: r}, nil
+}
+
+// Properties returns the properties of the table.
+func (r *RawReader) Properties() *Properties {
+	return &r.reader.Properties
+}
+
+// NewIter returns an iterator over the point records of the table, in the
+// order in which they are stored.
+func (r *RawReader) NewIter() *RawIter {
+	return &RawIter{iter: r.reader.NewIter(nil)}
+}
+
+// Close closes the reader and the underlying file.
+func (r *RawReader) Close() error {
+	if r.reader == nil {
+		return errors.New("pebble/table: reader is closed")
+	}
+	err := r.reader.Close()
+	r.reader = nil
+	return err
+}
+
+// RawIter iterates forward over the point records of a table opened with a
+// RawReader.
+type RawIter struct {
+	iter *Iterator
+}
+
+// First moves the iterator to the first record of the table. Returns true if
+// the iterator is pointing at a valid record and false otherwise.
+func (i *RawIter) First() bool {
+	return i.iter.First()
+}
+
+// Next moves the iterator to the next record in the table. Returns true if the
+// iterator is pointing at a valid record and false otherwise.
+func (i *RawIter) Next() bool {
+	return i.iter.Next()
+}
+
+// Key returns the key of the current record. The caller should not modify
+// the contents of the returned key, which may change on the next call to
+// Next.
+func (i *RawIter) Key() db.InternalKey {
+	return i.iter.Key()
+}
+
+// Value returns the value of the current record. The caller should not modify
+// the contents of the returned slice, which may change on the next call to
+// Next.
+func (i *RawIter) Value() []byte {
+	return i.iter.Value()
+}
+
+// Valid returns true if the iterator is positioned at a valid record and false
+// otherwise.
+func (i *RawIter) Valid() bool {
+	return i.iter.Valid()
+}
+
+// Error returns any accumulated error.
+func (i *RawIter) Error() error {
+	return i.iter.Error()
+}
+
+// Close closes the iterator and returns any accumulated error.
+func (i *RawIter) Close() error {
+	return i.iter.Close()
+}
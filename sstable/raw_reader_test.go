@@ -0,0 +1,106 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestRawReader(t *testing.T) {
+	// A comparer which orders the keys by their reversed bytes, so that the
+	// keys of the table are out of order with respect to the default
+	// comparer.
+	reversed := func(k []byte) []byte {
+		r := make([]byte, len(k))
+		for i := range k {
+			r[len(k)-1-i] = k[i]
+		}
+		return r
+	}
+	comparer := *db.DefaultComparer
+	comparer.Name = "test.reversed"
+	comparer.Compare = func(a, b []byte) int {
+		return bytes.Compare(reversed(a), reversed(b))
+	}
+	comparer.InlineKey = nil
+	comparer.AbbreviatedKey = nil
+	comparer.Separator = func(dst, a, b []byte) []byte {
+		return append(dst, a...)
+	}
+	comparer.Successor = func(dst, a []byte) []byte {
+		return append(dst, a...)
+	}
+
+	fs := storage.NewMem()
+	f, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The records span several data blocks.
+	const n = 1000
+	key := func(i int) []byte {
+		return reversed([]byte(fmt.Sprintf("%04d", i)))
+	}
+	w := NewWriter(f, &db.Options{Comparer: &comparer}, db.LevelOptions{BlockSize: 256})
+	for i := 0; i < n; i++ {
+		if err := w.Set(key(i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mismatched comparer is rejected by a regular reader.
+	f, err = fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := NewReader(f, 0, nil); r.err == nil {
+		t.Fatalf("expected a comparer mismatch")
+	}
+
+	f, err = fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRawReader(f, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := r.Properties().ComparatorName; name != comparer.Name {
+		t.Fatalf("expected comparer %s, but found %s", comparer.Name, name)
+	}
+
+	// A full scan returns the records in the order in which they are stored.
+	iter := r.NewIter()
+	var count int
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if k := iter.Key().UserKey; !bytes.Equal(k, key(count)) {
+			t.Fatalf("expected %s, but found %s", key(count), k)
+		}
+		if v := string(iter.Value()); v != fmt.Sprint(count) {
+			t.Fatalf("%s: expected %d, but found %s", key(count), count, v)
+		}
+		count++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Fatalf("expected %d records, but found %d", n, count)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err == nil {
+		t.Fatalf("expected an error closing a closed reader")
+	}
+}
@@ -6,10 +6,15 @@ package sstable
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/cache"
@@ -23,6 +28,12 @@ type blockHandle struct {
 	offset, length uint64
 }
 
+// BlockHandle is the file offset and length of a block, excluding the block
+// trailer.
+type BlockHandle struct {
+	Offset, Length uint64
+}
+
 // decodeBlockHandle returns the block handle encoded at the start of src, as
 // well as the number of bytes it occupies. It returns zero if given invalid
 // input.
@@ -54,16 +65,61 @@ type Iterator struct {
 	data      blockIter
 	err       error
 	closeHook func() error
+	// Whether the checksums of the data blocks read from disk are verified. See
+	// IterOptions.DisableChecksums.
+	verifyChecksums bool
+	// dataHandle, if non-nil, holds the reference to the data block in use by
+	// i.data. See db.Options.CacheAllocator.
+	dataHandle *cache.Handle
+	// values, if non-nil, resolves the values stored in the data blocks of a
+	// table with value blocks. See LevelOptions.ValueBlockThreshold.
+	values *valueBlockReader
+	// memoize causes readBlock to consult and update the memoized data block
+	// of the reader. It is set for the iterators of gets. See
+	// db.Options.MemoizeGetBlock.
+	memoize bool
+	// ctx, if non-nil, is checked before each data block is read. See
+	// IterOptions.Context.
+	ctx context.Context
+	// filtered is true if the data blocks are filtered by their block
+	// properties. See SetBlockPropertyFilters. props is a scratch buffer
+	// holding the block properties of the index entry being filtered. linked
+	// holds the offsets of the data blocks which always match, as they may
+	// share a user key with an adjacent block (see linkedBlocks).
+	filtered bool
+	invert   bool
+	filters  []blockPropertyFilter
+	props    [][]byte
+	linked   map[uint64]struct{}
 }
 
-func (i *Iterator) init(r *Reader) error {
+// blockPropertyFilter is a block property filter applied by an iterator, along
+// with the position of the property it is applied to in the block properties
+// of the index entries.
+type blockPropertyFilter struct {
+	filter db.BlockPropertyFilter
+	index  int
+}
+
+func (i *Iterator) init(r *Reader, o *db.IterOptions) error {
 	i.reader = r
+	i.verifyChecksums = !o.GetDisableChecksums()
+	i.ctx = o.GetContext()
 	var index block
 	index, i.err = r.readIndex()
 	if i.err != nil {
 		return i.err
 	}
 	i.err = i.index.init(r.compare, index, r.Properties.GlobalSeqNum)
+	i.index.validateOrder = r.verifyKeyOrder
+	i.data.valueDedup = r.Properties.ValueDedup
+	i.data.seqNumDelta = r.Properties.SeqNumDelta
+	i.data.validateOrder = r.verifyKeyOrder
+	i.data.inBlockFilters = r.Properties.BlockInternalFilter
+	i.data.filterPolicy = r.blockInternalFilterPolicy
+	if r.Properties.ValueBlocks {
+		i.values = &valueBlockReader{reader: r, verifyChecksum: i.verifyChecksums}
+	}
 	return i.err
 }
 
@@ -71,8 +127,10 @@ func (i *Iterator) init(r *Reader) error {
 // unpositioned. If unsuccessful, it sets i.err to any error encountered, which
 // may be nil if we have simply exhausted the entire table.
 func (i *Iterator) loadBlock() bool {
-	if !i.index.Valid() {
-		i.err = i.index.err
+	if !i.index.Valid() || i.err != nil {
+		if i.err == nil {
+			i.err = i.index.err
+		}
 		// TODO(peter): Need to test that seeking to a key outside of the sstable
 		// invalidates the iterator.
 		i.data.offset = 0
@@ -80,21 +138,132 @@ func (i *Iterator) loadBlock() bool {
 		return false
 	}
 	// Load the next block.
-	v := i.index.Value()
-	h, n := decodeBlockHandle(v)
-	if n == 0 || n != len(v) {
+	h, _, ok := i.reader.decodeIndexEntry(i.index.Value())
+	if !ok {
 		i.err = errors.New("pebble/table: corrupt index entry")
 		return false
 	}
-	block, _, err := i.reader.readBlock(h)
-	if err != nil {
-		i.err = err
+	block, dataHandle, ok := i.readBlock(h)
+	if !ok {
 		return false
 	}
+	i.dataHandle.Release()
+	i.dataHandle = dataHandle
 	i.err = i.data.init(i.reader.compare, block, i.reader.Properties.GlobalSeqNum)
 	return i.err == nil
 }
 
+// readBlock reads the data block with the given handle, which is first looked
+// up in the data block memoized by the reader if i.memoize is set. It returns
+// false and sets i.err if the block could not be read.
+func (i *Iterator) readBlock(h blockHandle) (block, *cache.Handle, bool) {
+	if i.memoize {
+		if b := i.reader.memoizedBlock(h); b != nil {
+			return b, nil, true
+		}
+	}
+	if i.canceled() {
+		return nil, nil, false
+	}
+	b, dataHandle, err := i.reader.readDataBlock(h, i.verifyChecksums)
+	if err != nil {
+		i.err = err
+		return nil, nil, false
+	}
+	if i.memoize && dataHandle == nil && i.verifyChecksums {
+		i.reader.memoizeBlock(h, b)
+	}
+	return b, dataHandle, true
+}
+
+// SetBlockPropertyFilters restricts the iterator to the data blocks whose block
+// properties intersect every filter, or if invert is true, to the data blocks
+// whose block properties do not. The other blocks are skipped without being
+// read. A filter is applied to the property collected by the
+// db.Options.BlockPropertyCollectors collector of the same name, and is
+// ignored if the table has no such property. A block which may share a user
+// key with an adjacent block always intersects the filters, so that the
+// versions of a user key are never split between the blocks returned with and
+// without invert. SetBlockPropertyFilters must be called before the iterator
+// is positioned.
+func (i *Iterator) SetBlockPropertyFilters(filters []db.BlockPropertyFilter, invert bool) error {
+	if i.err != nil {
+		return i.err
+	}
+	i.filtered = true
+	i.invert = invert
+	i.filters = i.reader.blockPropertyFilters(filters)
+	if len(i.filters) > 0 {
+		i.linked, i.err = i.reader.linkedBlocks(i.index.data)
+	}
+	return i.err
+}
+
+// skipFiltered steps the index forward, or backward if forward is false, past
+// the data blocks excluded by the block property filters of the iterator. An
+// error applying a filter is left in i.err, which causes the following
+// loadBlock to fail.
+func (i *Iterator) skipFiltered(forward bool) {
+	for i.filtered && i.err == nil && i.index.Valid() {
+		intersects, err := i.intersects(i.index.Value())
+		if err != nil {
+			i.err = err
+			return
+		}
+		if intersects != i.invert {
+			return
+		}
+		if forward {
+			i.index.Next()
+		} else {
+			i.index.Prev()
+		}
+	}
+}
+
+// intersects returns whether the block properties stored in the value of an
+// index entry intersect every block property filter of the iterator.
+func (i *Iterator) intersects(v []byte) (bool, error) {
+	bh, props, ok := i.reader.decodeIndexEntry(v)
+	if !ok {
+		return false, errors.New("pebble/table: corrupt index entry")
+	}
+	if len(i.filters) == 0 {
+		return true, nil
+	}
+	if _, ok := i.linked[bh.offset]; ok {
+		return true, nil
+	}
+
+	var err error
+	if i.props, err = decodeBlockProperties(i.props[:0], props); err != nil {
+		return false, err
+	}
+	for _, f := range i.filters {
+		if f.index >= len(i.props) {
+			return false, errCorruptBlockProperties
+		}
+		if intersects, err := f.filter.Intersects(i.props[f.index]); err != nil || !intersects {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// canceled returns true and invalidates the iterator, setting i.err to the
+// context error, if the context of the iterator is done.
+func (i *Iterator) canceled() bool {
+	if i.ctx == nil {
+		return false
+	}
+	if i.err = i.ctx.Err(); i.err == nil {
+		return false
+	}
+	i.data.offset = 0
+	i.data.restarts = 0
+	return true
+}
+
 // seekBlock loads the block at the current index position and positions i.data
 // at the first key in that block which is >= the given key. If unsuccessful,
 // it sets i.err to any error encountered, which may be nil if we have simply
@@ -110,9 +279,8 @@ func (i *Iterator) seekBlock(key []byte, f *blockFilterReader) bool {
 		return false
 	}
 	// Load the next block.
-	v := i.index.Value()
-	h, n := decodeBlockHandle(v)
-	if n == 0 || n != len(v) {
+	h, _, ok := i.reader.decodeIndexEntry(i.index.Value())
+	if !ok {
 		i.err = errors.New("pebble/table: corrupt index entry")
 		return false
 	}
@@ -127,17 +295,34 @@ func (i *Iterator) seekBlock(key []byte, f *blockFilterReader) bool {
 			return false
 		}
 	}
-	block, _, err := i.reader.readBlock(h)
-	if err != nil {
-		i.err = err
+	block, dataHandle, ok := i.readBlock(h)
+	if !ok {
 		return false
 	}
+	i.dataHandle.Release()
+	i.dataHandle = dataHandle
 	i.err = i.data.init(i.reader.compare, block, i.reader.Properties.GlobalSeqNum)
 	if i.err != nil {
 		return false
 	}
 	// Look for the key inside that block.
-	i.data.SeekGE(key)
+	i.checkKind(i.data.seekExact(key))
+	return true
+}
+
+// checkKind verifies that the data block entry i is positioned at, if valid is
+// true, has an internal key kind known to this reader. Otherwise, due to
+// corruption or a table written by a newer format, it sets i.err and
+// invalidates the iterator rather than surfacing an entry whose semantics are
+// unknown. It returns whether the iterator is positioned at a valid entry.
+func (i *Iterator) checkKind(valid bool) bool {
+	if !valid {
+		return false
+	}
+	if err := i.data.unknownKind(); err != nil {
+		i.err = err
+		return false
+	}
 	return true
 }
 
@@ -154,10 +339,11 @@ func (i *Iterator) SeekGE(key []byte) bool {
 	if !i.index.SeekGE(key) {
 		return false
 	}
+	i.skipFiltered(true)
 	if !i.loadBlock() {
 		return false
 	}
-	return i.data.SeekGE(key)
+	return i.checkKind(i.data.SeekGE(key))
 }
 
 // SeekLT implements internalIterator.SeekLT, as documented in the pebble
@@ -173,11 +359,12 @@ func (i *Iterator) SeekLT(key []byte) bool {
 	if !i.index.SeekGE(key) {
 		i.index.Last()
 	}
+	i.skipFiltered(false)
 	if !i.loadBlock() {
 		return false
 	}
 	if i.data.SeekLT(key) {
-		return true
+		return i.checkKind(true)
 	}
 	// The index contains separator keys which may lie between
 	// user-keys. Consider the user-keys:
@@ -193,10 +380,11 @@ func (i *Iterator) SeekLT(key []byte) bool {
 	if !i.index.Prev() {
 		return false
 	}
+	i.skipFiltered(false)
 	if !i.loadBlock() {
 		return false
 	}
-	return i.data.Last()
+	return i.checkKind(i.data.Last())
 }
 
 // First implements internalIterator.First, as documented in the pebble
@@ -212,10 +400,11 @@ func (i *Iterator) First() bool {
 	if !i.index.First() {
 		return false
 	}
+	i.skipFiltered(true)
 	if !i.loadBlock() {
 		return false
 	}
-	return i.data.First()
+	return i.checkKind(i.data.First())
 }
 
 // Last implements internalIterator.Last, as documented in the pebble
@@ -231,10 +420,11 @@ func (i *Iterator) Last() bool {
 	if !i.index.Last() {
 		return false
 	}
+	i.skipFiltered(false)
 	if !i.loadBlock() {
 		return false
 	}
-	return i.data.Last()
+	return i.checkKind(i.data.Last())
 }
 
 // Next implements internalIterator.Next, as documented in the pebble
@@ -244,7 +434,7 @@ func (i *Iterator) Next() bool {
 		return false
 	}
 	if i.data.Next() {
-		return true
+		return i.checkKind(true)
 	}
 	for {
 		if i.data.err != nil {
@@ -252,10 +442,17 @@ func (i *Iterator) Next() bool {
 			break
 		}
 		if !i.index.Next() {
+			// The index block iterator fails if its keys are out of order.
+			i.err = i.index.err
 			break
 		}
+		i.skipFiltered(true)
 		if i.loadBlock() {
-			return i.data.First()
+			return i.checkKind(i.data.First())
+		}
+		if i.err != nil || !i.index.Valid() {
+			// The skipped blocks extend to the end of the index.
+			break
 		}
 	}
 	return false
@@ -268,7 +465,7 @@ func (i *Iterator) Prev() bool {
 		return false
 	}
 	if i.data.Prev() {
-		return true
+		return i.checkKind(true)
 	}
 	for {
 		if i.data.err != nil {
@@ -276,10 +473,17 @@ func (i *Iterator) Prev() bool {
 			break
 		}
 		if !i.index.Prev() {
+			// The index block iterator fails if its keys are out of order.
+			i.err = i.index.err
 			break
 		}
+		i.skipFiltered(false)
 		if i.loadBlock() {
-			return i.data.Last()
+			return i.checkKind(i.data.Last())
+		}
+		if i.err != nil || !i.index.Valid() {
+			// The skipped blocks extend to the start of the index.
+			break
 		}
 	}
 	return false
@@ -291,9 +495,17 @@ func (i *Iterator) Key() db.InternalKey {
 }
 
 // Value implements internalIterator.Value, as documented in the pebble
-// package.
+// package. A value stored in a value block is read on demand, and an error
+// reading it is returned by Error.
 func (i *Iterator) Value() []byte {
-	return i.data.Value()
+	if i.values == nil {
+		return i.data.Value()
+	}
+	v, err := i.values.value(i.data.Value())
+	if err != nil {
+		i.err = err
+	}
+	return v
 }
 
 // Valid implements internalIterator.Valid, as documented in the pebble
@@ -308,6 +520,9 @@ func (i *Iterator) Error() error {
 	if err := i.data.Error(); err != nil {
 		return err
 	}
+	if err := i.index.Error(); err != nil {
+		return err
+	}
 	return i.err
 }
 
@@ -320,6 +535,8 @@ func (i *Iterator) SetCloseHook(fn func() error) {
 // Close implements internalIterator.Close, as documented in the pebble
 // package.
 func (i *Iterator) Close() error {
+	i.dataHandle.Release()
+	i.dataHandle = nil
 	if i.closeHook != nil {
 		if err := i.closeHook(); err != nil {
 			return err
@@ -328,6 +545,9 @@ func (i *Iterator) Close() error {
 	if err := i.data.Close(); err != nil {
 		return err
 	}
+	if err := i.index.Close(); err != nil {
+		return err
+	}
 	return i.err
 }
 
@@ -335,12 +555,19 @@ type weakCachedBlock struct {
 	bh     blockHandle
 	mu     sync.RWMutex
 	handle cache.WeakHandle
+	// pinned, if non-nil, is the handle of the block pinned in memory. See
+	// db.Options.MaxIndexAndFilterMemory.
+	pinned *cache.PinnedHandle
 }
 
 // Reader is a table reader.
 type Reader struct {
+	// latency is updated atomically. It is the first field in the struct to
+	// ensure 64-bit alignment on 32-bit platforms.
+	latency     LatencyStats
 	file        storage.File
 	fileNum     uint64
+	epoch       uint64
 	err         error
 	index       weakCachedBlock
 	filter      weakCachedBlock
@@ -348,14 +575,160 @@ type Reader struct {
 	rangeDelV2  bool
 	opts        *db.Options
 	cache       *cache.Cache
+	allocator   cache.Allocator
 	compare     db.Compare
 	blockFilter *blockFilterReader
 	tableFilter *tableFilterReader
-	Properties  Properties
+	// valueFilter is the value filter block, which is queried using
+	// valueFilterPolicy. See MayContainValue.
+	valueFilter       weakCachedBlock
+	valueFilterPolicy db.FilterPolicy
+	// valueIndex is the block holding the handles of the value blocks. See
+	// LevelOptions.ValueBlockThreshold.
+	valueIndex weakCachedBlock
+	// pageIndex is the page index block. See LevelOptions.PageIndexPageSize.
+	pageIndex weakCachedBlock
+	// blockInternalFilterPolicy is the policy of the filters stored in the data
+	// blocks, if the table was written with LevelOptions.BlockInternalFilter
+	// and the policy of its filter block is known.
+	blockInternalFilterPolicy db.FilterPolicy
+	// filterChecksum is the checksum of the contents of the filter block
+	// followed by the noCompressionBlockType byte, which for an uncompressed
+	// filter block is the checksum in its trailer. It is only set if
+	// verifyFilter is true.
+	filterChecksum uint32
+	verifyFilter   bool
+	// lastGetBlock points to the memoizedBlock holding the data block read by
+	// the last get, if db.Options.MemoizeGetBlock is set. Accessed atomically.
+	lastGetBlock   unsafe.Pointer
+	memoizeGet     bool
+	verifyKeyOrder bool
+	latencyStats   bool
+	// blockPropertyNames are the names of the block properties following the
+	// block handles in the index entries, if any. See
+	// db.Options.BlockPropertyCollectors.
+	blockPropertyNames []string
+	Properties         Properties
+	// tailIndex, if non-nil, is used in place of the index block. It indexes
+	// the data blocks of a table which is still being written. See TailReader.
+	tailIndex block
+	// metaBlocks holds the entries of the metaindex block.
+	metaBlocks map[string]blockHandle
+	// noCompression is true if the table was written without compression, in
+	// which case none of its blocks are compressed.
+	noCompression bool
+	// trailerLen is the length of the block trailers, as recorded in the
+	// footer. Only the block type and checksum at the start of a trailer are
+	// read.
+	trailerLen uint64
+}
+
+// Epoch returns the epoch recorded in the table footer. See Writer.SetEpoch.
+func (r *Reader) Epoch() uint64 {
+	return r.epoch
+}
+
+// Comment returns the comment set by Writer.SetComment when the table was
+// written, or the empty string if there is none.
+func (r *Reader) Comment() string {
+	return r.Properties.Comment
+}
+
+// MetaBlocks returns the names and handles of the meta blocks listed in the
+// metaindex block of the table, such as the filter, properties and range-del
+// blocks. Returns nil if the table could not be opened.
+func (r *Reader) MetaBlocks() map[string]BlockHandle {
+	if r.metaBlocks == nil {
+		return nil
+	}
+	m := make(map[string]BlockHandle, len(r.metaBlocks))
+	for name, bh := range r.metaBlocks {
+		m[name] = BlockHandle{Offset: bh.offset, Length: bh.length}
+	}
+	return m
+}
+
+var errCorruptBlockProperties = errors.New("pebble/table: corrupt block properties")
+
+// decodeIndexEntry decodes the value of an index entry into the handle of the
+// data block and the block properties of the block which follow it, if the
+// table has any. It returns false if the value is invalid.
+func (r *Reader) decodeIndexEntry(v []byte) (bh blockHandle, props []byte, ok bool) {
+	bh, n := decodeBlockHandle(v)
+	if n == 0 || (n != len(v) && r.blockPropertyNames == nil) {
+		return blockHandle{}, nil, false
+	}
+	return bh, v[n:], true
+}
+
+// linkedBlocks returns the offsets of the data blocks indexed by index which
+// may share a user key with an adjacent block. The separator between two
+// blocks is known to fall strictly between their user keys only if it was
+// shortened, in which case it carries the maximum trailer (see
+// db.InternalKey.Separator).
+func (r *Reader) linkedBlocks(index block) (map[uint64]struct{}, error) {
+	iter, err := newBlockIter(r.compare, index)
+	if err != nil {
+		return nil, err
+	}
+	strict := db.MakeSearchKey(nil).Trailer
+	var linked map[uint64]struct{}
+	var prev blockHandle
+	prevShared := false
+	for valid := iter.First(); valid; valid = iter.Next() {
+		bh, _, ok := r.decodeIndexEntry(iter.Value())
+		if !ok {
+			return nil, errors.New("pebble/table: corrupt index entry")
+		}
+		if prevShared {
+			if linked == nil {
+				linked = make(map[uint64]struct{})
+			}
+			linked[prev.offset] = struct{}{}
+			linked[bh.offset] = struct{}{}
+		}
+		prev, prevShared = bh, iter.Key().Trailer != strict
+	}
+	return linked, iter.err
+}
+
+// decodeBlockProperties appends to dst the block properties encoded in src, as
+// written by Writer.finishBlockProperties.
+func decodeBlockProperties(dst [][]byte, src []byte) ([][]byte, error) {
+	for len(src) > 0 {
+		n, m := binary.Uvarint(src)
+		if m <= 0 || n > uint64(len(src)-m) {
+			return dst, errCorruptBlockProperties
+		}
+		dst = append(dst, src[m:m+int(n)])
+		src = src[m+int(n):]
+	}
+	return dst, nil
+}
+
+// blockPropertyFilters returns the filters applied to the block properties of
+// the table, which are those named after one of its block properties.
+func (r *Reader) blockPropertyFilters(filters []db.BlockPropertyFilter) []blockPropertyFilter {
+	var res []blockPropertyFilter
+	for _, f := range filters {
+		for j, name := range r.blockPropertyNames {
+			if name == f.Name() {
+				res = append(res, blockPropertyFilter{filter: f, index: j})
+				break
+			}
+		}
+	}
+	return res
 }
 
 // Close implements DB.Close, as documented in the pebble package.
 func (r *Reader) Close() error {
+	r.index.pinned.Release()
+	r.filter.pinned.Release()
+	r.valueFilter.pinned.Release()
+	r.valueIndex.pinned.Release()
+	r.pageIndex.pinned.Release()
+	atomic.StorePointer(&r.lastGetBlock, nil)
 	if r.err != nil {
 		if r.file != nil {
 			r.file.Close()
@@ -375,7 +748,73 @@ func (r *Reader) Close() error {
 	return nil
 }
 
+// MayContainValue returns false if the table is known not to contain a set of
+// any key to the value, as determined by the value filter written for
+// LevelOptions.ValueFilterPolicy. It returns true if the table might contain
+// the value, which includes the case where the table has no value filter
+// matching a ValueFilterPolicy of the reader's options or the filter cannot be
+// read.
+func (r *Reader) MayContainValue(value []byte) bool {
+	if r.err != nil || r.valueFilterPolicy == nil {
+		return true
+	}
+	b, err := r.readWeakCachedBlock(&r.valueFilter)
+	if err != nil {
+		return true
+	}
+	return r.valueFilterPolicy.MayContain(db.TableFilter, b, value)
+}
+
 func (r *Reader) get(key []byte, o *db.IterOptions) (value []byte, err error) {
+	i, err := r.seekKey(key, o)
+	if err != nil {
+		return nil, err
+	}
+	value = i.Value()
+	if i.dataHandle != nil {
+		// The block holding the value may be freed once the iterator is closed.
+		value = append([]byte(nil), value...)
+	}
+	return value, i.Close()
+}
+
+// GetValueLen returns the length of the value of the newest entry for the key
+// in the table, without copying the value. The key exists if that entry is a
+// set or a merge, in which case length is the length of the value or merge
+// operand. It does not exist if the table holds no entry for the key or the
+// newest entry is a deletion. Range deletions are not consulted. This serves
+// queries which only need to know whether a key exists and the size of its
+// value, without transferring the value itself.
+func (r *Reader) GetValueLen(key []byte) (length int, exists bool, err error) {
+	i, err := r.seekKey(key, nil)
+	if err == db.ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	switch i.Key().Kind() {
+	case db.InternalKeyKindSet, db.InternalKeyKindMerge:
+		if i.values != nil {
+			// The length of a value in a value block is recorded in its
+			// reference.
+			if length, err = storedValueLen(i.data.Value()); err != nil {
+				i.Close()
+				return 0, false, err
+			}
+		} else {
+			length = len(i.Value())
+		}
+		exists = true
+	}
+	return length, exists, i.Close()
+}
+
+// seekKey returns an iterator positioned at the newest entry for the key,
+// consulting the table and block filters to avoid reading data blocks which
+// cannot contain the key. The caller must close the returned iterator. An
+// error of db.ErrNotFound is returned if the table holds no entry for the key.
+func (r *Reader) seekKey(key []byte, o *db.IterOptions) (*Iterator, error) {
 	if r.err != nil {
 		return nil, r.err
 	}
@@ -390,8 +829,8 @@ func (r *Reader) get(key []byte, o *db.IterOptions) (value []byte, err error) {
 		}
 	}
 
-	i := &Iterator{}
-	if err := i.init(r); err == nil {
+	i := &Iterator{memoize: r.memoizeGet}
+	if err := i.init(r, o); err == nil {
 		i.index.SeekGE(key)
 		i.seekBlock(key, r.blockFilter)
 	}
@@ -403,7 +842,7 @@ func (r *Reader) get(key []byte, o *db.IterOptions) (value []byte, err error) {
 		}
 		return nil, err
 	}
-	return i.Value(), i.Close()
+	return i, nil
 }
 
 // NewIter returns an internal iterator for the contents of the table.
@@ -415,7 +854,16 @@ func (r *Reader) NewIter(o *db.IterOptions) *Iterator {
 		return &Iterator{err: r.err}
 	}
 	i := &Iterator{}
-	_ = i.init(r)
+	_ = i.init(r, o)
+	return i
+}
+
+// NewGetIter is NewIter for an iterator serving a point lookup, such as the
+// iterators of pebble.DB.Get. The iterator consults and updates the data block
+// memoized by the reader, as Get does, if db.Options.MemoizeGetBlock is set.
+func (r *Reader) NewGetIter(o *db.IterOptions) *Iterator {
+	i := r.NewIter(o)
+	i.memoize = r.memoizeGet
 	return i
 }
 
@@ -439,12 +887,159 @@ func (r *Reader) NewRangeDelIter(o *db.IterOptions) *blockIter {
 	return i
 }
 
+// WarmCache reads the data blocks which overlap the key range [start,end)
+// into the block cache, without decoding their contents. At most budget bytes
+// of blocks are read; blocks which are already cached count against the
+// budget. Returns the number of bytes of blocks which were loaded. A nil start
+// or end leaves the corresponding side of the range unbounded.
+func (r *Reader) WarmCache(start, end []byte, budget int64) (int64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	index, err := r.readIndex()
+	if err != nil {
+		return 0, err
+	}
+	iter, err := newBlockIter(r.compare, index)
+	if err != nil {
+		return 0, err
+	}
+	var loaded int64
+	var valid bool
+	if start != nil {
+		valid = iter.SeekGE(start)
+	} else {
+		valid = iter.First()
+	}
+	for ; valid; valid = iter.Next() {
+		bh, n := decodeBlockHandle(iter.Value())
+		if n == 0 {
+			return loaded, errors.New("pebble/table: corrupt index entry")
+		}
+		if loaded+int64(bh.length) > budget {
+			break
+		}
+		if _, _, err := r.readBlock(bh); err != nil {
+			return loaded, err
+		}
+		loaded += int64(bh.length)
+		// The index key is an upper bound on the keys in the block, so the
+		// remaining blocks lie entirely past the end of the range.
+		if end != nil && r.compare(iter.Key().UserKey, end) >= 0 {
+			break
+		}
+	}
+	return loaded, iter.Close()
+}
+
+// WarmIndexAndFilter reads the index and filter blocks of the table, which are
+// pinned in memory if db.Options.MaxIndexAndFilterMemory is set, or loaded
+// into the block cache otherwise. Returns the number of bytes of blocks which
+// were read.
+func (r *Reader) WarmIndexAndFilter() (int64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	index, err := r.readIndex()
+	if err != nil {
+		return 0, err
+	}
+	n := int64(len(index))
+	if r.tableFilter != nil {
+		filter, err := r.readFilter()
+		if err != nil {
+			return n, err
+		}
+		n += int64(len(filter))
+	}
+	return n, nil
+}
+
+// RestartPoints returns the offsets of the restart points within the data
+// block which starts at the specified file offset. Intended for introspection
+// by tooling, such as analyzing the effectiveness of prefix compression.
+func (r *Reader) RestartPoints(offset uint64) ([]uint32, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	index, err := r.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	iter, err := newBlockIter(r.compare, index)
+	if err != nil {
+		return nil, err
+	}
+	for valid := iter.First(); valid; valid = iter.Next() {
+		bh, n := decodeBlockHandle(iter.Value())
+		if n == 0 {
+			return nil, errors.New("pebble/table: corrupt index entry")
+		}
+		if bh.offset != offset {
+			continue
+		}
+		b, _, err := r.readBlock(bh)
+		if err != nil {
+			return nil, err
+		}
+		data := &blockIter{inBlockFilters: r.Properties.BlockInternalFilter}
+		if err := data.init(r.compare, b, 0); err != nil {
+			return nil, err
+		}
+		return data.RestartPoints(), nil
+	}
+	return nil, fmt.Errorf("pebble/table: no data block at offset %d", offset)
+}
+
 func (r *Reader) readIndex() (block, error) {
+	if r.tailIndex != nil {
+		return r.tailIndex, nil
+	}
 	return r.readWeakCachedBlock(&r.index)
 }
 
 func (r *Reader) readFilter() (block, error) {
-	return r.readWeakCachedBlock(&r.filter)
+	b, err := r.readWeakCachedBlock(&r.filter)
+	if err != nil || !r.verifyFilter || len(b) == 0 {
+		return b, err
+	}
+	// The checksum is verified on every retrieval, as the cached block may have
+	// been corrupted since it was last retrieved.
+	if filterChecksum(b) != r.filterChecksum {
+		return nil, errors.New("pebble/table: invalid table (filter checksum mismatch)")
+	}
+	return b, nil
+}
+
+// filterChecksum returns the checksum of the contents of a filter block
+// followed by the noCompressionBlockType byte, which is what the trailer of an
+// uncompressed block covers.
+func filterChecksum(b []byte) uint32 {
+	return crc.New(b).Update([]byte{noCompressionBlockType}).Value()
+}
+
+// readFilterChecksum records the checksum of the filter block, so that the
+// filter block can be verified when it is retrieved from the cache. The
+// checksum of an uncompressed filter block is taken from its trailer. The
+// trailer of a compressed filter block covers the compressed contents, so the
+// block is read and decompressed, verifying the trailer, and the checksum of
+// the decompressed contents is computed instead.
+func (r *Reader) readFilterChecksum(bh blockHandle) error {
+	var trailer [blockTrailerLen]byte
+	if _, err := r.file.ReadAt(trailer[:], int64(bh.offset+bh.length)); err != nil {
+		return err
+	}
+	if trailer[0] == noCompressionBlockType {
+		r.filterChecksum = binary.LittleEndian.Uint32(trailer[1:])
+	} else {
+		b, _, err := r.readBlockInternal(bh, true /* verifyChecksum */, false /* addToCache */)
+		if err != nil {
+			return err
+		}
+		r.filterChecksum = filterChecksum(b)
+	}
+	r.verifyFilter = true
+	return nil
 }
 
 func (r *Reader) readRangeDel() (block, error) {
@@ -480,10 +1075,12 @@ func (r *Reader) readRangeDel() (block, error) {
 }
 
 func (r *Reader) readWeakCachedBlock(w *weakCachedBlock) (block, error) {
-	// Fast-path for retrieving the block from a weak cache handle.
+	// Fast-path for retrieving the block from a pinned or weak cache handle.
 	w.mu.RLock()
 	var b []byte
-	if w.handle != nil {
+	if w.pinned != nil {
+		b = w.pinned.Get()
+	} else if w.handle != nil {
 		b = w.handle.Get()
 	}
 	w.mu.RUnlock()
@@ -492,9 +1089,28 @@ func (r *Reader) readWeakCachedBlock(w *weakCachedBlock) (block, error) {
 	}
 
 	// Slow-path: read the index block from disk. This checks the cache again,
-	// but that is ok because somebody else might have inserted it for us.
-	b, h, err := r.readBlock(w.bh)
-	if err == nil && h != nil {
+	// but that is ok because somebody else might have inserted it for us. A
+	// block which is pinned is not added to the cache, where it would be
+	// accounted for twice.
+	pinned := r.opts.PinnedIndexAndFilterMemory()
+	b, h, err := r.readBlockInternal(w.bh, true /* verifyChecksum */, pinned == nil /* addToCache */)
+	if err != nil {
+		return b, err
+	}
+	if pinned != nil {
+		if p := pinned.Pin(b); p != nil {
+			w.mu.Lock()
+			// A concurrent read may have pinned the block as well.
+			w.pinned.Release()
+			w.pinned = p
+			w.mu.Unlock()
+			return b, nil
+		}
+		// The block is larger than the pinned memory budget, so it is cached
+		// instead.
+		h = r.cache.SetWithEpoch(r.fileNum, r.epoch, w.bh.offset, b)
+	}
+	if h != nil {
 		w.mu.Lock()
 		w.handle = h
 		w.mu.Unlock()
@@ -502,38 +1118,235 @@ func (r *Reader) readWeakCachedBlock(w *weakCachedBlock) (block, error) {
 	return b, err
 }
 
+// memoizedBlock is a data block retained by a reader, along with its handle.
+// See db.Options.MemoizeGetBlock.
+type memoizedBlock struct {
+	bh    blockHandle
+	block block
+}
+
+// memoizedBlock returns the data block read by the last get if it is the block
+// with the given handle, and nil otherwise.
+func (r *Reader) memoizedBlock(bh blockHandle) block {
+	if m := (*memoizedBlock)(atomic.LoadPointer(&r.lastGetBlock)); m != nil && m.bh == bh {
+		return m.block
+	}
+	return nil
+}
+
+// memoizeBlock replaces the data block read by the last get. The block must
+// have been verified against its checksum.
+func (r *Reader) memoizeBlock(bh blockHandle, b block) {
+	atomic.StorePointer(&r.lastGetBlock, unsafe.Pointer(&memoizedBlock{bh: bh, block: b}))
+}
+
+// readBufPool is a pool of scratch buffers shared by all readers for reading
+// blocks which may be compressed. The buffers only hold the contents of a
+// block until it has been decompressed, or copied if it turns out to be
+// uncompressed, so a buffer is never aliased by a block returned to the
+// caller or added to the block cache.
+var readBufPool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// readBufSize is the size of the largest block read into a buffer from
+// readBufPool. New buffers are allocated with at least this size, so that the
+// pooled buffers converge on the maximum block size and are not repeatedly
+// regrown. Accessed atomically.
+var readBufSize int64
+
+// getReadBuf returns a buffer of length n from readBufPool.
+func getReadBuf(n int) *[]byte {
+	bufp := readBufPool.Get().(*[]byte)
+	if cap(*bufp) < n {
+		size := atomic.LoadInt64(&readBufSize)
+		for int64(n) > size {
+			if atomic.CompareAndSwapInt64(&readBufSize, size, int64(n)) {
+				size = int64(n)
+				break
+			}
+			size = atomic.LoadInt64(&readBufSize)
+		}
+		*bufp = make([]byte, n, size)
+	}
+	*bufp = (*bufp)[:n]
+	return bufp
+}
+
 // readBlock reads and decompresses a block from disk into memory.
 func (r *Reader) readBlock(bh blockHandle) (block, cache.WeakHandle, error) {
-	if b := r.cache.Get(r.fileNum, bh.offset); b != nil {
+	return r.readBlockInternal(bh, true /* verifyChecksum */, true /* addToCache */)
+}
+
+// unverifiedBlockFlag is set in the offset under which a block read without
+// verifying its checksum is added to the block cache. Block offsets never have
+// the flag set, so the unverified copies of the blocks are cached apart from
+// the verified ones, and are only served to readers which do not verify
+// checksums either.
+const unverifiedBlockFlag = 1 << 63
+
+// readBlockInternal is readBlock, with the verification of the checksum of a
+// block read from disk and the insertion of the block into the block cache
+// optional. A block which is read without verifying its checksum is cached
+// under its offset with unverifiedBlockFlag set.
+func (r *Reader) readBlockInternal(
+	bh blockHandle, verifyChecksum, addToCache bool,
+) (block, cache.WeakHandle, error) {
+	// The latencies are only measured if requested, as reading the clock is
+	// not free relative to a cache hit.
+	var start time.Time
+	if r.latencyStats {
+		start = time.Now()
+	}
+	b := r.cache.GetWithEpoch(r.fileNum, r.epoch, bh.offset)
+	if b == nil && !verifyChecksum {
+		b = r.cache.GetWithEpoch(r.fileNum, r.epoch, bh.offset|unverifiedBlockFlag)
+	}
+	if b != nil {
+		if r.latencyStats {
+			r.latency.CacheHit.record(time.Since(start))
+		}
 		return b, nil, nil
 	}
+	b, err := r.readBlockFromFile(bh, verifyChecksum, nil /* alloc */)
+	if err != nil {
+		return nil, nil, err
+	}
+	var h cache.WeakHandle
+	if addToCache {
+		offset := bh.offset
+		if !verifyChecksum {
+			offset |= unverifiedBlockFlag
+		}
+		h = r.cache.SetWithEpoch(r.fileNum, r.epoch, offset, b)
+	}
+	if r.latencyStats {
+		r.latency.CacheMiss.record(time.Since(start))
+	}
+	return b, h, nil
+}
 
-	b := make([]byte, bh.length+blockTrailerLen)
-	if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
+// readDataBlock is readBlockInternal for the data blocks read by an Iterator,
+// which are always added to the block cache. If the reader has a
+// db.Options.CacheAllocator, a block read from disk is allocated by it, and
+// the returned handle holds a reference to the block which the caller must
+// release once it no longer uses the block. The handle is nil if the block is
+// allocated on the Go heap.
+func (r *Reader) readDataBlock(bh blockHandle, verifyChecksum bool) (block, *cache.Handle, error) {
+	if r.allocator == nil || r.cache == nil || !verifyChecksum {
+		b, _, err := r.readBlockInternal(bh, verifyChecksum, true /* addToCache */)
+		return b, nil, err
+	}
+	var start time.Time
+	if r.latencyStats {
+		start = time.Now()
+	}
+	if h := r.cache.GetHandle(r.fileNum, r.epoch, bh.offset); h != nil {
+		if r.latencyStats {
+			r.latency.CacheHit.record(time.Since(start))
+		}
+		return h.Get(), h, nil
+	}
+	b, err := r.readBlockFromFile(bh, verifyChecksum, r.allocator)
+	if err != nil {
 		return nil, nil, err
 	}
-	checksum0 := binary.LittleEndian.Uint32(b[bh.length+1:])
-	checksum1 := crc.New(b[:bh.length+1]).Value()
-	if checksum0 != checksum1 {
-		return nil, nil, errors.New("pebble/table: invalid table (checksum mismatch)")
+	h := r.cache.SetAllocated(r.fileNum, r.epoch, bh.offset, b, r.allocator)
+	if r.latencyStats {
+		r.latency.CacheMiss.record(time.Since(start))
 	}
-	switch b[bh.length] {
+	return b, h, nil
+}
+
+// readBlockFromFile reads and decompresses a block from disk, bypassing the
+// block cache. The block is allocated by alloc if non-nil, and on the Go heap
+// otherwise.
+func (r *Reader) readBlockFromFile(
+	bh blockHandle, verifyChecksum bool, alloc cache.Allocator,
+) (block, error) {
+	// The blocks of an uncompressed table are read directly into a buffer of
+	// their exact size, which is retained by the block. Other blocks, and all
+	// blocks which are allocated by alloc, are read into a pooled scratch
+	// buffer.
+	n := int(bh.length + r.trailerLen)
+	var b []byte
+	var bufp *[]byte
+	if r.noCompression && alloc == nil {
+		b = make([]byte, n)
+	} else {
+		bufp = getReadBuf(n)
+		b = *bufp
+	}
+	putBuf := func() {
+		if bufp != nil {
+			readBufPool.Put(bufp)
+		}
+	}
+	var ioStart time.Time
+	if r.latencyStats {
+		ioStart = time.Now()
+	}
+	if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
+		putBuf()
+		return nil, err
+	}
+	if r.latencyStats {
+		r.latency.IOWait.record(time.Since(ioStart))
+	}
+	if verifyChecksum {
+		checksum0 := binary.LittleEndian.Uint32(b[bh.length+1:])
+		checksum1 := crc.New(b[:bh.length+1]).Value()
+		if checksum0 != checksum1 {
+			putBuf()
+			return nil, errors.New("pebble/table: invalid table (checksum mismatch)")
+		}
+	}
+	newBuf := func(n int) []byte {
+		if alloc != nil {
+			return alloc.Alloc(n)
+		}
+		return make([]byte, n)
+	}
+	blockType := b[bh.length]
+	switch blockType {
 	case noCompressionBlockType:
-		b = b[:bh.length]
-		h := r.cache.Set(r.fileNum, bh.offset, b)
-		return b, h, nil
+		if bufp != nil {
+			// The block is copied out of the pooled buffer into a buffer of its
+			// exact size, as the block is retained by the cache.
+			b = newBuf(int(bh.length))
+			copy(b, *bufp)
+			readBufPool.Put(bufp)
+		} else {
+			// The block aliases the buffer it was read into, whose trailer is
+			// retained along with it.
+			b = b[:bh.length]
+		}
+		return b, nil
 	case snappyCompressionBlockType:
-		b, err := snappy.Decode(nil, b[:bh.length])
+		n, err := snappy.DecodedLen(b[:bh.length])
+		if err != nil {
+			putBuf()
+			return nil, err
+		}
+		decoded, err := snappy.Decode(newBuf(n), b[:bh.length])
+		putBuf()
 		if err != nil {
-			return nil, nil, err
+			if alloc != nil {
+				alloc.Free(decoded)
+			}
+			return nil, err
 		}
-		h := r.cache.Set(r.fileNum, bh.offset, b)
-		return b, h, nil
+		return decoded, nil
 	}
-	return nil, nil, fmt.Errorf("pebble/table: unknown block compression: %d", b[bh.length])
+	putBuf()
+	return nil, fmt.Errorf("pebble/table: unknown block compression: %d", blockType)
 }
 
-func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
+func (r *Reader) readMetaindex(
+	metaindexBH blockHandle, format db.TableFormat, o *db.Options,
+) error {
 	b, _, err := r.readBlock(metaindexBH)
 	if err != nil {
 		return err
@@ -551,6 +1364,7 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 		}
 		meta[string(i.Key().UserKey)] = bh
 	}
+	r.metaBlocks = meta
 	if err := i.Close(); err != nil {
 		return err
 	}
@@ -564,6 +1378,23 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 			return err
 		}
 	}
+	// Tables written without properties do not record their comparer.
+	if name := r.Properties.ComparatorName; name != "" && name != o.Comparer.Name &&
+		!o.IgnoreComparerMismatch {
+		return fmt.Errorf("pebble/table: comparer mismatch: table uses %s, options use %s",
+			name, o.Comparer.Name)
+	}
+	// The index entries only hold block properties in the pebble format.
+	if names := r.Properties.BlockPropertyNames; names != "" && format == db.TableFormatPebblev1 {
+		r.blockPropertyNames = strings.Split(strings.Trim(names, "[]"), ",")
+	}
+
+	if bh, ok := meta[metaValueIndexName]; ok {
+		r.valueIndex.bh = bh
+	}
+	if bh, ok := meta[metaPageIndexName]; ok {
+		r.pageIndex.bh = bh
+	}
 
 	if bh, ok := meta[metaRangeDelV2Name]; ok {
 		r.rangeDel.bh = bh
@@ -588,6 +1419,11 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 		for _, t := range types {
 			if bh, ok := meta[t.prefix+fp.Name()]; ok {
 				r.filter.bh = bh
+				if o.VerifyFilterChecksums {
+					if err := r.readFilterChecksum(bh); err != nil {
+						return err
+					}
+				}
 
 				// Read the filter block to a) make sure it exists and b) initialize
 				// the filter readers. Note that the filter readers do not (and should
@@ -613,6 +1449,9 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 					panic(fmt.Sprintf("unknown filter type: %v", t.ftype))
 				}
 
+				if r.Properties.BlockInternalFilter {
+					r.blockInternalFilterPolicy = fp
+				}
 				done = true
 				break
 			}
@@ -621,19 +1460,72 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 			break
 		}
 	}
+
+	for level := range r.opts.Levels {
+		fp := r.opts.Levels[level].ValueFilterPolicy
+		if fp == nil {
+			continue
+		}
+		if bh, ok := meta[valueFilterPrefix+fp.Name()]; ok {
+			r.valueFilter.bh = bh
+			r.valueFilterPolicy = fp
+			break
+		}
+	}
 	return nil
 }
 
+// readIndexRegion reads the metaindex and index blocks of the table with a
+// single I/O, and serves the reads of the blocks from memory until r.file is
+// restored. See db.Options.BulkIndexRead.
+func (r *Reader) readIndexRegion(metaindexBH, indexBH blockHandle) error {
+	start := metaindexBH.offset
+	end := indexBH.offset + indexBH.length + r.trailerLen
+	if indexBH.offset < start {
+		// The blocks were not written in the expected order, and are read
+		// separately.
+		return nil
+	}
+	data := make([]byte, end-start)
+	if _, err := r.file.ReadAt(data, int64(start)); err != nil {
+		return err
+	}
+	r.file = &regionFile{File: r.file, offset: start, data: data}
+	return nil
+}
+
+// regionFile is a file with a region of its contents held in memory. Reads
+// which lie within the region are served from memory.
+type regionFile struct {
+	storage.File
+	offset uint64
+	data   []byte
+}
+
+func (f *regionFile) ReadAt(p []byte, off int64) (int, error) {
+	if start := uint64(off); start >= f.offset && start+uint64(len(p)) <= f.offset+uint64(len(f.data)) {
+		return copy(p, f.data[start-f.offset:]), nil
+	}
+	return f.File.ReadAt(p, off)
+}
+
 // NewReader returns a new table reader for the file. Closing the reader will
 // close the file.
 func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 	o = o.EnsureDefaults()
 	r := &Reader{
-		file:    f,
-		fileNum: fileNum,
-		opts:    o,
-		cache:   o.Cache,
-		compare: o.Comparer.Compare,
+		file:           f,
+		fileNum:        fileNum,
+		opts:           o,
+		cache:          o.Cache,
+		allocator:      o.CacheAllocator,
+		compare:        o.Comparer.Compare,
+		trailerLen:     blockTrailerLen,
+		verifyKeyOrder: o.VerifyBlockKeyOrder,
+		latencyStats:   o.BlockLatencyStats,
+		// A block allocated by the CacheAllocator is freed once the cache
+		// evicts it, so it cannot be retained by the reader.
+		memoizeGet: o.MemoizeGetBlock && o.CacheAllocator == nil,
 	}
 	if f == nil {
 		r.err = errors.New("pebble/table: nil file")
@@ -644,12 +1536,32 @@ func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 		r.err = err
 		return r
 	}
+	r.epoch = footer.epoch
+	r.trailerLen = footer.trailerLen
+	if o.BulkIndexRead {
+		if err := r.readIndexRegion(footer.metaindexBH, footer.indexBH); err != nil {
+			r.err = err
+			return r
+		}
+	}
 	// Read the metaindex.
-	if err := r.readMetaindex(footer.metaindexBH, o); err != nil {
+	if err := r.readMetaindex(footer.metaindexBH, footer.format, o); err != nil {
+		r.file = f
 		r.err = err
 		return r
 	}
 	r.index.bh = footer.indexBH
+	r.noCompression = r.Properties.CompressionName == db.NoCompression.String()
+	if r.file != f {
+		// The index block was read along with the metaindex. Load it now, while
+		// it is still in memory.
+		_, err := r.readIndex()
+		r.file = f
+		if err != nil {
+			r.err = err
+			return r
+		}
+	}
 
 	// index, r.err = r.readIndex()
 	// iter, _ := newBlockIter(r.compare, index)
@@ -9,13 +9,16 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/petermattis/pebble/bloom"
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/crc"
 	"github.com/petermattis/pebble/internal/datadriven"
 	"github.com/petermattis/pebble/storage"
 )
@@ -123,6 +126,291 @@ func TestReader(t *testing.T) {
 	})
 }
 
+func TestReaderFilterChecksum(t *testing.T) {
+	testCases := []struct {
+		policy      db.FilterPolicy
+		ftype       db.FilterType
+		compression db.Compression
+	}{
+		{bloom.FilterPolicy(10), db.BlockFilter, db.NoCompression},
+		{bloom.FilterPolicy(10), db.TableFilter, db.NoCompression},
+		// The key list filter is compressible, unlike a bloom filter.
+		{keyListFilterPolicy{}, db.TableFilter, db.SnappyCompression},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("%s/%s/%s", c.policy.Name(), c.ftype, c.compression), func(t *testing.T) {
+			lo := db.LevelOptions{
+				FilterPolicy:      c.policy,
+				FilterType:        c.ftype,
+				FilterCompression: c.compression,
+			}
+			opts := &db.Options{
+				Cache:                 cache.New(1 << 20),
+				Levels:                []db.LevelOptions{lo},
+				VerifyFilterChecksums: true,
+			}
+
+			fs := storage.NewMem()
+			f, err := fs.Create("sstable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, opts, lo)
+			for i := 0; i < 100; i++ {
+				if err := w.Set([]byte(fmt.Sprintf("key%05d", i)), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = fs.Open("sstable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, opts)
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			var trailer [blockTrailerLen]byte
+			if _, err := f.ReadAt(trailer[:], int64(r.filter.bh.offset+r.filter.bh.length)); err != nil {
+				t.Fatal(err)
+			}
+			if compressed := trailer[0] != noCompressionBlockType; compressed != (c.compression == db.SnappyCompression) {
+				t.Fatalf("unexpected filter block type %d", trailer[0])
+			}
+			if _, err := r.get([]byte("key00050"), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// Corrupt the cached copy of the filter block.
+			b := opts.Cache.Get(0, r.filter.bh.offset)
+			if b == nil {
+				t.Fatalf("expected filter block to be cached")
+			}
+			b[0] ^= 0xff
+
+			const expected = "filter checksum mismatch"
+			if _, err := r.get([]byte("key00050"), nil); err == nil {
+				t.Fatalf("expected %q, but found success", expected)
+			} else if !strings.Contains(err.Error(), expected) {
+				t.Fatalf("expected %q, but found %v", expected, err)
+			}
+		})
+	}
+}
+
+// keyCollector records the user key of the first key of a data block.
+type keyCollector struct {
+	key []byte
+}
+
+func (c *keyCollector) Name() string {
+	return "key"
+}
+
+func (c *keyCollector) Add(key db.InternalKey, value []byte) error {
+	if c.key == nil {
+		c.key = append([]byte(nil), key.UserKey...)
+	}
+	return nil
+}
+
+func (c *keyCollector) FinishDataBlock(dst []byte) ([]byte, error) {
+	dst = append(dst, c.key...)
+	c.key = nil
+	return dst, nil
+}
+
+// keyFilter matches the data blocks whose keyCollector property is one of keys.
+type keyFilter struct {
+	keys string
+}
+
+func (f keyFilter) Name() string {
+	return "key"
+}
+
+func (f keyFilter) Intersects(prop []byte) (bool, error) {
+	return len(prop) == 1 && strings.IndexByte(f.keys, prop[0]) >= 0, nil
+}
+
+func TestReaderBlockPropertyFilters(t *testing.T) {
+	testCases := []struct {
+		name     string
+		format   db.TableFormat
+		expected string
+		inverted string
+	}{
+		// The blocks of "e" may share a user key, and are never skipped.
+		{"pebblev1", db.TableFormatPebblev1, "c#1,1 e#3,1 e#2,1 g#4,1", "a#0,1"},
+		// The collectors are ignored for the other formats, and so are the
+		// filters.
+		{"rocksdbv2", db.TableFormatRocksDBv2, "a#0,1 c#1,1 e#3,1 e#2,1 g#4,1", ""},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			// Place every key in a data block of its own.
+			lo := db.LevelOptions{BlockSize: 10}
+			opts := &db.Options{
+				BlockPropertyCollectors: []func() db.BlockPropertyCollector{
+					func() db.BlockPropertyCollector { return &keyCollector{} },
+				},
+				Levels:      []db.LevelOptions{lo},
+				TableFormat: c.format,
+			}
+
+			fs := storage.NewMem()
+			f, err := fs.Create("sstable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, opts, lo)
+			for _, key := range []db.InternalKey{
+				db.MakeInternalKey([]byte("a"), 0, db.InternalKeyKindSet),
+				db.MakeInternalKey([]byte("c"), 1, db.InternalKeyKindSet),
+				db.MakeInternalKey([]byte("e"), 3, db.InternalKeyKindSet),
+				db.MakeInternalKey([]byte("e"), 2, db.InternalKeyKindSet),
+				db.MakeInternalKey([]byte("g"), 4, db.InternalKeyKindSet),
+			} {
+				if err := w.Add(key, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = fs.Open("sstable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, opts)
+			defer r.Close()
+
+			for _, invert := range []bool{false, true} {
+				iter := r.NewIter(nil)
+				filters := []db.BlockPropertyFilter{keyFilter{keys: "cg"}}
+				if err := iter.SetBlockPropertyFilters(filters, invert); err != nil {
+					t.Fatal(err)
+				}
+				var keys []string
+				for valid := iter.First(); valid; valid = iter.Next() {
+					keys = append(keys, iter.Key().String())
+				}
+				var reversed []string
+				for valid := iter.Last(); valid; valid = iter.Prev() {
+					reversed = append([]string{iter.Key().String()}, reversed...)
+				}
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+				expected := c.expected
+				if invert {
+					expected = c.inverted
+				}
+				if actual := strings.Join(keys, " "); expected != actual {
+					t.Fatalf("invert=%t: expected %q, but found %q", invert, expected, actual)
+				}
+				if actual := strings.Join(reversed, " "); expected != actual {
+					t.Fatalf("invert=%t: expected %q in reverse, but found %q", invert, expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderLatencyStats(t *testing.T) {
+	opts := &db.Options{
+		Cache:             cache.New(1 << 20),
+		BlockLatencyStats: true,
+	}
+	lo := db.LevelOptions{
+		BlockSize:   256,
+		Compression: db.SnappyCompression,
+	}
+	fs := storage.NewMem()
+	f, err := fs.Create("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, opts, lo)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%05d", i))
+		if err := w.Set(key, bytes.Repeat(key, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = fs.Open("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, opts)
+	defer r.Close()
+
+	scan := func(r *Reader) {
+		iter := r.NewIter(nil)
+		for valid := iter.First(); valid; valid = iter.Next() {
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first scan reads every data block from the file, and the second
+	// finds every data block in the cache.
+	scan(r)
+	stats := r.LatencyStats()
+	misses, hits := stats.CacheMiss.Count(), stats.CacheHit.Count()
+	if misses < r.Properties.NumDataBlocks {
+		t.Fatalf("expected at least %d cache misses, but found %d", r.Properties.NumDataBlocks, misses)
+	}
+	if n := stats.IOWait.Count(); n != misses {
+		t.Fatalf("expected %d file reads, but found %d", misses, n)
+	}
+
+	scan(r)
+	stats = r.LatencyStats()
+	if n := stats.CacheMiss.Count(); n != misses {
+		t.Fatalf("expected %d cache misses, but found %d", misses, n)
+	}
+	if n := stats.CacheHit.Count() - hits; n < r.Properties.NumDataBlocks {
+		t.Fatalf("expected at least %d cache hits, but found %d", r.Properties.NumDataBlocks, n)
+	}
+
+	// The latencies are not recorded unless requested.
+	f, err = fs.Open("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2 := NewReader(f, 1, &db.Options{Cache: opts.Cache})
+	defer r2.Close()
+	scan(r2)
+	scan(r2)
+	if stats := r2.LatencyStats(); stats != (LatencyStats{}) {
+		t.Fatalf("expected no latencies to be recorded, but found %+v", stats)
+	}
+
+	var h LatencyHistogram
+	for _, d := range []time.Duration{0, 999 * time.Nanosecond, time.Microsecond,
+		3 * time.Microsecond, 4 * time.Microsecond, time.Hour} {
+		h.record(d)
+	}
+	expected := [NumLatencyBuckets]uint64{0: 2, 1: 1, 2: 1, 3: 1, NumLatencyBuckets - 1: 1}
+	if h.Buckets != expected {
+		t.Fatalf("expected %v, but found %v", expected, h.Buckets)
+	}
+	if d := LatencyBucketUpperBound(2); d != 4*time.Microsecond {
+		t.Fatalf("expected 4µs, but found %s", d)
+	}
+}
+
 func buildBenchmarkTable(b *testing.B, blockSize, restartInterval int) (*Reader, [][]byte) {
 	mem := storage.NewMem()
 	f0, err := mem.Create("bench")
@@ -246,3 +534,1320 @@ func BenchmarkTableIterPrev(b *testing.B) {
 			})
 	}
 }
+
+func BenchmarkTableIterParallelScan(b *testing.B) {
+	const blockSize = 32 << 10
+
+	for _, compression := range []db.Compression{db.SnappyCompression, db.NoCompression} {
+		b.Run(fmt.Sprintf("compression=%s", compression), func(b *testing.B) {
+			mem := storage.NewMem()
+			f0, err := mem.Create("bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			w := NewWriter(f0, nil, db.LevelOptions{
+				BlockSize:   blockSize,
+				Compression: compression,
+			})
+			var ikey db.InternalKey
+			value := make([]byte, 100)
+			for i := uint64(0); i < 1e5; i++ {
+				key := make([]byte, 8)
+				binary.BigEndian.PutUint64(key, i)
+				ikey.UserKey = key
+				w.Add(ikey, value)
+			}
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+			f1, err := mem.Open("bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			// NB: the reader does not use a cache so that every block is read
+			// from disk and decompressed.
+			r := NewReader(f1, 0, nil)
+			defer r.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				it := r.NewIter(nil)
+				for pb.Next() {
+					if !it.Next() {
+						it.First()
+					}
+				}
+				if err := it.Close(); err != nil {
+					b.Fatal(err)
+				}
+			})
+		})
+	}
+}
+
+// buildBlockCapacityTable writes a table whose values are random, so that
+// its blocks are stored uncompressed even when compression is enabled, unless
+// compressible is true, in which case the values are zeroes.
+func buildBlockCapacityTable(
+	tb testing.TB, compression db.Compression, compressible bool,
+) *Reader {
+	mem := storage.NewMem()
+	f0, err := mem.Create("test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	w := NewWriter(f0, nil, db.LevelOptions{
+		BlockSize:   4 << 10,
+		Compression: compression,
+	})
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		// The values vary in size so that the blocks do too.
+		value := make([]byte, rng.Intn(1000))
+		if !compressible {
+			rng.Read(value)
+		}
+		if err := w.Set([]byte(fmt.Sprintf("%05d", i)), value); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	f1, err := mem.Open("test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return NewReader(f1, 0, nil)
+}
+
+// readDataBlocks reads each of the data blocks of r, returning the number of
+// blocks and the total capacity of the buffers which hold them.
+func readDataBlocks(r *Reader) (blocks, capacity int, err error) {
+	index, err := r.readIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+	iter, err := newBlockIter(r.compare, index)
+	if err != nil {
+		return 0, 0, err
+	}
+	for valid := iter.First(); valid; valid = iter.Next() {
+		bh, _ := decodeBlockHandle(iter.Value())
+		b, _, err := r.readBlock(bh)
+		if err != nil {
+			return 0, 0, err
+		}
+		blocks++
+		capacity += cap(b)
+	}
+	return blocks, capacity, iter.Close()
+}
+
+func TestReaderUncompressedBlockCapacity(t *testing.T) {
+	for _, compression := range []db.Compression{db.SnappyCompression, db.NoCompression} {
+		t.Run(compression.String(), func(t *testing.T) {
+			r := buildBlockCapacityTable(t, compression, false /* compressible */)
+			defer r.Close()
+
+			// Read the blocks twice, so that the second pass reuses pooled
+			// buffers sized for the largest block.
+			for i := 0; i < 2; i++ {
+				blocks, capacity, err := readDataBlocks(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The blocks of an uncompressed table bypass the pool and are
+				// read directly into a buffer which also holds their trailer.
+				// Other blocks are copied out of a pooled buffer.
+				size := int(r.Properties.DataSize)
+				if compression != db.NoCompression {
+					size -= blocks * blockTrailerLen
+				}
+				if capacity != size {
+					t.Fatalf("blocks retain %d bytes, expected %d", capacity, size)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReaderReadBlocks reads each of the data blocks of a table from disk
+// per op. Only the compressed blocks, which are read when the values are
+// compressible and the table is compressed, are read into pooled buffers.
+func BenchmarkReaderReadBlocks(b *testing.B) {
+	for _, compressible := range []bool{false, true} {
+		for _, compression := range []db.Compression{db.SnappyCompression, db.NoCompression} {
+			b.Run(fmt.Sprintf("compressible=%t/compression=%s", compressible, compression), func(b *testing.B) {
+				r := buildBlockCapacityTable(b, compression, compressible)
+				defer r.Close()
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				var blocks, capacity int
+				for i := 0; i < b.N; i++ {
+					n, c, err := readDataBlocks(r)
+					if err != nil {
+						b.Fatal(err)
+					}
+					blocks += n
+					capacity += c
+				}
+				b.ReportMetric(float64(capacity)/float64(blocks), "retained-B/block")
+			})
+		}
+	}
+}
+
+func TestReaderRecoverScan(t *testing.T) {
+	const numKeys = 1000
+	fs := storage.NewMem()
+	f, err := fs.Create("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{
+		BlockSize:   256,
+		Compression: db.SnappyCompression,
+	})
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("%05d", i))
+		if err := w.Set(key, bytes.Repeat(key, 3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fs.Open("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer, err := readFooter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, stat.Size())
+	if _, err := f.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	indexOffset := int(footer.indexBH.offset)
+	testCases := []struct {
+		name string
+		// corrupt lists the offsets of the bytes to corrupt.
+		corrupt []int
+		// missing indicates that the keys in a data block are expected to be lost.
+		missing bool
+	}{
+		{"index", []int{indexOffset, indexOffset + 10}, false},
+		{"index+footer", []int{indexOffset, len(data) - 1}, false},
+		{"index+data", []int{indexOffset, indexOffset / 2}, true},
+		{"first-block", []int{indexOffset, 0}, true},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			b := append([]byte(nil), data...)
+			for _, offset := range c.corrupt {
+				b[offset] ^= 0xff
+			}
+			f, err := fs.Create(c.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(b); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if f, err = fs.Open(c.name); err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			defer r.Close()
+
+			if r.err == nil {
+				iter := r.NewIter(nil)
+				for valid := iter.First(); valid; valid = iter.Next() {
+				}
+				if err := iter.Close(); err == nil {
+					t.Fatalf("expected iteration over a corrupt index to fail")
+				}
+			}
+
+			// The recovered keys are expected to be the keys written, in order, with
+			// at most one contiguous gap for the keys of a corrupt data block.
+			var keys []int
+			skipped, err := r.RecoverScan(func(key db.InternalKey, value []byte) error {
+				i, err := strconv.Atoi(string(key.UserKey))
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(value, bytes.Repeat(key.UserKey, 3)) {
+					return fmt.Errorf("%s: unexpected value %q", key.UserKey, value)
+				}
+				keys = append(keys, i)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			gaps, lost := 0, numKeys-len(keys)
+			for j, next := 0, 0; j < len(keys); j++ {
+				if keys[j] < next {
+					t.Fatalf("expected key %05d to follow key %05d", keys[j], next-1)
+				} else if keys[j] > next {
+					gaps++
+				}
+				next = keys[j] + 1
+			}
+			if len(keys) > 0 && keys[len(keys)-1] != numKeys-1 {
+				gaps++
+			}
+			if !c.missing {
+				if lost != 0 {
+					t.Fatalf("expected %d keys, but found %d", numKeys, len(keys))
+				}
+				if skipped != 0 && r.err == nil {
+					t.Fatalf("expected no bytes to be skipped, but found %d", skipped)
+				}
+				return
+			}
+			if lost == 0 || lost > 50 || gaps > 1 {
+				t.Fatalf("expected a single block of keys to be lost, but lost %d keys in %d gaps",
+					lost, gaps)
+			}
+			if skipped == 0 {
+				t.Fatalf("expected bytes to be skipped")
+			}
+		})
+	}
+
+	r := NewReader(nil, 0, nil)
+	if _, err := r.RecoverScan(func(db.InternalKey, []byte) error { return nil }); err == nil {
+		t.Fatalf("expected an error for a nil file")
+	}
+}
+
+func TestReaderMaxIndexAndFilterMemory(t *testing.T) {
+	lo := db.LevelOptions{
+		BlockSize:    256,
+		FilterPolicy: bloom.FilterPolicy(10),
+		FilterType:   db.TableFilter,
+	}
+	opts := (&db.Options{
+		Levels:                  []db.LevelOptions{lo},
+		MaxIndexAndFilterMemory: 16 << 10,
+	}).EnsureDefaults()
+	pinned := opts.PinnedIndexAndFilterMemory()
+
+	const numTables, numKeys = 20, 500
+	fs := storage.NewMem()
+	var readers []*Reader
+	for i := 0; i < numTables; i++ {
+		name := fmt.Sprintf("%06d.sst", i)
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, opts, lo)
+		for j := 0; j < numKeys; j++ {
+			if err := w.Set([]byte(fmt.Sprintf("%05d", j)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if f, err = fs.Open(name); err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, NewReader(f, uint64(i), opts))
+	}
+
+	// The index and filter blocks of all the tables don't fit in the budget, so
+	// blocks are unpinned and reloaded as the tables are accessed.
+	var total uint64
+	for _, r := range readers {
+		total += r.Properties.IndexSize + r.Properties.FilterSize
+	}
+	if total <= uint64(pinned.MaxSize()) {
+		t.Fatalf("expected the index and filter blocks (%d bytes) to exceed the budget", total)
+	}
+	for pass := 0; pass < 2; pass++ {
+		for _, r := range readers {
+			for j := 0; j < numKeys; j += 50 {
+				if _, err := r.get([]byte(fmt.Sprintf("%05d", j)), nil); err != nil {
+					t.Fatal(err)
+				}
+				if n := pinned.Size(); n == 0 || n > pinned.MaxSize() {
+					t.Fatalf("expected between 1 and %d bytes pinned, but found %d", pinned.MaxSize(), n)
+				}
+			}
+		}
+	}
+
+	// Closing the readers returns their pinned blocks to the budget.
+	for _, r := range readers {
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := pinned.Size(); n != 0 {
+		t.Fatalf("expected no bytes pinned, but found %d", n)
+	}
+}
+
+func TestReaderPinnedBlocksNotCached(t *testing.T) {
+	lo := db.LevelOptions{
+		FilterPolicy: bloom.FilterPolicy(10),
+		FilterType:   db.TableFilter,
+	}
+	opts := (&db.Options{
+		Cache:                   cache.New(1 << 20),
+		Levels:                  []db.LevelOptions{lo},
+		MaxIndexAndFilterMemory: 1 << 20,
+	}).EnsureDefaults()
+
+	fs := storage.NewMem()
+	f, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, opts, lo)
+	for i := 0; i < 1000; i++ {
+		if err := w.Set([]byte(fmt.Sprintf("%05d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = fs.Open("test"); err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, opts)
+	defer r.Close()
+
+	// The index and filter blocks are pinned rather than cached.
+	size := opts.Cache.Size()
+	if _, err := r.readIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.readFilter(); err != nil {
+		t.Fatal(err)
+	}
+	if n := opts.PinnedIndexAndFilterMemory().Size(); n == 0 {
+		t.Fatalf("expected the index and filter blocks to be pinned")
+	}
+	if n := opts.Cache.Size(); n != size {
+		t.Fatalf("expected the cache size to remain %d, but found %d", size, n)
+	}
+}
+
+// countingFile counts the calls to ReadAt.
+type countingFile struct {
+	storage.File
+	reads int
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reads++
+	return f.File.ReadAt(p, off)
+}
+
+func TestReaderBulkIndexRead(t *testing.T) {
+	lo := db.LevelOptions{
+		FilterPolicy: bloom.FilterPolicy(10),
+		FilterType:   db.TableFilter,
+	}
+	fs := storage.NewMem()
+	f, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, lo)
+	for i := 0; i < 1000; i++ {
+		if err := w.Set([]byte(fmt.Sprintf("%05d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the table reads the footer, metaindex, properties and filter
+	// blocks, and the index block is read on first use. A bulk index read
+	// reads the metaindex and index blocks together, and loads the index block
+	// during the open.
+	testCases := []struct {
+		bulkIndexRead bool
+		openReads     int
+		indexReads    int
+	}{
+		{false, 4, 1},
+		{true, 4, 0},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprint(c.bulkIndexRead), func(t *testing.T) {
+			opts := &db.Options{
+				BulkIndexRead: c.bulkIndexRead,
+				Cache:         cache.New(1 << 20),
+				Levels:        []db.LevelOptions{lo},
+			}
+			f, err := fs.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cf := &countingFile{File: f}
+			r := NewReader(cf, 0, opts)
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if r.file != cf {
+				t.Fatalf("expected the reader to read from the file after the open")
+			}
+			if c.openReads != cf.reads {
+				t.Fatalf("expected %d reads during the open, but found %d", c.openReads, cf.reads)
+			}
+			cf.reads = 0
+			if _, err := r.readIndex(); err != nil {
+				t.Fatal(err)
+			}
+			if c.indexReads != cf.reads {
+				t.Fatalf("expected %d reads of the index block, but found %d", c.indexReads, cf.reads)
+			}
+			for i := 0; i < 1000; i += 100 {
+				key := []byte(fmt.Sprintf("%05d", i))
+				if _, err := r.get(key, nil); err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderMayContainValue(t *testing.T) {
+	lo := db.LevelOptions{
+		ValueFilterPolicy: bloom.FilterPolicy(10),
+	}
+	fs := storage.NewMem()
+	f, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, lo)
+	const n = 1000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%05d", i))
+		if err := w.Set(key, []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, &db.Options{Levels: []db.LevelOptions{lo}})
+	defer r.Close()
+
+	for i := 0; i < n; i++ {
+		if value := fmt.Sprintf("value-%d", i); !r.MayContainValue([]byte(value)) {
+			t.Fatalf("expected the table to contain %s", value)
+		}
+	}
+	// The keys are not added to the value filter. A 10 bits per key bloom
+	// filter has a false positive rate of about 1%.
+	var falsePositives int
+	for i := 0; i < 10*n; i++ {
+		if r.MayContainValue([]byte(fmt.Sprintf("absent-%d", i))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > n/5 {
+		t.Fatalf("expected at most %d false positives, but found %d", n/5, falsePositives)
+	}
+
+	// A reader which is not configured with the value filter policy cannot
+	// rule out any value.
+	f, err = fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2 := NewReader(f, 0, nil)
+	defer r2.Close()
+	if !r2.MayContainValue([]byte("absent-0")) {
+		t.Fatalf("expected a reader without a value filter to return true")
+	}
+}
+
+func TestReaderUnknownKeyKind(t *testing.T) {
+	fs := storage.NewMem()
+	f, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{
+		BlockSize:   64,
+		Compression: db.NoCompression,
+	})
+	// Kind 7 is a RocksDB SingleDelete, which pebble does not support.
+	const numKeys, badKey = 100, 50
+	for i := 0; i < numKeys; i++ {
+		kind := db.InternalKeyKind(db.InternalKeyKindSet)
+		if i == badKey {
+			kind = db.InternalKeyKind(7)
+		}
+		key := db.MakeInternalKey([]byte(fmt.Sprintf("%03d", i)), 0, kind)
+		if err := w.Add(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+
+	const expectedErr = `pebble/table: invalid table (unknown internal key kind 7 for key "050")`
+	checkErr := func(err error) {
+		t.Helper()
+		if err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected error %q, but found %v", expectedErr, err)
+		}
+	}
+
+	iter := r.NewIter(nil)
+	var n int
+	for valid := iter.First(); valid; valid = iter.Next() {
+		n++
+	}
+	if n != badKey {
+		t.Fatalf("expected %d keys before the error, but found %d", badKey, n)
+	}
+	checkErr(iter.Error())
+	if iter.Valid() || iter.Next() || iter.Prev() {
+		t.Fatalf("expected an invalid iterator after an error")
+	}
+	iter.Close()
+
+	iter = r.NewIter(nil)
+	n = 0
+	for valid := iter.Last(); valid; valid = iter.Prev() {
+		n++
+	}
+	if n != numKeys-badKey-1 {
+		t.Fatalf("expected %d keys before the error, but found %d", numKeys-badKey-1, n)
+	}
+	checkErr(iter.Error())
+	iter.Close()
+
+	iter = r.NewIter(nil)
+	if iter.SeekGE([]byte("050")) {
+		t.Fatalf("expected SeekGE to fail")
+	}
+	checkErr(iter.Error())
+	iter.Close()
+
+	iter = r.NewIter(nil)
+	if !iter.SeekGE([]byte("049")) || string(iter.Key().UserKey) != "049" {
+		t.Fatalf("expected SeekGE to find 049")
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.get([]byte("050"), nil)
+	checkErr(err)
+	if _, err := r.get([]byte("051"), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderGetValueLen(t *testing.T) {
+	for _, ftype := range []db.FilterType{db.BlockFilter, db.TableFilter} {
+		t.Run(ftype.String(), func(t *testing.T) {
+			fs := storage.NewMem()
+			f, err := fs.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, nil, db.LevelOptions{
+				BlockSize:    256,
+				FilterPolicy: bloom.FilterPolicy(10),
+				FilterType:   ftype,
+			})
+			const n = 1000
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprintf("%04d", i))
+				switch i % 3 {
+				case 0:
+					err = w.Set(key, bytes.Repeat([]byte("x"), i))
+				case 1:
+					err = w.Merge(key, bytes.Repeat([]byte("y"), i))
+				case 2:
+					err = w.Delete(key)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f, err = fs.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, &db.Options{
+				Levels: []db.LevelOptions{{
+					FilterPolicy: bloom.FilterPolicy(10),
+					FilterType:   ftype,
+				}},
+			})
+			defer r.Close()
+
+			for i := 0; i < n; i++ {
+				key := fmt.Sprintf("%04d", i)
+				length, exists, err := r.GetValueLen([]byte(key))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i%3 == 2 {
+					if exists {
+						t.Fatalf("%s: expected a deleted key to not exist", key)
+					}
+				} else if !exists || length != i {
+					t.Fatalf("%s: expected length %d, but found %d (exists=%t)", key, i, length, exists)
+				}
+			}
+			for _, key := range []string{"", "0000a", "9999"} {
+				if _, exists, err := r.GetValueLen([]byte(key)); err != nil || exists {
+					t.Fatalf("%q: expected a missing key, but found exists=%t (%v)", key, exists, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderMemoizeGetBlock(t *testing.T) {
+	fs := storage.NewMem()
+	f, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{BlockSize: 256})
+	// The odd keys are missing from the table.
+	const n = 1000
+	for i := 0; i < n; i += 2 {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := w.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf := &offsetRecordingFile{File: f, reads: make(map[int64]int)}
+	r := NewReader(rf, 0, &db.Options{
+		MemoizeGetBlock: true,
+	})
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	// blockOf returns the handle of the data block which may contain key.
+	index, err := r.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockOf := func(key []byte) (blockHandle, bool) {
+		i, err := newBlockIter(r.compare, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !i.SeekGE(key) {
+			return blockHandle{}, false
+		}
+		bh, _ := decodeBlockHandle(i.Value())
+		return bh, true
+	}
+
+	keys := make([]int, n+2)
+	for i := range keys {
+		keys[i] = i
+	}
+	check := func() {
+		for _, i := range keys {
+			key := []byte(fmt.Sprintf("%04d", i))
+			v, err := r.get(key, nil)
+			if i%2 == 1 || i >= n {
+				if err != db.ErrNotFound {
+					t.Fatalf("%s: expected not found, but found %v", key, err)
+				}
+			} else if err != nil || !bytes.Equal(v, key) {
+				t.Fatalf("%s: expected %s, but found %s (%v)", key, key, v, err)
+			}
+			if bh, ok := blockOf(key); ok {
+				m := (*memoizedBlock)(r.lastGetBlock)
+				if m == nil || m.bh != bh {
+					t.Fatalf("%s: expected the block at %d to be memoized", key, bh.offset)
+				}
+			}
+		}
+	}
+
+	// The table has no block cache, so every get landing in a data block
+	// which is not memoized reads the block from the file. The sequential
+	// gets read each data block once.
+	check()
+	dataBlocks := make(map[int64]bool)
+	for _, i := range keys {
+		if bh, ok := blockOf([]byte(fmt.Sprintf("%04d", i))); ok {
+			dataBlocks[int64(bh.offset)] = true
+		}
+	}
+	if len(dataBlocks) < 2 {
+		t.Fatalf("expected several data blocks, but found %d", len(dataBlocks))
+	}
+	for off := range dataBlocks {
+		if reads := rf.reads[off]; reads != 1 {
+			t.Fatalf("expected the data block at %d to be read once, but found %d reads", off, reads)
+		}
+	}
+
+	// Gets in a random order replace the memoized block as they move between
+	// data blocks.
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	rng.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	check()
+}
+
+func BenchmarkReaderSequentialGet(b *testing.B) {
+	for _, memoize := range []bool{false, true} {
+		b.Run(fmt.Sprintf("memoize=%t", memoize), func(b *testing.B) {
+			mem := storage.NewMem()
+			f, err := mem.Create("bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			w := NewWriter(f, nil, db.LevelOptions{BlockSize: 32 << 10})
+			var keys [][]byte
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("%08d", i))
+				keys = append(keys, key)
+				if err := w.Set(key, key); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+			f, err = mem.Open("bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			// Without a block cache, a get which does not find its data block
+			// memoized reads and decompresses the block.
+			r := NewReader(f, 0, &db.Options{
+				MemoizeGetBlock: memoize,
+			})
+			defer r.Close()
+			if r.Properties.NumDataBlocks != 1 {
+				b.Fatalf("expected a single data block, but found %d", r.Properties.NumDataBlocks)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.get(keys[i%len(keys)], nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderComparerMismatch(t *testing.T) {
+	// A comparer which orders the keys like the default comparer, but under a
+	// different name.
+	comparer := *db.DefaultComparer
+	comparer.Name = "test.comparer"
+
+	fs := storage.NewMem()
+	f, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, &db.Options{Comparer: &comparer}, db.LevelOptions{})
+	for i := 0; i < 10; i++ {
+		if err := w.Set([]byte(fmt.Sprint(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(o *db.Options) *Reader {
+		f, err := fs.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewReader(f, 0, o)
+	}
+
+	r := open(nil)
+	const expected = "pebble/table: comparer mismatch: table uses test.comparer, " +
+		"options use leveldb.BytewiseComparator"
+	if _, err := r.get([]byte("5"), nil); err == nil || err.Error() != expected {
+		t.Fatalf("expected %q, but found %v", expected, err)
+	}
+	r.Close()
+
+	for _, o := range []*db.Options{
+		{Comparer: &comparer},
+		{IgnoreComparerMismatch: true},
+	} {
+		r := open(o)
+		if _, err := r.get([]byte("5"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// falsePositiveTableFilterPolicy is a filter policy whose table filters
+// cannot rule out any key, as if every lookup was a false positive.
+type falsePositiveTableFilterPolicy struct {
+	db.FilterPolicy
+}
+
+func (p falsePositiveTableFilterPolicy) MayContain(ftype db.FilterType, f, key []byte) bool {
+	if ftype == db.TableFilter {
+		return true
+	}
+	return p.FilterPolicy.MayContain(ftype, f, key)
+}
+
+func TestReaderBlockInternalFilter(t *testing.T) {
+	var comparisons int
+	comparer := *db.DefaultComparer
+	comparer.Compare = func(a, b []byte) int {
+		comparisons++
+		return db.DefaultComparer.Compare(a, b)
+	}
+	policy := falsePositiveTableFilterPolicy{bloom.FilterPolicy(10)}
+
+	var counts [2]int
+	for j, blockInternalFilter := range []bool{false, true} {
+		lo := db.LevelOptions{
+			FilterPolicy:        policy,
+			BlockInternalFilter: blockInternalFilter,
+		}
+		fs := storage.NewMem()
+		f, err := fs.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, &db.Options{Comparer: &comparer}, lo)
+		for i := 0; i < 2000; i += 2 {
+			key := []byte(fmt.Sprintf("%05d", i))
+			if err := w.Set(key, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = fs.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, 0, &db.Options{
+			Comparer: &comparer,
+			Levels:   []db.LevelOptions{lo},
+		})
+		if r.Properties.BlockInternalFilter != blockInternalFilter {
+			t.Fatalf("expected %t, but found %t", blockInternalFilter, r.Properties.BlockInternalFilter)
+		}
+
+		// The blocks are readable, with or without the in-block filters.
+		var n int
+		iter := r.NewIter(nil)
+		for valid := iter.First(); valid; valid = iter.Next() {
+			if key := fmt.Sprintf("%05d", 2*n); string(iter.Key().UserKey) != key || string(iter.Value()) != key {
+				t.Fatalf("expected %s, but found %s:%s", key, iter.Key().UserKey, iter.Value())
+			}
+			n++
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1000 {
+			t.Fatalf("expected 1000 keys, but found %d", n)
+		}
+
+		for i := 0; i < 2000; i += 2 {
+			key := fmt.Sprintf("%05d", i)
+			if v, err := r.get([]byte(key), nil); err != nil || string(v) != key {
+				t.Fatalf("%s: expected %s, but found %s (%v)", key, key, v, err)
+			}
+		}
+
+		// Count the comparisons made looking up the absent keys, which the table
+		// filter does not rule out.
+		comparisons = 0
+		for i := 1; i < 2000; i += 2 {
+			key := fmt.Sprintf("%05d", i)
+			if _, err := r.get([]byte(key), nil); err != db.ErrNotFound {
+				t.Fatalf("%s: expected not found, but found %v", key, err)
+			}
+		}
+		counts[j] = comparisons
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Logf("comparisons: %d without in-block filters, %d with", counts[0], counts[1])
+	if counts[1]*3/2 > counts[0] {
+		t.Fatalf("expected in-block filters to reduce comparisons: %d vs %d", counts[1], counts[0])
+	}
+}
+
+func TestReaderMetaBlocks(t *testing.T) {
+	for _, ftype := range []db.FilterType{db.BlockFilter, db.TableFilter} {
+		t.Run(ftype.String(), func(t *testing.T) {
+			lo := db.LevelOptions{
+				FilterPolicy: bloom.FilterPolicy(10),
+				FilterType:   ftype,
+			}
+			fs := storage.NewMem()
+			f, err := fs.Create("sstable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, nil, lo)
+			if err := w.Set([]byte("a"), []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.DeleteRange([]byte("b"), []byte("c")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if f, err = fs.Open("sstable"); err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, &db.Options{Levels: []db.LevelOptions{lo}})
+			defer r.Close()
+
+			var names []string
+			meta := r.MetaBlocks()
+			for name := range meta {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			filterName := "filter.rocksdb.BuiltinBloomFilter"
+			if ftype == db.TableFilter {
+				filterName = "full" + filterName
+			}
+			expected := []string{filterName, metaRangeDelName, metaRangeDelV2Name, metaPropertiesName}
+			sort.Strings(expected)
+			if e, f := strings.Join(expected, " "), strings.Join(names, " "); e != f {
+				t.Fatalf("expected %s, but found %s", e, f)
+			}
+
+			// The filter block directly follows the data blocks.
+			fh := meta[filterName]
+			if e := (BlockHandle{r.Properties.DataSize, r.Properties.FilterSize}); e != fh {
+				t.Fatalf("expected filter block handle %+v, but found %+v", e, fh)
+			}
+		})
+	}
+}
+
+func TestReaderDisableChecksums(t *testing.T) {
+	fs := storage.NewMem()
+	f, err := fs.Create("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{
+		BlockSize:   100,
+		Compression: db.NoCompression,
+	})
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		if err := w.Set(key, bytes.Repeat([]byte("v"), 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the value of the first key, leaving the block decodable.
+	f, err = fs.Open("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, stat.Size())
+	if _, err := f.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	i := bytes.Index(data, []byte("vvvv"))
+	data[i] = 'x'
+	if f, err = fs.Create("sstable"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The readers share a block cache. The unverified read comes first, and
+	// must not populate the cache with the corrupt block for the verified reads
+	// which follow it. The last unverified read is served from the cache.
+	blockCache := cache.New(1 << 20)
+	testCases := []struct {
+		opts     *db.IterOptions
+		expected string
+	}{
+		{&db.IterOptions{DisableChecksums: true}, ""},
+		{nil, "pebble/table: invalid table (checksum mismatch)"},
+		{&db.IterOptions{DisableChecksums: false}, "pebble/table: invalid table (checksum mismatch)"},
+		{&db.IterOptions{DisableChecksums: true}, ""},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("disable=%t", c.opts.GetDisableChecksums()), func(t *testing.T) {
+			f, err := fs.Open("sstable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, &db.Options{Cache: blockCache})
+			defer r.Close()
+
+			iter := r.NewIter(c.opts)
+			var n int
+			for valid := iter.First(); valid; valid = iter.Next() {
+				n++
+			}
+			err = iter.Close()
+			if c.expected != "" {
+				if err == nil || err.Error() != c.expected {
+					t.Fatalf("expected %q, but found %v", c.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 100 {
+				t.Fatalf("expected 100 keys, but found %d", n)
+			}
+		})
+	}
+
+	// The corrupt block is the first data block, which is only cached as an
+	// unverified block.
+	if b := blockCache.Get(0, 0); b != nil {
+		t.Fatalf("expected the corrupt block not to be cached as a verified block")
+	}
+	if b := blockCache.Get(0, unverifiedBlockFlag); b == nil {
+		t.Fatalf("expected the corrupt block to be cached as an unverified block")
+	}
+}
+
+func BenchmarkTableIterScanChecksums(b *testing.B) {
+	mem := storage.NewMem()
+	f0, err := mem.Create("bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := NewWriter(f0, nil, db.LevelOptions{
+		BlockSize:   32 << 10,
+		Compression: db.NoCompression,
+	})
+	var ikey db.InternalKey
+	value := make([]byte, 100)
+	for i := uint64(0); i < 1e5; i++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, i)
+		ikey.UserKey = key
+		w.Add(ikey, value)
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+	f1, err := mem.Open("bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	// The table is read without a block cache so that every block is read, and
+	// its checksum verified, on every scan.
+	r := NewReader(f1, 0, nil)
+	defer r.Close()
+
+	for _, disable := range []bool{false, true} {
+		b.Run(fmt.Sprintf("disable=%t", disable), func(b *testing.B) {
+			stat, err := f1.Stat()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(stat.Size())
+			for i := 0; i < b.N; i++ {
+				it := r.NewIter(&db.IterOptions{DisableChecksums: disable})
+				for valid := it.First(); valid; valid = it.Next() {
+				}
+				if err := it.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderVerifyBlockKeyOrderIndex(t *testing.T) {
+	fs := storage.NewMem()
+	f, err := fs.Create("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{
+		BlockSize:   64,
+		Compression: db.NoCompression,
+	})
+	const numKeys = 100
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		if err := w.Set(key, bytes.Repeat(key, 5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = fs.Open("sstable"); err != nil {
+		t.Fatal(err)
+	}
+	footer, err := readFooter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, stat.Size())
+	if _, err := f.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Rewrite the index block with two adjacent entries swapped. Every index
+	// entry is a restart point, so the rewritten block has the same size.
+	bh := footer.indexBH
+	iter, err := newBlockIter(bytes.Compare, data[bh.offset:bh.offset+bh.length])
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		key   db.InternalKey
+		value []byte
+	}
+	var entries []entry
+	for valid := iter.First(); valid; valid = iter.Next() {
+		entries = append(entries, entry{iter.Key().Clone(), append([]byte(nil), iter.Value()...)})
+	}
+	if len(entries) < 4 {
+		t.Fatalf("expected at least 4 data blocks, but found %d", len(entries))
+	}
+	const swap = 2
+	entries[swap], entries[swap+1] = entries[swap+1], entries[swap]
+	bw := blockWriter{restartInterval: 1}
+	for _, e := range entries {
+		bw.add(e.key, e.value)
+	}
+	index := bw.finish()
+	if uint64(len(index)) != bh.length {
+		t.Fatalf("expected an index block of %d bytes, but found %d", bh.length, len(index))
+	}
+	copy(data[bh.offset:], index)
+	checksum := crc.New(data[bh.offset : bh.offset+bh.length+1]).Value()
+	binary.LittleEndian.PutUint32(data[bh.offset+bh.length+1:], checksum)
+	if f, err = fs.Create("sstable"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reverse := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reverse=%t", reverse), func(t *testing.T) {
+			f, err := fs.Open("sstable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, &db.Options{VerifyBlockKeyOrder: true})
+			defer r.Close()
+
+			iter := r.NewIter(nil)
+			var n int
+			if reverse {
+				for valid := iter.Last(); valid; valid = iter.Prev() {
+					n++
+				}
+			} else {
+				for valid := iter.First(); valid; valid = iter.Next() {
+					n++
+				}
+			}
+			if n == numKeys {
+				t.Fatalf("expected iteration to stop at the misordered index entries")
+			}
+			const expected = "out of order"
+			if err := iter.Error(); err == nil || !strings.Contains(err.Error(), expected) {
+				t.Fatalf("expected %q, but found %v", expected, err)
+			}
+			if err := iter.Close(); err == nil || !strings.Contains(err.Error(), expected) {
+				t.Fatalf("expected %q, but found %v", expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/rangedel"
+)
+
+// SeqNumIterator iterates over the user-visible contents of a table as of a
+// read sequence number. It is the single-table analog of iterating over a DB
+// snapshot: only records with a sequence number less than or equal to the read
+// sequence number are considered, and deletions, range deletions and merges
+// are resolved as they would be at that sequence number. Note that records in
+// other tables are not considered, so a key whose newest visible record is a
+// merge operand is returned with the merged value of the operands in this
+// table.
+//
+// Reverse iteration is implemented by repositioning the underlying iterator
+// at every user key and is slower than forward iteration.
+type SeqNumIterator struct {
+	cmp   db.Compare
+	merge db.Merge
+	// seqNum is the read sequence number. Records with larger sequence numbers
+	// are invisible.
+	seqNum       uint64
+	iter         *Iterator
+	iterValid    bool
+	rangeDelIter *blockIter
+	key          []byte
+	value        []byte
+	valid        bool
+	err          error
+}
+
+// NewIterAtSeqNum returns an iterator over the user-visible contents of the
+// table as of the specified sequence number. See SeqNumIterator.
+func (r *Reader) NewIterAtSeqNum(seqNum uint64) *SeqNumIterator {
+	i := &SeqNumIterator{
+		cmp:    r.compare,
+		merge:  r.opts.Merger.Merge,
+		seqNum: seqNum,
+		iter:   r.NewIter(nil),
+	}
+	if r.err == nil {
+		i.rangeDelIter = r.NewRangeDelIter(nil)
+	}
+	return i
+}
+
+// deleted returns true if the record is covered by a range tombstone which is
+// visible at the read sequence number.
+func (i *SeqNumIterator) deleted(key db.InternalKey) bool {
+	if i.rangeDelIter == nil {
+		return false
+	}
+	t := rangedel.Get(i.cmp, i.rangeDelIter, key.UserKey, i.seqNum+1)
+	return t.Deletes(key.SeqNum())
+}
+
+// resolve determines the visible value of the user key at the current
+// position of the underlying iterator, which must be at the newest record for
+// the user key. Returns false if the user key has no visible value. The
+// underlying iterator is left positioned at a record for the user key or at
+// the start of the next user key.
+func (i *SeqNumIterator) resolve() bool {
+	i.key = append(i.key[:0], i.iter.Key().UserKey...)
+	merging := false
+	for ; i.iterValid; i.iterValid = i.iter.Next() {
+		key := i.iter.Key()
+		if i.cmp(i.key, key.UserKey) != 0 {
+			break
+		}
+		if key.SeqNum() > i.seqNum {
+			continue
+		}
+		if i.deleted(key) {
+			return merging
+		}
+		switch key.Kind() {
+		case db.InternalKeyKindDelete:
+			return merging
+
+		case db.InternalKeyKindSet:
+			if merging {
+				i.value = i.merge(i.key, i.value, i.iter.Value(), nil)
+			} else {
+				i.value = append(i.value[:0], i.iter.Value()...)
+			}
+			return true
+
+		case db.InternalKeyKindMerge:
+			if merging {
+				i.value = i.merge(i.key, i.value, i.iter.Value(), nil)
+			} else {
+				i.value = append(i.value[:0], i.iter.Value()...)
+				merging = true
+			}
+
+		default:
+			i.err = fmt.Errorf("pebble/table: invalid internal key kind: %d", key.Kind())
+			i.iterValid = false
+			return false
+		}
+	}
+	return merging
+}
+
+// skipUserKey advances the underlying iterator past the records for the
+// current user key.
+func (i *SeqNumIterator) skipUserKey() {
+	for i.iterValid && i.cmp(i.key, i.iter.Key().UserKey) == 0 {
+		i.iterValid = i.iter.Next()
+	}
+}
+
+func (i *SeqNumIterator) findNextEntry() bool {
+	for i.iterValid {
+		if i.resolve() {
+			i.valid = true
+			return true
+		}
+		i.skipUserKey()
+	}
+	i.valid = false
+	return false
+}
+
+func (i *SeqNumIterator) findPrevEntry() bool {
+	for i.iterValid {
+		// Position the underlying iterator at the newest record for the user key
+		// before resolving it.
+		i.key = append(i.key[:0], i.iter.Key().UserKey...)
+		if i.iterValid = i.iter.SeekGE(i.key); !i.iterValid {
+			break
+		}
+		if i.resolve() {
+			i.valid = true
+			return true
+		}
+		if i.err != nil {
+			break
+		}
+		i.iterValid = i.iter.SeekLT(i.key)
+	}
+	i.valid = false
+	return false
+}
+
+// SeekGE moves the iterator to the first visible key which is greater than or
+// equal to the given key.
+func (i *SeqNumIterator) SeekGE(key []byte) bool {
+	if i.err != nil {
+		return false
+	}
+	i.iterValid = i.iter.SeekGE(key)
+	return i.findNextEntry()
+}
+
+// SeekLT moves the iterator to the last visible key which is less than the
+// given key.
+func (i *SeqNumIterator) SeekLT(key []byte) bool {
+	if i.err != nil {
+		return false
+	}
+	i.iterValid = i.iter.SeekLT(key)
+	return i.findPrevEntry()
+}
+
+// First moves the iterator to the first visible key.
+func (i *SeqNumIterator) First() bool {
+	if i.err != nil {
+		return false
+	}
+	i.iterValid = i.iter.First()
+	return i.findNextEntry()
+}
+
+// Last moves the iterator to the last visible key.
+func (i *SeqNumIterator) Last() bool {
+	if i.err != nil {
+		return false
+	}
+	i.iterValid = i.iter.Last()
+	return i.findPrevEntry()
+}
+
+// Next moves the iterator to the next visible key. It returns whether the
+// iterator is exhausted.
+func (i *SeqNumIterator) Next() bool {
+	if i.err != nil || !i.valid {
+		return false
+	}
+	i.skipUserKey()
+	return i.findNextEntry()
+}
+
+// Prev moves the iterator to the previous visible key. It returns whether the
+// iterator is exhausted.
+func (i *SeqNumIterator) Prev() bool {
+	if i.err != nil || !i.valid {
+		return false
+	}
+	i.iterValid = i.iter.SeekLT(i.key)
+	return i.findPrevEntry()
+}
+
+// Key returns the user key at the current position.
+func (i *SeqNumIterator) Key() []byte {
+	return i.key
+}
+
+// Value returns the resolved value at the current position.
+func (i *SeqNumIterator) Value() []byte {
+	return i.value
+}
+
+// Valid returns true if the iterator is positioned at a valid key/value pair
+// and false otherwise.
+func (i *SeqNumIterator) Valid() bool {
+	return i.valid
+}
+
+// Error returns any accumulated error.
+func (i *SeqNumIterator) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.iter.Error()
+}
+
+// Close closes the iterator and returns any accumulated error.
+func (i *SeqNumIterator) Close() error {
+	err := i.iter.Close()
+	if i.err != nil {
+		err = i.err
+	}
+	if i.rangeDelIter != nil {
+		if err1 := i.rangeDelIter.Close(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestIterAtSeqNum(t *testing.T) {
+	fs := storage.NewMem()
+	f0, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, nil, db.LevelOptions{})
+	for _, r := range []string{
+		"a.SET.5:a5",
+		"a.SET.2:a2",
+		"b.DEL.4:",
+		"b.SET.1:b1",
+		"c.MERGE.6:c6",
+		"c.MERGE.3:c3",
+		"c.SET.1:c1",
+		"d.SET.2:d2",
+		"e.SET.9:e9",
+		"e.SET.3:e3",
+		"f.SET.3:f3",
+		"e.RANGEDEL.7:g",
+	} {
+		j := strings.Index(r, ":")
+		if err := w.Add(db.ParseInternalKey(r[:j]), []byte(r[j+1:])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, 0, nil)
+	defer r.Close()
+
+	testCases := []struct {
+		seqNum   uint64
+		expected string
+	}{
+		{0, ""},
+		{1, "b:b1 c:c1"},
+		{2, "a:a2 b:b1 c:c1 d:d2"},
+		{3, "a:a2 b:b1 c:c3c1 d:d2 e:e3 f:f3"},
+		{4, "a:a2 c:c3c1 d:d2 e:e3 f:f3"},
+		{5, "a:a5 c:c3c1 d:d2 e:e3 f:f3"},
+		{6, "a:a5 c:c6c3c1 d:d2 e:e3 f:f3"},
+		{7, "a:a5 c:c6c3c1 d:d2"},
+		{9, "a:a5 c:c6c3c1 d:d2 e:e9"},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprint(c.seqNum), func(t *testing.T) {
+			iter := r.NewIterAtSeqNum(c.seqNum)
+			defer func() {
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+
+			var forward []string
+			for valid := iter.First(); valid; valid = iter.Next() {
+				forward = append(forward, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+			}
+			if actual := strings.Join(forward, " "); c.expected != actual {
+				t.Fatalf("forward: expected %q, but found %q", c.expected, actual)
+			}
+
+			var reverse []string
+			for valid := iter.Last(); valid; valid = iter.Prev() {
+				reverse = append([]string{fmt.Sprintf("%s:%s", iter.Key(), iter.Value())}, reverse...)
+			}
+			if actual := strings.Join(reverse, " "); c.expected != actual {
+				t.Fatalf("reverse: expected %q, but found %q", c.expected, actual)
+			}
+		})
+	}
+
+	// Changing direction returns to the neighboring visible keys.
+	iter := r.NewIterAtSeqNum(4)
+	defer iter.Close()
+	var steps []string
+	iter.SeekGE([]byte("b"))
+	steps = append(steps, string(iter.Key()))
+	iter.Prev()
+	steps = append(steps, string(iter.Key()))
+	iter.Next()
+	steps = append(steps, string(iter.Key()))
+	iter.Next()
+	steps = append(steps, string(iter.Key()))
+	iter.SeekLT([]byte("c"))
+	steps = append(steps, string(iter.Key()))
+	if expected, actual := "c a c d a", strings.Join(steps, " "); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/bytealloc"
+	"github.com/petermattis/pebble/internal/rangedel"
+	"github.com/petermattis/pebble/storage"
+)
+
+type sortingEntry struct {
+	key   db.InternalKey
+	value []byte
+	// index is the order in which the entry was added. It is used to break ties
+	// between entries with identical internal keys: the entry added last wins.
+	index int
+}
+
+type sortingEntries struct {
+	cmp     db.Compare
+	entries []sortingEntry
+}
+
+func (s *sortingEntries) Len() int { return len(s.entries) }
+func (s *sortingEntries) Less(i, j int) bool {
+	if c := db.InternalCompare(s.cmp, s.entries[i].key, s.entries[j].key); c != 0 {
+		return c < 0
+	}
+	return s.entries[i].index > s.entries[j].index
+}
+func (s *sortingEntries) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+}
+
+// SortingWriter is a table writer which accepts keys in any order. The keys
+// and values are buffered in memory and sorted using the configured comparer
+// when the writer is closed, at which point a normal sorted table is
+// emitted. This trades memory for convenience and is intended for small
+// tables, such as those built from an unsorted ingestion source.
+//
+// If multiple entries are added for the same user key, the entries older than
+// the newest entry which is not a merge are dropped, as they are shadowed by
+// it. Merge operands are retained along with the older entries they apply to.
+// Of the entries with identical sequence numbers and kinds, only the one added
+// last is retained. Expect memory usage on the order of the total size of the
+// keys and values added.
+type SortingWriter struct {
+	w          *Writer
+	alloc      bytealloc.A
+	points     sortingEntries
+	tombstones sortingEntries
+	n          int
+	err        error
+}
+
+// NewSortingWriter returns a new sorting table writer for the file. Closing
+// the writer will close the file.
+func NewSortingWriter(f storage.File, o *db.Options, lo db.LevelOptions) *SortingWriter {
+	o = o.EnsureDefaults()
+	return &SortingWriter{
+		w:          NewWriter(f, o, lo),
+		points:     sortingEntries{cmp: o.Comparer.Compare},
+		tombstones: sortingEntries{cmp: o.Comparer.Compare},
+	}
+}
+
+// Set sets the value for the given key. The sequence number is set to 0.
+func (w *SortingWriter) Set(key, value []byte) error {
+	return w.Add(db.MakeInternalKey(key, 0, db.InternalKeyKindSet), value)
+}
+
+// Delete deletes the value for the given key. The sequence number is set to 0.
+func (w *SortingWriter) Delete(key []byte) error {
+	return w.Add(db.MakeInternalKey(key, 0, db.InternalKeyKindDelete), nil)
+}
+
+// DeleteRange deletes all of the keys (and values) in the range [start,end)
+// (inclusive on start, exclusive on end). The sequence number is set to 0.
+func (w *SortingWriter) DeleteRange(start, end []byte) error {
+	return w.Add(db.MakeInternalKey(start, 0, db.InternalKeyKindRangeDelete), end)
+}
+
+// Merge adds an action to the DB that merges the value at key with the new
+// value. The sequence number is set to 0.
+func (w *SortingWriter) Merge(key, value []byte) error {
+	return w.Add(db.MakeInternalKey(key, 0, db.InternalKeyKindMerge), value)
+}
+
+// Add adds a key/value pair to the table being written. Unlike Writer.Add,
+// the keys may be added in any order, and range deletion tombstones do not
+// need to be fragmented. The key and value are copied.
+func (w *SortingWriter) Add(key db.InternalKey, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	var e sortingEntry
+	w.alloc, e.key.UserKey = w.alloc.Copy(key.UserKey)
+	w.alloc, e.value = w.alloc.Copy(value)
+	e.key.Trailer = key.Trailer
+	e.index = w.n
+	w.n++
+	if key.Kind() == db.InternalKeyKindRangeDelete {
+		w.tombstones.entries = append(w.tombstones.entries, e)
+	} else {
+		w.points.entries = append(w.points.entries, e)
+	}
+	return nil
+}
+
+// Close sorts the buffered entries, writes them to the table and closes the
+// underlying file that the table was written to.
+func (w *SortingWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("pebble: writer is closed")
+
+	cmp := w.points.cmp
+	sort.Sort(&w.points)
+	var prev []byte
+	var shadowed bool
+	for i, e := range w.points.entries {
+		// Entries for the same user key are sorted by decreasing sequence number,
+		// so the first entry for each user key is the newest. An entry is
+		// shadowed by a newer set or deletion, but not by a newer merge, whose
+		// operand applies to it.
+		if i > 0 && cmp(prev, e.key.UserKey) == 0 {
+			if shadowed || e.key.Trailer == w.points.entries[i-1].key.Trailer {
+				continue
+			}
+		}
+		prev = e.key.UserKey
+		shadowed = e.key.Kind() != db.InternalKeyKindMerge
+		if err := w.w.Add(e.key, e.value); err != nil {
+			w.w.Close()
+			return err
+		}
+	}
+
+	sort.Sort(&w.tombstones)
+	var fragmented []rangedel.Tombstone
+	frag := rangedel.Fragmenter{
+		Cmp: cmp,
+		Emit: func(t []rangedel.Tombstone) {
+			fragmented = append(fragmented, t...)
+		},
+	}
+	for _, e := range w.tombstones.entries {
+		frag.Add(e.key, e.value)
+	}
+	frag.Finish()
+	for i, t := range fragmented {
+		// Identical tombstones would be rejected by the Writer and are redundant.
+		if i > 0 && fragmented[i-1].Start.Trailer == t.Start.Trailer &&
+			cmp(fragmented[i-1].Start.UserKey, t.Start.UserKey) == 0 &&
+			cmp(fragmented[i-1].End, t.End) == 0 {
+			continue
+		}
+		if err := w.w.Add(t.Start, t.End); err != nil {
+			w.w.Close()
+			return err
+		}
+	}
+
+	w.points.entries = nil
+	w.tombstones.entries = nil
+	w.alloc = nil
+	return w.w.Close()
+}
+
+// Metadata returns the metadata for the finished sstable. Only valid to call
+// after the sstable has been finished.
+func (w *SortingWriter) Metadata() (*WriterMetadata, error) {
+	return w.w.Metadata()
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestSortingWriter(t *testing.T) {
+	seed := time.Now().UnixNano()
+	rng := rand.New(rand.NewSource(seed))
+	t.Logf("seed: %d", seed)
+
+	const count = 1000
+	type kv struct {
+		key   db.InternalKey
+		value string
+	}
+	var input []kv
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("%05d", i))
+		input = append(input, kv{db.MakeInternalKey(key, uint64(i+1), db.InternalKeyKindSet), "old"})
+		if i%3 == 0 {
+			// Add a newer entry for every third key. Only the newest entry should be
+			// written to the table.
+			input = append(input, kv{db.MakeInternalKey(key, uint64(count+i+1), db.InternalKeyKindSet), "new"})
+		}
+	}
+	rng.Shuffle(len(input), func(i, j int) { input[i], input[j] = input[j], input[i] })
+
+	fs := storage.NewMem()
+	f0, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewSortingWriter(f0, nil, db.LevelOptions{BlockSize: 128})
+	for _, e := range input {
+		if err := w.Add(e.key, []byte(e.value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Range tombstones may be added out of order and unfragmented.
+	if err := w.Add(db.MakeInternalKey([]byte("00500"), 1, db.InternalKeyKindRangeDelete), []byte("00600")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(db.MakeInternalKey([]byte("00100"), 2, db.InternalKeyKindRangeDelete), []byte("00550")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, 0, nil)
+	defer r.Close()
+
+	iter := r.NewIter(nil)
+	i := 0
+	for valid := iter.First(); valid; valid = iter.Next() {
+		key := iter.Key()
+		if expected := fmt.Sprintf("%05d", i); expected != string(key.UserKey) {
+			t.Fatalf("expected %s, but found %s", expected, key)
+		}
+		expected := "old"
+		if i%3 == 0 {
+			expected = "new"
+		}
+		if expected != string(iter.Value()) {
+			t.Fatalf("%s: expected %s, but found %s", key, expected, iter.Value())
+		}
+		i++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if i != count {
+		t.Fatalf("expected %d keys, but found %d", count, i)
+	}
+
+	rangeDelIter := r.NewRangeDelIter(nil)
+	if rangeDelIter == nil {
+		t.Fatalf("expected range tombstones")
+	}
+	var tombstones []string
+	for valid := rangeDelIter.First(); valid; valid = rangeDelIter.Next() {
+		tombstones = append(tombstones, fmt.Sprintf("%s-%s", rangeDelIter.Key(), rangeDelIter.Value()))
+	}
+	if err := rangeDelIter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprint([]string{
+		"00100#2,15-00500",
+		"00500#2,15-00550",
+		"00500#1,15-00550",
+		"00550#1,15-00600",
+	})
+	if actual := fmt.Sprint(tombstones); expected != actual {
+		t.Fatalf("expected %s, but found %s", expected, actual)
+	}
+}
+
+func TestSortingWriterMerge(t *testing.T) {
+	fs := storage.NewMem()
+	f0, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewSortingWriter(f0, nil, db.LevelOptions{})
+	for _, s := range []string{
+		"b.MERGE.4:b4",
+		"a.MERGE.3:a3",
+		"a.SET.1:a1",
+		"b.SET.3:b3",
+		"a.MERGE.2:a2",
+		"b.SET.1:b1",
+		"c.SET.1:c1",
+		"c.DEL.2:",
+		"d.MERGE.1:d1",
+		"d.MERGE.1:d1'",
+	} {
+		kv := strings.Split(s, ":")
+		if err := w.Add(db.ParseInternalKey(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, 0, nil)
+	defer r.Close()
+
+	// The merge operands are retained along with the set they apply to, while
+	// the entries shadowed by a set or deletion are dropped. Of the identical
+	// merges of d, the one added last is retained.
+	var actual []string
+	iter := r.NewIter(nil)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		actual = append(actual, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"a#3,2:a3",
+		"a#2,2:a2",
+		"a#1,1:a1",
+		"b#4,2:b4",
+		"b#3,1:b3",
+		"c#2,0:",
+		"d#1,2:d1'",
+	}
+	if fmt.Sprint(expected) != fmt.Sprint(actual) {
+		t.Fatalf("expected\n%s\nbut found\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"context"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// KV is a key/value pair sent by Reader.Stream. The key and value are copies
+// owned by the receiver.
+type KV struct {
+	Key   db.InternalKey
+	Value []byte
+}
+
+// Stream iterates over the entries of the table in a goroutine, sending each
+// on the returned channel in key order. The sends block until the receiver is
+// ready, so the iteration proceeds at the pace of the receiver. The channel is
+// closed once the iteration is exhausted, fails or ctx is done, after which
+// the error channel yields the error which stopped the iteration, if any, and
+// is closed. A receiver which stops early must cancel ctx for the goroutine to
+// exit, and the Reader must not be closed before the channel is closed.
+func (r *Reader) Stream(ctx context.Context) (<-chan KV, <-chan error) {
+	kvs := make(chan KV)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(kvs)
+
+		iter := r.NewIter(nil)
+		var err error
+		for valid := iter.First(); valid; valid = iter.Next() {
+			// A select with both cases ready picks one at random, so ctx is
+			// checked first to stop promptly once it is done.
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			kv := KV{
+				Key:   iter.Key().Clone(),
+				Value: append([]byte(nil), iter.Value()...),
+			}
+			select {
+			case kvs <- kv:
+				continue
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			break
+		}
+		if closeErr := iter.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			errc <- err
+		}
+	}()
+	return kvs, errc
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestStream(t *testing.T) {
+	fs := storage.NewMem()
+	f, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{
+		BlockSize: 256,
+	})
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := w.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+
+	// The whole table is streamed in order.
+	kvs, errc := r.Stream(context.Background())
+	var n int
+	for kv := range kvs {
+		if key := fmt.Sprintf("%04d", n); string(kv.Key.UserKey) != key || string(kv.Value) != key {
+			t.Fatalf("expected %s, but found %s:%s", key, kv.Key.UserKey, kv.Value)
+		}
+		n++
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Fatalf("expected 1000 entries, but found %d", n)
+	}
+
+	// Cancelling the context after consuming part of the stream stops the
+	// goroutine, which closes both channels.
+	ctx, cancel := context.WithCancel(context.Background())
+	kvs, errc = r.Stream(ctx)
+	for i := 0; i < 10; i++ {
+		kv := <-kvs
+		if key := fmt.Sprintf("%04d", i); string(kv.Key.UserKey) != key {
+			t.Fatalf("expected %s, but found %s", key, kv.Key.UserKey)
+		}
+	}
+	// The goroutine is blocked sending the next entry until it is cancelled.
+	time.Sleep(time.Millisecond)
+	cancel()
+	n = 0
+	for range kvs {
+		n++
+	}
+	if n > 1 {
+		t.Fatalf("expected at most one entry after cancellation, but found %d", n)
+	}
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("expected %v, but found %v", context.Canceled, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for the stream to stop")
+	}
+	if _, ok := <-errc; ok {
+		t.Fatalf("expected the error channel to be closed")
+	}
+}
@@ -62,6 +62,7 @@ To write a table with three entries:
 */
 package sstable // import "github.com/petermattis/pebble/sstable"
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -91,7 +92,9 @@ The table file format looks like:
 Each block consists of some data and a 5 byte trailer: a 1 byte block type and
 a 4 byte checksum of the compressed data. The block type gives the per-block
 compression used; each block is compressed independently. The checksum
-algorithm is described in the pebble/crc package.
+algorithm is described in the pebble/crc package. A table may record a longer
+trailer length in its footer, in which case the checksum is followed by bytes
+reserved for a larger checksum, which are ignored by readers.
 
 The decompressed block data consists of a sequence of key/value entries
 followed by a trailer. Each key is encoded as a shared prefix length and a
@@ -140,8 +143,13 @@ const (
 	minFooterLen = levelDBFooterLen
 	maxFooterLen = rocksDBFooterLen
 
+	// The pebble footer has the same layout as the RocksDB footer, and differs
+	// in its magic number and version.
+	pebbleDBMagic = "\xf0\x9f\xaa\xb3\xf0\x9f\xaa\xb3"
+
 	levelDBFormatVersion  = 0
 	rocksDBFormatVersion2 = 2
+	pebbleFormatVersion1  = 1
 
 	noChecksum     = 0
 	checksumCRC32c = 1
@@ -158,6 +166,10 @@ const (
 	metaPropertiesName = "rocksdb.properties"
 	metaRangeDelName   = "rocksdb.range_del"
 	metaRangeDelV2Name = "rocksdb.range_del2"
+
+	// valueFilterPrefix is the prefix of the name of the meta block holding
+	// the value filter, which is followed by the name of the filter policy.
+	valueFilterPrefix = "pebble.valuefilter."
 )
 
 // legacy (LevelDB) footer format:
@@ -172,11 +184,48 @@ const (
 //    <padding> to make the total size 2 * BlockHandle::kMaxEncodedLength + 1
 //    footer version (4 bytes)
 //    table_magic_number (8 bytes)
+// pebble footer format: the RocksDB footer format, with footer version 1 and a
+// distinct magic number, so that the readers which cannot decode the index
+// entries of TableFormatPebblev1 reject the table.
+//
+// In all formats, a non-zero table epoch is stored as a varint64 in the
+// padding immediately following the index handle. Readers which are unaware
+// of the epoch ignore the padding, and a zero epoch is indistinguishable from
+// the padding. A block trailer length other than blockTrailerLen is stored as
+// a varint64 following the epoch, which is then stored even if it is zero. A
+// zero trailer length, as read from the padding of older tables, denotes
+// blockTrailerLen.
 type footer struct {
 	format      db.TableFormat
 	checksum    uint8
 	metaindexBH blockHandle
 	indexBH     blockHandle
+	epoch       uint64
+	trailerLen  uint64
+}
+
+// epochFits returns true if the epoch and trailer length fit in the padding of
+// the footer.
+func (f footer) epochFits() bool {
+	var tmp [blockHandleMaxLen]byte
+	n := encodeBlockHandle(tmp[:], f.metaindexBH)
+	n += encodeBlockHandle(tmp[:], f.indexBH)
+	n += f.encodePadding(tmp[:])
+	return n <= 2*blockHandleMaxLen
+}
+
+// encodePadding encodes the epoch and trailer length, which are stored in the
+// padding of the footer, into buf and returns the number of bytes written.
+func (f footer) encodePadding(buf []byte) int {
+	var n int
+	extended := f.trailerLen != 0 && f.trailerLen != blockTrailerLen
+	if f.epoch != 0 || extended {
+		n += binary.PutUvarint(buf[n:], f.epoch)
+	}
+	if extended {
+		n += binary.PutUvarint(buf[n:], f.trailerLen)
+	}
+	return n
 }
 
 func readFooter(f storage.File) (footer, error) {
@@ -209,16 +258,23 @@ func readFooter(f storage.File) (footer, error) {
 		footer.format = db.TableFormatLevelDB
 		footer.checksum = checksumCRC32c
 
-	case rocksDBMagic:
+	case rocksDBMagic, pebbleDBMagic:
 		if len(buf) < rocksDBFooterLen {
 			return footer, fmt.Errorf("pebble/table: invalid table (footer too short): %d", len(buf))
 		}
 		buf = buf[len(buf)-rocksDBFooterLen:]
 		version := binary.LittleEndian.Uint32(buf[rocksDBVersionOffset:rocksDBMagicOffset])
-		if version != rocksDBFormatVersion2 {
-			return footer, fmt.Errorf("pebble/table: unsupported format version %d", version)
+		if string(buf[rocksDBMagicOffset:]) == pebbleDBMagic {
+			if version != pebbleFormatVersion1 {
+				return footer, fmt.Errorf("pebble/table: unsupported format version %d", version)
+			}
+			footer.format = db.TableFormatPebblev1
+		} else {
+			if version != rocksDBFormatVersion2 {
+				return footer, fmt.Errorf("pebble/table: unsupported format version %d", version)
+			}
+			footer.format = db.TableFormatRocksDBv2
 		}
-		footer.format = db.TableFormatRocksDBv2
 		footer.checksum = uint8(buf[0])
 		if footer.checksum != checksumCRC32c {
 			return footer, fmt.Errorf("pebble/table: unsupported checksum type %d", footer.checksum)
@@ -230,6 +286,9 @@ func readFooter(f storage.File) (footer, error) {
 	}
 
 	{
+		// Restrict buf to the block handles and padding.
+		buf = buf[:2*blockHandleMaxLen]
+
 		var n int
 		footer.metaindexBH, n = decodeBlockHandle(buf)
 		if n == 0 {
@@ -241,11 +300,139 @@ func readFooter(f storage.File) (footer, error) {
 		if n == 0 {
 			return footer, errors.New("pebble/table: invalid table (bad index block handle)")
 		}
+		buf = buf[n:]
+
+		// The epoch and trailer length are stored in the padding following the
+		// handles.
+		if len(buf) > 0 {
+			footer.epoch, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return footer, errors.New("pebble/table: invalid table (bad epoch)")
+			}
+			buf = buf[n:]
+		}
+		if len(buf) > 0 {
+			footer.trailerLen, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return footer, errors.New("pebble/table: invalid table (bad block trailer length)")
+			}
+		}
+		if footer.trailerLen == 0 {
+			footer.trailerLen = blockTrailerLen
+		} else if footer.trailerLen < blockTrailerLen {
+			return footer, fmt.Errorf(
+				"pebble/table: invalid table (bad block trailer length %d)", footer.trailerLen)
+		}
 	}
 
 	return footer, nil
 }
 
+// Footer describes the format features of a table. It is returned by
+// ReadFooter.
+type Footer struct {
+	// Format is the table format.
+	Format db.TableFormat
+	// FormatVersion is the format version stored in the footer. It is always 0
+	// for the LevelDB format.
+	FormatVersion uint32
+	// Checksum is the name of the block checksum type: "crc32c".
+	Checksum string
+	// IndexType is the index type recorded in the table properties. The value 0
+	// denotes a binary search index.
+	IndexType uint32
+	// Compression is the name of the block compression recorded in the table
+	// properties. It is empty if the table does not have a properties block.
+	Compression string
+	// Epoch is the table epoch. See Writer.SetEpoch.
+	Epoch uint64
+	// BlockTrailerLength is the length of the trailer of each block, which
+	// holds the block type and checksum.
+	BlockTrailerLength uint64
+	// The location of the metaindex and index blocks. The lengths do not
+	// include the block trailer.
+	MetaindexOffset, MetaindexLength uint64
+	IndexOffset, IndexLength         uint64
+	// The location of the footer.
+	FooterOffset, FooterLength uint64
+}
+
+// ReadFooter reads the footer of the table in f, along with the metaindex and
+// properties blocks, and reports the format features used by the table. The
+// index and filter blocks are not read. This is much cheaper than opening the
+// table with NewReader. The file is not closed.
+func ReadFooter(f storage.File) (*Footer, error) {
+	footer, err := readFooter(f)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	result := &Footer{
+		Format:             footer.format,
+		Checksum:           "crc32c",
+		Epoch:              footer.epoch,
+		BlockTrailerLength: footer.trailerLen,
+		MetaindexOffset:    footer.metaindexBH.offset,
+		MetaindexLength:    footer.metaindexBH.length,
+		IndexOffset:        footer.indexBH.offset,
+		IndexLength:        footer.indexBH.length,
+	}
+	switch footer.format {
+	case db.TableFormatLevelDB:
+		result.FormatVersion = levelDBFormatVersion
+		result.FooterLength = levelDBFooterLen
+	case db.TableFormatRocksDBv2:
+		result.FormatVersion = rocksDBFormatVersion2
+		result.FooterLength = rocksDBFooterLen
+	case db.TableFormatPebblev1:
+		result.FormatVersion = pebbleFormatVersion1
+		result.FooterLength = rocksDBFooterLen
+	}
+	result.FooterOffset = uint64(stat.Size()) - result.FooterLength
+
+	// The index type and compression are recorded in the properties block. Note
+	// that a nil cache is valid, and prevents the blocks from being cached.
+	r := &Reader{file: f, trailerLen: footer.trailerLen}
+	b, _, err := r.readBlock(footer.metaindexBH)
+	if err != nil {
+		return nil, err
+	}
+	i, err := newRawBlockIter(bytes.Compare, b)
+	if err != nil {
+		return nil, err
+	}
+	var propsBH blockHandle
+	for valid := i.First(); valid; valid = i.Next() {
+		if string(i.Key().UserKey) == metaPropertiesName {
+			var n int
+			propsBH, n = decodeBlockHandle(i.Value())
+			if n == 0 {
+				return nil, errors.New("pebble/table: invalid table (bad properties block handle)")
+			}
+			break
+		}
+	}
+	if err := i.Close(); err != nil {
+		return nil, err
+	}
+	if propsBH.length > 0 {
+		b, _, err := r.readBlock(propsBH)
+		if err != nil {
+			return nil, err
+		}
+		var props Properties
+		if err := props.load(b, propsBH.offset); err != nil {
+			return nil, err
+		}
+		result.IndexType = props.IndexType
+		result.Compression = props.CompressionName
+	}
+	return result, nil
+}
+
 func (f footer) encode(buf []byte) []byte {
 	switch f.format {
 	case db.TableFormatLevelDB:
@@ -255,9 +442,10 @@ func (f footer) encode(buf []byte) []byte {
 		}
 		n := encodeBlockHandle(buf[0:], f.metaindexBH)
 		n += encodeBlockHandle(buf[n:], f.indexBH)
+		f.encodePadding(buf[n:])
 		copy(buf[len(buf)-len(levelDBMagic):], levelDBMagic)
 
-	case db.TableFormatRocksDBv2:
+	case db.TableFormatRocksDBv2, db.TableFormatPebblev1:
 		buf = buf[:rocksDBFooterLen]
 		for i := range buf {
 			buf[i] = 0
@@ -266,8 +454,14 @@ func (f footer) encode(buf []byte) []byte {
 		n := 1
 		n += encodeBlockHandle(buf[n:], f.metaindexBH)
 		n += encodeBlockHandle(buf[n:], f.indexBH)
-		binary.LittleEndian.PutUint32(buf[rocksDBVersionOffset:], rocksDBFormatVersion2)
-		copy(buf[len(buf)-len(rocksDBMagic):], rocksDBMagic)
+		f.encodePadding(buf[n:])
+		if f.format == db.TableFormatPebblev1 {
+			binary.LittleEndian.PutUint32(buf[rocksDBVersionOffset:], pebbleFormatVersion1)
+			copy(buf[len(buf)-len(pebbleDBMagic):], pebbleDBMagic)
+		} else {
+			binary.LittleEndian.PutUint32(buf[rocksDBVersionOffset:], rocksDBFormatVersion2)
+			copy(buf[len(buf)-len(rocksDBMagic):], rocksDBMagic)
+		}
 	}
 
 	return buf
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -19,6 +20,7 @@ import (
 
 	"github.com/kr/pretty"
 	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/storage"
 )
@@ -433,6 +435,368 @@ func (c *countingFilterPolicy) MayContain(ftype db.FilterType, filter, key []byt
 	return got
 }
 
+// keyListFilterPolicy is a filter policy whose filter is the list of keys
+// added to it. Unlike a Bloom filter, the encoded filter compresses well.
+type keyListFilterPolicy struct{}
+
+func (keyListFilterPolicy) Name() string { return "key-list" }
+
+func (keyListFilterPolicy) MayContain(ftype db.FilterType, filter, key []byte) bool {
+	for len(filter) > 0 {
+		n := int(filter[0])
+		if bytes.Equal(filter[1:1+n], key) {
+			return true
+		}
+		filter = filter[1+n:]
+	}
+	return false
+}
+
+func (keyListFilterPolicy) NewWriter(ftype db.FilterType) db.FilterWriter {
+	return &keyListFilterWriter{}
+}
+
+type keyListFilterWriter struct {
+	buf []byte
+}
+
+func (w *keyListFilterWriter) AddKey(key []byte) {
+	w.buf = append(w.buf, byte(len(key)))
+	w.buf = append(w.buf, key...)
+}
+
+func (w *keyListFilterWriter) Finish(buf []byte) []byte {
+	buf = append(buf, w.buf...)
+	w.buf = w.buf[:0]
+	return buf
+}
+
+func TestFilterCompression(t *testing.T) {
+	fs := storage.NewMem()
+	opts := &db.Options{
+		Levels: []db.LevelOptions{{
+			FilterPolicy: keyListFilterPolicy{},
+			FilterType:   db.TableFilter,
+		}},
+	}
+
+	build := func(name string, compression db.Compression) *Reader {
+		f0, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, opts, db.LevelOptions{
+			FilterPolicy:      keyListFilterPolicy{},
+			FilterType:        db.TableFilter,
+			FilterCompression: compression,
+		})
+		for i := 0; i < 1000; i += 2 {
+			if err := w.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f1, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewReader(f1, 0, opts)
+	}
+
+	filterBlockType := func(r *Reader) byte {
+		var trailer [blockTrailerLen]byte
+		bh := r.filter.bh
+		if _, err := r.file.ReadAt(trailer[:], int64(bh.offset+bh.length)); err != nil {
+			t.Fatal(err)
+		}
+		return trailer[0]
+	}
+
+	uncompressed := build("uncompressed", db.DefaultCompression)
+	defer uncompressed.Close()
+	compressed := build("compressed", db.SnappyCompression)
+	defer compressed.Close()
+
+	if typ := filterBlockType(uncompressed); typ != noCompressionBlockType {
+		t.Fatalf("expected uncompressed filter block by default, but found type %d", typ)
+	}
+	if typ := filterBlockType(compressed); typ != snappyCompressionBlockType {
+		t.Fatalf("expected snappy compressed filter block, but found type %d", typ)
+	}
+	if uncompressed.Properties.FilterSize <= compressed.Properties.FilterSize {
+		t.Fatalf("expected compressed filter (%d bytes) to be smaller than uncompressed filter (%d bytes)",
+			compressed.Properties.FilterSize, uncompressed.Properties.FilterSize)
+	}
+
+	uncompressedFilter, err := uncompressed.readFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedFilter, err := compressed.readFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uncompressedFilter, compressedFilter) {
+		t.Fatalf("decompressed filter does not match the uncompressed filter")
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		expected := uncompressed.tableFilter.mayContain(uncompressedFilter, key)
+		if actual := compressed.tableFilter.mayContain(compressedFilter, key); expected != actual {
+			t.Fatalf("%s: expected mayContain=%t, but found %t", key, expected, actual)
+		}
+		if expected != (i%2 == 0) {
+			t.Fatalf("%s: unexpected mayContain=%t", key, expected)
+		}
+		if _, err := compressed.get(key, nil); (err == nil) != expected {
+			t.Fatalf("%s: unexpected get error: %v", key, err)
+		}
+	}
+}
+
+func TestValueDedup(t *testing.T) {
+	fs := storage.NewMem()
+
+	// Runs of adjacent keys share a value, with runs spanning restart points
+	// and block boundaries.
+	const n = 2000
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%05d", i))
+	}
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf("value-%020d", i/7))
+	}
+
+	build := func(name string, dedup bool) *Reader {
+		f0, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, nil, db.LevelOptions{
+			BlockSize:   1024,
+			Compression: db.NoCompression,
+			ValueDedup:  dedup,
+		})
+		for i := 0; i < n; i++ {
+			if err := w.Set(key(i), value(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f1, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewReader(f1, 0, nil)
+	}
+
+	plain := build("plain", false)
+	defer plain.Close()
+	dedup := build("dedup", true)
+	defer dedup.Close()
+
+	if plain.Properties.ValueDedup || !dedup.Properties.ValueDedup {
+		t.Fatalf("unexpected value dedup properties: %t, %t",
+			plain.Properties.ValueDedup, dedup.Properties.ValueDedup)
+	}
+	if dedup.Properties.DataSize >= plain.Properties.DataSize/2 {
+		t.Fatalf("expected deduped data size (%d) to be less than half of %d",
+			dedup.Properties.DataSize, plain.Properties.DataSize)
+	}
+
+	check := func(iter *Iterator, i int) {
+		t.Helper()
+		if !iter.Valid() {
+			t.Fatalf("%s: expected valid iterator", key(i))
+		}
+		if k := iter.Key().UserKey; !bytes.Equal(k, key(i)) {
+			t.Fatalf("expected %s, but found %s", key(i), k)
+		}
+		if v := iter.Value(); !bytes.Equal(v, value(i)) {
+			t.Fatalf("%s: expected %s, but found %s", key(i), value(i), v)
+		}
+	}
+
+	iter := dedup.NewIter(nil)
+	i := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		check(iter, i)
+		i++
+	}
+	if i != n {
+		t.Fatalf("expected %d keys, but found %d", n, i)
+	}
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		i--
+		check(iter, i)
+	}
+	if i != 0 {
+		t.Fatalf("expected %d keys in reverse, but found %d", n, n-i)
+	}
+	for _, j := range []int{0, 1, 6, 7, 100, 1234, n - 1} {
+		iter.SeekGE(key(j))
+		check(iter, j)
+		iter.Next()
+		if j+1 < n {
+			check(iter, j+1)
+		}
+		if j > 0 {
+			iter.SeekLT(key(j))
+			check(iter, j-1)
+			iter.Prev()
+			if j > 1 {
+				check(iter, j-2)
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, j := range []int{0, 3, 999, n - 1} {
+		v, err := dedup.get(key(j), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, value(j)) {
+			t.Fatalf("%s: expected %s, but found %s", key(j), value(j), v)
+		}
+	}
+}
+
+func TestSeqNumDelta(t *testing.T) {
+	fs := storage.NewMem()
+
+	// Each key has many versions, with runs of versions spanning restart points
+	// and block boundaries. The gaps between the sequence numbers of the
+	// versions vary, including gaps which need a multi-byte varint.
+	const n, versions = 100, 30
+	type entry struct {
+		key   db.InternalKey
+		value []byte
+	}
+	var entries []entry
+	for i := 0; i < n; i++ {
+		seqNum := uint64(1 << 40)
+		for j := 0; j < versions; j++ {
+			var kind db.InternalKeyKind
+			switch j % 5 {
+			case 3:
+				kind = db.InternalKeyKindMerge
+			case 4:
+				kind = db.InternalKeyKindDelete
+			default:
+				kind = db.InternalKeyKindSet
+			}
+			var value []byte
+			if kind != db.InternalKeyKindDelete {
+				value = []byte(fmt.Sprintf("v%d", j))
+			}
+			entries = append(entries, entry{
+				key:   db.MakeInternalKey([]byte(fmt.Sprintf("%05d", i)), seqNum, kind),
+				value: value,
+			})
+			seqNum -= uint64(1 + (i*j)%300)
+		}
+	}
+
+	build := func(name string, delta bool) *Reader {
+		f0, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, nil, db.LevelOptions{
+			BlockSize:   1024,
+			Compression: db.NoCompression,
+			SeqNumDelta: delta,
+		})
+		for _, e := range entries {
+			if err := w.Add(e.key, e.value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f1, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewReader(f1, 0, nil)
+	}
+
+	plain := build("plain", false)
+	defer plain.Close()
+	delta := build("delta", true)
+	defer delta.Close()
+
+	if plain.Properties.SeqNumDelta || !delta.Properties.SeqNumDelta {
+		t.Fatalf("unexpected seqnum delta properties: %t, %t",
+			plain.Properties.SeqNumDelta, delta.Properties.SeqNumDelta)
+	}
+	if delta.Properties.DataSize >= plain.Properties.DataSize*3/4 {
+		t.Fatalf("expected delta encoded data size (%d) to be less than 3/4 of %d",
+			delta.Properties.DataSize, plain.Properties.DataSize)
+	}
+	if delta.Properties.NumDataBlocks >= plain.Properties.NumDataBlocks {
+		t.Fatalf("expected fewer than %d data blocks, but found %d",
+			plain.Properties.NumDataBlocks, delta.Properties.NumDataBlocks)
+	}
+
+	check := func(iter *Iterator, i int) {
+		t.Helper()
+		if !iter.Valid() {
+			t.Fatalf("%s: expected valid iterator", entries[i].key)
+		}
+		if k := iter.Key(); !bytes.Equal(k.UserKey, entries[i].key.UserKey) || k.Trailer != entries[i].key.Trailer {
+			t.Fatalf("expected %s, but found %s", entries[i].key, k)
+		}
+		if v := iter.Value(); !bytes.Equal(v, entries[i].value) {
+			t.Fatalf("%s: expected %s, but found %s", entries[i].key, entries[i].value, v)
+		}
+	}
+
+	iter := delta.NewIter(nil)
+	i := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		check(iter, i)
+		i++
+	}
+	if i != len(entries) {
+		t.Fatalf("expected %d entries, but found %d", len(entries), i)
+	}
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		i--
+		check(iter, i)
+	}
+	if i != 0 {
+		t.Fatalf("expected %d entries in reverse, but found %d", len(entries), len(entries)-i)
+	}
+	for _, k := range []int{0, 1, 17, 50, n - 1} {
+		// The first entry of each key is its newest version.
+		j := k * versions
+		iter.SeekGE(entries[j].key.UserKey)
+		check(iter, j)
+		iter.Next()
+		check(iter, j+1)
+		if k > 0 {
+			iter.SeekLT(entries[j].key.UserKey)
+			check(iter, j-1)
+			iter.Prev()
+			check(iter, j-2)
+			iter.Next()
+			check(iter, j-1)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestWriterRoundTrip(t *testing.T) {
 	// Check that we can read a freshly made table.
 	f, err := build(db.DefaultCompression, nil, 0)
@@ -581,54 +945,80 @@ func TestFooterRoundTrip(t *testing.T) {
 	} {
 		t.Run(fmt.Sprintf("format=%d", format), func(t *testing.T) {
 			for _, checksum := range []uint8{checksumCRC32c} {
-				t.Run(fmt.Sprintf("checksum=%d", checksum), func(t *testing.T) {
-					footer := footer{
-						format:      format,
-						checksum:    checksum,
-						metaindexBH: blockHandle{offset: 1, length: 2},
-						indexBH:     blockHandle{offset: 3, length: 4},
-					}
-					for offset := range []int64{0, 1, 100} {
-						t.Run(fmt.Sprintf("offset=%d", offset), func(t *testing.T) {
-							fs := storage.NewMem()
-							f, err := fs.Create("test")
-							if err != nil {
-								t.Fatal(err)
-							}
-							if _, err := f.Write(buf[:offset]); err != nil {
-								t.Fatal(err)
-							}
-							if _, err := f.Write(footer.encode(buf[100:])); err != nil {
-								t.Fatal(err)
-							}
-							if err := f.Close(); err != nil {
-								t.Fatal(err)
-							}
-
-							f, err = fs.Open("test")
-							if err != nil {
-								t.Fatal(err)
-							}
-							result, err := readFooter(f)
-							if err != nil {
-								t.Fatal(err)
-							}
-							if err := f.Close(); err != nil {
-								t.Fatal(err)
-							}
-
-							if diff := pretty.Diff(footer, result); diff != nil {
-								t.Fatalf("expected %+v, but found %+v\n%s",
-									footer, result, strings.Join(diff, "\n"))
-							}
-						})
-					}
-				})
+				for _, trailerLen := range []uint64{blockTrailerLen, blockTrailerLen + 4} {
+					t.Run(fmt.Sprintf("checksum=%d,trailer=%d", checksum, trailerLen), func(t *testing.T) {
+						footer := footer{
+							format:      format,
+							checksum:    checksum,
+							metaindexBH: blockHandle{offset: 1, length: 2},
+							indexBH:     blockHandle{offset: 3, length: 4},
+							trailerLen:  trailerLen,
+						}
+						for offset := range []int64{0, 1, 100} {
+							t.Run(fmt.Sprintf("offset=%d", offset), func(t *testing.T) {
+								fs := storage.NewMem()
+								f, err := fs.Create("test")
+								if err != nil {
+									t.Fatal(err)
+								}
+								if _, err := f.Write(buf[:offset]); err != nil {
+									t.Fatal(err)
+								}
+								if _, err := f.Write(footer.encode(buf[100:])); err != nil {
+									t.Fatal(err)
+								}
+								if err := f.Close(); err != nil {
+									t.Fatal(err)
+								}
+
+								f, err = fs.Open("test")
+								if err != nil {
+									t.Fatal(err)
+								}
+								result, err := readFooter(f)
+								if err != nil {
+									t.Fatal(err)
+								}
+								if err := f.Close(); err != nil {
+									t.Fatal(err)
+								}
+
+								if diff := pretty.Diff(footer, result); diff != nil {
+									t.Fatalf("expected %+v, but found %+v\n%s",
+										footer, result, strings.Join(diff, "\n"))
+								}
+							})
+						}
+					})
+				}
 			}
 		})
 	}
 }
 
+func TestFooterEpochFits(t *testing.T) {
+	const max = math.MaxUint64
+	testCases := []struct {
+		metaindexBH, indexBH blockHandle
+		epoch                uint64
+		expected             bool
+	}{
+		{blockHandle{1, 2}, blockHandle{3, 4}, 0, true},
+		{blockHandle{1, 2}, blockHandle{3, 4}, max, true},
+		// Each block handle encodes to its maximum length of 20 bytes, which
+		// leaves no room for the epoch.
+		{blockHandle{max, max}, blockHandle{max, max}, 0, true},
+		{blockHandle{max, max}, blockHandle{max, max}, 1, false},
+		{blockHandle{max, max}, blockHandle{1, 2}, max, true},
+	}
+	for _, c := range testCases {
+		f := footer{metaindexBH: c.metaindexBH, indexBH: c.indexBH, epoch: c.epoch}
+		if fits := f.epochFits(); fits != c.expected {
+			t.Errorf("%+v: expected %t, but found %t", f, c.expected, fits)
+		}
+	}
+}
+
 func TestReadFooter(t *testing.T) {
 	encode := func(format db.TableFormat, checksum uint8) string {
 		f := footer{
@@ -676,3 +1066,223 @@ func TestReadFooter(t *testing.T) {
 		})
 	}
 }
+
+func TestReadFooterFeatures(t *testing.T) {
+	testCases := []struct {
+		format      db.TableFormat
+		compression db.Compression
+		expected    string
+	}{
+		{db.TableFormatLevelDB, db.NoCompression, "format=1 version=0 checksum=crc32c index-type=0 compression=NoCompression"},
+		{db.TableFormatRocksDBv2, db.NoCompression, "format=0 version=2 checksum=crc32c index-type=0 compression=NoCompression"},
+		{db.TableFormatRocksDBv2, db.SnappyCompression, "format=0 version=2 checksum=crc32c index-type=0 compression=Snappy"},
+	}
+	for _, c := range testCases {
+		t.Run(c.expected, func(t *testing.T) {
+			fs := storage.NewMem()
+			f0, err := fs.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f0, &db.Options{TableFormat: c.format}, db.LevelOptions{Compression: c.compression})
+			for i := 0; i < 100; i++ {
+				if err := w.Set([]byte(fmt.Sprintf("%03d", i)), []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f1, err := fs.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f1.Close()
+			footer, err := ReadFooter(f1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual := fmt.Sprintf("format=%d version=%d checksum=%s index-type=%d compression=%s",
+				footer.Format, footer.FormatVersion, footer.Checksum, footer.IndexType, footer.Compression)
+			if c.expected != actual {
+				t.Fatalf("expected %s, but found %s", c.expected, actual)
+			}
+
+			stat, err := f1.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if footer.FooterOffset+footer.FooterLength != uint64(stat.Size()) {
+				t.Fatalf("footer [%d,+%d) does not end the file of size %d",
+					footer.FooterOffset, footer.FooterLength, stat.Size())
+			}
+			if footer.IndexOffset+footer.IndexLength+blockTrailerLen != footer.FooterOffset {
+				t.Fatalf("expected index block to precede the footer: %+v", footer)
+			}
+			if footer.MetaindexOffset+footer.MetaindexLength+blockTrailerLen != footer.IndexOffset {
+				t.Fatalf("expected metaindex block to precede the index block: %+v", footer)
+			}
+		})
+	}
+}
+
+func TestReaderEpoch(t *testing.T) {
+	fs := storage.NewMem()
+	c := cache.New(1 << 20)
+	opts := &db.Options{Cache: c}
+	const fileNum = 1
+
+	build := func(epoch uint64, value string) *Reader {
+		f0, err := fs.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, opts, db.LevelOptions{})
+		w.SetEpoch(epoch)
+		for i := 0; i < 100; i++ {
+			if err := w.Set([]byte(fmt.Sprintf("%03d", i)), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		f1, err := fs.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		footer, err := ReadFooter(f1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if footer.Epoch != epoch {
+			t.Fatalf("expected epoch %d, but found %d", epoch, footer.Epoch)
+		}
+		return NewReader(f1, fileNum, opts)
+	}
+
+	scan := func(r *Reader, expected string) {
+		iter := r.NewIter(nil)
+		n := 0
+		for valid := iter.First(); valid; valid = iter.Next() {
+			if v := string(iter.Value()); v != expected {
+				t.Fatalf("%s: expected %s, but found %s", iter.Key(), expected, v)
+			}
+			n++
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != 100 {
+			t.Fatalf("expected 100 keys, but found %d", n)
+		}
+	}
+
+	// Populate the cache with the blocks from the first incarnation of the
+	// file.
+	r := build(1, "old")
+	scan(r, "old")
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the file using the same file number, but a new epoch. The blocks
+	// are at the same offsets, but the cache must not return the stale blocks.
+	r = build(2, "new")
+	scan(r, "new")
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderExtendedBlockTrailer(t *testing.T) {
+	lo := db.LevelOptions{
+		BlockSize:    256,
+		FilterPolicy: bloom.FilterPolicy(10),
+		FilterType:   db.BlockFilter,
+	}
+	for _, format := range []db.TableFormat{db.TableFormatLevelDB, db.TableFormatRocksDBv2} {
+		t.Run(fmt.Sprint(format), func(t *testing.T) {
+			// Write a table whose block trailers have room for an 8 byte checksum.
+			mem := storage.NewMem()
+			f, err := mem.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := &db.Options{TableFormat: format, Levels: []db.LevelOptions{lo}}
+			w := NewWriter(f, opts, lo)
+			w.trailerLen = blockTrailerLen + 4
+			w.SetEpoch(7)
+			var keys []string
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("%04d", i)
+				if err := w.Set([]byte(key), []byte(key)); err != nil {
+					t.Fatal(err)
+				}
+				keys = append(keys, key)
+			}
+			if err := w.DeleteRange([]byte("a"), []byte("b")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = mem.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			footer, err := ReadFooter(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if footer.BlockTrailerLength != 9 || footer.Epoch != 7 {
+				t.Fatalf("expected trailer length 9 and epoch 7, but found %d and %d",
+					footer.BlockTrailerLength, footer.Epoch)
+			}
+
+			r := NewReader(f, 0, opts)
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			iter := r.NewIter(nil)
+			var found []string
+			for valid := iter.First(); valid; valid = iter.Next() {
+				if string(iter.Key().UserKey) != string(iter.Value()) {
+					t.Fatalf("%s: unexpected value %s", iter.Key().UserKey, iter.Value())
+				}
+				found = append(found, string(iter.Key().UserKey))
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if e, f := strings.Join(keys, " "), strings.Join(found, " "); e != f {
+				t.Fatalf("expected %d keys, but found %d", len(keys), len(found))
+			}
+			if _, err := r.get([]byte("0500"), nil); err != nil {
+				t.Fatal(err)
+			}
+			rangeDelIter := r.NewRangeDelIter(nil)
+			if rangeDelIter == nil || !rangeDelIter.First() || string(rangeDelIter.Value()) != "b" {
+				t.Fatalf("expected the range deletion [a,b)")
+			}
+			rangeDelIter.Close()
+
+			var n int
+			skipped, err := r.RecoverScan(func(key db.InternalKey, value []byte) error {
+				n++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skipped != 0 || n != len(keys) {
+				t.Fatalf("expected to recover %d keys, but recovered %d and skipped %d bytes",
+					len(keys), n, skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+// TailReader reads a table which is still being written. Until the table is
+// finished, only the data blocks which have been completely written to the
+// file (see Writer.Flush) are visible. Refresh picks up the data blocks which
+// have been written since the previous call, and switches to reading the
+// finished table once its footer has been written.
+//
+// The data blocks of an unfinished table are not indexed on disk. They are
+// found by scanning forward from the end of the last known block for a block
+// trailer whose checksum matches the preceding bytes, and each block found is
+// verified to contain point records ordered after those of the previous
+// block. A torn block at the end of the file is ignored until the rest of it
+// has been written. Range deletion tombstones, filters and properties are only
+// available once the table is finished.
+//
+// Tables written with TableFormatPebblev1, LevelOptions.ValueDedup,
+// LevelOptions.SeqNumDelta, LevelOptions.BlockAlignment,
+// LevelOptions.BlockInternalFilter, LevelOptions.ValueBlockThreshold or
+// LevelOptions.PageIndexPageSize cannot be tailed. Writer.Flush returns an
+// error for such a table, and Refresh returns an error once it has been
+// finished, as the blocks of the unfinished table cannot be told apart from
+// plain data blocks until the properties have been written.
+//
+// Refresh must not be called concurrently with NewIter. Iterators only see the
+// blocks which were visible when they were created.
+type TailReader struct {
+	file    storage.File
+	fileNum uint64
+	opts    *db.Options
+	reader  *Reader
+	// offset is the file offset of the end of the last data block found.
+	offset uint64
+	// scanner finds the data blocks following offset.
+	scanner dataBlockScanner
+	// index holds an index entry for each of the data blocks found, keyed by
+	// the last key in the block.
+	index    blockWriter
+	finished bool
+	buf      []byte
+}
+
+// NewTailReader returns a new reader for a table which is being written to
+// the file, and loads the data blocks which have been written so far. Closing
+// the reader will close the file.
+func NewTailReader(f storage.File, fileNum uint64, o *db.Options) (*TailReader, error) {
+	if f == nil {
+		return nil, errors.New("pebble/table: nil file")
+	}
+	t := &TailReader{
+		file:    f,
+		fileNum: fileNum,
+		opts:    o.EnsureDefaults(),
+		index: blockWriter{
+			restartInterval: 1,
+		},
+	}
+	t.scanner.cmp = t.opts.Comparer.Compare
+	if err := t.Refresh(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Refresh loads the data blocks which have been written to the file since the
+// last call. If the table has been finished, the reader switches to reading
+// the finished table, including its range deletion tombstones.
+func (t *TailReader) Refresh() error {
+	if t.finished {
+		return nil
+	}
+	stat, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(stat.Size())
+
+	if size >= minFooterLen {
+		if footer, err := readFooter(t.file); err == nil {
+			r := NewReader(t.file, t.fileNum, t.opts)
+			if r.err != nil {
+				return r.err
+			}
+			if err := checkTailable(footer.format, &r.Properties); err != nil {
+				return err
+			}
+			t.reader = r
+			t.finished = true
+			return nil
+		}
+	}
+
+	if size > t.offset {
+		n := int(size - t.offset)
+		if cap(t.buf) < n {
+			t.buf = make([]byte, n)
+		}
+		b := t.buf[:n]
+		n, err = t.file.ReadAt(b, int64(t.offset))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		b = b[:n]
+		for {
+			length, ok := t.nextBlock(b)
+			if !ok {
+				break
+			}
+			t.offset += uint64(length) + blockTrailerLen
+			b = b[length+blockTrailerLen:]
+		}
+	}
+
+	// The index block is finished in a copy of the buffer so that further
+	// entries can be added, and so that iterators created before this call
+	// retain the index they were created with.
+	index := t.index
+	index.buf = append([]byte(nil), t.index.buf...)
+	index.restarts = append([]uint32(nil), t.index.restarts...)
+	t.reader = &Reader{
+		file:       t.file,
+		fileNum:    t.fileNum,
+		opts:       t.opts,
+		cache:      t.opts.Cache,
+		compare:    t.opts.Comparer.Compare,
+		trailerLen: blockTrailerLen,
+		tailIndex:  index.finish(),
+	}
+	return nil
+}
+
+// checkTailable returns an error if a table with the specified format and
+// properties cannot be tailed, as its data blocks are not plain data blocks
+// or are not contiguous.
+func checkTailable(format db.TableFormat, props *Properties) error {
+	var feature string
+	switch {
+	case format == db.TableFormatPebblev1:
+		feature = "TableFormatPebblev1"
+	case props.ValueDedup:
+		feature = "value dedup"
+	case props.SeqNumDelta:
+		feature = "seqnum delta"
+	case props.BlockAlignment != 0:
+		feature = "block alignment"
+	case props.BlockInternalFilter:
+		feature = "block internal filters"
+	case props.ValueBlocks:
+		feature = "value blocks"
+	case props.PageIndexPageSize != 0:
+		feature = "a page index"
+	default:
+		return nil
+	}
+	return fmt.Errorf("pebble/table: cannot tail a table written with %s", feature)
+}
+
+// nextBlock looks for a complete data block at the start of b, which holds
+// the unscanned remainder of the file. If one is found, an index entry is
+// added for it and its length (excluding the trailer) is returned.
+func (t *TailReader) nextBlock(b []byte) (int, bool) {
+	_, length, ok := t.scanner.next(b, 0)
+	if !ok {
+		return 0, false
+	}
+	var tmp [2 * binary.MaxVarintLen64]byte
+	n := encodeBlockHandle(tmp[:], blockHandle{t.offset, uint64(length)})
+	t.index.add(t.scanner.lastKey, tmp[:n])
+	return length, true
+}
+
+// Finished returns true if the table has been finished by the writer and the
+// reader has switched to reading the finished table.
+func (t *TailReader) Finished() bool {
+	return t.finished
+}
+
+// Reader returns the underlying reader, which reflects the state of the table
+// as of the last call to Refresh.
+func (t *TailReader) Reader() *Reader {
+	return t.reader
+}
+
+// NewIter returns an internal iterator over the data blocks which were
+// visible as of the last call to Refresh.
+func (t *TailReader) NewIter(o *db.IterOptions) *Iterator {
+	return t.reader.NewIter(o)
+}
+
+// Close closes the reader and the underlying file.
+func (t *TailReader) Close() error {
+	if t.reader == nil {
+		return errors.New("pebble/table: reader is closed")
+	}
+	err := t.reader.Close()
+	t.reader = nil
+	return err
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestTailReader(t *testing.T) {
+	for _, compression := range []db.Compression{db.NoCompression, db.SnappyCompression} {
+		t.Run(compression.String(), func(t *testing.T) {
+			fs := storage.NewMem()
+			f0, err := fs.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f0, nil, db.LevelOptions{
+				BlockSize:   256,
+				Compression: compression,
+			})
+
+			f1, err := fs.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewTailReader(f1, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			// scan returns the number of keys visible to the reader, verifying that
+			// they are a prefix of the keys written.
+			scan := func() int {
+				iter := r.NewIter(nil)
+				n := 0
+				for valid := iter.First(); valid; valid = iter.Next() {
+					if expected := fmt.Sprintf("%05d", n); string(iter.Key().UserKey) != expected {
+						t.Fatalf("expected %s, but found %s", expected, iter.Key().UserKey)
+					}
+					n++
+				}
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+				return n
+			}
+
+			if n := scan(); n != 0 {
+				t.Fatalf("expected no keys, but found %d", n)
+			}
+
+			const numKeys = 1000
+			last := 0
+			for i := 0; i < numKeys; i++ {
+				key := db.MakeInternalKey([]byte(fmt.Sprintf("%05d", i)), uint64(i), db.InternalKeyKindSet)
+				if err := w.Add(key, []byte(fmt.Sprintf("value-%d", i))); err != nil {
+					t.Fatal(err)
+				}
+				if i%100 != 99 {
+					continue
+				}
+
+				// Keys only become visible once their block has been flushed.
+				if err := r.Refresh(); err != nil {
+					t.Fatal(err)
+				}
+				if n := scan(); n != last {
+					t.Fatalf("expected %d keys before flushing, but found %d", last, n)
+				}
+				if err := w.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				iter := r.NewIter(nil)
+				if err := r.Refresh(); err != nil {
+					t.Fatal(err)
+				}
+				n := scan()
+				if n <= last || n > i+1 {
+					t.Fatalf("expected between %d and %d keys, but found %d", last+1, i+1, n)
+				}
+				last = n
+
+				// An iterator created before the refresh doesn't see the new blocks.
+				if iter.Last() && string(iter.Key().UserKey) >= fmt.Sprintf("%05d", last) {
+					t.Fatalf("iterator created before refresh found %s", iter.Key().UserKey)
+				}
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if r.Finished() {
+				t.Fatalf("expected the table to not be finished")
+			}
+
+			if err := w.DeleteRange([]byte("a"), []byte("b")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Refresh(); err != nil {
+				t.Fatal(err)
+			}
+			if !r.Finished() {
+				t.Fatalf("expected the table to be finished")
+			}
+			if n := scan(); n != numKeys {
+				t.Fatalf("expected %d keys, but found %d", numKeys, n)
+			}
+			if r.Reader().NewRangeDelIter(nil) == nil {
+				t.Fatalf("expected range tombstones")
+			}
+		})
+	}
+}
+
+func TestTailReaderTornBlock(t *testing.T) {
+	fs := storage.NewMem()
+	f0, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, nil, db.LevelOptions{BlockSize: 128})
+	const numKeys = 100
+	for i := 0; i < numKeys; i++ {
+		key := db.MakeInternalKey([]byte(fmt.Sprintf("%05d", i)), uint64(i), db.InternalKeyKindSet)
+		if err := w.Add(key, []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f1.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, stat.Size())
+	if _, err := f1.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncate the table at every offset. The reader should see the keys in
+	// the complete blocks, which increase with the truncation offset, and
+	// ignore the torn block.
+	last := 0
+	for size := 0; size < len(data); size++ {
+		f, err := fs.Create("torn")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(data[:size]); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if f, err = fs.Open("torn"); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewTailReader(f, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iter := r.NewIter(nil)
+		n := 0
+		for valid := iter.First(); valid; valid = iter.Next() {
+			if expected := fmt.Sprintf("%05d", n); string(iter.Key().UserKey) != expected {
+				t.Fatalf("%d: expected %s, but found %s", size, expected, iter.Key().UserKey)
+			}
+			n++
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n < last || n > numKeys {
+			t.Fatalf("%d: expected between %d and %d keys, but found %d", size, last, numKeys, n)
+		}
+		last = n
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if last != numKeys {
+		t.Fatalf("expected %d keys, but found %d", numKeys, last)
+	}
+}
+
+func TestTailReaderUnsupported(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts *db.Options
+		lo   db.LevelOptions
+	}{
+		{"pebblev1", &db.Options{TableFormat: db.TableFormatPebblev1}, db.LevelOptions{}},
+		{"value-dedup", nil, db.LevelOptions{ValueDedup: true}},
+		{"seqnum-delta", nil, db.LevelOptions{SeqNumDelta: true}},
+		{"block-alignment", nil, db.LevelOptions{BlockAlignment: 4096}},
+		{"block-internal-filter", nil, db.LevelOptions{
+			FilterPolicy:        bloom.FilterPolicy(10),
+			BlockInternalFilter: true,
+		}},
+		{"value-blocks", nil, db.LevelOptions{ValueBlockThreshold: 1}},
+		{"page-index", nil, db.LevelOptions{PageIndexPageSize: 4096}},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			fs := storage.NewMem()
+			f0, err := fs.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f0, c.opts, c.lo)
+			for i := 0; i < 100; i++ {
+				if err := w.Set([]byte(fmt.Sprintf("%05d", i)), []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Flush(); err == nil {
+				t.Fatalf("expected flushing to fail")
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f1, err := fs.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewTailReader(f1, 0, c.opts); err == nil {
+				t.Fatalf("expected the finished table to be rejected")
+			} else if !strings.HasPrefix(err.Error(), "pebble/table: cannot tail") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := f1.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
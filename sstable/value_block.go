@@ -0,0 +1,270 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// The values stored in the data blocks of a table written with
+// LevelOptions.ValueBlockThreshold are prefixed by a tag. A valueInline tag
+// is followed by the value itself, and a valueBlockRef tag by the varint
+// encoded index of the value block holding the value, and the offset and
+// length of the value within the value block.
+const (
+	valueInline   = 0
+	valueBlockRef = 1
+)
+
+// metaValueIndexName is the name of the meta block holding the handles of the
+// value blocks of a table, in order. Each handle is encoded as its offset and
+// length, as little-endian uint64s, so that the handle of a value block is
+// found without decoding the preceding handles.
+const metaValueIndexName = "pebble.value.index"
+
+const valueIndexEntryLen = 16
+
+var errCorruptValueRef = errors.New("pebble/table: corrupt value block reference")
+
+// valueBlockWriter accumulates the values which a Writer stores in value
+// blocks. See LevelOptions.ValueBlockThreshold.
+type valueBlockWriter struct {
+	threshold int
+	blockSize int
+	// buf holds the values of the value block being built.
+	buf []byte
+	// sealed holds the value blocks which have been completed but not yet
+	// written. The value blocks are only written following a data block, as
+	// the block filters are keyed by the offsets of the data blocks.
+	sealed [][]byte
+	// handles holds the handles of the value blocks which have been written,
+	// in order.
+	handles []blockHandle
+	// tmp holds the value returned by encode.
+	tmp []byte
+	// dedup, if non-nil, remembers the locations of the most recently stored
+	// distinct values. See LevelOptions.ValueBlockDedup.
+	dedup *valueDedupSet
+	// dedups is the number of values stored as references to a value stored
+	// earlier.
+	dedups uint64
+}
+
+// encode returns the value to store in the data block entry for value. A value
+// which is at least the threshold in length is appended to the current value
+// block and replaced by a reference to it, or replaced by a reference to an
+// identical value stored earlier. The returned value is only valid until the
+// next call.
+func (w *valueBlockWriter) encode(value []byte) []byte {
+	if len(value) < w.threshold {
+		w.tmp = append(append(w.tmp[:0], valueInline), value...)
+		return w.tmp
+	}
+	var hash [sha256.Size]byte
+	if w.dedup != nil {
+		hash = sha256.Sum256(value)
+		if ref, ok := w.dedup.refs[hash]; ok {
+			w.dedups++
+			return w.encodeRef(ref)
+		}
+	}
+	ref := valueRef{
+		index:  uint64(len(w.handles) + len(w.sealed)),
+		offset: uint64(len(w.buf)),
+		length: uint64(len(value)),
+	}
+	w.buf = append(w.buf, value...)
+	if len(w.buf) >= w.blockSize {
+		w.seal()
+	}
+	if w.dedup != nil {
+		w.dedup.add(hash, ref)
+	}
+	return w.encodeRef(ref)
+}
+
+// encodeRef returns the value to store in the data block entry for a value
+// stored in a value block.
+func (w *valueBlockWriter) encodeRef(ref valueRef) []byte {
+	w.tmp = append(w.tmp[:0], valueBlockRef)
+	w.tmp = appendUvarint(w.tmp, ref.index)
+	w.tmp = appendUvarint(w.tmp, ref.offset)
+	w.tmp = appendUvarint(w.tmp, ref.length)
+	return w.tmp
+}
+
+// seal completes the current value block, if it holds any values.
+func (w *valueBlockWriter) seal() {
+	if len(w.buf) > 0 {
+		w.sealed = append(w.sealed, w.buf)
+		w.buf = nil
+	}
+}
+
+// valueRef is the location of a value stored in a value block: the index of
+// the value block, and the offset and length of the value within the block.
+type valueRef struct {
+	index, offset, length uint64
+}
+
+// valueDedupSet maps the SHA-256 hashes of the most recently stored distinct
+// values to their locations. The oldest value is forgotten once the set is
+// full.
+type valueDedupSet struct {
+	refs map[[sha256.Size]byte]valueRef
+	// recent holds the hashes of the values in the set, as a ring in which
+	// next is the position of the oldest hash once the ring is full.
+	recent [][sha256.Size]byte
+	next   int
+}
+
+func newValueDedupSet(size int) *valueDedupSet {
+	return &valueDedupSet{
+		refs:   make(map[[sha256.Size]byte]valueRef, size),
+		recent: make([][sha256.Size]byte, 0, size),
+	}
+}
+
+// add adds the hash and location of a value to the set, forgetting the oldest
+// value if the set is full.
+func (s *valueDedupSet) add(hash [sha256.Size]byte, ref valueRef) {
+	if len(s.recent) < cap(s.recent) {
+		s.recent = append(s.recent, hash)
+	} else {
+		delete(s.refs, s.recent[s.next])
+		s.recent[s.next] = hash
+		s.next = (s.next + 1) % len(s.recent)
+	}
+	s.refs[hash] = ref
+}
+
+// finish returns the contents of the value index block.
+func (w *valueBlockWriter) finish() []byte {
+	b := make([]byte, valueIndexEntryLen*len(w.handles))
+	for j, h := range w.handles {
+		binary.LittleEndian.PutUint64(b[valueIndexEntryLen*j:], h.offset)
+		binary.LittleEndian.PutUint64(b[valueIndexEntryLen*j+8:], h.length)
+	}
+	return b
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+// decodeValueRef decodes a value stored in a data block entry, which is
+// either the value itself or a reference to it. It returns the inline value,
+// or the index of the value block holding the value and the offset and length
+// of the value within the block.
+func decodeValueRef(v []byte) (inline []byte, index, offset, length uint64, err error) {
+	if len(v) == 0 {
+		return nil, 0, 0, 0, errCorruptValueRef
+	}
+	switch v[0] {
+	case valueInline:
+		return v[1:], 0, 0, 0, nil
+	case valueBlockRef:
+	default:
+		return nil, 0, 0, 0, errCorruptValueRef
+	}
+	v = v[1:]
+	for _, p := range []*uint64{&index, &offset, &length} {
+		x, n := binary.Uvarint(v)
+		if n <= 0 {
+			return nil, 0, 0, 0, errCorruptValueRef
+		}
+		*p, v = x, v[n:]
+	}
+	if len(v) != 0 {
+		return nil, 0, 0, 0, errCorruptValueRef
+	}
+	return nil, index, offset, length, nil
+}
+
+// storedValueLen returns the length of the value stored in a data block entry
+// of a table with value blocks, without reading the value block holding it.
+func storedValueLen(v []byte) (int, error) {
+	inline, _, _, length, err := decodeValueRef(v)
+	if err != nil {
+		return 0, err
+	}
+	if inline != nil {
+		return len(inline), nil
+	}
+	return int(length), nil
+}
+
+// valueBlockHandle returns the handle of the value block with the given index.
+func (r *Reader) valueBlockHandle(index uint64) (blockHandle, error) {
+	b, err := r.readWeakCachedBlock(&r.valueIndex)
+	if err != nil {
+		return blockHandle{}, err
+	}
+	if index >= uint64(len(b)/valueIndexEntryLen) {
+		return blockHandle{}, errCorruptValueRef
+	}
+	b = b[valueIndexEntryLen*index:]
+	return blockHandle{
+		offset: binary.LittleEndian.Uint64(b),
+		length: binary.LittleEndian.Uint64(b[8:]),
+	}, nil
+}
+
+// valueBlockLengths returns the lengths of the value blocks, keyed by their
+// offsets.
+func (r *Reader) valueBlockLengths() (map[uint64]uint64, error) {
+	m := make(map[uint64]uint64, r.Properties.NumValueBlocks)
+	for index := uint64(0); index < r.Properties.NumValueBlocks; index++ {
+		bh, err := r.valueBlockHandle(index)
+		if err != nil {
+			return nil, err
+		}
+		m[bh.offset] = bh.length
+	}
+	return m, nil
+}
+
+// valueBlockReader resolves the values stored in the data blocks of a table
+// with value blocks. A value block is read when one of its values is first
+// requested, and retained until a value of another value block is requested,
+// so that a scan over the adjacent keys whose values share a value block
+// reads and decompresses the block once.
+type valueBlockReader struct {
+	reader         *Reader
+	verifyChecksum bool
+	// noCache causes the value blocks read to not be added to the block cache.
+	noCache bool
+	// block is the value block with the given index, if non-nil.
+	block block
+	index uint64
+}
+
+// value returns the value stored in a data block entry. A value read from a
+// value block remains valid after the value block is released.
+func (v *valueBlockReader) value(stored []byte) ([]byte, error) {
+	inline, index, offset, length, err := decodeValueRef(stored)
+	if err != nil || inline != nil {
+		return inline, err
+	}
+	if v.block == nil || v.index != index {
+		bh, err := v.reader.valueBlockHandle(index)
+		if err != nil {
+			return nil, err
+		}
+		b, _, err := v.reader.readBlockInternal(bh, v.verifyChecksum, !v.noCache)
+		if err != nil {
+			return nil, err
+		}
+		v.block, v.index = b, index
+	}
+	if offset+length > uint64(len(v.block)) {
+		return nil, errCorruptValueRef
+	}
+	return v.block[offset : offset+length : offset+length], nil
+}
@@ -0,0 +1,268 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+// offsetRecordingFile records the number of reads at each offset.
+type offsetRecordingFile struct {
+	storage.File
+	mu    sync.Mutex
+	reads map[int64]int
+}
+
+func (f *offsetRecordingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	f.reads[off]++
+	f.mu.Unlock()
+	return f.File.ReadAt(p, off)
+}
+
+func TestValueBlocks(t *testing.T) {
+	lo := db.LevelOptions{
+		BlockSize:           1024,
+		FilterPolicy:        bloom.FilterPolicy(10),
+		FilterType:          db.BlockFilter,
+		ValueBlockThreshold: 64,
+	}
+	// The values of the even keys are stored in value blocks.
+	const n = 1000
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%04d", i))
+	}
+	value := func(i int) []byte {
+		if i%2 == 0 {
+			return bytes.Repeat([]byte{byte('a' + i%26)}, 100)
+		}
+		return []byte(fmt.Sprintf("v%d", i))
+	}
+
+	fs := storage.NewMem()
+	f, err := fs.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, lo)
+	for i := 0; i < n; i++ {
+		if err := w.Set(key(i), value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = fs.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf := &offsetRecordingFile{File: f, reads: make(map[int64]int)}
+	r := NewReader(rf, 0, &db.Options{
+		Levels: []db.LevelOptions{lo},
+	})
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !r.Properties.ValueBlocks || r.Properties.NumValueBlocks < 2 {
+		t.Fatalf("expected several value blocks, but found %d", r.Properties.NumValueBlocks)
+	}
+	valueBlocks, err := r.valueBlockLengths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valueBlockReads := func() map[int64]int {
+		rf.mu.Lock()
+		defer rf.mu.Unlock()
+		m := make(map[int64]int)
+		for off, reads := range rf.reads {
+			if _, ok := valueBlocks[uint64(off)]; ok {
+				m[off] = reads
+			}
+		}
+		for off := range rf.reads {
+			delete(rf.reads, off)
+		}
+		return m
+	}
+	valueBlockReads()
+
+	// The value blocks are not read by a scan which only consults the keys.
+	iter := r.NewIter(nil)
+	var count int
+	for valid := iter.First(); valid; valid = iter.Next() {
+		count++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Fatalf("expected %d keys, but found %d", n, count)
+	}
+	if m := valueBlockReads(); len(m) != 0 {
+		t.Fatalf("expected no value block reads, but found %v", m)
+	}
+
+	// A scan which consults the values reads each value block once, as the
+	// adjacent keys referencing the same value block share its decompressed
+	// contents. The reader has no block cache.
+	iter = r.NewIter(nil)
+	count = 0
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if v := iter.Value(); !bytes.Equal(v, value(count)) {
+			t.Fatalf("%s: expected %s, but found %s", iter.Key().UserKey, value(count), v)
+		}
+		count++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m := valueBlockReads()
+	if len(m) != len(valueBlocks) {
+		t.Fatalf("expected %d value blocks to be read, but found %d", len(valueBlocks), len(m))
+	}
+	for off, reads := range m {
+		if reads != 1 {
+			t.Fatalf("expected the value block at %d to be read once, but found %d reads", off, reads)
+		}
+	}
+
+	// The block filters are keyed by the offsets of the data blocks, which are
+	// interspersed with the value blocks.
+	for i := 0; i < n; i++ {
+		v, err := r.get(key(i), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", key(i), err)
+		}
+		if !bytes.Equal(v, value(i)) {
+			t.Fatalf("%s: expected %s, but found %s", key(i), value(i), v)
+		}
+	}
+
+	// The length of a value in a value block is found without reading it.
+	valueBlockReads()
+	for i := 0; i < n; i += 2 {
+		length, exists, err := r.GetValueLen(key(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists || length != len(value(i)) {
+			t.Fatalf("%s: expected length %d, but found %d (%t)", key(i), len(value(i)), length, exists)
+		}
+	}
+	if m := valueBlockReads(); len(m) != 0 {
+		t.Fatalf("expected no value block reads, but found %v", m)
+	}
+
+	pi := r.NewParallelIter(4)
+	count = 0
+	for pi.Next() {
+		if v := pi.Value(); !bytes.Equal(v, value(count)) {
+			t.Fatalf("%s: expected %s, but found %s", pi.Key().UserKey, value(count), v)
+		}
+		count++
+	}
+	if err := pi.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Fatalf("expected %d keys, but found %d", n, count)
+	}
+
+	// RecoverScan skips the value blocks interspersed with the data blocks.
+	count = 0
+	skipped, err := r.RecoverScan(func(k db.InternalKey, v []byte) error {
+		if !bytes.Equal(v, value(count)) {
+			return fmt.Errorf("%s: expected %s, but found %s", k.UserKey, value(count), v)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 0 || count != n {
+		t.Fatalf("expected %d keys and no skipped bytes, but found %d keys and %d skipped bytes",
+			n, count, skipped)
+	}
+}
+
+func TestValueBlockDedup(t *testing.T) {
+	fs := storage.NewMem()
+	// build writes a table whose values cycle through the given number of
+	// distinct values, remembering window values, and returns the number of
+	// deduped values.
+	build := func(distinct, window int) uint64 {
+		t.Helper()
+		const n = 100
+		key := func(i int) []byte {
+			return []byte(fmt.Sprintf("%04d", i))
+		}
+		value := func(i int) []byte {
+			return bytes.Repeat([]byte{byte('a' + i%distinct)}, 100)
+		}
+		f, err := fs.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, nil, db.LevelOptions{
+			BlockSize:           256,
+			ValueBlockThreshold: 64,
+			ValueBlockDedup:     window,
+		})
+		for i := 0; i < n; i++ {
+			if err := w.Set(key(i), value(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err = fs.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, 0, nil)
+		defer r.Close()
+		iter := r.NewIter(nil)
+		i := 0
+		for iter.First(); iter.Valid(); iter.Next() {
+			if v := iter.Value(); !bytes.Equal(v, value(i)) {
+				t.Fatalf("%s: expected %s, but found %s", key(i), value(i), v)
+			}
+			i++
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if i != n {
+			t.Fatalf("expected %d keys, but found %d", n, i)
+		}
+		return r.Properties.NumValueDedups
+	}
+
+	// Every value after the first occurrence of each distinct value is deduped
+	// while the distinct values fit in the window.
+	if dedups := build(3, 3); dedups != 97 {
+		t.Fatalf("expected 97 deduped values, but found %d", dedups)
+	}
+	// A value is forgotten before it repeats once the window is too small.
+	if dedups := build(3, 2); dedups != 0 {
+		t.Fatalf("expected no deduped values, but found %d", dedups)
+	}
+	if dedups := build(3, 0); dedups != 0 {
+		t.Fatalf("expected no deduped values, but found %d", dedups)
+	}
+}
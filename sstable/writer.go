@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"strings"
 
 	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/db"
@@ -28,6 +29,10 @@ type WriterMetadata struct {
 	LargestRange   db.InternalKey
 	SmallestSeqNum uint64
 	LargestSeqNum  uint64
+	// NumEntries and NumDeletions are the number of point entries in the
+	// table, and the number of those which are deletions.
+	NumEntries   uint64
+	NumDeletions uint64
 }
 
 func (m *WriterMetadata) updateSeqNum(seqNum uint64) {
@@ -87,9 +92,20 @@ type Writer struct {
 	bytesPerSync       int
 	compare            db.Compare
 	compression        db.Compression
+	filterCompression  db.Compression
 	separator          db.Separator
 	successor          db.Successor
 	tableFormat        db.TableFormat
+	duplicateKeyPolicy db.DuplicateKeyPolicy
+	// epoch is recorded in the table footer. See SetEpoch.
+	epoch uint64
+	// blockAlignment is the alignment of the data blocks. See
+	// LevelOptions.BlockAlignment.
+	blockAlignment uint64
+	// trailerLen is the length of the block trailers, which is recorded in the
+	// footer if it is not blockTrailerLen. Longer trailers are only written by
+	// tests, in order to exercise the reading of tables with larger checksums.
+	trailerLen uint64
 	// A table is a series of blocks and a block's index entry contains a
 	// separator key between one block and the next. Thus, a finished block
 	// cannot be written until the first key in the next block is seen.
@@ -111,6 +127,24 @@ type Writer struct {
 	compressedBuf []byte
 	// filter accumulates the filter block.
 	filter filterWriter
+	// valueFilter accumulates the value filter block. See
+	// LevelOptions.ValueFilterPolicy.
+	valueFilter *tableFilterWriter
+	// valueBlocks, if non-nil, accumulates the value blocks. See
+	// LevelOptions.ValueBlockThreshold.
+	valueBlocks *valueBlockWriter
+	// pageIndex, if non-nil, accumulates the page index. See
+	// LevelOptions.PageIndexPageSize.
+	pageIndex *pageIndexWriter
+	// blockProps are the collectors of the block properties stored in the
+	// index entries. See db.Options.BlockPropertyCollectors. pendingProps
+	// holds the encoded properties of the block of pendingBH, which follow
+	// its handle in indexValue. propBuf is a scratch buffer for the property
+	// of a single collector.
+	blockProps   []db.BlockPropertyCollector
+	pendingProps []byte
+	propBuf      []byte
+	indexValue   []byte
 	// tmp is a scratch buffer, large enough to hold either footerLen bytes,
 	// blockTrailerLen bytes, or (5 * binary.MaxVarintLen64) bytes.
 	tmp [rocksDBFooterLen]byte
@@ -184,14 +218,34 @@ func (w *Writer) Add(key db.InternalKey, value []byte) error {
 }
 
 func (w *Writer) addPoint(key db.InternalKey, value []byte) error {
+	if w.props.NumEntries > 0 && w.meta.LargestPoint.SeqNum() == key.SeqNum() &&
+		w.compare(w.meta.LargestPoint.UserKey, key.UserKey) == 0 {
+		switch w.duplicateKeyPolicy {
+		case db.DuplicateKeyKeepFirst:
+			return nil
+		default:
+			w.err = fmt.Errorf("pebble: duplicate key: %s, %s", w.meta.LargestPoint, key)
+			return w.err
+		}
+	}
 	if db.InternalCompare(w.compare, w.meta.LargestPoint, key) >= 0 {
 		w.err = fmt.Errorf("pebble: keys must be added in order: %s, %s", w.meta.LargestPoint, key)
 		return w.err
 	}
 
-	if err := w.maybeFlush(key, value); err != nil {
+	stored := value
+	if w.valueBlocks != nil {
+		stored = w.valueBlocks.encode(value)
+	}
+	if err := w.maybeFlush(key, stored); err != nil {
 		return err
 	}
+	for _, c := range w.blockProps {
+		if err := c.Add(key, value); err != nil {
+			w.err = err
+			return w.err
+		}
+	}
 
 	w.meta.updateSeqNum(key.SeqNum())
 	w.meta.updateLargestPoint(key)
@@ -199,6 +253,9 @@ func (w *Writer) addPoint(key db.InternalKey, value []byte) error {
 	if w.filter != nil {
 		w.filter.addKey(key.UserKey)
 	}
+	if w.valueFilter != nil && key.Kind() == db.InternalKeyKindSet {
+		w.valueFilter.addKey(value)
+	}
 	if w.props.NumEntries == 0 {
 		w.meta.SmallestPoint = key.Clone()
 	}
@@ -208,7 +265,10 @@ func (w *Writer) addPoint(key db.InternalKey, value []byte) error {
 	}
 	w.props.RawKeySize += uint64(key.Size())
 	w.props.RawValueSize += uint64(len(value))
-	w.block.add(key, value)
+	if w.pageIndex != nil && w.block.nEntries == 0 {
+		w.pageIndex.setFirstKey(key)
+	}
+	w.block.add(key, stored)
 	return nil
 }
 
@@ -280,11 +340,33 @@ func (w *Writer) maybeFlush(key db.InternalKey, value []byte) error {
 		w.err = err
 		return w.err
 	}
+	if err := w.finishBlockProperties(); err != nil {
+		w.err = err
+		return w.err
+	}
 	w.pendingBH = bh
 	w.flushPendingBH(key)
 	return nil
 }
 
+// finishBlockProperties encodes the block properties of the data block which
+// was just finished into pendingProps, as the length-prefixed property of each
+// collector in turn.
+func (w *Writer) finishBlockProperties() error {
+	w.pendingProps = w.pendingProps[:0]
+	for _, c := range w.blockProps {
+		var err error
+		w.propBuf, err = c.FinishDataBlock(w.propBuf[:0])
+		if err != nil {
+			return err
+		}
+		n := binary.PutUvarint(w.tmp[:], uint64(len(w.propBuf)))
+		w.pendingProps = append(w.pendingProps, w.tmp[:n]...)
+		w.pendingProps = append(w.pendingProps, w.propBuf...)
+	}
+	return nil
+}
+
 // flushPendingBH adds any pending block handle to the index entries.
 func (w *Writer) flushPendingBH(key db.InternalKey) {
 	if w.pendingBH.length == 0 {
@@ -300,14 +382,30 @@ func (w *Writer) flushPendingBH(key db.InternalKey) {
 		sep = prevKey.Separator(w.compare, w.separator, nil, key)
 	}
 	n := encodeBlockHandle(w.tmp[:], w.pendingBH)
-	w.indexBlock.add(sep, w.tmp[:n])
+	if w.blockProps == nil {
+		w.indexBlock.add(sep, w.tmp[:n])
+	} else {
+		w.indexValue = append(append(w.indexValue[:0], w.tmp[:n]...), w.pendingProps...)
+		w.indexBlock.add(sep, w.indexValue)
+	}
 	w.pendingBH = blockHandle{}
 }
 
 // finishBlock finishes the current block and returns its block handle, which is
 // its offset and length in the table.
 func (w *Writer) finishBlock(block *blockWriter) (blockHandle, error) {
+	nEntries := block.nEntries
 	bh, err := w.writeRawBlock(block.finish(), w.compression)
+	if err == nil && block == &w.block {
+		if w.pageIndex != nil && nEntries > 0 {
+			w.pageIndex.addBlock(bh)
+		}
+		// Write the completed value blocks and pad the data block before the
+		// filter records the offset of the next block.
+		if err = w.writeValueBlocks(); err == nil {
+			err = w.writePadding()
+		}
+	}
 
 	// Calculate filters.
 	if w.filter != nil {
@@ -344,8 +442,14 @@ func (w *Writer) writeRawBlock(b []byte, compression db.Compression) (blockHandl
 	if _, err := w.writer.Write(w.tmp[:5]); err != nil {
 		return blockHandle{}, err
 	}
+	if w.trailerLen > blockTrailerLen {
+		// The remainder of an extended trailer is reserved.
+		if _, err := w.writer.Write(zeroPadding[:w.trailerLen-blockTrailerLen]); err != nil {
+			return blockHandle{}, err
+		}
+	}
 	bh := blockHandle{w.offset, uint64(len(b))}
-	w.offset += uint64(len(b)) + blockTrailerLen
+	w.offset += uint64(len(b)) + w.trailerLen
 
 	// Sync the file periodically to smooth out disk traffic.
 	if w.bytesPerSync > 0 && (w.offset-w.syncOffset) >= uint64(w.bytesPerSync) {
@@ -362,6 +466,46 @@ func (w *Writer) writeRawBlock(b []byte, compression db.Compression) (blockHandl
 	return bh, nil
 }
 
+// writeValueBlocks writes the value blocks which have been completed.
+func (w *Writer) writeValueBlocks() error {
+	if w.valueBlocks == nil {
+		return nil
+	}
+	for _, b := range w.valueBlocks.sealed {
+		bh, err := w.writeRawBlock(b, w.compression)
+		if err != nil {
+			return err
+		}
+		w.valueBlocks.handles = append(w.valueBlocks.handles, bh)
+	}
+	w.valueBlocks.sealed = w.valueBlocks.sealed[:0]
+	return nil
+}
+
+// writePadding writes zero bytes until the offset is a multiple of the block
+// alignment.
+func (w *Writer) writePadding() error {
+	if w.blockAlignment == 0 {
+		return nil
+	}
+	n := (w.blockAlignment - w.offset%w.blockAlignment) % w.blockAlignment
+	for n > 0 {
+		chunk := n
+		if chunk > uint64(len(zeroPadding)) {
+			chunk = uint64(len(zeroPadding))
+		}
+		if _, err := w.writer.Write(zeroPadding[:chunk]); err != nil {
+			return err
+		}
+		w.offset += chunk
+		n -= chunk
+	}
+	return nil
+}
+
+// zeroPadding is the source of the padding written by writePadding.
+var zeroPadding [4096]byte
+
 // Close finishes writing the table and closes the underlying file that the
 // table was written to.
 func (w *Writer) Close() (err error) {
@@ -382,12 +526,20 @@ func (w *Writer) Close() (err error) {
 	// Finish the last data block, or force an empty data block if there
 	// aren't any data blocks at all.
 	w.flushPendingBH(db.InternalKey{})
+	if w.valueBlocks != nil {
+		// The last value block is written following the last data block.
+		w.valueBlocks.seal()
+	}
 	if w.block.nEntries > 0 || w.indexBlock.nEntries == 0 {
 		bh, err := w.finishBlock(&w.block)
 		if err != nil {
 			w.err = err
 			return w.err
 		}
+		if err := w.finishBlockProperties(); err != nil {
+			w.err = err
+			return w.err
+		}
 		w.pendingBH = bh
 		w.flushPendingBH(db.InternalKey{})
 	}
@@ -403,7 +555,7 @@ func (w *Writer) Close() (err error) {
 			w.err = err
 			return w.err
 		}
-		bh, err := w.writeRawBlock(b, db.NoCompression)
+		bh, err := w.writeRawBlock(b, w.filterCompression)
 		if err != nil {
 			w.err = err
 			return w.err
@@ -414,6 +566,46 @@ func (w *Writer) Close() (err error) {
 		w.props.FilterSize = bh.length
 	}
 
+	// Write the page index block.
+	if w.pageIndex != nil {
+		bh, err := w.writeRawBlock(w.pageIndex.finish(), w.compression)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		metaindex.add(db.InternalKey{UserKey: []byte(metaPageIndexName)}, w.tmp[:n])
+	}
+
+	// Write the value index block.
+	if w.valueBlocks != nil && len(w.valueBlocks.handles) > 0 {
+		bh, err := w.writeRawBlock(w.valueBlocks.finish(), db.NoCompression)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		metaindex.add(db.InternalKey{UserKey: []byte(metaValueIndexName)}, w.tmp[:n])
+		w.props.NumValueBlocks = uint64(len(w.valueBlocks.handles))
+		w.props.NumValueDedups = w.valueBlocks.dedups
+	}
+
+	// Write the value filter block.
+	if w.valueFilter != nil && w.valueFilter.count > 0 {
+		b, err := w.valueFilter.finish()
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		bh, err := w.writeRawBlock(b, w.filterCompression)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		metaindex.add(db.InternalKey{UserKey: []byte(valueFilterPrefix + w.valueFilter.policyName())}, w.tmp[:n])
+	}
+
 	// Write the range-del block.
 	if w.props.NumRangeDeletions > 0 {
 		// Because the range tombstones are fragmented, the end key of the last
@@ -445,7 +637,7 @@ func (w *Writer) Close() (err error) {
 		// NB: RocksDB includes the block trailer length in the index size
 		// property, though it doesn't include the trailer in the filter size
 		// property.
-		w.props.IndexSize = uint64(w.indexBlock.estimatedSize()) + blockTrailerLen
+		w.props.IndexSize = uint64(w.indexBlock.estimatedSize()) + w.trailerLen
 		w.props.save(&raw)
 		bh, err := w.writeRawBlock(raw.finish(), db.NoCompression)
 		if err != nil {
@@ -477,6 +669,12 @@ func (w *Writer) Close() (err error) {
 		checksum:    checksumCRC32c,
 		metaindexBH: metaindexBH,
 		indexBH:     indexBH,
+		epoch:       w.epoch,
+		trailerLen:  w.trailerLen,
+	}
+	if !footer.epochFits() {
+		w.err = fmt.Errorf("pebble: epoch %d does not fit in the table footer", w.epoch)
+		return w.err
 	}
 	if _, err := w.writer.Write(footer.encode(w.tmp[:])); err != nil {
 		w.err = err
@@ -508,12 +706,62 @@ func (w *Writer) Close() (err error) {
 		return err
 	}
 	w.meta.Size = uint64(size)
+	w.meta.NumEntries = w.props.NumEntries
+	w.meta.NumDeletions = w.props.NumDeletions
 
 	// Make any future calls to Set or Close return an error.
 	w.err = errors.New("pebble: writer is closed")
 	return nil
 }
 
+// Flush writes the data blocks which have been completed to the underlying
+// file, making them visible to a TailReader. The block currently being built
+// is not written, so records remain invisible until their block has been
+// completed, either by reaching the target block size or by Close. Returns
+// an error if the table is written with options which TailReader does not
+// support, in which case nothing is written.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := checkTailable(w.tableFormat, &w.props); err != nil {
+		return err
+	}
+	// If the file does its own buffering, w.writer is the file.
+	if f, ok := w.writer.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// SetEpoch sets the epoch recorded in the table footer. The epoch
+// participates in the block cache key, allowing a table to be rewritten under
+// the same file number without the cache serving blocks from the previous
+// incarnation of the file. Each rewrite of a file number should use a larger
+// epoch than the last. The default epoch is 0. Must be called before Close.
+func (w *Writer) SetEpoch(epoch uint64) {
+	w.epoch = epoch
+}
+
+// MaxCommentLen is the maximum length of a table comment. See SetComment.
+const MaxCommentLen = 4 << 10
+
+// SetComment sets a short human-readable label for the table, such as the job
+// which produced it, which is stored in the table properties and returned by
+// Reader.Comment. Returns an error if the comment is longer than
+// MaxCommentLen bytes. Must be called before Close.
+func (w *Writer) SetComment(comment string) error {
+	if len(comment) > MaxCommentLen {
+		return fmt.Errorf("pebble: table comment of %d bytes exceeds the maximum of %d bytes",
+			len(comment), MaxCommentLen)
+	}
+	w.props.Comment = comment
+	return nil
+}
+
 // EstimatedSize returns the estimated size of the sstable being written if a
 // called to Finish() was made without adding additional keys.
 func (w *Writer) EstimatedSize() uint64 {
@@ -544,11 +792,16 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 		bytesPerSync:       o.BytesPerSync,
 		compare:            o.Comparer.Compare,
 		compression:        lo.Compression,
+		filterCompression:  lo.FilterCompression,
 		separator:          o.Comparer.Separator,
 		successor:          o.Comparer.Successor,
 		tableFormat:        o.TableFormat,
+		duplicateKeyPolicy: o.DuplicateKeyPolicy,
+		trailerLen:         blockTrailerLen,
 		block: blockWriter{
 			restartInterval: lo.BlockRestartInterval,
+			valueDedup:      lo.ValueDedup,
+			seqNumDelta:     lo.SeqNumDelta,
 		},
 		indexBlock: blockWriter{
 			restartInterval: 1,
@@ -561,24 +814,71 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 		w.err = errors.New("pebble: nil file")
 		return w
 	}
+	if lo.BlockAlignment > 0 {
+		w.blockAlignment = uint64(lo.BlockAlignment)
+	}
 
-	if lo.FilterPolicy != nil {
+	if policy := lo.FilterPolicy; policy != nil {
+		if p, ok := policy.(db.SizedFilterPolicy); ok && lo.FilterBitsPerKey > 0 {
+			policy = p.WithBitsPerKey(lo.FilterBitsPerKey)
+		}
+		if lo.BlockInternalFilter {
+			w.block.filter = policy.NewWriter(db.BlockFilter)
+			w.props.BlockInternalFilter = true
+		}
 		switch lo.FilterType {
 		case db.BlockFilter:
-			w.filter = newBlockFilterWriter(lo.FilterPolicy)
+			w.filter = newBlockFilterWriter(policy)
 		case db.TableFilter:
-			w.filter = newTableFilterWriter(lo.FilterPolicy)
+			w.filter = newTableFilterWriter(policy)
 		default:
 			panic(fmt.Sprintf("unknown filter type: %v", lo.FilterType))
 		}
 	}
+	if lo.ValueFilterPolicy != nil {
+		w.valueFilter = newTableFilterWriter(lo.ValueFilterPolicy)
+	}
+	if lo.ValueBlockThreshold > 0 {
+		w.valueBlocks = &valueBlockWriter{
+			threshold: lo.ValueBlockThreshold,
+			blockSize: lo.BlockSize,
+		}
+		if lo.ValueBlockDedup > 0 {
+			w.valueBlocks.dedup = newValueDedupSet(lo.ValueBlockDedup)
+		}
+		w.props.ValueBlocks = true
+	}
+	if lo.PageIndexPageSize > 0 {
+		w.pageIndex = &pageIndexWriter{
+			pageSize: uint64(lo.PageIndexPageSize),
+			block: blockWriter{
+				restartInterval: 1,
+			},
+		}
+		w.props.PageIndexPageSize = uint64(lo.PageIndexPageSize)
+	}
 
 	w.props.ColumnFamilyID = math.MaxInt32
 	w.props.ComparatorName = o.Comparer.Name
 	w.props.CompressionName = lo.Compression.String()
 	w.props.MergeOperatorName = o.Merger.Name
 	w.props.PrefixExtractorName = "nullptr"
+	if o.PrefixExtractor != nil && o.PrefixExtractor.Name != "" {
+		w.props.PrefixExtractorName = o.PrefixExtractor.Name
+	}
 	w.props.PropertyCollectorNames = "[]"
+	if o.TableFormat == db.TableFormatPebblev1 && len(o.BlockPropertyCollectors) > 0 {
+		names := make([]string, len(o.BlockPropertyCollectors))
+		for i, newCollector := range o.BlockPropertyCollectors {
+			c := newCollector()
+			w.blockProps = append(w.blockProps, c)
+			names[i] = c.Name()
+		}
+		w.props.BlockPropertyNames = "[" + strings.Join(names, ",") + "]"
+	}
+	w.props.ValueDedup = lo.ValueDedup
+	w.props.SeqNumDelta = lo.SeqNumDelta
+	w.props.BlockAlignment = w.blockAlignment
 	w.props.WholeKeyFiltering = true
 	w.props.Version = 2 // TODO(peter): what is this?
 
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/petermattis/pebble/bloom"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/datadriven"
 	"github.com/petermattis/pebble/internal/rangedel"
@@ -33,7 +34,24 @@ func TestWriter(t *testing.T) {
 				return err.Error()
 			}
 
-			w := NewWriter(f0, nil, db.LevelOptions{})
+			o := &db.Options{}
+			for _, arg := range td.CmdArgs {
+				switch arg.Key {
+				case "duplicate-key-policy":
+					switch arg.Vals[0] {
+					case "error":
+						o.DuplicateKeyPolicy = db.DuplicateKeyError
+					case "keep-first":
+						o.DuplicateKeyPolicy = db.DuplicateKeyKeepFirst
+					default:
+						return fmt.Sprintf("unknown duplicate key policy: %s", arg.Vals[0])
+					}
+				default:
+					return fmt.Sprintf("unknown arg: %s", arg.Key)
+				}
+			}
+
+			w := NewWriter(f0, o, db.LevelOptions{})
 			var tombstones []rangedel.Tombstone
 			f := rangedel.Fragmenter{
 				Cmp: db.DefaultComparer.Compare,
@@ -156,3 +174,288 @@ func TestWriter(t *testing.T) {
 		}
 	})
 }
+
+func TestWriterNumRangeDeletions(t *testing.T) {
+	for _, n := range []int{0, 1, 5} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			fs := storage.NewMem()
+			f, err := fs.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, nil, db.LevelOptions{})
+			if err := w.Set([]byte("a"), []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < n; i++ {
+				start, end := fmt.Sprintf("b%d", i), fmt.Sprintf("b%da", i)
+				if err := w.DeleteRange([]byte(start), []byte(end)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if f, err = fs.Open("test"); err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if v := r.Properties.NumRangeDeletions; v != uint64(n) {
+				t.Fatalf("expected %d range deletions, but found %d", n, v)
+			}
+			// The range-del block is only written if the table contains range
+			// tombstones.
+			if hasBlock := r.rangeDel.bh.length != 0; hasBlock != (n > 0) {
+				t.Fatalf("expected range-del block: %t, but found %t", n > 0, hasBlock)
+			}
+			if iter := r.NewRangeDelIter(nil); (iter != nil) != (n > 0) {
+				t.Fatalf("expected range-del iterator: %t, but found %t", n > 0, iter != nil)
+			}
+		})
+	}
+}
+
+func TestWriterComment(t *testing.T) {
+	testCases := []struct {
+		comment string
+		err     bool
+	}{
+		{"", false},
+		{"job=42", false},
+		{strings.Repeat("x", MaxCommentLen), false},
+		{strings.Repeat("x", MaxCommentLen+1), true},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprint(len(c.comment)), func(t *testing.T) {
+			fs := storage.NewMem()
+			f, err := fs.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, nil, db.LevelOptions{})
+			err = w.SetComment(c.comment)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expected an error for a comment of %d bytes", len(c.comment))
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Set([]byte("a"), []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if f, err = fs.Open("test"); err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			// A rejected comment is not stored.
+			expected := c.comment
+			if c.err {
+				expected = ""
+			}
+			if comment := r.Comment(); comment != expected {
+				t.Fatalf("expected comment %q, but found %q", expected, comment)
+			}
+		})
+	}
+}
+
+func TestWriterFilterType(t *testing.T) {
+	policy := bloom.FilterPolicy(10)
+	testCases := []struct {
+		name     string
+		lo       db.LevelOptions
+		expected string
+	}{
+		{"default", db.LevelOptions{FilterPolicy: policy}, "fullfilter."},
+		{"block", db.LevelOptions{FilterPolicy: policy, FilterType: db.BlockFilter}, "filter."},
+		{"table", db.LevelOptions{FilterPolicy: policy, FilterType: db.TableFilter}, "fullfilter."},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			fs := storage.NewMem()
+			f, err := fs.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, nil, c.lo)
+			for i := 0; i < 1000; i++ {
+				if err := w.Set([]byte(fmt.Sprintf("%04d", i)), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if f, err = fs.Open("test"); err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, &db.Options{Levels: []db.LevelOptions{c.lo}})
+			defer r.Close()
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			// Only the filter of the selected type is written.
+			var filters []string
+			for name := range r.MetaBlocks() {
+				if strings.HasPrefix(name, "filter.") || strings.HasPrefix(name, "fullfilter.") {
+					filters = append(filters, name)
+				}
+			}
+			if expected := c.expected + policy.Name(); len(filters) != 1 || filters[0] != expected {
+				t.Fatalf("expected filter %s, but found %v", expected, filters)
+			}
+			if _, err := r.get([]byte("0500"), nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWriterFilterBitsPerKeyFPRate(t *testing.T) {
+	fpRatePolicy, err := bloom.FilterPolicyForFPRate(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// filterSize returns the size of the filter of a table written with the
+	// specified policy and bits per key.
+	filterSize := func(policy db.FilterPolicy, bitsPerKey int) uint64 {
+		fs := storage.NewMem()
+		f, err := fs.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lo := db.LevelOptions{FilterPolicy: policy, FilterBitsPerKey: bitsPerKey}
+		w := NewWriter(f, nil, lo)
+		for i := 0; i < 1000; i++ {
+			if err := w.Set([]byte(fmt.Sprintf("%04d", i)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if f, err = fs.Open("test"); err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, 0, &db.Options{Levels: []db.LevelOptions{lo}})
+		defer r.Close()
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.Properties.FilterSize
+	}
+
+	// FilterBitsPerKey resizes the filters of a SizedFilterPolicy...
+	if a, b := filterSize(bloom.FilterPolicy(10), 0), filterSize(bloom.FilterPolicy(10), 2); a <= b {
+		t.Fatalf("expected FilterBitsPerKey to shrink the filter, but found %d and %d bytes", a, b)
+	}
+	// ...but the false positive rate takes precedence over it.
+	if a, b := filterSize(fpRatePolicy, 0), filterSize(fpRatePolicy, 2); a != b {
+		t.Fatalf("expected FilterBitsPerKey to be ignored, but found %d and %d bytes", a, b)
+	}
+}
+
+func TestWriterBlockAlignment(t *testing.T) {
+	const numKeys = 2000
+	for _, alignment := range []int{0, 1000, 4096} {
+		t.Run(fmt.Sprintf("alignment=%d", alignment), func(t *testing.T) {
+			lo := db.LevelOptions{
+				BlockAlignment: alignment,
+				BlockSize:      1000,
+				FilterPolicy:   bloom.FilterPolicy(10),
+				FilterType:     db.BlockFilter,
+			}
+			opts := &db.Options{
+				Levels: []db.LevelOptions{lo},
+			}
+			fs := storage.NewMem()
+			f, err := fs.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, opts, lo)
+			for i := 0; i < numKeys; i++ {
+				key := []byte(fmt.Sprintf("%05d", i))
+				if err := w.Set(key, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f, err = fs.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, opts)
+			defer r.Close()
+			if r.Properties.BlockAlignment != uint64(alignment) {
+				t.Fatalf("expected alignment %d, but found %d", alignment, r.Properties.BlockAlignment)
+			}
+
+			// Every data block starts at an aligned offset.
+			index, err := r.readIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			iter, err := newBlockIter(r.compare, index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var blocks int
+			for valid := iter.First(); valid; valid = iter.Next() {
+				bh, _ := decodeBlockHandle(iter.Value())
+				if alignment > 0 && bh.offset%uint64(alignment) != 0 {
+					t.Fatalf("block at offset %d is not aligned to %d", bh.offset, alignment)
+				}
+				blocks++
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if blocks < 2 {
+				t.Fatalf("expected multiple data blocks, but found %d", blocks)
+			}
+
+			// The keys are readable through the index, through the filter and by
+			// scanning the data blocks without the index.
+			for i := 0; i < numKeys; i++ {
+				key := []byte(fmt.Sprintf("%05d", i))
+				if v, err := r.get(key, nil); err != nil || !bytes.Equal(v, key) {
+					t.Fatalf("%s: expected %s, but found %s (%v)", key, key, v, err)
+				}
+			}
+			var scanned int
+			skipped, err := r.RecoverScan(func(key db.InternalKey, value []byte) error {
+				if expected := fmt.Sprintf("%05d", scanned); string(key.UserKey) != expected {
+					return fmt.Errorf("expected %s, but found %s", expected, key.UserKey)
+				}
+				scanned++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skipped != 0 || scanned != numKeys {
+				t.Fatalf("expected %d keys and no skipped bytes, but found %d keys and %d skipped bytes",
+					numKeys, scanned, skipped)
+			}
+		})
+	}
+}
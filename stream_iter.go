@@ -0,0 +1,239 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/rangedel"
+)
+
+// StreamEventKind is the kind of a StreamEvent.
+type StreamEventKind int8
+
+// The kinds of StreamEvent.
+const (
+	// StreamPointKey is a point record: a set, merge or point deletion.
+	StreamPointKey StreamEventKind = iota
+	// StreamRangeTombstone is a fragment of a range deletion tombstone.
+	StreamRangeTombstone
+)
+
+func (k StreamEventKind) String() string {
+	switch k {
+	case StreamPointKey:
+		return "point"
+	case StreamRangeTombstone:
+		return "rangedel"
+	}
+	return fmt.Sprintf("unknown(%d)", int8(k))
+}
+
+// StreamEvent is an event yielded by a StreamIter: either a point record or a
+// range tombstone fragment.
+type StreamEvent struct {
+	Kind StreamEventKind
+	// Key is the internal key of a point record, or the start key of a range
+	// tombstone fragment along with the sequence number of the tombstone.
+	Key db.InternalKey
+	// Value is the value of a point record. It is nil for a range tombstone
+	// fragment.
+	Value []byte
+	// End is the exclusive end key of a range tombstone fragment. It is nil for
+	// a point record.
+	End []byte
+}
+
+// StreamIter iterates over every record in the DB, yielding both the point
+// records and the range tombstone fragments in a single stream ordered by
+// internal key: ascending user key, then descending sequence number, where a
+// range tombstone fragment is positioned at its start key. Unlike Iterator,
+// every version of a key is yielded and no record is hidden by a newer point
+// or range deletion, which allows a consumer to reconstruct the mutation
+// history visible to the iterator.
+//
+// Overlapping range tombstones from different memtables and tables are
+// fragmented such that any two fragments either have the same bounds or do
+// not overlap. The fragments are computed when the iterator is created and
+// held in memory.
+//
+// A StreamIter only supports forward iteration and is not safe for concurrent
+// use.
+type StreamIter struct {
+	cmp       db.Compare
+	version   *version
+	iter      internalIterator
+	fragments []rangedel.Tombstone
+	// pos is the index of the next fragment to yield.
+	pos   int
+	event StreamEvent
+	valid bool
+	err   error
+}
+
+// NewStreamIter returns a StreamIter over the records in the DB visible at the
+// time of the call. The iterator must be closed when it is no longer needed.
+func (d *DB) NewStreamIter() *StreamIter {
+	d.mu.Lock()
+	seqNum := atomic.LoadUint64(&d.mu.versions.visibleSeqNum)
+	current := d.mu.versions.currentVersion()
+	current.ref()
+	memtables := d.mu.mem.queue
+	d.mu.Unlock()
+
+	i := &StreamIter{
+		cmp:     d.cmp,
+		version: current,
+	}
+	var iters, rangeDelIters []internalIterator
+	addRangeDelIter := func(iter internalIterator) {
+		if iter != nil {
+			rangeDelIters = append(rangeDelIters, iter)
+		}
+	}
+	closeIters := func() {
+		for _, iter := range iters {
+			iter.Close()
+		}
+		for _, iter := range rangeDelIters {
+			iter.Close()
+		}
+	}
+
+	for j := len(memtables) - 1; j >= 0; j-- {
+		mem := memtables[j]
+		iters = append(iters, mem.newIter(nil))
+		addRangeDelIter(mem.newRangeDelIter(nil))
+	}
+	for j := len(current.files[0]) - 1; j >= 0; j-- {
+		f := &current.files[0][j]
+		iter, rangeDelIter, err := d.newIters(f, nil)
+		if err != nil {
+			closeIters()
+			i.err = fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
+			return i
+		}
+		iters = append(iters, iter)
+		addRangeDelIter(rangeDelIter)
+	}
+	for level := 1; level < len(current.files); level++ {
+		if len(current.files[level]) == 0 {
+			continue
+		}
+		files := current.files[level]
+		iters = append(iters, newLevelIter(nil, d.cmp, d.newIters, files))
+		rangeDelIters = append(rangeDelIters, newLevelIter(nil, d.cmp, rangeDelOnly(d.newIters), files))
+	}
+
+	// The tombstones are merged across all of the sources, which yields them
+	// ordered by start key as required by the fragmenter.
+	frag := rangedel.Fragmenter{
+		Cmp: d.cmp,
+		Emit: func(fragments []rangedel.Tombstone) {
+			i.fragments = append(i.fragments, fragments...)
+		},
+	}
+	rangeDels := newMergingIter(d.cmp, rangeDelIters...)
+	rangeDels.snapshot = seqNum
+	for valid := rangeDels.First(); valid; valid = rangeDels.Next() {
+		// The fragmenter retains the keys, which may be overwritten by the
+		// iterator.
+		frag.Add(rangeDels.Key().Clone(), append([]byte(nil), rangeDels.Value()...))
+	}
+	frag.Finish()
+	if err := rangeDels.Close(); err != nil {
+		for _, iter := range iters {
+			iter.Close()
+		}
+		i.err = err
+		return i
+	}
+
+	points := newMergingIter(d.cmp, iters...)
+	points.snapshot = seqNum
+	i.iter = points
+	return i
+}
+
+// First moves the iterator to the first event, returning whether the iterator
+// is pointing at a valid event.
+func (i *StreamIter) First() bool {
+	if i.err != nil {
+		return false
+	}
+	i.pos = 0
+	i.iter.First()
+	return i.findNext()
+}
+
+// Next moves the iterator to the next event, returning whether the iterator
+// is pointing at a valid event.
+func (i *StreamIter) Next() bool {
+	if i.err != nil || !i.valid {
+		return false
+	}
+	if i.event.Kind == StreamPointKey {
+		i.iter.Next()
+	} else {
+		i.pos++
+	}
+	return i.findNext()
+}
+
+// findNext positions the iterator at the smaller of the current point record
+// and the next range tombstone fragment.
+func (i *StreamIter) findNext() bool {
+	i.valid = false
+	point := i.iter.Valid()
+	fragment := i.pos < len(i.fragments)
+	if fragment && (!point || db.InternalCompare(i.cmp, i.fragments[i.pos].Start, i.iter.Key()) < 0) {
+		t := &i.fragments[i.pos]
+		i.event = StreamEvent{Kind: StreamRangeTombstone, Key: t.Start, End: t.End}
+		i.valid = true
+	} else if point {
+		i.event = StreamEvent{Kind: StreamPointKey, Key: i.iter.Key(), Value: i.iter.Value()}
+		i.valid = true
+	}
+	return i.valid
+}
+
+// Valid returns true if the iterator is positioned at a valid event.
+func (i *StreamIter) Valid() bool {
+	return i.valid
+}
+
+// Event returns the event at the current iterator position. The keys and
+// values of a point record are only valid until the next call to Next.
+func (i *StreamIter) Event() StreamEvent {
+	return i.event
+}
+
+// Error returns any accumulated error.
+func (i *StreamIter) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	if i.iter != nil {
+		return i.iter.Error()
+	}
+	return nil
+}
+
+// Close closes the iterator and returns any accumulated error. It is not
+// valid to call any method, including Close, after the iterator has been
+// closed.
+func (i *StreamIter) Close() error {
+	if i.iter != nil {
+		if err := i.iter.Close(); err != nil && i.err == nil {
+			i.err = err
+		}
+		i.iter = nil
+	}
+	i.version.unref()
+	i.valid = false
+	return i.err
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestStreamIter(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The writes are spread across two tables and the memtable, and the range
+	// tombstones overlap across the second table and the memtable. The first
+	// table prevents the range tombstone from being elided when the second
+	// table is flushed.
+	ops := []func() error{
+		func() error { return d.Set([]byte("a"), []byte("1"), nil) },
+		func() error { return d.Set([]byte("c"), []byte("1"), nil) },
+		d.Flush,
+		func() error { return d.DeleteRange([]byte("b"), []byte("d"), nil) },
+		d.Flush,
+		func() error { return d.Set([]byte("b"), []byte("2"), nil) },
+		func() error { return d.DeleteRange([]byte("a"), []byte("c"), nil) },
+		func() error { return d.Set([]byte("c"), []byte("2"), nil) },
+		func() error { return d.Delete([]byte("a"), nil) },
+	}
+	for _, op := range ops {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every version of each key is yielded, newest first, with the range
+	// tombstone fragments interleaved by sequence number at their start keys.
+	expected := []string{
+		"a#6,DEL",
+		"a#4,RANGEDEL-b",
+		"a#0,SET=1",
+		"b#4,RANGEDEL-c",
+		"b#3,SET=2",
+		"b#2,RANGEDEL-c",
+		"c#5,SET=2",
+		"c#2,RANGEDEL-d",
+		"c#1,SET=1",
+	}
+
+	iter := d.NewStreamIter()
+	// A write after the iterator was created is not visible.
+	if err := d.Set([]byte("b"), []byte("3"), nil); err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		e := iter.Event()
+		s := fmt.Sprintf("%s#%d,%s", e.Key.UserKey, e.Key.SeqNum(), e.Key.Kind())
+		switch e.Kind {
+		case StreamPointKey:
+			if e.Key.Kind() == db.InternalKeyKindSet {
+				s += "=" + string(e.Value)
+			}
+		case StreamRangeTombstone:
+			s += "-" + string(e.End)
+		}
+		found = append(found, s)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e, f := strings.Join(expected, "\n"), strings.Join(found, "\n"); e != f {
+		t.Fatalf("expected\n%s\nbut found\n%s", e, f)
+	}
+}
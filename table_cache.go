@@ -31,6 +31,9 @@ type tableCache struct {
 		iters     map[*sstable.Iterator][]byte
 		dummy     tableCacheNode
 		releasing int
+		// hits and misses count the lookups of tables which were and were not
+		// open, respectively.
+		hits, misses int64
 	}
 }
 
@@ -49,7 +52,24 @@ func (c *tableCache) init(dirname string, fs storage.Storage, opts *db.Options,
 	}
 }
 
-func (c *tableCache) newIters(meta *fileMetadata) (internalIterator, internalIterator, error) {
+func (c *tableCache) newIters(
+	meta *fileMetadata, opts *db.IterOptions,
+) (internalIterator, internalIterator, error) {
+	return c.newItersInternal(meta, opts, false /* get */)
+}
+
+// newGetIters is newIters for the point lookups of DB.Get. The table iterators
+// consult and update the data block memoized by their reader. See
+// db.Options.MemoizeGetBlock.
+func (c *tableCache) newGetIters(
+	meta *fileMetadata, opts *db.IterOptions,
+) (internalIterator, internalIterator, error) {
+	return c.newItersInternal(meta, opts, true /* get */)
+}
+
+func (c *tableCache) newItersInternal(
+	meta *fileMetadata, opts *db.IterOptions, get bool,
+) (internalIterator, internalIterator, error) {
 	// Calling findNode gives us the responsibility of decrementing n's
 	// refCount. If opening the underlying table resulted in error, then we
 	// decrement this straight away. Otherwise, we pass that responsibility to
@@ -67,7 +87,12 @@ func (c *tableCache) newIters(meta *fileMetadata) (internalIterator, internalIte
 	}
 	n.result <- x
 
-	iter := x.reader.NewIter(nil)
+	var iter *sstable.Iterator
+	if get {
+		iter = x.reader.NewGetIter(opts)
+	} else {
+		iter = x.reader.NewIter(opts)
+	}
 	atomic.AddInt32(&c.mu.iterCount, 1)
 	if raceEnabled {
 		c.mu.Lock()
@@ -99,6 +124,25 @@ func (c *tableCache) newIters(meta *fileMetadata) (internalIterator, internalIte
 	return iter, nil, nil
 }
 
+// withReader invokes fn with the reader for the specified table. The table is
+// referenced for the duration of the call.
+func (c *tableCache) withReader(meta *fileMetadata, fn func(*sstable.Reader) error) error {
+	n := c.findNode(meta)
+	x := <-n.result
+	if x.err != nil {
+		if !c.unrefNode(n) {
+			// Try loading the table again; the error may be transient.
+			go n.load(c)
+		}
+		return x.err
+	}
+	n.result <- x
+
+	err := fn(x.reader)
+	c.unrefNode(n)
+	return err
+}
+
 // releaseNode releases a node from the tableCache.
 //
 // c.mu must be held when calling this.
@@ -114,14 +158,21 @@ func (c *tableCache) releaseNode(n *tableCacheNode) {
 }
 
 // findNode returns the node for the table with the given file number, creating
-// that node if it didn't already exist. The caller is responsible for
-// decrementing the returned node's refCount.
+// that node if it didn't already exist. A node for an earlier epoch of the
+// table, which was rewritten under the same file number, is released and
+// replaced. The caller is responsible for decrementing the returned node's
+// refCount.
 func (c *tableCache) findNode(meta *fileMetadata) *tableCacheNode {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	n := c.mu.nodes[meta.fileNum]
+	if n != nil && n.meta.epoch != meta.epoch {
+		c.releaseNode(n)
+		n = nil
+	}
 	if n == nil {
+		c.mu.misses++
 		n = &tableCacheNode{
 			meta:     meta,
 			refCount: 1,
@@ -134,6 +185,7 @@ func (c *tableCache) findNode(meta *fileMetadata) *tableCacheNode {
 		}
 		go n.load(c)
 	} else {
+		c.mu.hits++
 		// Remove n from the doubly-linked list.
 		n.next.prev = n.prev
 		n.prev.next = n.next
@@ -167,6 +219,14 @@ func (c *tableCache) unrefNode(n *tableCacheNode) bool {
 	return res
 }
 
+// metrics returns the number of open tables, and the number of lookups of
+// tables which were and were not open.
+func (c *tableCache) metrics() (size int, hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.mu.nodes), c.mu.hits, c.mu.misses
+}
+
 func (c *tableCache) evict(fileNum uint64) {
 	c.mu.Lock()
 	if n := c.mu.nodes[fileNum]; n != nil {
@@ -233,6 +293,12 @@ func (n *tableCacheNode) load(c *tableCache) {
 		return
 	}
 	r := sstable.NewReader(f, n.meta.fileNum, c.opts)
+	if epoch := r.Epoch(); epoch != n.meta.epoch {
+		_ = r.Close()
+		n.result <- tableReaderOrError{err: fmt.Errorf(
+			"pebble: table %d has epoch %d, expected %d", n.meta.fileNum, epoch, n.meta.epoch)}
+		return
+	}
 	if n.meta.smallestSeqNum == n.meta.largestSeqNum {
 		r.Properties.GlobalSeqNum = n.meta.largestSeqNum
 	}
@@ -169,7 +169,7 @@ func testTableCacheRandomAccess(t *testing.T, concurrent bool) {
 			rngMu.Lock()
 			fileNum, sleepTime := rng.Intn(tableCacheTestNumTables), rng.Intn(1000)
 			rngMu.Unlock()
-			iter, _, err := c.newIters(&fileMetadata{fileNum: uint64(fileNum)})
+			iter, _, err := c.newIters(&fileMetadata{fileNum: uint64(fileNum)}, nil)
 			if err != nil {
 				errc <- fmt.Errorf("i=%d, fileNum=%d: find: %v", i, fileNum, err)
 				return
@@ -228,7 +228,7 @@ func TestTableCacheFrequentlyUsed(t *testing.T) {
 
 	for i := 0; i < N; i++ {
 		for _, j := range [...]int{pinned0, i % tableCacheTestNumTables, pinned1} {
-			iter, _, err := c.newIters(&fileMetadata{fileNum: uint64(j)})
+			iter, _, err := c.newIters(&fileMetadata{fileNum: uint64(j)}, nil)
 			if err != nil {
 				t.Fatalf("i=%d, j=%d: find: %v", i, j, err)
 			}
@@ -263,7 +263,7 @@ func TestTableCacheEvictions(t *testing.T) {
 	rng := rand.New(rand.NewSource(2))
 	for i := 0; i < N; i++ {
 		j := rng.Intn(tableCacheTestNumTables)
-		iter, _, err := c.newIters(&fileMetadata{fileNum: uint64(j)})
+		iter, _, err := c.newIters(&fileMetadata{fileNum: uint64(j)}, nil)
 		if err != nil {
 			t.Fatalf("i=%d, j=%d: find: %v", i, j, err)
 		}
@@ -303,7 +303,7 @@ func TestTableCacheIterLeak(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, _, err := c.newIters(&fileMetadata{fileNum: 0}); err != nil {
+	if _, _, err := c.newIters(&fileMetadata{fileNum: 0}, nil); err != nil {
 		t.Fatal(err)
 	}
 	if err := c.Close(); err == nil {
@@ -314,3 +314,56 @@ func TestTableCacheIterLeak(t *testing.T) {
 		t.Log(err.Error())
 	}
 }
+
+func TestTableCacheEpoch(t *testing.T) {
+	c, fs, err := newTableCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// get returns the value of the key in table 1, as seen through the table
+	// cache by a version in which the table has the specified epoch.
+	get := func(epoch uint64) (string, error) {
+		iter, _, err := c.newIters(&fileMetadata{fileNum: 1, epoch: epoch}, nil)
+		if err != nil {
+			return "", err
+		}
+		defer iter.Close()
+		if !iter.First() {
+			return "", fmt.Errorf("expected a key")
+		}
+		return string(iter.Value()), nil
+	}
+	if v, err := get(0); err != nil {
+		t.Fatal(err)
+	} else if v != "x" {
+		t.Fatalf("expected x, but found %s", v)
+	}
+
+	// Rewrite the table under the same file number with a new epoch. The
+	// table cache reopens the table for the new epoch, and rejects lookups of
+	// the old epoch rather than serving them from the rewritten table.
+	f, err := fs.Create(dbFilename("", fileTypeTable, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := sstable.NewWriter(f, nil, db.LevelOptions{})
+	tw.SetEpoch(1)
+	if err := tw.Add(db.ParseInternalKey("k.SET.1"), []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := get(1); err != nil {
+		t.Fatal(err)
+	} else if v != "y" {
+		t.Fatalf("expected y, but found %s", v)
+	}
+	if _, err := get(0); err == nil {
+		t.Fatalf("expected a lookup of the old epoch to fail")
+	} else if !strings.Contains(err.Error(), "has epoch 1, expected 0") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
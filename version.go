@@ -29,6 +29,14 @@ type fileMetadata struct {
 	largestSeqNum  uint64
 	// true if client asked us nicely to compact this file.
 	markedForCompaction bool
+	// checksum is the checksum of the whole file, if hasChecksum is set. See
+	// Options.CompactionOutputChecksums.
+	checksum    uint32
+	hasChecksum bool
+	// epoch is the epoch recorded in the table footer. A table rewritten
+	// under the same file number carries a larger epoch, which causes the
+	// table cache to reopen it. See sstable.Writer.SetEpoch.
+	epoch uint64
 }
 
 func (m *fileMetadata) String() string {
@@ -44,6 +52,8 @@ func (m *fileMetadata) tableInfo(dirname string) db.TableInfo {
 		Largest:        m.largest,
 		SmallestSeqNum: m.smallestSeqNum,
 		LargestSeqNum:  m.largestSeqNum,
+		Checksum:       m.checksum,
+		HasChecksum:    m.hasChecksum,
 	}
 }
 
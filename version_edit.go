@@ -48,11 +48,20 @@ const (
 	tagColumnFamilyDrop = 202
 	tagMaxColumnFamily  = 203
 
+	// Pebble tags.
+	tagFormatVersion = 300
+
 	// The custom tags sub-format used by tagNewFile4.
 	customTagTerminate         = 1
 	customTagNeedsCompaction   = 2
 	customTagPathID            = 65
 	customTagNonSafeIgnoreMask = 1 << 6
+
+	// Pebble custom tags. They are allocated from 32 upwards, clear of the
+	// tags used by RocksDB, and below customTagNonSafeIgnoreMask so that they
+	// may be ignored by a reader which does not know them.
+	customTagEpoch    = 32
+	customTagChecksum = 33
 )
 
 type deletedFileEntry struct {
@@ -67,6 +76,7 @@ type newFileEntry struct {
 
 type versionEdit struct {
 	comparatorName string
+	formatVersion  db.FormatMajorVersion
 	logNumber      uint64
 	prevLogNumber  uint64
 	nextFileNumber uint64
@@ -97,6 +107,13 @@ func (v *versionEdit) decode(r io.Reader) error {
 			}
 			v.comparatorName = string(s)
 
+		case tagFormatVersion:
+			n, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			v.formatVersion = db.FormatMajorVersion(n)
+
 		case tagLogNumber:
 			n, err := d.readUvarint()
 			if err != nil {
@@ -182,6 +199,9 @@ func (v *versionEdit) decode(r io.Reader) error {
 				}
 			}
 			var markedForCompaction bool
+			var checksum uint32
+			var hasChecksum bool
+			var epoch uint64
 			if tag == tagNewFile4 {
 				for {
 					customTag, err := d.readUvarint()
@@ -202,6 +222,20 @@ func (v *versionEdit) decode(r io.Reader) error {
 						}
 						markedForCompaction = (field[0] == 1)
 
+					case customTagChecksum:
+						if len(field) != 4 {
+							return fmt.Errorf("new-file4: checksum field wrong size")
+						}
+						checksum = binary.LittleEndian.Uint32(field)
+						hasChecksum = true
+
+					case customTagEpoch:
+						var n int
+						epoch, n = binary.Uvarint(field)
+						if n <= 0 || n != len(field) {
+							return fmt.Errorf("new-file4: epoch field malformed")
+						}
+
 					case customTagPathID:
 						return fmt.Errorf("new-file4: path-id field not supported")
 
@@ -222,6 +256,9 @@ func (v *versionEdit) decode(r io.Reader) error {
 					smallestSeqNum:      smallestSeqNum,
 					largestSeqNum:       largestSeqNum,
 					markedForCompaction: markedForCompaction,
+					checksum:            checksum,
+					hasChecksum:         hasChecksum,
+					epoch:               epoch,
 				},
 			})
 
@@ -248,6 +285,10 @@ func (v *versionEdit) encode(w io.Writer) error {
 		e.writeUvarint(tagComparator)
 		e.writeString(v.comparatorName)
 	}
+	if v.formatVersion != db.FormatMostCompatible {
+		e.writeUvarint(tagFormatVersion)
+		e.writeUvarint(uint64(v.formatVersion))
+	}
 	if v.logNumber != 0 {
 		e.writeUvarint(tagLogNumber)
 		e.writeUvarint(v.logNumber)
@@ -271,7 +312,7 @@ func (v *versionEdit) encode(w io.Writer) error {
 	}
 	for _, x := range v.newFiles {
 		var customFields bool
-		if x.meta.markedForCompaction {
+		if x.meta.markedForCompaction || x.meta.hasChecksum || x.meta.epoch != 0 {
 			customFields = true
 			e.writeUvarint(tagNewFile4)
 		} else {
@@ -289,6 +330,18 @@ func (v *versionEdit) encode(w io.Writer) error {
 				e.writeUvarint(customTagNeedsCompaction)
 				e.writeBytes([]byte{1})
 			}
+			if x.meta.hasChecksum {
+				var buf [4]byte
+				binary.LittleEndian.PutUint32(buf[:], x.meta.checksum)
+				e.writeUvarint(customTagChecksum)
+				e.writeBytes(buf[:])
+			}
+			if x.meta.epoch != 0 {
+				var buf [binary.MaxVarintLen64]byte
+				n := binary.PutUvarint(buf[:], x.meta.epoch)
+				e.writeUvarint(customTagEpoch)
+				e.writeBytes(buf[:n])
+			}
 			e.writeUvarint(customTagTerminate)
 		}
 	}
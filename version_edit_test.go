@@ -41,6 +41,7 @@ func TestVersionEditRoundTrip(t *testing.T) {
 		// A complete version edit.
 		{
 			comparatorName: "11",
+			formatVersion:  db.FormatVersioned,
 			logNumber:      22,
 			prevLogNumber:  33,
 			nextFileNumber: 44,
@@ -77,6 +78,43 @@ func TestVersionEditRoundTrip(t *testing.T) {
 						markedForCompaction: true,
 					},
 				},
+				{
+					level: 6,
+					meta: fileMetadata{
+						fileNum:        807,
+						size:           8070,
+						smallest:       db.DecodeInternalKey([]byte("a\x00\x01\x02\x03\x04\x05\x06\x07")),
+						largest:        db.DecodeInternalKey([]byte("z\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+						smallestSeqNum: 6,
+						largestSeqNum:  7,
+						checksum:       0xdeadbeef,
+						hasChecksum:    true,
+					},
+				},
+				{
+					level: 6,
+					meta: fileMetadata{
+						fileNum:        808,
+						size:           8080,
+						smallest:       db.DecodeInternalKey([]byte("a\x00\x01\x02\x03\x04\x05\x06\x07")),
+						largest:        db.DecodeInternalKey([]byte("z\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+						smallestSeqNum: 8,
+						largestSeqNum:  9,
+						epoch:          1 << 40,
+					},
+				},
+				{
+					level: 6,
+					meta: fileMetadata{
+						fileNum:        809,
+						size:           8090,
+						smallest:       db.DecodeInternalKey([]byte("a\x00\x01\x02\x03\x04\x05\x06\x07")),
+						largest:        db.DecodeInternalKey([]byte("z\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+						smallestSeqNum: 10,
+						largestSeqNum:  11,
+						hasChecksum:    true,
+					},
+				},
 			},
 		},
 	}
@@ -87,6 +125,35 @@ func TestVersionEditRoundTrip(t *testing.T) {
 	}
 }
 
+func TestVersionEditDecodeRocksDBFileChecksum(t *testing.T) {
+	// RocksDB records the checksum of a file under custom tag 7, as a string
+	// of any length. It is ignored, rather than taken for a pebble checksum.
+	e := versionEditEncoder{new(bytes.Buffer)}
+	e.writeUvarint(tagNewFile4)
+	e.writeUvarint(6)
+	e.writeUvarint(810)
+	e.writeUvarint(8100)
+	e.writeKey(db.MakeInternalKey([]byte("a"), 1, db.InternalKeyKindSet))
+	e.writeKey(db.MakeInternalKey([]byte("z"), 2, db.InternalKeyKindSet))
+	e.writeUvarint(1)
+	e.writeUvarint(2)
+	e.writeUvarint(7)
+	e.writeBytes([]byte("rocksdb-file-checksum"))
+	e.writeUvarint(customTagTerminate)
+
+	var ve versionEdit
+	if err := ve.decode(e.Buffer); err != nil {
+		t.Fatal(err)
+	}
+	if len(ve.newFiles) != 1 {
+		t.Fatalf("expected 1 new file, but found %d", len(ve.newFiles))
+	}
+	if meta := ve.newFiles[0].meta; meta.fileNum != 810 || meta.hasChecksum {
+		t.Fatalf("expected file 810 without a checksum, but found %d (checksum %t)",
+			meta.fileNum, meta.hasChecksum)
+	}
+}
+
 func TestVersionEditDecode(t *testing.T) {
 	testCases := []struct {
 		filename     string
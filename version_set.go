@@ -34,6 +34,10 @@ type versionSet struct {
 	versions versionList
 	picker   *compactionPicker
 
+	// formatVersion is the format version recorded in the manifest. See
+	// db.Options.MinFormatVersion.
+	formatVersion db.FormatMajorVersion
+
 	logNumber          uint64
 	prevLogNumber      uint64
 	nextFileNumber     uint64
@@ -43,13 +47,14 @@ type versionSet struct {
 
 	manifestFile storage.File
 	manifest     *record.Writer
+	// manifestSize is the size of the manifest, excluding the last edit.
+	manifestSize int64
 
 	writing    bool
 	writerCond sync.Cond
 }
 
-// load loads the version set from the manifest file.
-func (vs *versionSet) load(dirname string, opts *db.Options, mu *sync.Mutex) error {
+func (vs *versionSet) init(dirname string, opts *db.Options, mu *sync.Mutex) {
 	vs.dirname = dirname
 	vs.mu = mu
 	vs.versions.mu = mu
@@ -61,6 +66,29 @@ func (vs *versionSet) load(dirname string, opts *db.Options, mu *sync.Mutex) err
 	vs.versions.init()
 	// For historical reasons, the next file number is initialized to 2.
 	vs.nextFileNumber = 2
+}
+
+// create initializes the version set of a new, empty DB without writing to
+// disk. The manifest is created by the first call to logAndApply. See
+// db.Options.FastOpenEmpty.
+func (vs *versionSet) create(dirname string, opts *db.Options, mu *sync.Mutex) error {
+	vs.init(dirname, opts, mu)
+	vs.formatVersion = opts.MinFormatVersion
+	vs.manifestFileNumber = vs.nextFileNum()
+
+	var bve bulkVersionEdit
+	newVersion, err := bve.apply(opts, nil, vs.cmp)
+	if err != nil {
+		return err
+	}
+	vs.append(newVersion)
+	vs.picker = newCompactionPicker(newVersion, opts)
+	return nil
+}
+
+// load loads the version set from the manifest file.
+func (vs *versionSet) load(dirname string, opts *db.Options, mu *sync.Mutex) error {
+	vs.init(dirname, opts, mu)
 
 	// Read the CURRENT file to find the current manifest file.
 	current, err := vs.fs.Open(dbFilename(dirname, fileTypeCurrent, 0))
@@ -117,6 +145,14 @@ func (vs *versionSet) load(dirname string, opts *db.Options, mu *sync.Mutex) err
 					b, dirname, ve.comparatorName, vs.cmpName)
 			}
 		}
+		if ve.formatVersion > db.FormatNewest {
+			return fmt.Errorf("pebble: manifest file %q for DB %q: "+
+				"format version %d is newer than the newest supported format version %d",
+				b, dirname, ve.formatVersion, db.FormatNewest)
+		}
+		if ve.formatVersion > vs.formatVersion {
+			vs.formatVersion = ve.formatVersion
+		}
 		bve.accumulate(&ve)
 		if ve.logNumber != 0 {
 			vs.logNumber = ve.logNumber
@@ -171,6 +207,14 @@ func (vs *versionSet) logAndApply(ve *versionEdit) error {
 			panic(fmt.Sprintf("pebble: inconsistent versionEdit logNumber %d", ve.logNumber))
 		}
 	}
+	// Once the manifest exceeds Options.MaxManifestSize, the edit starts a new
+	// manifest following a snapshot of the current version.
+	manifestFileNum := vs.manifestFileNumber
+	rollover := vs.manifest != nil && vs.opts.MaxManifestSize > 0 &&
+		vs.manifestSize >= vs.opts.MaxManifestSize
+	if rollover {
+		manifestFileNum = vs.nextFileNum()
+	}
 	ve.nextFileNumber = vs.nextFileNumber
 	ve.lastSequence = atomic.LoadUint64(&vs.logSeqNum)
 
@@ -186,34 +230,38 @@ func (vs *versionSet) logAndApply(ve *versionEdit) error {
 		vs.mu.Unlock()
 		defer vs.mu.Lock()
 
-		// TODO(peter): if vs.manifest becomes too large, create a new one.
-		if vs.manifest == nil {
-			if err := vs.createManifest(vs.dirname); err != nil {
+		if rollover {
+			oldManifest, oldManifestFile := vs.manifest, vs.manifestFile
+			if err := vs.createManifest(vs.dirname, manifestFileNum); err != nil {
+				return err
+			}
+			if err := vs.logEdit(ve, manifestFileNum); err != nil {
+				// The old manifest remains current.
+				vs.manifest.Close()
+				vs.manifestFile.Close()
+				vs.fs.Remove(dbFilename(vs.dirname, fileTypeManifest, manifestFileNum))
+				vs.manifest, vs.manifestFile = oldManifest, oldManifestFile
+				return err
+			}
+			oldManifest.Close()
+			oldManifestFile.Close()
+		} else {
+			if vs.manifest == nil {
+				if err := vs.createManifest(vs.dirname, manifestFileNum); err != nil {
+					return err
+				}
+			}
+			if err := vs.logEdit(ve, manifestFileNum); err != nil {
 				return err
 			}
-		}
-
-		w, err := vs.manifest.Next()
-		if err != nil {
-			return err
-		}
-		if err := ve.encode(w); err != nil {
-			return err
-		}
-		if err := vs.manifest.Flush(); err != nil {
-			return err
-		}
-		if err := vs.manifestFile.Sync(); err != nil {
-			return err
-		}
-		if err := setCurrentFile(vs.dirname, vs.fs, vs.manifestFileNumber); err != nil {
-			return err
 		}
 		picker = newCompactionPicker(newVersion, vs.opts)
 		return nil
 	}(); err != nil {
 		return err
 	}
+	// The previous manifest is obsolete once the new one is current.
+	vs.manifestFileNumber = manifestFileNum
 
 	// Install the new version.
 	vs.append(newVersion)
@@ -227,10 +275,33 @@ func (vs *versionSet) logAndApply(ve *versionEdit) error {
 	return nil
 }
 
+// logEdit appends the version edit to the manifest, and makes the manifest
+// current.
+func (vs *versionSet) logEdit(ve *versionEdit, manifestFileNum uint64) error {
+	w, err := vs.manifest.Next()
+	if err != nil {
+		return err
+	}
+	if err := ve.encode(w); err != nil {
+		return err
+	}
+	if err := vs.manifest.Flush(); err != nil {
+		return err
+	}
+	if err := vs.manifestFile.Sync(); err != nil {
+		return err
+	}
+	if err := setCurrentFile(vs.dirname, vs.fs, manifestFileNum); err != nil {
+		return err
+	}
+	vs.manifestSize, _ = vs.manifest.LastRecordOffset()
+	return nil
+}
+
 // createManifest creates a manifest file that contains a snapshot of vs.
-func (vs *versionSet) createManifest(dirname string) (err error) {
+func (vs *versionSet) createManifest(dirname string, fileNum uint64) (err error) {
 	var (
-		filename     = dbFilename(dirname, fileTypeManifest, vs.manifestFileNumber)
+		filename     = dbFilename(dirname, fileTypeManifest, fileNum)
 		manifestFile storage.File
 		manifest     *record.Writer
 	)
@@ -254,6 +325,9 @@ func (vs *versionSet) createManifest(dirname string) (err error) {
 
 	snapshot := versionEdit{
 		comparatorName: vs.cmpName,
+		formatVersion:  vs.formatVersion,
+		logNumber:      vs.logNumber,
+		prevLogNumber:  vs.prevLogNumber,
 	}
 	for level, fileMetadata := range vs.currentVersion().files {
 		for _, meta := range fileMetadata {